@@ -1,56 +1,69 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/ecdsa"
+	"database/sql"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ipfs/go-cid"
+	"github.com/jackc/pglogrepl"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib" // register the pgx database/sql driver
+	"github.com/mitchellh/go-homedir"
 	"github.com/olekukonko/tablewriter"
 	"github.com/schollz/progressbar/v3"
 	"github.com/tablelandnetwork/basin-cli/internal/app"
+	"github.com/tablelandnetwork/basin-cli/pkg/ecmh"
 	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
 	"github.com/tablelandnetwork/basin-cli/pkg/signing"
 	"github.com/tablelandnetwork/basin-cli/pkg/vaultsprovider"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
+	"golang.org/x/term"
 	"gopkg.in/yaml.v3"
 )
 
 var vaultNameRx = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)[.]([a-zA-Z_][a-zA-Z0-9_]*$)`)
 
 func newVaultCreateCommand() *cli.Command {
-	var address, provider string
+	var privateKey, keystore, password, provider string
 	var cache int64
 
 	return &cli.Command{
 		Name:      "create",
 		Usage:     "Create a new vault",
 		ArgsUsage: "<vault_name>",
-		Description: "Create a vault for a given account's address as either database streaming \n" +
-			"or file uploading. Optionally, also set a cache duration for the data.\n\nEXAMPLE:\n\n" +
-			"vaults create --account 0x1234abcd --cache 10 my.vault",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:        "account",
-				Aliases:     []string{"a"},
-				Category:    "REQUIRED:",
-				Usage:       "Ethereum wallet address",
-				Destination: &address,
-				Required:    true,
-			},
+		Description: "Create a vault for the account of a private key as either database streaming \n" +
+			"or file uploading. Optionally, also set a cache duration for the data. The \n" +
+			"request is signed with the private key.\n\nEXAMPLE:\n\n" +
+			"vaults create --private-key 0x1234abcd --cache 10 my.vault\n" +
+			"vaults create --keystore /path/to/keystore.json my.vault",
+		Flags: append(accountKeyFlags(&privateKey, &keystore, &password),
 			&cli.StringFlag{
 				Name:        "provider",
 				Aliases:     []string{"p"},
@@ -68,7 +81,7 @@ func newVaultCreateCommand() *cli.Command {
 				Destination: &cache,
 				Value:       0,
 			},
-		},
+		),
 		Action: func(cCtx *cli.Context) error {
 			if cCtx.NArg() != 1 {
 				return errors.New("must provide a vault name")
@@ -80,35 +93,28 @@ func newVaultCreateCommand() *cli.Command {
 				return err
 			}
 
-			account, err := app.NewAccount(address)
-			if err != nil {
-				return fmt.Errorf("not a valid account: %s", err)
+			if cache < 0 || cache > math.MaxUint32 {
+				return fmt.Errorf("invalid cache duration: %d", cache)
 			}
 
-			dir, err := defaultConfigLocation(cCtx.String("dir"))
+			key, err := accountKey(privateKey, keystore, password)
 			if err != nil {
-				return fmt.Errorf("default config location: %s", err)
+				return err
 			}
-
-			f, err := os.OpenFile(path.Join(dir, "config.yaml"), os.O_RDWR|os.O_CREATE, 0o666)
+			account, err := app.NewAccount(crypto.PubkeyToAddress(key.PublicKey).Hex())
 			if err != nil {
-				return fmt.Errorf("os create: %s", err)
+				return fmt.Errorf("not a valid account: %s", err)
 			}
-			defer func() {
-				_ = f.Close()
-			}()
 
-			cfg, err := loadConfig(path.Join(dir, "config.yaml"))
+			dir, err := defaultConfigLocation(cCtx.String("dir"))
 			if err != nil {
-				return fmt.Errorf("load config: %s", err)
-			}
-
-			cfg.Vaults[pub] = vault{
-				ProviderHost: provider,
+				return fmt.Errorf("default config location: %s", err)
 			}
 
-			if err := yaml.NewEncoder(f).Encode(cfg); err != nil {
-				return fmt.Errorf("encode: %s", err)
+			// the vault is only recorded in the config once the provider created it,
+			// so check the config can be read first
+			if _, _, err := readConfigDocument(dir); err != nil {
+				return err
 			}
 
 			bp := vaultsprovider.New(provider)
@@ -117,65 +123,141 @@ func newVaultCreateCommand() *cli.Command {
 				Vault:         app.Vault(fmt.Sprintf("%s.%s", ns, rel)),
 				CacheDuration: app.CacheDuration(cache),
 			}
+			if req.Auth, err = app.NewRequestAuth(app.DefaultRequestTTL); err != nil {
+				return err
+			}
+			if req.Auth.Signature, err = app.SignRequest(key, req); err != nil {
+				return fmt.Errorf("sign: %s", err)
+			}
 
 			if err := bp.CreateVault(cCtx.Context, req); err != nil {
 				return fmt.Errorf("create vault: %s", err)
 			}
 
+			if err := updateConfig(cCtx.Context, dir, func(doc *yaml.Node) error {
+				return setVaultProvider(doc, pub, provider)
+			}); err != nil {
+				return fmt.Errorf(
+					"vault %s was created, but not added to the config, add it with `vaults config repair`: %s", pub, err,
+				)
+			}
 			if err := os.MkdirAll(path.Join(dir, pub), 0o755); err != nil {
 				return fmt.Errorf("mk db dir: %s", err)
 			}
 
-			fmt.Printf("\033[32mVault %s.%s created.\033[0m\n\n", ns, rel)
+			fmt.Printf("\033[32mVault %s.%s created for %s.\033[0m\n\n", ns, rel, account.Hex())
 			return nil
 		},
 	}
 }
 
 func newStreamCommand() *cli.Command {
-	var privateKey, dburi, tables string
-	var winSize int64
+	var privateKey, dburi, tables, maxRetainedWAL, out string
+	var winSize, chunkSize int64
+	var allowPublicationChange, snapshotNewTables, dryRun, commitSlot bool
 
 	return &cli.Command{
 		Name:      "stream",
 		Usage:     "Starts a daemon process that streams Postgres changes to a vault",
 		ArgsUsage: "<vault_name>",
-		Description: "The daemon will continuously stream database changes (except deletions) \n" +
-			"to the vault, as long as the daemon is actively running.\n\n" +
-			"EXAMPLE:\n\nvaults stream --private-key 0x1234abcd my.vault",
+		Description: "The daemon will continuously stream database changes to the vault, \n" +
+			"as long as the daemon is actively running. Each exported row is a change, \n" +
+			"with its kind (I, U or D) in the _op column and its LSN in _lsn.\n\n" +
+			"The database, tables, private key and window size are read from the \n" +
+			"vault's settings in config.yaml when they are not given as flags or \n" +
+			"environment variables.\n\n" +
+			"With --dry-run, the exported Parquet files are written to the --out \n" +
+			"directory instead of the vault, each with a JSON sidecar describing its \n" +
+			"table, row count, LSN range and schema. A dry run does not consume the \n" +
+			"replication slot unless --commit-slot is set, but the slot can't be \n" +
+			"used by another stream while it runs.\n\n" +
+			"EXAMPLE:\n\nvaults stream --private-key 0x1234abcd my.vault\n" +
+			"vaults stream --dry-run --out ./exports my.vault",
 
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:        "private-key",
 				Aliases:     []string{"k"},
-				Category:    "REQUIRED:",
+				Category:    "OPTIONAL:",
 				Usage:       "Ethereum wallet private key",
+				DefaultText: "private_key or private_key_file in config",
+				EnvVars:     []string{"VAULTS_PRIVATE_KEY"},
 				Destination: &privateKey,
-				Required:    true,
 			},
 			&cli.StringFlag{
 				Name:        "dburi",
-				Category:    "REQUIRED:",
+				Category:    "OPTIONAL:",
 				Usage:       "PostgreSQL connection string (e.g., postgresql://postgres:[PASSWORD]@[HOST]:[PORT]/postgres)",
+				DefaultText: "dburi in config",
+				EnvVars:     []string{"VAULTS_DBURI"},
 				Destination: &dburi,
-				Required:    true,
 			},
 			&cli.StringFlag{
 				Name:        "tables",
 				Aliases:     []string{"t"},
-				Category:    "REQUIRED:",
+				Category:    "OPTIONAL:",
 				Usage:       "PostgreSQL tables to be replicated separated by comma (e.g. tbl1,tbl2,tbl3)",
+				DefaultText: "tables in config",
+				EnvVars:     []string{"VAULTS_TABLES"},
 				Destination: &tables,
-				Required:    true,
 			},
 			&cli.Int64Flag{
 				Name:        "window-size",
 				Category:    "OPTIONAL:",
 				Usage:       "Number of seconds for which WAL updates are buffered before being sent to the provider",
-				DefaultText: fmt.Sprintf("%d", DefaultWindowSize),
+				DefaultText: fmt.Sprintf("window_size in config, or %d", DefaultWindowSize),
+				EnvVars:     []string{"VAULTS_WINDOW_SIZE"},
 				Destination: &winSize,
 				Value:       DefaultWindowSize,
 			},
+			&cli.Int64Flag{
+				Name:        "chunk-size",
+				Category:    "OPTIONAL:",
+				Usage:       "Files larger than this number of bytes are uploaded in resumable chunks (0 disables it)",
+				DefaultText: fmt.Sprintf("%d", app.DefaultChunkSize),
+				Destination: &chunkSize,
+				Value:       app.DefaultChunkSize,
+			},
+			&cli.StringFlag{
+				Name:        "max-retained-wal",
+				Category:    "OPTIONAL:",
+				Usage:       "Warn at startup if the replication slot retains more WAL than this size (e.g., 500MB)",
+				DefaultText: fmt.Sprintf("max_retained_wal in config, or %s", DefaultMaxRetainedWAL),
+				EnvVars:     []string{"VAULTS_MAX_RETAINED_WAL"},
+				Destination: &maxRetainedWAL,
+			},
+			&cli.BoolFlag{
+				Name:        "allow-publication-change",
+				Category:    "OPTIONAL:",
+				Usage:       "Add and drop tables of the existing publication to match the requested tables",
+				Destination: &allowPublicationChange,
+			},
+			&cli.BoolFlag{
+				Name:        "snapshot-new-tables",
+				Category:    "OPTIONAL:",
+				Usage:       "Load the existing rows of tables added to the publication, or of all tables on the first run, into the first window",
+				Destination: &snapshotNewTables,
+			},
+			&cli.BoolFlag{
+				Name:        "dry-run",
+				Category:    "OPTIONAL:",
+				Usage:       "Write the exported files to the --out directory instead of uploading them",
+				Destination: &dryRun,
+			},
+			&cli.StringFlag{
+				Name:        "out",
+				Category:    "OPTIONAL:",
+				Usage:       "The directory dry runs write the exported files to",
+				Destination: &out,
+			},
+			&cli.BoolFlag{
+				Name:        "commit-slot",
+				Category:    "OPTIONAL:",
+				Usage:       "Confirm the replayed transactions to the replication slot, so they are not streamed again",
+				DefaultText: "true, or false with --dry-run",
+				Destination: &commitSlot,
+				Value:       true,
+			},
 		},
 		Action: func(cCtx *cli.Context) error {
 			if cCtx.NArg() != 1 {
@@ -198,6 +280,48 @@ func newStreamCommand() *cli.Command {
 				return fmt.Errorf("load config: %s", err)
 			}
 
+			// flags and environment variables take precedence over the config
+			settings := cfg.Vaults[vault]
+			if !cCtx.IsSet("private-key") {
+				if privateKey, err = settings.privateKey(); err != nil {
+					return fmt.Errorf("private key: %s", err)
+				}
+			}
+			if !cCtx.IsSet("dburi") {
+				if dburi, err = settings.dbURI(); err != nil {
+					return fmt.Errorf("dburi: %s", err)
+				}
+			}
+			if !cCtx.IsSet("tables") {
+				tables = strings.Join(settings.Tables, ",")
+			}
+			if !cCtx.IsSet("window-size") && settings.WindowSize > 0 {
+				winSize = settings.WindowSize
+			}
+			if !cCtx.IsSet("max-retained-wal") {
+				maxRetainedWAL = settings.MaxRetainedWAL
+			}
+			if maxRetainedWAL == "" {
+				maxRetainedWAL = DefaultMaxRetainedWAL
+			}
+			walLimit, err := humanize.ParseBytes(maxRetainedWAL)
+			if err != nil {
+				return fmt.Errorf("invalid max retained wal: %s", err)
+			}
+			if dryRun && !cCtx.IsSet("commit-slot") {
+				commitSlot = false
+			}
+			switch {
+			case dryRun && out == "":
+				return errors.New("missing out: a dry run needs --out")
+			case privateKey == "" && !dryRun:
+				return errors.New("missing private key: use --private-key, VAULTS_PRIVATE_KEY or the vault's config")
+			case dburi == "":
+				return errors.New("missing dburi: use --dburi, VAULTS_DBURI or the vault's config")
+			case tables == "":
+				return errors.New("missing tables: use --tables, VAULTS_TABLES or the vault's config")
+			}
+
 			publication := pgrepl.Publication(strings.Replace(vault, ".", "_", -1))
 			setup, err := NewDatabaseStreamSetup(cCtx.Context, dburi, publication, tables)
 			if err != nil {
@@ -207,9 +331,11 @@ func newStreamCommand() *cli.Command {
 				_ = setup.Close(cCtx.Context)
 			}()
 
-			if err := setup.CreatePublicationIfNotExists(cCtx.Context); err != nil {
-				return fmt.Errorf("failed to create database publication: %s", err)
+			added, err := setup.ReconcilePublication(cCtx.Context, allowPublicationChange)
+			if err != nil {
+				return fmt.Errorf("failed to setup database publication: %s", err)
 			}
+			warnRetainedWAL(cCtx.Context, setup, walLimit)
 
 			tableSchemas, err := setup.TableSchemas(cCtx.Context)
 			if err != nil {
@@ -221,16 +347,45 @@ func newStreamCommand() *cli.Command {
 				return fmt.Errorf("failed to create replicator: %s", err)
 			}
 
-			privateKey, err := crypto.HexToECDSA(privateKey)
+			var key *ecdsa.PrivateKey
+			if privateKey == "" {
+				// dry runs without a key sign with a throwaway one
+				key, err = crypto.GenerateKey()
+			} else {
+				key, err = crypto.HexToECDSA(privateKey)
+			}
 			if err != nil {
 				return err
 			}
 
 			// Creates a new db manager when replication starts
-			bp := vaultsprovider.New(cfg.Vaults[vault].ProviderHost)
-			uploader := app.NewVaultsUploader(ns, rel, bp, privateKey)
-			dbDir := path.Join(dir, vault)
-			dbm := app.NewDBManager(dbDir, tableSchemas, time.Duration(winSize)*time.Second, uploader)
+			var dbm *app.DBManager
+			if dryRun {
+				bp, err := vaultsprovider.NewFSProvider(out)
+				if err != nil {
+					return fmt.Errorf("dry run provider: %s", err)
+				}
+				uploader := app.NewVaultsUploader(ns, rel, bp, key)
+
+				// the windows of a dry run are kept apart from the vault's
+				dbDir := path.Join(dir, "dry-run", vault)
+				if err := os.MkdirAll(dbDir, 0o755); err != nil {
+					return fmt.Errorf("create dry run dir: %s", err)
+				}
+				dbm = app.NewDBManager(dbDir, tableSchemas, time.Duration(winSize)*time.Second, uploader)
+			} else {
+				bp := vaultsprovider.New(cfg.Vaults[vault].ProviderHost)
+				uploader := app.NewVaultsUploader(ns, rel, bp, key)
+				uploader.EnableResumableUploads(path.Join(dir, "uploads"), chunkSize)
+				dbDir := path.Join(dir, vault)
+				dbm = app.NewDBManager(dbDir, tableSchemas, time.Duration(winSize)*time.Second, uploader)
+
+				ledger, err := app.OpenLedger(cCtx.Context, path.Join(dir, "ledger.db"))
+				if err != nil {
+					return fmt.Errorf("open ledger: %s", err)
+				}
+				dbm.EnableLedger(ledger)
+			}
 
 			// Before starting replication, upload the remaining data
 			if err := dbm.UploadAll(cCtx.Context); err != nil {
@@ -238,6 +393,18 @@ func newStreamCommand() *cli.Command {
 			}
 
 			vaultsStreamer := app.NewVaultsStreamer(ns, r, dbm)
+			if snapshotNewTables && len(added) > 0 {
+				snapshots := []app.TableSchema{}
+				for _, schema := range tableSchemas {
+					if slices.Contains(added, schema.Table) {
+						snapshots = append(snapshots, schema)
+					}
+				}
+				vaultsStreamer.SnapshotTables(setup, snapshots)
+			}
+			if !commitSlot {
+				vaultsStreamer.DisableCommits()
+			}
 			if err := vaultsStreamer.Run(cCtx.Context); err != nil {
 				return fmt.Errorf("run: %s", err)
 			}
@@ -247,100 +414,208 @@ func newStreamCommand() *cli.Command {
 	}
 }
 
-func newWriteCommand() *cli.Command {
-	var privateKey, vaultName string
-	var timestamp string
+func newDaemonCommand() *cli.Command {
+	var privateKey, metricsAddress, maxRetainedWAL string
+	var chunkSize int64
+	var allowPublicationChange bool
 
 	return &cli.Command{
-		Name:      "write",
-		Usage:     "Write a Parquet file",
-		ArgsUsage: "<file_path>",
-		Description: "A Parquet file can be pushed directly to the vault, as an \n" +
-			"alternative to continuous Postgres data streaming.\n\n" +
-			"EXAMPLE:\n\nvaults write --vault my.vault --private-key 0x1234abcd /path/to/file.parquet",
+		Name:      "daemon",
+		Usage:     "Starts a daemon process that streams Postgres changes to many vaults",
+		UsageText: "vaults daemon [command options]",
+		Description: "The daemon runs the pipelines in the daemon section of config.yaml. \n" +
+			"A single publication and replication slot cover the tables of all \n" +
+			"pipelines, and each change is routed to the vaults of its table.\n\n" +
+			"The private key and the retained WAL threshold are read from the daemon \n" +
+			"section when they are not given as flags or environment variables.\n\n" +
+			"A pipeline that fails stops, while the others keep streaming. Each \n" +
+			"pipeline first uploads the windows it left behind, and fails if it \n" +
+			"can't. The replication slot is held back until the daemon is restarted, \n" +
+			"so the failed vault does not lose changes, but the slot is shared: \n" +
+			"Postgres retains the WAL of all vaults until then.\n\n" +
+			"EXAMPLE:\n\nvaults daemon --private-key 0x1234abcd --metrics-address :9090",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:        "private-key",
 				Aliases:     []string{"k"},
-				Category:    "REQUIRED:",
+				Category:    "OPTIONAL:",
 				Usage:       "Ethereum wallet private key",
+				DefaultText: "daemon.private_key or daemon.private_key_file in config",
+				EnvVars:     []string{"VAULTS_PRIVATE_KEY"},
 				Destination: &privateKey,
-				Required:    true,
 			},
 			&cli.StringFlag{
-				Name:        "vault",
-				Aliases:     []string{"v"},
-				Category:    "REQUIRED:",
-				Usage:       "Vault name",
-				Destination: &vaultName,
-				Required:    true,
+				Name:        "metrics-address",
+				Category:    "OPTIONAL:",
+				Usage:       "Address to serve Prometheus metrics on, overriding daemon.metrics_address (e.g., :9090)",
+				Destination: &metricsAddress,
+			},
+			&cli.Int64Flag{
+				Name:        "chunk-size",
+				Category:    "OPTIONAL:",
+				Usage:       "Files larger than this number of bytes are uploaded in resumable chunks (0 disables it)",
+				DefaultText: fmt.Sprintf("%d", app.DefaultChunkSize),
+				Destination: &chunkSize,
+				Value:       app.DefaultChunkSize,
 			},
 			&cli.StringFlag{
-				Name:        "timestamp",
+				Name:        "max-retained-wal",
 				Category:    "OPTIONAL:",
-				Usage:       "The time the file was created",
-				DefaultText: "current epoch in UTC",
-				Destination: &timestamp,
+				Usage:       "Warn at startup if the replication slot retains more WAL than this size (e.g., 500MB)",
+				DefaultText: fmt.Sprintf("daemon.max_retained_wal in config, or %s", DefaultMaxRetainedWAL),
+				EnvVars:     []string{"VAULTS_MAX_RETAINED_WAL"},
+				Destination: &maxRetainedWAL,
+			},
+			&cli.BoolFlag{
+				Name:        "allow-publication-change",
+				Category:    "OPTIONAL:",
+				Usage:       "Add and drop tables of the existing publication to match the tables of the pipelines",
+				Destination: &allowPublicationChange,
 			},
 		},
 		Action: func(cCtx *cli.Context) error {
-			if cCtx.NArg() != 1 {
-				return errors.New("must provide a file path")
+			ctx := cCtx.Context
+			dir, err := defaultConfigLocation(cCtx.String("dir"))
+			if err != nil {
+				return fmt.Errorf("default config location: %s", err)
 			}
-			ns, rel, err := parseVaultName(vaultName)
+
+			cfg, err := loadConfig(path.Join(dir, "config.yaml"))
 			if err != nil {
-				return err
+				return fmt.Errorf("load config: %s", err)
+			}
+			if err := cfg.Daemon.validate(); err != nil {
+				return fmt.Errorf("invalid daemon config: %s", err)
 			}
 
-			privateKey, err := crypto.HexToECDSA(privateKey)
+			// flags and environment variables take precedence over the config
+			if !cCtx.IsSet("private-key") {
+				if privateKey, err = cfg.Daemon.privateKey(); err != nil {
+					return fmt.Errorf("private key: %s", err)
+				}
+			}
+			if privateKey == "" {
+				return errors.New("missing private key: use --private-key, VAULTS_PRIVATE_KEY or the daemon's config")
+			}
+			key, err := crypto.HexToECDSA(privateKey)
 			if err != nil {
 				return err
 			}
 
-			dir, err := defaultConfigLocation(cCtx.String("dir"))
+			if !cCtx.IsSet("max-retained-wal") {
+				maxRetainedWAL = cfg.Daemon.MaxRetainedWAL
+			}
+			if maxRetainedWAL == "" {
+				maxRetainedWAL = DefaultMaxRetainedWAL
+			}
+			walLimit, err := humanize.ParseBytes(maxRetainedWAL)
 			if err != nil {
-				return fmt.Errorf("default config location: %s", err)
+				return fmt.Errorf("invalid max retained wal: %s", err)
 			}
 
-			cfg, err := loadConfig(path.Join(dir, "config.yaml"))
+			dburi, err := interpolate(cfg.Daemon.DBURI)
 			if err != nil {
-				return fmt.Errorf("load config: %s", err)
+				return fmt.Errorf("daemon.dburi: %s", err)
 			}
 
-			bp := vaultsprovider.New(cfg.Vaults[vaultName].ProviderHost)
-
-			filepath := cCtx.Args().First()
-
-			f, err := os.Open(filepath)
+			publication := pgrepl.Publication(cfg.Daemon.Publication)
+			if publication == "" {
+				publication = DefaultDaemonPublication
+			}
+			setup, err := NewDatabaseStreamSetup(
+				ctx, dburi, publication, strings.Join(cfg.Daemon.tables(), ","),
+			)
 			if err != nil {
-				return fmt.Errorf("open file: %s", err)
+				return fmt.Errorf("new database stream setup: %s", err)
 			}
 			defer func() {
-				_ = f.Close()
+				_ = setup.Close(ctx)
 			}()
 
-			fi, err := f.Stat()
+			if _, err := setup.ReconcilePublication(ctx, allowPublicationChange); err != nil {
+				return fmt.Errorf("failed to setup database publication: %s", err)
+			}
+			warnRetainedWAL(ctx, setup, walLimit)
+
+			tableSchemas, err := setup.TableSchemas(ctx)
 			if err != nil {
-				return fmt.Errorf("fstat: %s", err)
+				return fmt.Errorf("getting tables schemas: %s", err)
+			}
+			schemas := map[string]app.TableSchema{}
+			for _, schema := range tableSchemas {
+				schemas[schema.Table] = schema
 			}
 
-			bar := progressbar.DefaultBytes(
-				fi.Size(),
-				"Writing...",
-			)
+			ledger, err := app.OpenLedger(ctx, path.Join(dir, "ledger.db"))
+			if err != nil {
+				return fmt.Errorf("open ledger: %s", err)
+			}
+
+			pipelines := []*app.StreamPipeline{}
+			for _, p := range cfg.Daemon.Pipelines {
+				ns, rel, _ := parseVaultName(p.Vault)
+
+				pipelineSchemas := []app.TableSchema{}
+				for _, table := range p.Tables {
+					schema, ok := schemas[table]
+					if !ok {
+						return fmt.Errorf("table %s of vault %s not found", table, p.Vault)
+					}
+					pipelineSchemas = append(pipelineSchemas, schema)
+				}
+
+				providerHost := p.ProviderHost
+				if providerHost == "" {
+					providerHost = cfg.Vaults[p.Vault].ProviderHost
+				}
+				if providerHost == "" {
+					providerHost = DefaultProviderHost
+				}
+				winSize := p.WindowSize
+				if winSize == 0 {
+					winSize = DefaultWindowSize
+				}
+
+				dbDir := path.Join(dir, p.Vault)
+				if err := os.MkdirAll(dbDir, 0o755); err != nil {
+					return fmt.Errorf("mkdir: %s", err)
+				}
+
+				uploader := app.NewVaultsUploader(ns, rel, vaultsprovider.New(providerHost), key)
+				uploader.EnableResumableUploads(path.Join(dir, "uploads"), chunkSize)
+				dbm := app.NewDBManager(dbDir, pipelineSchemas, time.Duration(winSize)*time.Second, uploader)
+				dbm.EnableLedger(ledger)
 
-			if timestamp == "" {
-				timestamp = fmt.Sprint(time.Now().UTC().Unix())
+				pipeline, err := app.NewStreamPipeline(app.Vault(p.Vault), dbm)
+				if err != nil {
+					return fmt.Errorf("pipeline of %s: %s", p.Vault, err)
+				}
+				pipelines = append(pipelines, pipeline)
 			}
 
-			ts, err := app.ParseTimestamp(timestamp)
+			r, err := pgrepl.New(dburi, publication)
 			if err != nil {
-				return err
+				return fmt.Errorf("failed to create replicator: %s", err)
+			}
+
+			metrics := app.NewStreamMetrics()
+			if metricsAddress == "" {
+				metricsAddress = cfg.Daemon.MetricsAddress
+			}
+			if metricsAddress != "" {
+				mux := http.NewServeMux()
+				mux.Handle("/metrics", metrics.Handler())
+				go func() {
+					slog.Info("serving metrics", "address", metricsAddress)
+					if err := http.ListenAndServe(metricsAddress, mux); err != nil {
+						slog.Error("metrics server", "error", err)
+					}
+				}()
 			}
 
-			vaultsStreamer := app.NewVaultsUploader(ns, rel, bp, privateKey)
-			if err := vaultsStreamer.Upload(cCtx.Context, filepath, bar, ts, fi.Size()); err != nil {
-				return fmt.Errorf("upload: %s", err)
+			daemon := app.NewStreamDaemon(r, pipelines, metrics)
+			if err := daemon.Run(ctx); err != nil {
+				return fmt.Errorf("run: %s", err)
 			}
 
 			return nil
@@ -348,231 +623,843 @@ func newWriteCommand() *cli.Command {
 	}
 }
 
-func newListCommand() *cli.Command {
-	var address, provider, format string
+func newReplayCommand() *cli.Command {
+	var input, schema, out, vault string
+	var winSize int64
 
 	return &cli.Command{
-		Name:  "list",
-		Usage: "List vaults of a given account",
-		Description: "Listing vaults will show all vaults that have been created by the provided \n" +
-			"account's address and logged as either line delimited text or a json array.\n\n" +
-			"EXAMPLE:\n\nvaults list --account 0x1234abcd --format json",
+		Name:      "replay",
+		Usage:     "Replays a recorded replication stream into Parquet files",
+		UsageText: "vaults replay [command options]",
+		Description: "Reads the transactions of a transcript, one JSON encoded transaction per \n" +
+			"line as recorded by capture, and runs them through the same windows \n" +
+			"stream uses. The exported Parquet files are written to the --out \n" +
+			"directory, each with a JSON sidecar, like a stream dry run. Windows are \n" +
+			"rotated by the commit time of the transactions, so a transcript is \n" +
+			"always split in the same windows.\n\n" +
+			"The schema file is a JSON list of tables, as written by capture:\n\n" +
+			"[{\"table\": \"t\", \"columns\": [{\"name\": \"id\", \"type\": \"integer\", \n" +
+			"  \"nullable\": false, \"primary\": true}]}]\n\n" +
+			"EXAMPLE:\n\nvaults replay --input wal.ndjson --schema schema.json --out ./exports",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:        "account",
-				Aliases:     []string{"a"},
+				Name:        "input",
+				Aliases:     []string{"i"},
 				Category:    "REQUIRED:",
-				Usage:       "Ethereum wallet address",
-				Destination: &address,
+				Usage:       "The transcript to replay, or - for stdin",
+				Destination: &input,
 				Required:    true,
 			},
 			&cli.StringFlag{
-				Name:        "provider",
-				Aliases:     []string{"p"},
+				Name:        "schema",
+				Category:    "REQUIRED:",
+				Usage:       "The JSON file with the schemas of the replayed tables",
+				Destination: &schema,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "out",
+				Category:    "REQUIRED:",
+				Usage:       "The directory the exported files are written to",
+				Destination: &out,
+				Required:    true,
+			},
+			&cli.Int64Flag{
+				Name:        "window-size",
 				Category:    "OPTIONAL:",
-				Usage:       "The provider's address and port (e.g., localhost:8080)",
-				DefaultText: DefaultProviderHost,
-				Destination: &provider,
-				Value:       DefaultProviderHost,
+				Usage:       "Number of seconds of commit time a window covers (0 replays all in one window)",
+				DefaultText: fmt.Sprintf("%d", DefaultWindowSize),
+				Destination: &winSize,
+				Value:       DefaultWindowSize,
 			},
 			&cli.StringFlag{
-				Name:        "format",
+				Name:        "vault",
 				Category:    "OPTIONAL:",
-				Usage:       "The output format (table or json)",
-				DefaultText: "table",
-				Destination: &format,
-				Value:       "table",
+				Usage:       "The vault name recorded in the sidecars",
+				DefaultText: "replay.transcript",
+				Destination: &vault,
+				Value:       "replay.transcript",
 			},
 		},
 		Action: func(cCtx *cli.Context) error {
-			account, err := app.NewAccount(address)
+			ns, rel, err := parseVaultName(vault)
 			if err != nil {
-				return fmt.Errorf("%s is not a valid Ethereum wallet address", address)
+				return err
+			}
+			if winSize < 0 {
+				return errors.New("window size must not be negative")
 			}
 
-			bp := vaultsprovider.New(provider)
-			vaults, err := bp.ListVaults(cCtx.Context, app.ListVaultsParams{Account: account})
+			f, err := os.Open(schema)
 			if err != nil {
-				return fmt.Errorf("failed to list vaults: %s", err)
+				return fmt.Errorf("open schema: %s", err)
+			}
+			schemas, err := app.ReadTableSchemas(f)
+			_ = f.Close()
+			if err != nil {
+				return fmt.Errorf("read schema: %s", err)
 			}
 
-			if format == "table" {
-				table := tablewriter.NewWriter(os.Stdout)
-				table.SetHeader([]string{"Vault", "Cache Duration"})
-				for _, vault := range vaults {
-					cacheDuration := ""
-					if vault.CacheDuration != nil {
-						cacheDuration = fmt.Sprint(*vault.CacheDuration)
-					}
-					table.Append([]string{
-						string(vault.Vault), cacheDuration,
-					})
-				}
-				table.Render()
-			} else if format == "json" {
-				jsonData, err := json.Marshal(vaults)
+			var r io.Reader = os.Stdin
+			if input != "-" {
+				f, err := os.Open(input)
 				if err != nil {
-					return fmt.Errorf("error serializing events to JSON")
+					return fmt.Errorf("open input: %s", err)
 				}
-				fmt.Println(string(jsonData))
-			} else {
-				return fmt.Errorf("invalid format: %s", format)
+				defer func() {
+					_ = f.Close()
+				}()
+				r = f
+			}
+
+			bp, err := vaultsprovider.NewFSProvider(out)
+			if err != nil {
+				return fmt.Errorf("replay provider: %s", err)
+			}
+			// replayed files are signed with a throwaway key
+			key, err := crypto.GenerateKey()
+			if err != nil {
+				return err
+			}
+
+			dbDir, err := os.MkdirTemp("", "vaults-replay")
+			if err != nil {
+				return fmt.Errorf("create windows dir: %s", err)
+			}
+			defer func() {
+				_ = os.RemoveAll(dbDir)
+			}()
+
+			uploader := app.NewVaultsUploader(ns, rel, bp, key)
+			dbm := app.NewDBManager(dbDir, schemas, time.Duration(winSize)*time.Second, uploader)
+			dbm.RotateManually()
+
+			n, err := app.ReplayTranscript(cCtx.Context, r, dbm)
+			if err != nil {
+				return fmt.Errorf("replay: %s", err)
 			}
+			fmt.Printf("replayed %d transactions into %s\n", n, out)
 
 			return nil
 		},
 	}
 }
 
-func newListEventsCommand() *cli.Command {
-	var vault, provider, before, after, at, format string
-	var limit, offset, latest int
+func newCaptureCommand() *cli.Command {
+	var dburi, output, schema string
+	var maxTxs int64
 
 	return &cli.Command{
-		Name:      "events",
-		Usage:     "List events of a given vault",
-		UsageText: "vaults events [command options]",
-		Description: "Vault events can be filtered by date ranges (unix, ISO 8601 date,\n" +
-			"or ISO 8601 date & time), returning the event metadata and \n" +
-			"corresponding CID.\n\n" +
-			"EXAMPLE:\n\nvaults events --vault my.vault \\\n" +
-			"--limit 10 --offset 3 \\\n--after 2023-09-01 --before 2023-12-01 \\\n" +
-			"--format json",
+		Name:      "capture",
+		Usage:     "Records the replication stream of a vault to a transcript",
+		ArgsUsage: "<vault_name>",
+		Description: "Writes the transactions of the vault's publication, one JSON encoded \n" +
+			"transaction per line, so they can be replayed offline with replay. \n" +
+			"Capture streams from a temporary replication slot of its own, which \n" +
+			"Postgres drops when capture exits, so the vault's slot is neither \n" +
+			"created nor consumed and its stream can keep running. Only the \n" +
+			"transactions committed after capture starts are recorded.\n\n" +
+			"EXAMPLE:\n\nvaults capture --output wal.ndjson --schema schema.json --max-txs 100 my.vault",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:        "vault",
-				Aliases:     []string{"v"},
-				Category:    "REQUIRED:",
-				Usage:       "Vault name",
-				Destination: &vault,
-				Required:    true,
+				Name:        "dburi",
+				Category:    "OPTIONAL:",
+				Usage:       "PostgreSQL connection string (e.g., postgresql://postgres:[PASSWORD]@[HOST]:[PORT]/postgres)",
+				DefaultText: "dburi in config",
+				EnvVars:     []string{"VAULTS_DBURI"},
+				Destination: &dburi,
 			},
 			&cli.StringFlag{
-				Name:        "provider",
-				Aliases:     []string{"p"},
+				Name:        "output",
+				Aliases:     []string{"o"},
 				Category:    "OPTIONAL:",
-				Usage:       "The provider's address and port (e.g., localhost:8080)",
-				DefaultText: DefaultProviderHost,
-				Destination: &provider,
-				Value:       DefaultProviderHost,
+				Usage:       "The file the transcript is written to",
+				DefaultText: "stdout",
+				Destination: &output,
 			},
-			&cli.IntFlag{
-				Name:        "limit",
+			&cli.StringFlag{
+				Name:        "schema",
 				Category:    "OPTIONAL:",
-				Usage:       "The number of deals to fetch",
-				DefaultText: "10",
-				Destination: &limit,
-				Value:       10,
+				Usage:       "Also write the schemas of the replicated tables to this file",
+				Destination: &schema,
 			},
-			&cli.IntFlag{
-				Name:        "latest",
+			&cli.Int64Flag{
+				Name:        "max-txs",
 				Category:    "OPTIONAL:",
-				Usage:       "The latest N deals to fetch",
-				Destination: &latest,
+				Usage:       "Stop after recording this number of transactions (0 records until interrupted)",
+				Destination: &maxTxs,
 			},
-			&cli.IntFlag{
-				Name:        "offset",
-				Category:    "OPTIONAL:",
-				Usage:       "The epoch to start from",
-				DefaultText: "0",
-				Destination: &offset,
-				Value:       0,
+		},
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() != 1 {
+				return errors.New("must provide a vault name")
+			}
+			vault := cCtx.Args().First()
+			if _, _, err := parseVaultName(vault); err != nil {
+				return err
+			}
+
+			dburi, err := vaultDBURI(cCtx, dburi, vault)
+			if err != nil {
+				return err
+			}
+
+			publication := pgrepl.Publication(strings.Replace(vault, ".", "_", -1))
+			r, err := pgrepl.NewTemporary(dburi, publication)
+			if err != nil {
+				return fmt.Errorf("failed to create replicator: %s", err)
+			}
+
+			txs, tables, err := r.StartReplication(cCtx.Context)
+			if err != nil {
+				return fmt.Errorf("start replication: %s", err)
+			}
+
+			if schema != "" {
+				if err := writeTableSchemas(cCtx.Context, dburi, publication, tables, schema); err != nil {
+					return err
+				}
+			}
+
+			var w io.Writer = os.Stdout
+			if output != "" {
+				f, err := os.Create(output)
+				if err != nil {
+					return fmt.Errorf("create output: %s", err)
+				}
+				defer func() {
+					_ = f.Close()
+				}()
+				w = f
+			}
+
+			transcript := app.NewTranscriptWriter(w)
+			var n int64
+			for tx := range txs {
+				if err := transcript.Write(tx); err != nil {
+					return err
+				}
+				n++
+				if maxTxs > 0 && n >= maxTxs {
+					break
+				}
+			}
+			slog.Info("capture finished", "transactions", n)
+
+			return nil
+		},
+	}
+}
+
+// writeTableSchemas writes the schemas of the tables to a JSON file replay reads.
+func writeTableSchemas(
+	ctx context.Context, dburi string, publication pgrepl.Publication, tables []string, filename string,
+) error {
+	setup, err := NewDatabaseStreamSetup(ctx, dburi, publication, strings.Join(tables, ","))
+	if err != nil {
+		return fmt.Errorf("new database stream setup: %s", err)
+	}
+	defer func() {
+		_ = setup.Close(ctx)
+	}()
+
+	schemas, err := setup.TableSchemas(ctx)
+	if err != nil {
+		return fmt.Errorf("getting tables schemas: %s", err)
+	}
+
+	buf, err := json.MarshalIndent(schemas, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal schemas: %s", err)
+	}
+	if err := os.WriteFile(filename, buf, 0o644); err != nil {
+		return fmt.Errorf("write schemas: %s", err)
+	}
+
+	return nil
+}
+
+func newPgCommand() *cli.Command {
+	var dburi string
+	var yes bool
+
+	dburiFlag := &cli.StringFlag{
+		Name:        "dburi",
+		Category:    "OPTIONAL:",
+		Usage:       "PostgreSQL connection string (e.g., postgresql://postgres:[PASSWORD]@[HOST]:[PORT]/postgres)",
+		DefaultText: "dburi in config",
+		EnvVars:     []string{"VAULTS_DBURI"},
+		Destination: &dburi,
+	}
+
+	// connect resolves the vault's publication and connects to its database.
+	connect := func(cCtx *cli.Context) (pgrepl.Publication, *pgrepl.Conn, error) {
+		if cCtx.NArg() != 1 {
+			return "", nil, errors.New("must provide a vault name")
+		}
+		vault := cCtx.Args().First()
+		if _, _, err := parseVaultName(vault); err != nil {
+			return "", nil, err
+		}
+
+		uri, err := vaultDBURI(cCtx, dburi, vault)
+		if err != nil {
+			return "", nil, err
+		}
+		conn, err := pgx.Connect(cCtx.Context, uri)
+		if err != nil {
+			return "", nil, fmt.Errorf("connect: %s", err)
+		}
+
+		return pgrepl.Publication(strings.Replace(vault, ".", "_", -1)), &pgrepl.Conn{Conn: conn}, nil
+	}
+
+	return &cli.Command{
+		Name:      "pg",
+		Usage:     "Manage the Postgres publication and replication slot of a vault",
+		UsageText: "vaults pg <subcommand> [command options] <vault_name>",
+		Description: "vaults stream creates the pub_basin_<vault> publication and the \n" +
+			"basin_<vault> replication slot, with the dot of the vault name replaced \n" +
+			"by an underscore. Postgres keeps the WAL the slot has not confirmed, \n" +
+			"so an abandoned slot can fill up the disk.",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "status",
+				Usage:       "Show the publication and replication slot of a vault",
+				UsageText:   "vaults pg status [command options] <vault_name>",
+				Description: "EXAMPLE:\n\nvaults pg status my.vault",
+				Flags:       []cli.Flag{dburiFlag},
+				Action: func(cCtx *cli.Context) error {
+					publication, conn, err := connect(cCtx)
+					if err != nil {
+						return err
+					}
+					defer func() {
+						_ = conn.Close(cCtx.Context)
+					}()
+
+					tables, err := conn.GetPublicationTables(cCtx.Context, publication)
+					if err != nil {
+						return err
+					}
+
+					table := tablewriter.NewWriter(os.Stdout)
+					table.Append([]string{"Publication", publication.FullName()})
+					table.Append([]string{"Tables", strings.Join(tables, ", ")})
+					table.Append([]string{"Slot", publication.SlotName()})
+
+					status, err := conn.GetSlotStatus(cCtx.Context, publication.SlotName())
+					if errors.Is(err, pgx.ErrNoRows) {
+						table.Append([]string{"Status", "no slot"})
+						table.Render()
+						return nil
+					} else if err != nil {
+						return err
+					}
+
+					active := "inactive"
+					if status.Active {
+						active = "active"
+					}
+					table.Append([]string{"Status", active})
+					table.Append([]string{"Confirmed flush LSN", status.ConfirmedFlushLSN.String()})
+					table.Append([]string{"Current LSN", status.CurrentLSN.String()})
+					table.Append([]string{"Retained WAL", humanize.IBytes(uint64(status.RetainedWAL))})
+					table.Render()
+					return nil
+				},
+			},
+			{
+				Name:        "teardown",
+				Usage:       "Drop the replication slot and publication of a vault",
+				UsageText:   "vaults pg teardown [command options] <vault_name>",
+				Description: "The slot must not be in use, so stop the stream first.\n\nEXAMPLE:\n\nvaults pg teardown my.vault",
+				Flags:       []cli.Flag{dburiFlag},
+				Action: func(cCtx *cli.Context) error {
+					publication, conn, err := connect(cCtx)
+					if err != nil {
+						return err
+					}
+					defer func() {
+						_ = conn.Close(cCtx.Context)
+					}()
+
+					if _, err := conn.GetSlotStatus(cCtx.Context, publication.SlotName()); err == nil {
+						if err := conn.DropSlot(cCtx.Context, publication.SlotName()); err != nil {
+							return err
+						}
+						fmt.Printf("Dropped replication slot %s\n", publication.SlotName())
+					} else if !errors.Is(err, pgx.ErrNoRows) {
+						return err
+					}
+
+					if err := conn.DropPublication(cCtx.Context, publication); err != nil {
+						return err
+					}
+					fmt.Printf("Dropped publication %s\n", publication.FullName())
+					return nil
+				},
+			},
+			{
+				Name:      "reset",
+				Usage:     "Recreate the replication slot of a vault at the current LSN",
+				UsageText: "vaults pg reset [command options] <vault_name>",
+				Description: "Changes the slot has not confirmed are skipped, and will not be \n" +
+					"streamed to the vault. The slot must not be in use, so stop the \n" +
+					"stream first.\n\nEXAMPLE:\n\nvaults pg reset my.vault",
+				Flags: []cli.Flag{
+					dburiFlag,
+					&cli.BoolFlag{
+						Name:        "yes",
+						Aliases:     []string{"y"},
+						Category:    "OPTIONAL:",
+						Usage:       "Do not ask for confirmation",
+						Destination: &yes,
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					publication, conn, err := connect(cCtx)
+					if err != nil {
+						return err
+					}
+					defer func() {
+						_ = conn.Close(cCtx.Context)
+					}()
+
+					status, err := conn.GetSlotStatus(cCtx.Context, publication.SlotName())
+					if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+						return err
+					}
+
+					if !yes {
+						fmt.Printf(
+							"The changes not confirmed by %s (%s of WAL) will not be streamed. Continue? [y/N] ",
+							publication.SlotName(), humanize.IBytes(uint64(status.RetainedWAL)),
+						)
+						answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+						if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+							return errors.New("aborted")
+						}
+					}
+
+					if err == nil {
+						if err := conn.DropSlot(cCtx.Context, publication.SlotName()); err != nil {
+							return err
+						}
+					}
+					lsn, err := conn.CreateSlot(cCtx.Context, publication.SlotName())
+					if err != nil {
+						return err
+					}
+
+					fmt.Printf("Replication slot %s recreated at %s\n", publication.SlotName(), lsn)
+					return nil
+				},
 			},
+		},
+	}
+}
+
+// vaultDBURI returns dburi if the flag or its environment variable is set,
+// or the dburi in the vault's config.
+func vaultDBURI(cCtx *cli.Context, dburi string, vault string) (string, error) {
+	if cCtx.IsSet("dburi") {
+		return dburi, nil
+	}
+
+	dir, err := defaultConfigLocation(cCtx.String("dir"))
+	if err != nil {
+		return "", fmt.Errorf("default config location: %s", err)
+	}
+	cfg, err := loadConfig(path.Join(dir, "config.yaml"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("load config: %s", err)
+	}
+
+	uri, err := cfg.Vaults[vault].dbURI()
+	if err != nil {
+		return "", fmt.Errorf("dburi: %s", err)
+	}
+	if uri == "" {
+		return "", errors.New("missing dburi: use --dburi, VAULTS_DBURI or the vault's config")
+	}
+
+	return uri, nil
+}
+
+// warnRetainedWAL warns when the publication's replication slot retains more WAL than limit.
+func warnRetainedWAL(ctx context.Context, setup *DatabaseStreamSetup, limit uint64) {
+	slot := setup.publication.SlotName()
+	status, err := (&pgrepl.Conn{Conn: setup.pgConn}).GetSlotStatus(ctx, slot)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return
+	} else if err != nil {
+		slog.Warn("failed to check the replication slot", "slot", slot, "error", err)
+		return
+	}
+
+	if uint64(status.RetainedWAL) > limit {
+		slog.Warn(
+			"the replication slot is retaining a lot of WAL, check for abandoned slots with `vaults pg status`",
+			"slot", slot, "retained", humanize.IBytes(uint64(status.RetainedWAL)), "limit", humanize.IBytes(limit),
+		)
+	}
+}
+
+func newWriteCommand() *cli.Command {
+	var privateKey, vaultName string
+	var timestamp, timestampFrom, filenameRegex string
+	var chunkSize int64
+	var concurrency int
+
+	return &cli.Command{
+		Name:      "write",
+		Usage:     "Write Parquet files",
+		ArgsUsage: "<file_path> [<file_path> | <dir> | <glob>...]",
+		Description: "Parquet files can be pushed directly to the vault, as an \n" +
+			"alternative to continuous Postgres data streaming. Directories are searched \n" +
+			"for Parquet files and glob patterns are expanded. Files already uploaded \n" +
+			"to the vault from this machine are skipped.\n\n" +
+			"EXAMPLE:\n\nvaults write --vault my.vault --private-key 0x1234abcd /path/to/file.parquet\n" +
+			"vaults write --vault my.vault --private-key 0x1234abcd --timestamp-from mtime /path/to/dir",
+		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:        "before",
-				Category:    "OPTIONAL:",
-				Usage:       "Filter deals created before this timestamp",
-				Destination: &before,
-				Value:       "",
+				Name:        "private-key",
+				Aliases:     []string{"k"},
+				Category:    "REQUIRED:",
+				Usage:       "Ethereum wallet private key",
+				Destination: &privateKey,
+				Required:    true,
 			},
 			&cli.StringFlag{
-				Name:        "after",
+				Name:        "vault",
+				Aliases:     []string{"v"},
+				Category:    "REQUIRED:",
+				Usage:       "Vault name",
+				Destination: &vaultName,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "timestamp",
 				Category:    "OPTIONAL:",
-				Usage:       "Filter deals created after this timestamp",
-				Destination: &after,
-				Value:       "",
+				Usage:       "The time the file was created",
+				DefaultText: "current epoch in UTC",
+				Destination: &timestamp,
 			},
 			&cli.StringFlag{
-				Name:        "at",
+				Name:        "timestamp-from",
 				Category:    "OPTIONAL:",
-				Usage:       "Filter deals created at this timestamp",
-				Destination: &at,
-				Value:       "",
+				Usage:       "Derive each file's timestamp from its modification time or name (mtime or filename-regex)",
+				Destination: &timestampFrom,
 			},
 			&cli.StringFlag{
-				Name:        "format",
+				Name:        "filename-regex",
 				Category:    "OPTIONAL:",
-				Usage:       "The output format (table or json)",
-				DefaultText: "table",
-				Destination: &format,
-				Value:       "table",
+				Usage:       "Regex whose first capture group is the timestamp in the file name",
+				DefaultText: DefaultFilenameRegex,
+				Destination: &filenameRegex,
+				Value:       DefaultFilenameRegex,
+			},
+			&cli.IntFlag{
+				Name:        "concurrency",
+				Aliases:     []string{"c"},
+				Category:    "OPTIONAL:",
+				Usage:       "Number of files uploaded at the same time",
+				DefaultText: "4",
+				Destination: &concurrency,
+				Value:       4,
+			},
+			&cli.Int64Flag{
+				Name:        "chunk-size",
+				Category:    "OPTIONAL:",
+				Usage:       "Files larger than this number of bytes are uploaded in resumable chunks (0 disables it)",
+				DefaultText: fmt.Sprintf("%d", app.DefaultChunkSize),
+				Destination: &chunkSize,
+				Value:       app.DefaultChunkSize,
 			},
 		},
 		Action: func(cCtx *cli.Context) error {
-			ns, rel, err := parseVaultName(vault)
+			if cCtx.NArg() == 0 {
+				return errors.New("must provide a file path")
+			}
+			ns, rel, err := parseVaultName(vaultName)
 			if err != nil {
 				return err
 			}
 
-			bp := vaultsprovider.New(provider)
+			privateKey, err := crypto.HexToECDSA(privateKey)
+			if err != nil {
+				return err
+			}
 
-			b, a, err := validateBeforeAndAfter(before, after, at)
+			tsFn, err := timestampFunc(timestamp, timestampFrom, filenameRegex)
 			if err != nil {
 				return err
 			}
 
-			var req app.ListVaultEventsParams
-			if latest > 0 {
-				req = app.ListVaultEventsParams{
-					Vault:  app.Vault(fmt.Sprintf("%s.%s", ns, rel)),
-					Limit:  uint32(latest),
-					Offset: 0,
-					Before: b,
-					After:  a,
-				}
-			} else {
-				if offset < 0 {
-					return errors.New("offset has to be greater than 0")
-				}
+			dir, err := defaultConfigLocation(cCtx.String("dir"))
+			if err != nil {
+				return fmt.Errorf("default config location: %s", err)
+			}
 
-				if limit < 0 {
-					return errors.New("limit has to be greater than 0")
-				}
+			cfg, err := loadConfig(path.Join(dir, "config.yaml"))
+			if err != nil {
+				return fmt.Errorf("load config: %s", err)
+			}
 
-				req = app.ListVaultEventsParams{
-					Vault:  app.Vault(fmt.Sprintf("%s.%s", ns, rel)),
-					Limit:  uint32(limit),
-					Offset: uint32(offset),
-					Before: b,
-					After:  a,
-				}
+			files, err := app.ExpandPaths(cCtx.Args().Slice())
+			if err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				return errors.New("no files to write")
 			}
 
-			events, err := bp.ListVaultEvents(cCtx.Context, req)
+			ledger, err := app.OpenLedger(cCtx.Context, path.Join(dir, "ledger.db"))
 			if err != nil {
-				return fmt.Errorf("failed to fetch deals: %s", err)
+				return fmt.Errorf("open ledger: %s", err)
 			}
 
-			if format == "table" {
-				table := tablewriter.NewWriter(os.Stdout)
-				table.SetHeader([]string{"CID", "Timestamp", "Archived", "Cache Expiry"})
+			bp := vaultsprovider.New(cfg.Vaults[vaultName].ProviderHost)
+			uploader := app.NewVaultsUploader(ns, rel, bp, privateKey)
+			uploader.EnableResumableUploads(path.Join(dir, "uploads"), chunkSize)
 
-				for _, event := range events {
-					isArchived := "N"
-					if event.IsArchived {
-						isArchived = "Y"
-					}
-					timestamp := "(null)"
-					if event.Timestamp > 0 {
-						timestamp = time.Unix(event.Timestamp, 0).Format(time.RFC3339)
+			batch := app.NewBatchUploader(uploader, ledger, concurrency, tsFn)
+			items, err := batch.Plan(cCtx.Context, files)
+			if err != nil {
+				return err
+			}
+
+			var total int64
+			for _, item := range items {
+				if !item.Skip {
+					total += item.Size
+				}
+			}
+
+			bar := progressbar.DefaultBytes(
+				total,
+				"Writing...",
+			)
+
+			summary := batch.Upload(cCtx.Context, items, bar)
+			_ = bar.Finish()
+
+			fmt.Printf(
+				"\n%d uploaded (%s), %d skipped, %d failed\n",
+				summary.Uploaded, humanize.Bytes(uint64(summary.Bytes)), summary.Skipped, len(summary.Failures),
+			)
+			for file, err := range summary.Failures {
+				fmt.Printf("\033[31m%s: %s\033[0m\n", file, err)
+			}
+
+			if len(summary.Failures) > 0 {
+				return fmt.Errorf("%d files failed to upload", len(summary.Failures))
+			}
+
+			return nil
+		},
+	}
+}
+
+func newWatchCommand() *cli.Command {
+	var privateKey, vaultName, archiveDir string
+	var stableFor, chunkSize int64
+	var doneMarker, deleteFiles bool
+
+	return &cli.Command{
+		Name:      "watch",
+		Usage:     "Starts a daemon process that writes the Parquet files dropped into a directory",
+		ArgsUsage: "<dir>",
+		Description: "The daemon watches a directory and writes each new Parquet file to the vault \n" +
+			"once it is complete: either its size stopped changing, or a <file>.done marker \n" +
+			"was created. Written files are moved to an archive folder or deleted. Failed \n" +
+			"writes are retried with backoff, also after a restart. The event timestamp is \n" +
+			"the file's modification time. Written files are recorded in the ledger, so a \n" +
+			"file that could not be archived is not written again.\n\n" +
+			"EXAMPLE:\n\nvaults watch --vault my.vault --private-key 0x1234abcd /path/to/dir",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "private-key",
+				Aliases:     []string{"k"},
+				Category:    "REQUIRED:",
+				Usage:       "Ethereum wallet private key",
+				Destination: &privateKey,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "vault",
+				Aliases:     []string{"v"},
+				Category:    "REQUIRED:",
+				Usage:       "Vault name",
+				Destination: &vaultName,
+				Required:    true,
+			},
+			&cli.Int64Flag{
+				Name:        "stable-for",
+				Category:    "OPTIONAL:",
+				Usage:       "Number of seconds a file's size must stay unchanged before it is written",
+				DefaultText: "5",
+				Destination: &stableFor,
+				Value:       5,
+			},
+			&cli.BoolFlag{
+				Name:        "done-marker",
+				Category:    "OPTIONAL:",
+				Usage:       "Wait for a <file>.done marker instead of a stable file size",
+				Destination: &doneMarker,
+			},
+			&cli.StringFlag{
+				Name:        "archive-dir",
+				Category:    "OPTIONAL:",
+				Usage:       "Where written files are moved to",
+				DefaultText: "<dir>/archive",
+				Destination: &archiveDir,
+			},
+			&cli.BoolFlag{
+				Name:        "delete",
+				Category:    "OPTIONAL:",
+				Usage:       "Delete written files instead of archiving them",
+				Destination: &deleteFiles,
+			},
+			&cli.Int64Flag{
+				Name:        "chunk-size",
+				Category:    "OPTIONAL:",
+				Usage:       "Files larger than this number of bytes are uploaded in resumable chunks (0 disables it)",
+				DefaultText: fmt.Sprintf("%d", app.DefaultChunkSize),
+				Destination: &chunkSize,
+				Value:       app.DefaultChunkSize,
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() != 1 {
+				return errors.New("must provide a directory")
+			}
+			watchDir := cCtx.Args().First()
+
+			ns, rel, err := parseVaultName(vaultName)
+			if err != nil {
+				return err
+			}
+
+			privateKey, err := crypto.HexToECDSA(privateKey)
+			if err != nil {
+				return err
+			}
+
+			dir, err := defaultConfigLocation(cCtx.String("dir"))
+			if err != nil {
+				return fmt.Errorf("default config location: %s", err)
+			}
+
+			cfg, err := loadConfig(path.Join(dir, "config.yaml"))
+			if err != nil {
+				return fmt.Errorf("load config: %s", err)
+			}
+
+			if deleteFiles {
+				archiveDir = ""
+			} else if archiveDir == "" {
+				archiveDir = path.Join(watchDir, "archive")
+			}
+
+			stateDir := path.Join(dir, vaultName)
+			if err := os.MkdirAll(stateDir, 0o755); err != nil {
+				return fmt.Errorf("mk state dir: %s", err)
+			}
+
+			bp := vaultsprovider.New(cfg.Vaults[vaultName].ProviderHost)
+			uploader := app.NewVaultsUploader(ns, rel, bp, privateKey)
+			uploader.EnableResumableUploads(path.Join(dir, "uploads"), chunkSize)
+
+			ledger, err := app.OpenLedger(cCtx.Context, path.Join(dir, "ledger.db"))
+			if err != nil {
+				return fmt.Errorf("open ledger: %s", err)
+			}
+
+			watcher := app.NewDirWatcher(watchDir, uploader, app.WatcherConfig{
+				StableFor:  time.Duration(stableFor) * time.Second,
+				DoneMarker: doneMarker,
+				ArchiveDir: archiveDir,
+				RetryPath:  path.Join(stateDir, "watch-retries.json"),
+				Ledger:     ledger,
+			})
+
+			ctx, stop := signal.NotifyContext(cCtx.Context, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			if err := watcher.Run(ctx); err != nil {
+				return fmt.Errorf("watch: %s", err)
+			}
+
+			return nil
+		},
+	}
+}
+
+func newListCommand() *cli.Command {
+	var address, provider, format string
+
+	return &cli.Command{
+		Name:  "list",
+		Usage: "List vaults of a given account",
+		Description: "Listing vaults will show all vaults that have been created by the provided \n" +
+			"account's address and logged as either line delimited text or a json array.\n\n" +
+			"EXAMPLE:\n\nvaults list --account 0x1234abcd --format json",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "account",
+				Aliases:     []string{"a"},
+				Category:    "REQUIRED:",
+				Usage:       "Ethereum wallet address",
+				Destination: &address,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "provider",
+				Aliases:     []string{"p"},
+				Category:    "OPTIONAL:",
+				Usage:       "The provider's address and port (e.g., localhost:8080)",
+				DefaultText: DefaultProviderHost,
+				Destination: &provider,
+				Value:       DefaultProviderHost,
+			},
+			&cli.StringFlag{
+				Name:        "format",
+				Category:    "OPTIONAL:",
+				Usage:       "The output format (table or json)",
+				DefaultText: "table",
+				Destination: &format,
+				Value:       "table",
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			account, err := app.NewAccount(address)
+			if err != nil {
+				return fmt.Errorf("%s is not a valid Ethereum wallet address", address)
+			}
+
+			bp := vaultsprovider.New(provider)
+			vaults, err := bp.ListVaults(cCtx.Context, app.ListVaultsParams{Account: account})
+			if err != nil {
+				return fmt.Errorf("failed to list vaults: %s", err)
+			}
+
+			if format == "table" {
+				table := tablewriter.NewWriter(os.Stdout)
+				table.SetHeader([]string{"Vault", "Cache Duration"})
+				for _, vault := range vaults {
+					cacheDuration := ""
+					if vault.CacheDuration != nil {
+						cacheDuration = fmt.Sprint(*vault.CacheDuration)
 					}
 					table.Append([]string{
-						event.CID, timestamp, isArchived, event.CacheExpiry,
+						string(vault.Vault), cacheDuration,
 					})
 				}
 				table.Render()
 			} else if format == "json" {
-				jsonData, err := json.Marshal(events)
+				jsonData, err := json.Marshal(vaults)
 				if err != nil {
 					return fmt.Errorf("error serializing events to JSON")
 				}
@@ -580,115 +1467,2045 @@ func newListEventsCommand() *cli.Command {
 			} else {
 				return fmt.Errorf("invalid format: %s", format)
 			}
+
+			return nil
+		},
+	}
+}
+
+func newInfoCommand() *cli.Command {
+	var provider, format string
+
+	return &cli.Command{
+		Name:      "info",
+		Usage:     "Show the details of a vault",
+		ArgsUsage: "<vault_name>",
+		Description: "Shows the owner, creation time, cache duration, number of events \n" +
+			"and total size of a vault, as a table or a json object.\n\n" +
+			"EXAMPLE:\n\nvaults info --format json my.vault",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "provider",
+				Aliases:     []string{"p"},
+				Category:    "OPTIONAL:",
+				Usage:       "The provider's address and port (e.g., localhost:8080)",
+				DefaultText: DefaultProviderHost,
+				Destination: &provider,
+				Value:       DefaultProviderHost,
+			},
+			&cli.StringFlag{
+				Name:        "format",
+				Category:    "OPTIONAL:",
+				Usage:       "The output format (table or json)",
+				DefaultText: "table",
+				Destination: &format,
+				Value:       "table",
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() != 1 {
+				return errors.New("must provide a vault name")
+			}
+			vault := cCtx.Args().First()
+			if _, _, err := parseVaultName(vault); err != nil {
+				return err
+			}
+
+			bp := vaultsprovider.New(provider)
+			info, err := bp.GetVault(cCtx.Context, app.GetVaultParams{Vault: app.Vault(vault)})
+			if err != nil {
+				return fmt.Errorf("failed to get vault: %s", err)
+			}
+
+			if format == "table" {
+				cacheDuration := ""
+				if info.CacheDuration != nil {
+					cacheDuration = fmt.Sprintf("%d minutes", *info.CacheDuration)
+				}
+
+				table := tablewriter.NewWriter(os.Stdout)
+				table.Append([]string{"Vault", string(info.Vault)})
+				table.Append([]string{"Owner", info.Owner})
+				table.Append([]string{"Created", time.Unix(info.CreatedAt, 0).UTC().Format(time.RFC3339)})
+				table.Append([]string{"Cache Duration", cacheDuration})
+				table.Append([]string{"Events", fmt.Sprint(info.EventCount)})
+				table.Append([]string{"Total Size", humanize.IBytes(uint64(info.TotalSize))})
+				table.Render()
+			} else if format == "json" {
+				jsonData, err := json.Marshal(info)
+				if err != nil {
+					return fmt.Errorf("error serializing vault to JSON")
+				}
+				fmt.Println(string(jsonData))
+			} else {
+				return fmt.Errorf("invalid format: %s", format)
+			}
+
 			return nil
 		},
 	}
 }
 
-func newSignCommand() *cli.Command {
-	var privateKey string
+func newUpdateCommand() *cli.Command {
+	var privateKey, keystore, password, provider string
+	var cache int64
+
+	return &cli.Command{
+		Name:      "update",
+		Usage:     "Change the cache duration of a vault",
+		ArgsUsage: "<vault_name>",
+		Description: "The request is signed with the private key of the vault's owner.\n\n" +
+			"EXAMPLE:\n\nvaults update --private-key 0x1234abcd --cache 60 my.vault",
+		Flags: append(accountKeyFlags(&privateKey, &keystore, &password),
+			&cli.Int64Flag{
+				Name:        "cache",
+				Category:    "REQUIRED:",
+				Usage:       "Time duration (in minutes) that the data will be available in the cache",
+				Destination: &cache,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "provider",
+				Aliases:     []string{"p"},
+				Category:    "OPTIONAL:",
+				Usage:       "The provider's address and port (e.g., localhost:8080)",
+				DefaultText: DefaultProviderHost,
+				Destination: &provider,
+				Value:       DefaultProviderHost,
+			},
+		),
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() != 1 {
+				return errors.New("must provide a vault name")
+			}
+			vault := cCtx.Args().First()
+			if _, _, err := parseVaultName(vault); err != nil {
+				return err
+			}
+			if cache < 0 || cache > math.MaxUint32 {
+				return fmt.Errorf("invalid cache duration: %d", cache)
+			}
+
+			key, err := accountKey(privateKey, keystore, password)
+			if err != nil {
+				return err
+			}
+
+			params := app.UpdateVaultParams{
+				Vault:         app.Vault(vault),
+				CacheDuration: app.CacheDuration(cache),
+			}
+			if params.Auth, err = app.NewRequestAuth(app.DefaultRequestTTL); err != nil {
+				return err
+			}
+			if params.Auth.Signature, err = app.SignRequest(key, params); err != nil {
+				return fmt.Errorf("sign: %s", err)
+			}
+
+			bp := vaultsprovider.New(provider)
+			if err := bp.UpdateVault(cCtx.Context, params); err != nil {
+				return fmt.Errorf("update vault: %s", err)
+			}
+
+			fmt.Printf("\033[32mVault %s updated.\033[0m\n\n", vault)
+			return nil
+		},
+	}
+}
+
+func newDeleteCommand() *cli.Command {
+	var privateKey, keystore, password, provider string
+	var yes bool
+
+	return &cli.Command{
+		Name:      "delete",
+		Usage:     "Delete a vault and its events",
+		ArgsUsage: "<vault_name>",
+		Description: "The request is signed with the private key of the vault's owner. \n" +
+			"The vault's local config and data are kept.\n\n" +
+			"EXAMPLE:\n\nvaults delete --private-key 0x1234abcd my.vault",
+		Flags: append(accountKeyFlags(&privateKey, &keystore, &password),
+			&cli.StringFlag{
+				Name:        "provider",
+				Aliases:     []string{"p"},
+				Category:    "OPTIONAL:",
+				Usage:       "The provider's address and port (e.g., localhost:8080)",
+				DefaultText: DefaultProviderHost,
+				Destination: &provider,
+				Value:       DefaultProviderHost,
+			},
+			&cli.BoolFlag{
+				Name:        "yes",
+				Aliases:     []string{"y"},
+				Category:    "OPTIONAL:",
+				Usage:       "Do not ask for confirmation",
+				Destination: &yes,
+			},
+		),
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() != 1 {
+				return errors.New("must provide a vault name")
+			}
+			vault := cCtx.Args().First()
+			if _, _, err := parseVaultName(vault); err != nil {
+				return err
+			}
+
+			key, err := accountKey(privateKey, keystore, password)
+			if err != nil {
+				return err
+			}
+
+			if !yes {
+				fmt.Printf("The vault %s and all its events will be deleted. Continue? [y/N] ", vault)
+				answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+				if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+					return errors.New("aborted")
+				}
+			}
+
+			params := app.DeleteVaultParams{Vault: app.Vault(vault)}
+			if params.Auth, err = app.NewRequestAuth(app.DefaultRequestTTL); err != nil {
+				return err
+			}
+			if params.Auth.Signature, err = app.SignRequest(key, params); err != nil {
+				return fmt.Errorf("sign: %s", err)
+			}
+
+			bp := vaultsprovider.New(provider)
+			if err := bp.DeleteVault(cCtx.Context, params); err != nil {
+				return fmt.Errorf("delete vault: %s", err)
+			}
+
+			fmt.Printf("\033[32mVault %s deleted.\033[0m\n\n", vault)
+			return nil
+		},
+	}
+}
+
+func newListEventsCommand() *cli.Command {
+	var vault, provider, before, after, at, format, hook string
+	var limit, offset, latest int
+	var all, follow bool
+	var interval time.Duration
+
+	return &cli.Command{
+		Name:      "events",
+		Usage:     "List events of a given vault",
+		UsageText: "vaults events [command options]",
+		Description: "Vault events can be filtered by date ranges (unix, ISO 8601 date,\n" +
+			"or ISO 8601 date & time), returning the event metadata and \n" +
+			"corresponding CID.\n\n" +
+			"With --follow, the command keeps polling for new events, printing\n" +
+			"them or running a command for each of them as they arrive.\n\n" +
+			"EXAMPLE:\n\nvaults events --vault my.vault \\\n" +
+			"--limit 10 --offset 3 \\\n--after 2023-09-01 --before 2023-12-01 \\\n" +
+			"--format json\n\n" +
+			"vaults events --vault my.vault --latest 1 --follow \\\n" +
+			"--exec 'vaults retrieve --output data/$1.parquet $1'",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "vault",
+				Aliases:     []string{"v"},
+				Category:    "REQUIRED:",
+				Usage:       "Vault name",
+				Destination: &vault,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "provider",
+				Aliases:     []string{"p"},
+				Category:    "OPTIONAL:",
+				Usage:       "The provider's address and port (e.g., localhost:8080)",
+				DefaultText: DefaultProviderHost,
+				Destination: &provider,
+				Value:       DefaultProviderHost,
+			},
+			&cli.IntFlag{
+				Name:        "limit",
+				Category:    "OPTIONAL:",
+				Usage:       "The number of deals to fetch",
+				DefaultText: "10",
+				Destination: &limit,
+				Value:       10,
+			},
+			&cli.IntFlag{
+				Name:        "latest",
+				Category:    "OPTIONAL:",
+				Usage:       "The latest N deals to fetch",
+				Destination: &latest,
+			},
+			&cli.IntFlag{
+				Name:        "offset",
+				Category:    "OPTIONAL:",
+				Usage:       "The epoch to start from",
+				DefaultText: "0",
+				Destination: &offset,
+				Value:       0,
+			},
+			&cli.BoolFlag{
+				Name:        "all",
+				Category:    "OPTIONAL:",
+				Usage:       "Fetch all the deals, page by page, ignoring limit and offset",
+				Destination: &all,
+			},
+			&cli.StringFlag{
+				Name:        "before",
+				Category:    "OPTIONAL:",
+				Usage:       "Filter deals created before this timestamp",
+				Destination: &before,
+				Value:       "",
+			},
+			&cli.StringFlag{
+				Name:        "after",
+				Category:    "OPTIONAL:",
+				Usage:       "Filter deals created after this timestamp",
+				Destination: &after,
+				Value:       "",
+			},
+			&cli.StringFlag{
+				Name:        "at",
+				Category:    "OPTIONAL:",
+				Usage:       "Filter deals created at this timestamp",
+				Destination: &at,
+				Value:       "",
+			},
+			&cli.StringFlag{
+				Name:        "format",
+				Category:    "OPTIONAL:",
+				Usage:       "The output format (table, json, ndjson or csv)",
+				DefaultText: "table",
+				Destination: &format,
+				Value:       "table",
+			},
+			&cli.BoolFlag{
+				Name:        "follow",
+				Aliases:     []string{"f"},
+				Category:    "OPTIONAL:",
+				Usage:       "Keep polling for events newer than the last one listed",
+				Destination: &follow,
+			},
+			&cli.DurationFlag{
+				Name:        "interval",
+				Category:    "OPTIONAL:",
+				Usage:       "With --follow, how often to poll for new events",
+				DefaultText: app.DefaultFollowInterval.String(),
+				Destination: &interval,
+				Value:       app.DefaultFollowInterval,
+			},
+			&cli.StringFlag{
+				Name:        "exec",
+				Category:    "OPTIONAL:",
+				Usage:       "With --follow, run this shell command for each new event instead of printing it, with the CID as $1",
+				Destination: &hook,
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			ns, rel, err := parseVaultName(vault)
+			if err != nil {
+				return err
+			}
+
+			bp := vaultsprovider.New(provider)
+
+			b, a, err := validateBeforeAndAfter(before, after, at)
+			if err != nil {
+				return err
+			}
+
+			if all && latest > 0 {
+				return errors.New("--all and --latest cannot be used together")
+			}
+			if follow && (before != "" || at != "") {
+				return errors.New("--follow cannot be used with --before or --at")
+			}
+			if hook != "" && !follow {
+				return errors.New("--exec requires --follow")
+			}
+
+			printer, err := newEventPrinter(os.Stdout, format)
+			if err != nil {
+				return err
+			}
+
+			v := app.Vault(fmt.Sprintf("%s.%s", ns, rel))
+			listed := []app.EventInfo{}
+			if all {
+				if err := app.PageEvents(cCtx.Context, bp, v, b, a, func(page []app.EventInfo) error {
+					listed = append(listed, page...)
+					return printer.write(page)
+				}); err != nil {
+					return fmt.Errorf("failed to fetch deals: %s", err)
+				}
+			} else {
+				var req app.ListVaultEventsParams
+				if latest > 0 {
+					req = app.ListVaultEventsParams{
+						Vault:  v,
+						Limit:  uint32(latest),
+						Offset: 0,
+						Before: b,
+						After:  a,
+					}
+				} else {
+					if offset < 0 {
+						return errors.New("offset has to be greater than 0")
+					}
+
+					if limit < 0 {
+						return errors.New("limit has to be greater than 0")
+					}
+
+					req = app.ListVaultEventsParams{
+						Vault:  v,
+						Limit:  uint32(limit),
+						Offset: uint32(offset),
+						Before: b,
+						After:  a,
+					}
+				}
+
+				listed, err = bp.ListVaultEvents(cCtx.Context, req)
+				if err != nil {
+					return fmt.Errorf("failed to fetch deals: %s", err)
+				}
+				if err := printer.write(listed); err != nil {
+					return err
+				}
+			}
+
+			if err := printer.flush(); err != nil {
+				return err
+			}
+
+			if !follow {
+				return nil
+			}
+
+			ctx, stop := signal.NotifyContext(cCtx.Context, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			follower := app.NewEventFollower(bp, v, a, interval)
+			follower.MarkSeen(listed)
+			return follower.Follow(ctx, func(events []app.EventInfo) error {
+				if hook == "" {
+					if err := printer.write(events); err != nil {
+						return err
+					}
+					return printer.flush()
+				}
+
+				for _, event := range events {
+					runEventHook(ctx, hook, v, event)
+				}
+				return nil
+			})
+		},
+	}
+}
+
+// runEventHook runs a shell command for an event, with the CID as $1
+// and the event details in the environment. Failures are only logged.
+func runEventHook(ctx context.Context, hook string, vault app.Vault, event app.EventInfo) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook, "vaults", event.CID)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"VAULTS_VAULT="+string(vault),
+		"VAULTS_EVENT_CID="+event.CID,
+		fmt.Sprintf("VAULTS_EVENT_TIMESTAMP=%d", event.Timestamp),
+	)
+
+	if err := cmd.Run(); err != nil {
+		slog.Error("event hook failed", "cid", event.CID, "error", err)
+	}
+}
+
+// eventPrinter writes events in one of the output formats.
+// The ndjson and csv formats are streamed as events are written,
+// table and json are rendered on flush.
+type eventPrinter struct {
+	w       io.Writer
+	format  string
+	pending []app.EventInfo
+	csv     *csv.Writer
+}
+
+func newEventPrinter(w io.Writer, format string) (*eventPrinter, error) {
+	p := &eventPrinter{w: w, format: format, pending: []app.EventInfo{}}
+	switch format {
+	case "table", "json", "ndjson":
+	case "csv":
+		p.csv = csv.NewWriter(w)
+		if err := p.csv.Write([]string{"cid", "timestamp", "is_archived", "cache_expiry"}); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid format: %s", format)
+	}
+
+	return p, nil
+}
+
+func (p *eventPrinter) write(events []app.EventInfo) error {
+	switch p.format {
+	case "ndjson":
+		enc := json.NewEncoder(p.w)
+		for _, event := range events {
+			if err := enc.Encode(event); err != nil {
+				return fmt.Errorf("error serializing events to JSON")
+			}
+		}
+		return nil
+	case "csv":
+		for _, event := range events {
+			if err := p.csv.Write([]string{
+				event.CID,
+				strconv.FormatInt(event.Timestamp, 10),
+				strconv.FormatBool(event.IsArchived),
+				event.CacheExpiry,
+			}); err != nil {
+				return err
+			}
+		}
+		p.csv.Flush()
+		return p.csv.Error()
+	default:
+		p.pending = append(p.pending, events...)
+		return nil
+	}
+}
+
+func (p *eventPrinter) flush() error {
+	events := p.pending
+	p.pending = []app.EventInfo{}
+
+	switch p.format {
+	case "table":
+		table := tablewriter.NewWriter(p.w)
+		table.SetHeader([]string{"CID", "Timestamp", "Archived", "Cache Expiry"})
+
+		for _, event := range events {
+			isArchived := "N"
+			if event.IsArchived {
+				isArchived = "Y"
+			}
+			timestamp := "(null)"
+			if event.Timestamp > 0 {
+				timestamp = time.Unix(event.Timestamp, 0).Format(time.RFC3339)
+			}
+			table.Append([]string{
+				event.CID, timestamp, isArchived, event.CacheExpiry,
+			})
+		}
+		table.Render()
+	case "json":
+		jsonData, err := json.Marshal(events)
+		if err != nil {
+			return fmt.Errorf("error serializing events to JSON")
+		}
+		fmt.Fprintln(p.w, string(jsonData))
+	}
+
+	return nil
+}
+
+func newSignCommand() *cli.Command {
+	var privateKey string
+
+	return &cli.Command{
+		Name:      "sign",
+		Usage:     "Sign a file with a private key",
+		ArgsUsage: "<file_path>",
+		Description: "Signing a file with take a provide key and a path to the desired file\n" +
+			"to produce a hex encoded string (e.g., can be used in the HTTP API).\n\n" +
+			"EXAMPLE:\n\nvaults sign --private-key 0x1234abcd /path/to/file",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "private-key",
+				Aliases:     []string{"k"},
+				Category:    "REQUIRED:",
+				Usage:       "Ethereum wallet private key",
+				Destination: &privateKey,
+				Required:    true,
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() != 1 {
+				return errors.New("must provide a file path")
+			}
+			filepath := cCtx.Args().First()
+
+			privateKey, err := crypto.HexToECDSA(privateKey)
+			if err != nil {
+				return err
+			}
+
+			signer := signing.NewSigner(privateKey)
+			signatureBytes, err := signer.SignFile(filepath)
+			if err != nil {
+				return fmt.Errorf("failed to sign file: %s", err)
+			}
+			signature := hex.EncodeToString(signatureBytes)
+			fmt.Println(signature)
+
+			return nil
+		},
+	}
+}
+
+func newRetrieveCommand() *cli.Command {
+	var output, provider, vault, before, after, dir string
+	var timeout int64
+	var keepCAR bool
+	var concurrency int
+
+	return &cli.Command{
+		Name:      "retrieve",
+		Usage:     "Retrieve an event by CID, or all the events of a vault",
+		ArgsUsage: "<event_cid>",
+		Description: "Retrieving an event will download the event's content into the \n" +
+			"specified file or to stdout. Every block is verified against the CID, \n" +
+			"and files split into many blocks are reassembled. Use --car to write \n" +
+			"the verified CAR file instead.\n\n" +
+			"With --vault, every event of the vault in the time range is retrieved \n" +
+			"into --dir, along with a manifest.json mapping CIDs to files. Running \n" +
+			"it again skips the events already retrieved.\n\n" +
+			"EXAMPLES:\n\nvaults retrieve --output filename bafy...\n" +
+			"vaults retrieve --vault my.vault --after 2023-09-01 --dir out/",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Category:    "OPTIONAL:",
+				Usage:       "The file to store the retrieved content, or '-' for stdout",
+				DefaultText: "stdout",
+				Destination: &output,
+			},
+			&cli.StringFlag{
+				Name:        "provider",
+				Aliases:     []string{"p"},
+				Category:    "OPTIONAL:",
+				Usage:       "The provider's address and port (e.g., localhost:8080)",
+				DefaultText: DefaultProviderHost,
+				Destination: &provider,
+				Value:       DefaultProviderHost,
+			},
+			&cli.Int64Flag{
+				Name:        "timeout",
+				Aliases:     []string{"t"},
+				Category:    "OPTIONAL:",
+				Usage:       "Timeout for retrieval operation (seconds)",
+				DefaultText: "no timeout",
+				Destination: &timeout,
+				Value:       0,
+			},
+			&cli.BoolFlag{
+				Name:        "car",
+				Category:    "OPTIONAL:",
+				Usage:       "Write the verified CAR file instead of extracting its content",
+				Destination: &keepCAR,
+			},
+			&cli.StringFlag{
+				Name:        "vault",
+				Aliases:     []string{"v"},
+				Category:    "OPTIONAL:",
+				Usage:       "Retrieve all the events of this vault instead of a single CID",
+				Destination: &vault,
+			},
+			&cli.StringFlag{
+				Name:        "before",
+				Category:    "OPTIONAL:",
+				Usage:       "With --vault, retrieve events created before this timestamp",
+				Destination: &before,
+			},
+			&cli.StringFlag{
+				Name:        "after",
+				Category:    "OPTIONAL:",
+				Usage:       "With --vault, retrieve events created after this timestamp",
+				Destination: &after,
+			},
+			&cli.StringFlag{
+				Name:        "dir",
+				Aliases:     []string{"d"},
+				Category:    "OPTIONAL:",
+				Usage:       "With --vault, the directory to store the retrieved files",
+				DefaultText: "current directory",
+				Destination: &dir,
+				Value:       ".",
+			},
+			&cli.IntFlag{
+				Name:        "concurrency",
+				Aliases:     []string{"c"},
+				Category:    "OPTIONAL:",
+				Usage:       "With --vault, the number of events retrieved in parallel",
+				Destination: &concurrency,
+				Value:       4,
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			if vault != "" {
+				return retrieveVault(cCtx, vaultsprovider.New(provider), vault, before, after, dir, timeout, concurrency)
+			}
+
+			arg := cCtx.Args().Get(0)
+			if arg == "" {
+				return errors.New("must provide an event CID")
+			}
+
+			rootCid, err := cid.Parse(arg)
+			if err != nil {
+				return errors.New("CID is invalid")
+			}
+
+			bp := vaultsprovider.New(provider)
+			if keepCAR {
+				configDir, err := defaultConfigLocation("")
+				if err != nil {
+					return fmt.Errorf("default config location: %s", err)
+				}
+				retriever, err := newRetriever(configDir, bp, timeout)
+				if err != nil {
+					return err
+				}
+				retriever.KeepCAR(true)
+				source, err := retriever.Retrieve(cCtx.Context, rootCid, output)
+				if err != nil {
+					return fmt.Errorf("failed to retrieve: %s", err)
+				}
+				fmt.Fprintf(os.Stderr, "> Retrieved %s from %s\n", rootCid, source)
+				return nil
+			}
+
+			cache, err := openCache(bp, timeout)
+			if err != nil {
+				return err
+			}
+			source, err := cache.Retrieve(cCtx.Context, rootCid, output)
+			if err != nil {
+				return fmt.Errorf("failed to retrieve: %s", err)
+			}
+			fmt.Fprintf(os.Stderr, "> Retrieved %s from %s\n", rootCid, source)
+
+			return cache.Trim()
+		},
+	}
+}
+
+func newQueryCommand() *cli.Command {
+	var vault, provider, before, after, at, format string
+	var timeout int64
+	var concurrency int
+
+	return &cli.Command{
+		Name:      "query",
+		Usage:     "Run a SQL query over the events of a vault",
+		ArgsUsage: "<sql>",
+		Description: "The events of the vault in the time range are retrieved into a local \n" +
+			"cache, and registered as a view named after the vault's relation. \n" +
+			"Events already in the cache are not retrieved again.\n\n" +
+			"EXAMPLE:\n\nvaults query --vault my.vault --after 2023-09-01 \\\n" +
+			"\"SELECT count(*) FROM vault\"",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "vault",
+				Aliases:     []string{"v"},
+				Category:    "REQUIRED:",
+				Usage:       "Vault name",
+				Destination: &vault,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "provider",
+				Aliases:     []string{"p"},
+				Category:    "OPTIONAL:",
+				Usage:       "The provider's address and port (e.g., localhost:8080)",
+				DefaultText: DefaultProviderHost,
+				Destination: &provider,
+				Value:       DefaultProviderHost,
+			},
+			&cli.StringFlag{
+				Name:        "before",
+				Category:    "OPTIONAL:",
+				Usage:       "Query events created before this timestamp",
+				Destination: &before,
+			},
+			&cli.StringFlag{
+				Name:        "after",
+				Category:    "OPTIONAL:",
+				Usage:       "Query events created after this timestamp",
+				Destination: &after,
+			},
+			&cli.StringFlag{
+				Name:        "at",
+				Category:    "OPTIONAL:",
+				Usage:       "Query events created at this timestamp",
+				Destination: &at,
+			},
+			&cli.StringFlag{
+				Name:        "format",
+				Category:    "OPTIONAL:",
+				Usage:       "The output format (table, csv or json)",
+				DefaultText: "table",
+				Destination: &format,
+				Value:       "table",
+			},
+			&cli.Int64Flag{
+				Name:        "timeout",
+				Aliases:     []string{"t"},
+				Category:    "OPTIONAL:",
+				Usage:       "Timeout for retrieval operation (seconds)",
+				DefaultText: "no timeout",
+				Destination: &timeout,
+			},
+			&cli.IntFlag{
+				Name:        "concurrency",
+				Aliases:     []string{"c"},
+				Category:    "OPTIONAL:",
+				Usage:       "The number of events retrieved in parallel",
+				Destination: &concurrency,
+				Value:       4,
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			query := cCtx.Args().Get(0)
+			if query == "" {
+				return errors.New("must provide a query")
+			}
+
+			ns, rel, err := parseVaultName(vault)
+			if err != nil {
+				return err
+			}
+
+			b, a, err := validateBeforeAndAfter(before, after, at)
+			if err != nil {
+				return err
+			}
+
+			if format != "table" && format != "csv" && format != "json" {
+				return fmt.Errorf("unknown format %s", format)
+			}
+
+			bp := vaultsprovider.New(provider)
+			cache, err := openCache(bp, timeout)
+			if err != nil {
+				return err
+			}
+
+			querier := app.NewQuerier(bp, cache, concurrency)
+			result, err := querier.Query(cCtx.Context, app.Vault(fmt.Sprintf("%s.%s", ns, rel)), b, a, query)
+			if err != nil {
+				return fmt.Errorf("failed to query: %s", err)
+			}
+
+			return printQueryResult(os.Stdout, result, format)
+		},
+	}
+}
+
+func newMaterializeCommand() *cli.Command {
+	var vault, provider, out, primaryKey string
+	var timeout int64
+
+	return &cli.Command{
+		Name:      "materialize",
+		Usage:     "Rebuild the current state of a table from the change events of a vault",
+		UsageText: "vaults materialize [command options]",
+		Description: "The events of the vault are applied in timestamp order to a DuckDB \n" +
+			"table named after the vault's relation, keyed on the primary key recorded \n" +
+			"in the events. Rows with an _op column of D are deleted, and the others \n" +
+			"replace the row with the same key. Running it again only applies the \n" +
+			"new events.\n\n" +
+			"If --out is a .parquet file, the state is kept in <out>.duckdb and the \n" +
+			"table is exported to the Parquet file.\n\n" +
+			"EXAMPLE:\n\nvaults materialize --vault my.vault --out state.duckdb",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "vault",
+				Aliases:     []string{"v"},
+				Category:    "REQUIRED:",
+				Usage:       "Vault name",
+				Destination: &vault,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "out",
+				Aliases:     []string{"o"},
+				Category:    "REQUIRED:",
+				Usage:       "The DuckDB database or Parquet file to write the table to",
+				Destination: &out,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "primary-key",
+				Category:    "OPTIONAL:",
+				Usage:       "Comma separated primary key columns, if not recorded in the events",
+				Destination: &primaryKey,
+			},
+			&cli.StringFlag{
+				Name:        "provider",
+				Aliases:     []string{"p"},
+				Category:    "OPTIONAL:",
+				Usage:       "The provider's address and port (e.g., localhost:8080)",
+				DefaultText: DefaultProviderHost,
+				Destination: &provider,
+				Value:       DefaultProviderHost,
+			},
+			&cli.Int64Flag{
+				Name:        "timeout",
+				Aliases:     []string{"t"},
+				Category:    "OPTIONAL:",
+				Usage:       "Timeout for retrieval operation (seconds)",
+				DefaultText: "no timeout",
+				Destination: &timeout,
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			ns, rel, err := parseVaultName(vault)
+			if err != nil {
+				return err
+			}
+			v := app.Vault(fmt.Sprintf("%s.%s", ns, rel))
+
+			bp := vaultsprovider.New(provider)
+			cache, err := openCache(bp, timeout)
+			if err != nil {
+				return err
+			}
+
+			dbPath := out
+			toParquet := strings.HasSuffix(out, ".parquet")
+			if toParquet {
+				dbPath = out + ".duckdb"
+			}
+
+			m, err := app.OpenMaterializer(cCtx.Context, dbPath, bp, cache)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = m.Close()
+			}()
+
+			if primaryKey != "" {
+				m.SetPrimaryKey(strings.Split(primaryKey, ","))
+			}
+
+			summary, err := m.Materialize(cCtx.Context, v)
+			if err != nil {
+				return fmt.Errorf("failed to materialize: %s", err)
+			}
+
+			if toParquet {
+				if err := m.ExportParquet(cCtx.Context, v, out); err != nil {
+					return err
+				}
+			}
+
+			fmt.Printf("%d events applied, %d rows in %s\n", summary.Applied, summary.Rows, rel)
+			return nil
+		},
+	}
+}
+
+func newAuditCommand() *cli.Command {
+	var dburi, vault, tables, provider string
+	var timeout, maxRows int64
+
+	return &cli.Command{
+		Name:      "audit",
+		Usage:     "Check that a vault matches the tables it replicates from Postgres",
+		UsageText: "vaults audit [command options]",
+		Description: "The tables are scanned in a single consistent snapshot and their \n" +
+			"multiset hash digest is compared with the latest digest exported to the \n" +
+			"vault. Run it while the stream is caught up, otherwise recent changes \n" +
+			"show up as a mismatch. Only tables loaded with --snapshot-new-tables \n" +
+			"have a digest; the others are reported as NO DIGEST.\n\n" +
+			"When a table does not match, its replica is rebuilt from the vault's \n" +
+			"events and both sides are bisected by primary key range to find the \n" +
+			"rows that differ.\n\n" +
+			"EXAMPLE:\n\nvaults audit --vault my.vault --tables t1,t2",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "dburi",
+				Category:    "OPTIONAL:",
+				Usage:       "PostgreSQL connection string (e.g., postgresql://postgres:[PASSWORD]@[HOST]:[PORT]/postgres)",
+				DefaultText: "dburi in config",
+				EnvVars:     []string{"VAULTS_DBURI"},
+				Destination: &dburi,
+			},
+			&cli.StringFlag{
+				Name:        "vault",
+				Aliases:     []string{"v"},
+				Category:    "REQUIRED:",
+				Usage:       "Vault name",
+				Destination: &vault,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "tables",
+				Category:    "REQUIRED:",
+				Usage:       "Comma separated tables to audit",
+				Destination: &tables,
+				Required:    true,
+			},
+			&cli.Int64Flag{
+				Name:        "max-rows",
+				Category:    "OPTIONAL:",
+				Usage:       "Compare ranges row by row once they have at most this many rows",
+				Destination: &maxRows,
+				Value:       16,
+			},
+			&cli.StringFlag{
+				Name:        "provider",
+				Aliases:     []string{"p"},
+				Category:    "OPTIONAL:",
+				Usage:       "The provider's address and port (e.g., localhost:8080)",
+				DefaultText: DefaultProviderHost,
+				Destination: &provider,
+				Value:       DefaultProviderHost,
+			},
+			&cli.Int64Flag{
+				Name:        "timeout",
+				Aliases:     []string{"t"},
+				Category:    "OPTIONAL:",
+				Usage:       "Timeout for retrieval operation (seconds)",
+				DefaultText: "no timeout",
+				Destination: &timeout,
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			ctx := cCtx.Context
+			ns, rel, err := parseVaultName(vault)
+			if err != nil {
+				return err
+			}
+			v := app.Vault(fmt.Sprintf("%s.%s", ns, rel))
+			if maxRows < 1 {
+				return errors.New("max-rows must be at least 1")
+			}
+
+			dburi, err := vaultDBURI(cCtx, dburi, vault)
+			if err != nil {
+				return err
+			}
+
+			publication := pgrepl.Publication(strings.Replace(vault, ".", "_", -1))
+			setup, err := NewDatabaseStreamSetup(ctx, dburi, publication, tables)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = setup.Close(ctx)
+			}()
+
+			schemas, err := setup.TableSchemas(ctx)
+			if err != nil {
+				return err
+			}
+
+			pg, err := sql.Open("pgx", dburi)
+			if err != nil {
+				return fmt.Errorf("connect: %s", err)
+			}
+			defer func() {
+				_ = pg.Close()
+			}()
+
+			// every table is read from the same snapshot
+			tx, err := pg.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+			if err != nil {
+				return fmt.Errorf("begin: %s", err)
+			}
+			defer func() {
+				_ = tx.Rollback()
+			}()
+
+			bp := vaultsprovider.New(provider)
+			cache, err := openCache(bp, timeout)
+			if err != nil {
+				return err
+			}
+
+			found := map[string]app.TableSchema{}
+			for _, schema := range schemas {
+				found[schema.Table] = schema
+			}
+
+			mismatches := 0
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Table", "Rows", "Status"})
+			diffs := map[string][]app.RowDiff{}
+			for _, name := range strings.Split(tables, ",") {
+				schema, ok := found[name]
+				if !ok {
+					return fmt.Errorf("table %s not found", name)
+				}
+
+				source, err := app.NewAuditTable(tx, name, schema.Columns)
+				if err != nil {
+					return fmt.Errorf("%s: %s", name, err)
+				}
+				digest, rows, err := source.TextDigest(ctx)
+				if err != nil {
+					return fmt.Errorf("%s: %s", name, err)
+				}
+
+				exported, err := latestDigest(ctx, bp, cache, v, name)
+				if err != nil {
+					return fmt.Errorf("%s: %s", name, err)
+				}
+
+				status := "MATCH"
+				if exported == nil {
+					status = "NO DIGEST"
+				} else if !digest.Equal(exported) {
+					status = "MISMATCH"
+					mismatches++
+
+					diffs[name], err = auditReplica(ctx, bp, cache, v, source, schema, maxRows)
+					if err != nil {
+						return fmt.Errorf("%s: %s", name, err)
+					}
+				}
+				table.Append([]string{name, fmt.Sprint(rows), status})
+			}
+			table.Render()
+
+			for _, name := range strings.Split(tables, ",") {
+				for _, diff := range diffs[name] {
+					fmt.Printf("%s %s: source %s, vault %s\n",
+						name, strings.Join(diff.Key, ","), formatAuditRow(diff.Source), formatAuditRow(diff.Replica),
+					)
+				}
+			}
+
+			if mismatches > 0 {
+				return cli.Exit(fmt.Sprintf("%d tables do not match", mismatches), 1)
+			}
+			return nil
+		},
+	}
+}
+
+// latestDigest returns the digest of the table in the vault's most recent
+// event that recorded one, or nil if there is none.
+func latestDigest(
+	ctx context.Context, bp *vaultsprovider.VaultsProvider, cache *app.ContentCache, vault app.Vault, table string,
+) (*ecmh.MultisetHash, error) {
+	var digest string
+	if err := app.ReplicaEvents(ctx, bp, cache, vault, func(e app.ReplicaEvent) bool {
+		if e.Table == table && e.Digest != "" {
+			digest = e.Digest
+			return false
+		}
+		return true
+	}); err != nil && !errors.Is(err, app.ErrNoEvents) {
+		return nil, err
+	}
+	if digest == "" {
+		return nil, nil
+	}
+
+	h := ecmh.NewMultisetHash()
+	if err := h.UnmarshalText([]byte(digest)); err != nil {
+		return nil, fmt.Errorf("invalid digest: %s", err)
+	}
+
+	return h, nil
+}
+
+// auditReplica rebuilds the table from the vault's events and bisects it against the source.
+func auditReplica(
+	ctx context.Context,
+	bp *vaultsprovider.VaultsProvider,
+	cache *app.ContentCache,
+	vault app.Vault,
+	source *app.AuditTable,
+	schema app.TableSchema,
+	maxRows int64,
+) ([]app.RowDiff, error) {
+	files := []string{}
+	if err := app.ReplicaEvents(ctx, bp, cache, vault, func(e app.ReplicaEvent) bool {
+		if e.Table == schema.Table {
+			files = append([]string{e.Path}, files...)
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	pk := []string{}
+	for _, c := range schema.Columns {
+		if c.IsPrimary {
+			pk = append(pk, c.Name)
+		}
+	}
+
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open db: %s", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	// the replica lives in a single in-memory database
+	db.SetMaxOpenConns(1)
+
+	columns, err := app.LoadReplica(ctx, db, schema.Table, files, pk)
+	if err != nil {
+		return nil, fmt.Errorf("load replica: %s", err)
+	}
+
+	replica, err := app.NewAuditTable(db, schema.Table, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.Bisect(ctx, source, replica, maxRows)
+}
+
+func formatAuditRow(row map[string]*string) string {
+	if row == nil {
+		return "missing"
+	}
+
+	names := make([]string, 0, len(row))
+	for name := range row {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make([]string, len(names))
+	for i, name := range names {
+		value := "NULL"
+		if row[name] != nil {
+			value = strconv.Quote(*row[name])
+		}
+		values[i] = fmt.Sprintf("%s=%s", name, value)
+	}
+
+	return "{" + strings.Join(values, " ") + "}"
+}
+
+func printQueryResult(w io.Writer, result *app.QueryResult, format string) error {
+	switch format {
+	case "json":
+		rows := make([]map[string]any, len(result.Rows))
+		for i, row := range result.Rows {
+			rows[i] = make(map[string]any, len(row))
+			for j, v := range row {
+				if b, ok := v.([]byte); ok {
+					v = string(b)
+				}
+				rows[i][result.Columns[j]] = v
+			}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(result.Columns); err != nil {
+			return err
+		}
+		for _, row := range result.Rows {
+			record := make([]string, len(row))
+			for i, v := range row {
+				if v != nil {
+					record[i] = formatQueryValue(v)
+				}
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		table := tablewriter.NewWriter(w)
+		table.SetHeader(result.Columns)
+		for _, row := range result.Rows {
+			record := make([]string, len(row))
+			for i, v := range row {
+				record[i] = "(null)"
+				if v != nil {
+					record[i] = formatQueryValue(v)
+				}
+			}
+			table.Append(record)
+		}
+		table.Render()
+		return nil
+	}
+}
+
+func formatQueryValue(v any) string {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// openCache opens the retrieval cache under the config directory.
+func openCache(bp *vaultsprovider.VaultsProvider, timeout int64) (*app.ContentCache, error) {
+	dir, err := defaultConfigLocation("")
+	if err != nil {
+		return nil, fmt.Errorf("default config location: %s", err)
+	}
+
+	maxSize, err := cacheMaxSize(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	retriever, err := newRetriever(dir, bp, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := app.NewContentCache(path.Join(dir, "cache"), maxSize, retriever)
+	if err != nil {
+		return nil, fmt.Errorf("open cache: %s", err)
+	}
+
+	return cache, nil
+}
+
+// newRetriever creates a retriever with the sources set in the config, if there is one.
+func newRetriever(dir string, bp *vaultsprovider.VaultsProvider, timeout int64) (*app.Retriever, error) {
+	cfg, err := loadConfig(path.Join(dir, "config.yaml"))
+	if errors.Is(err, os.ErrNotExist) {
+		return app.NewRetriever(bp, timeout), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load config: %s", err)
+	}
+
+	sources := cfg.Retrieval.retrievalSources()
+	if len(sources) == 0 {
+		return app.NewRetriever(bp, timeout), nil
+	}
+
+	retriever, err := app.NewRetrieverWithSources(bp, timeout, sources)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retrieval config: %s", err)
+	}
+
+	return retriever, nil
+}
+
+// cacheMaxSize reads the cache size limit from the config, if there is one.
+func cacheMaxSize(dir string) (int64, error) {
+	cfg, err := loadConfig(path.Join(dir, "config.yaml"))
+	if errors.Is(err, os.ErrNotExist) {
+		return app.DefaultCacheSize, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("load config: %s", err)
+	}
+	if cfg.Cache.MaxSize == "" {
+		return app.DefaultCacheSize, nil
+	}
+
+	size, err := humanize.ParseBytes(cfg.Cache.MaxSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cache max_size: %s", err)
+	}
+
+	return int64(size), nil
+}
+
+func retrieveVault(
+	cCtx *cli.Context,
+	bp *vaultsprovider.VaultsProvider,
+	vault, before, after, dir string,
+	timeout int64,
+	concurrency int,
+) error {
+	ns, rel, err := parseVaultName(vault)
+	if err != nil {
+		return err
+	}
+
+	b, a, err := validateBeforeAndAfter(before, after, "")
+	if err != nil {
+		return err
+	}
+
+	cache, err := openCache(bp, timeout)
+	if err != nil {
+		return err
+	}
+
+	batch := app.NewBatchRetriever(bp, cache, concurrency)
+	summary, err := batch.Retrieve(cCtx.Context, app.Vault(fmt.Sprintf("%s.%s", ns, rel)), b, a, dir)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve: %s", err)
+	}
+
+	fmt.Printf(
+		"%d retrieved, %d skipped, %d failed\n",
+		summary.Retrieved, summary.Skipped, len(summary.Failures),
+	)
+	for c, err := range summary.Failures {
+		fmt.Printf("\033[31m%s: %s\033[0m\n", c, err)
+	}
+
+	if len(summary.Failures) > 0 {
+		return fmt.Errorf("%d events failed to retrieve", len(summary.Failures))
+	}
+
+	return nil
+}
+
+func newCacheCommand() *cli.Command {
+	var maxSize string
+
+	return &cli.Command{
+		Name:      "cache",
+		Usage:     "Manage the local cache of retrieved events",
+		UsageText: "vaults cache <subcommand> [arguments...]",
+		Description: "Retrieved events are cached under ~/.vaults/cache, keyed by CID, \n" +
+			"and shared by retrieve, query and materialize. The least recently used \n" +
+			"entries are evicted to keep the cache under cache.max_size in the config \n" +
+			"(10GB by default).",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "ls",
+				Usage:     "List the cached events, most recently used first",
+				UsageText: "vaults cache ls",
+				Action: func(cCtx *cli.Context) error {
+					cache, err := openCache(nil, 0)
+					if err != nil {
+						return err
+					}
+
+					entries, err := cache.List()
+					if err != nil {
+						return err
+					}
+
+					var total int64
+					table := tablewriter.NewWriter(os.Stdout)
+					table.SetHeader([]string{"CID", "Filename", "Size", "Last Used"})
+					for _, e := range entries {
+						total += e.Size
+						table.Append([]string{
+							e.CID, e.Filename, humanize.Bytes(uint64(e.Size)), e.LastUsed.Format(time.RFC3339),
+						})
+					}
+					table.Render()
+					fmt.Printf("%d entries, %s\n", len(entries), humanize.Bytes(uint64(total)))
+
+					return nil
+				},
+			},
+			{
+				Name:      "prune",
+				Usage:     "Evict the least recently used events until the cache fits a size",
+				UsageText: "vaults cache prune [command options]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "max-size",
+						Category:    "OPTIONAL:",
+						Usage:       "The size to prune the cache to (e.g., 500MB)",
+						DefaultText: "cache.max_size in the config",
+						Destination: &maxSize,
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					dir, err := defaultConfigLocation(cCtx.String("dir"))
+					if err != nil {
+						return fmt.Errorf("default config location: %s", err)
+					}
+
+					size, err := cacheMaxSize(dir)
+					if err != nil {
+						return err
+					}
+					if maxSize != "" {
+						s, err := humanize.ParseBytes(maxSize)
+						if err != nil {
+							return fmt.Errorf("invalid max size: %s", err)
+						}
+						size = int64(s)
+					}
+
+					cache, err := openCache(nil, 0)
+					if err != nil {
+						return err
+					}
+
+					evicted, err := cache.Prune(size)
+					if err != nil {
+						return err
+					}
+
+					var freed int64
+					for _, e := range evicted {
+						freed += e.Size
+					}
+					fmt.Printf("%d entries evicted, %s freed\n", len(evicted), humanize.Bytes(uint64(freed)))
+
+					return nil
+				},
+			},
+			{
+				Name:      "clear",
+				Usage:     "Remove every cached event",
+				UsageText: "vaults cache clear",
+				Action: func(cCtx *cli.Context) error {
+					cache, err := openCache(nil, 0)
+					if err != nil {
+						return err
+					}
+
+					if err := cache.Clear(); err != nil {
+						return err
+					}
+					fmt.Println("Cache cleared")
+
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func newLedgerCommand() *cli.Command {
+	var vault, provider, format string
+
+	formatFlag := &cli.StringFlag{
+		Name:        "format",
+		Category:    "OPTIONAL:",
+		Usage:       "The output format (table or json)",
+		DefaultText: "table",
+		Destination: &format,
+		Value:       "table",
+	}
+	vaultFlag := &cli.StringFlag{
+		Name:        "vault",
+		Aliases:     []string{"v"},
+		Category:    "OPTIONAL:",
+		Usage:       "Only the files uploaded to this vault",
+		Destination: &vault,
+	}
+
+	return &cli.Command{
+		Name:      "ledger",
+		Usage:     "Inspect the files uploaded from this machine",
+		UsageText: "vaults ledger <subcommand> [arguments...]",
+		Description: "Files uploaded by write and stream are recorded in ~/.vaults/ledger.db, \n" +
+			"with their hash, size, signature, the CID of the event the provider \n" +
+			"created and, for streamed files, the source tables and LSN range.",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "ls",
+				Usage:       "List the uploaded files, oldest first",
+				UsageText:   "vaults ledger ls [command options]",
+				Description: "EXAMPLE:\n\nvaults ledger ls --vault my.vault --format json",
+				Flags:       []cli.Flag{vaultFlag, formatFlag},
+				Action: func(cCtx *cli.Context) error {
+					ledger, err := openLedger(cCtx)
+					if err != nil {
+						return err
+					}
+
+					entries, err := ledger.Entries(cCtx.Context, app.Vault(vault))
+					if err != nil {
+						return err
+					}
+
+					switch format {
+					case "table":
+						table := tablewriter.NewWriter(os.Stdout)
+						table.SetHeader([]string{"Vault", "CID", "Filename", "Size", "Tables", "LSN Range", "Uploaded"})
+						for _, e := range entries {
+							r := newLedgerRecord(e)
+							table.Append([]string{
+								r.Vault, r.CID, r.Filename, humanize.Bytes(uint64(r.Size)),
+								strings.Join(r.Tables, ","), lsnRange(r), r.UploadedAt,
+							})
+						}
+						table.Render()
+					case "json":
+						return printLedgerRecords(entries)
+					default:
+						return fmt.Errorf("invalid format: %s", format)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:        "show",
+				Usage:       "Show the uploaded files with a CID or file hash",
+				UsageText:   "vaults ledger show [command options] <cid_or_file_hash>",
+				Description: "EXAMPLE:\n\nvaults ledger show bafybeiabc...",
+				Flags:       []cli.Flag{formatFlag},
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 1 {
+						return errors.New("must provide a CID or file hash")
+					}
+
+					ledger, err := openLedger(cCtx)
+					if err != nil {
+						return err
+					}
+
+					entries, err := ledger.Find(cCtx.Context, cCtx.Args().First())
+					if err != nil {
+						return err
+					}
+					if len(entries) == 0 {
+						return fmt.Errorf("%s is not in the ledger", cCtx.Args().First())
+					}
+
+					switch format {
+					case "table":
+						for _, e := range entries {
+							r := newLedgerRecord(e)
+							table := tablewriter.NewWriter(os.Stdout)
+							table.Append([]string{"Vault", r.Vault})
+							table.Append([]string{"CID", r.CID})
+							table.Append([]string{"Filename", r.Filename})
+							table.Append([]string{"File Hash", r.FileHash})
+							table.Append([]string{"Size", humanize.Bytes(uint64(r.Size))})
+							table.Append([]string{"Timestamp", fmt.Sprint(r.Timestamp)})
+							table.Append([]string{"Uploaded", r.UploadedAt})
+							table.Append([]string{"Tables", strings.Join(r.Tables, ",")})
+							table.Append([]string{"LSN Range", lsnRange(r)})
+							table.Append([]string{"Signature", r.Signature})
+							table.Render()
+						}
+					case "json":
+						return printLedgerRecords(entries)
+					default:
+						return fmt.Errorf("invalid format: %s", format)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "reconcile",
+				Usage:     "Check that the uploaded files are still listed by their vaults",
+				UsageText: "vaults ledger reconcile [command options]",
+				Description: "Lists the events of each vault in the ledger and reports the uploaded \n" +
+					"files whose event is missing. It exits with an error if any is. Files \n" +
+					"without a CID, because the provider didn't respond with one, can't be \n" +
+					"checked.\n\n" +
+					"EXAMPLE:\n\nvaults ledger reconcile --vault my.vault",
+				Flags: []cli.Flag{
+					vaultFlag,
+					&cli.StringFlag{
+						Name:        "provider",
+						Aliases:     []string{"p"},
+						Category:    "OPTIONAL:",
+						Usage:       "The provider's address and port (e.g., localhost:8080)",
+						DefaultText: "the vault's provider in the config",
+						Destination: &provider,
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					dir, err := defaultConfigLocation(cCtx.String("dir"))
+					if err != nil {
+						return fmt.Errorf("default config location: %s", err)
+					}
+					cfg, err := loadConfig(path.Join(dir, "config.yaml"))
+					if err != nil && !os.IsNotExist(err) {
+						return fmt.Errorf("load config: %s", err)
+					}
+
+					ledger, err := openLedger(cCtx)
+					if err != nil {
+						return err
+					}
+					entries, err := ledger.Entries(cCtx.Context, app.Vault(vault))
+					if err != nil {
+						return err
+					}
+
+					vaults := []app.Vault{}
+					unchecked := 0
+					for _, e := range entries {
+						if !slices.Contains(vaults, e.Vault) {
+							vaults = append(vaults, e.Vault)
+						}
+						if e.CID == "" {
+							unchecked++
+						}
+					}
+
+					missing := []app.LedgerEntry{}
+					for _, v := range vaults {
+						host := provider
+						if host == "" && cfg != nil {
+							host = cfg.Vaults[string(v)].ProviderHost
+						}
+						if host == "" {
+							host = DefaultProviderHost
+						}
+
+						m, err := app.MissingEvents(cCtx.Context, vaultsprovider.New(host), v, entries)
+						if err != nil {
+							return fmt.Errorf("reconcile %s: %s", v, err)
+						}
+						missing = append(missing, m...)
+					}
+
+					for _, e := range missing {
+						fmt.Printf("missing %s %s (%s, uploaded %s)\n",
+							e.Vault, e.CID, e.Filename, e.UploadedAt.Format(time.RFC3339))
+					}
+					if unchecked > 0 {
+						fmt.Printf("%d files have no CID and were not checked\n", unchecked)
+					}
+					if len(missing) > 0 {
+						return fmt.Errorf("%d of %d files are missing from their vaults", len(missing), len(entries))
+					}
+					fmt.Printf("%d files checked in %d vaults, none missing\n", len(entries)-unchecked, len(vaults))
+
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func openLedger(cCtx *cli.Context) (*app.Ledger, error) {
+	dir, err := defaultConfigLocation(cCtx.String("dir"))
+	if err != nil {
+		return nil, fmt.Errorf("default config location: %s", err)
+	}
+
+	ledger, err := app.OpenLedger(cCtx.Context, path.Join(dir, "ledger.db"))
+	if err != nil {
+		return nil, fmt.Errorf("open ledger: %s", err)
+	}
+	return ledger, nil
+}
+
+// ledgerRecord is the json representation of a ledger entry.
+type ledgerRecord struct {
+	Vault      string   `json:"vault"`
+	CID        string   `json:"cid"`
+	Filename   string   `json:"filename"`
+	FileHash   string   `json:"file_hash"`
+	Size       int64    `json:"size"`
+	Timestamp  int64    `json:"timestamp"`
+	UploadedAt string   `json:"uploaded_at"`
+	Signature  string   `json:"signature"`
+	Tables     []string `json:"tables,omitempty"`
+	StartLSN   string   `json:"start_lsn,omitempty"`
+	EndLSN     string   `json:"end_lsn,omitempty"`
+}
 
-	return &cli.Command{
-		Name:      "sign",
-		Usage:     "Sign a file with a private key",
-		ArgsUsage: "<file_path>",
-		Description: "Signing a file with take a provide key and a path to the desired file\n" +
-			"to produce a hex encoded string (e.g., can be used in the HTTP API).\n\n" +
-			"EXAMPLE:\n\nvaults sign --private-key 0x1234abcd /path/to/file",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:        "private-key",
-				Aliases:     []string{"k"},
-				Category:    "REQUIRED:",
-				Usage:       "Ethereum wallet private key",
-				Destination: &privateKey,
-				Required:    true,
-			},
-		},
-		Action: func(cCtx *cli.Context) error {
-			if cCtx.NArg() != 1 {
-				return errors.New("must provide a file path")
-			}
-			filepath := cCtx.Args().First()
+func newLedgerRecord(e app.LedgerEntry) ledgerRecord {
+	r := ledgerRecord{
+		Vault:      string(e.Vault),
+		CID:        e.CID,
+		Filename:   e.Filename,
+		FileHash:   e.FileHash,
+		Size:       e.Size,
+		Timestamp:  e.Timestamp,
+		UploadedAt: e.UploadedAt.UTC().Format(time.RFC3339),
+		Signature:  e.Signature,
+		Tables:     e.Tables,
+	}
+	if !e.Window.IsZero() {
+		r.StartLSN = e.Window.StartLSN.String()
+		r.EndLSN = e.Window.EndLSN.String()
+	}
+	return r
+}
 
-			privateKey, err := crypto.HexToECDSA(privateKey)
-			if err != nil {
-				return err
-			}
+func lsnRange(r ledgerRecord) string {
+	if r.StartLSN == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s", r.StartLSN, r.EndLSN)
+}
 
-			signer := signing.NewSigner(privateKey)
-			signatureBytes, err := signer.SignFile(filepath)
-			if err != nil {
-				return fmt.Errorf("failed to sign file: %s", err)
-			}
-			signature := hex.EncodeToString(signatureBytes)
-			fmt.Println(signature)
+func printLedgerRecords(entries []app.LedgerEntry) error {
+	records := make([]ledgerRecord, len(entries))
+	for i, e := range entries {
+		records[i] = newLedgerRecord(e)
+	}
 
-			return nil
-		},
+	jsonData, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("error serializing ledger to JSON")
 	}
+	fmt.Println(string(jsonData))
+	return nil
 }
 
-func newRetrieveCommand() *cli.Command {
-	var output, provider string
-	var timeout int64
+func newConfigCommand() *cli.Command {
+	var address, provider string
+	var dryRun bool
 
 	return &cli.Command{
-		Name:      "retrieve",
-		Usage:     "Retrieve an event by CID",
-		ArgsUsage: "<event_cid>",
-		Description: "Retrieving an event will download the event's CAR file into the \n" +
-			"specified file or to stdout.\n\n" +
-			"EXAMPLE:\n\nvaults retrieve --output filename bafy...",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:        "output",
-				Aliases:     []string{"o"},
-				Category:    "OPTIONAL:",
-				Usage:       "The file to store the retrieved content, or '-' for stdout",
-				DefaultText: "stdout",
-				Destination: &output,
+		Name:      "config",
+		Usage:     "Read, change and validate the settings in config.yaml",
+		UsageText: "vaults config <subcommand> [arguments...]",
+		Description: "Keys are dotted paths in config.yaml. Vault settings are under \n" +
+			"vaults.<vault_name>, e.g. vaults.my.vault.dburi.\n\n" +
+			"String values can reference environment variables as ${NAME}, which \n" +
+			"are expanded when the setting is used, so secrets do not need to be \n" +
+			"stored in the file. Flags take precedence over environment variables, \n" +
+			"which take precedence over the config file.",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "get",
+				Usage:       "Print a setting, as stored in the file",
+				UsageText:   "vaults config get <key>",
+				Description: "EXAMPLE:\n\nvaults config get vaults.my.vault.tables",
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 1 {
+						return errors.New("must provide a key")
+					}
+					keys, err := configKey(cCtx.Args().First())
+					if err != nil {
+						return err
+					}
+
+					doc, _, err := readConfigDocument(cCtx.String("dir"))
+					if err != nil {
+						return err
+					}
+					node, err := lookupConfigNode(doc, keys, false)
+					if err != nil {
+						return err
+					}
+					if node == nil {
+						return fmt.Errorf("%s is not set", cCtx.Args().First())
+					}
+
+					if node.Kind == yaml.ScalarNode {
+						fmt.Println(node.Value)
+						return nil
+					}
+					return yaml.NewEncoder(os.Stdout).Encode(node)
+				},
 			},
-			&cli.StringFlag{
-				Name:        "provider",
-				Aliases:     []string{"p"},
-				Category:    "OPTIONAL:",
-				Usage:       "The provider's address and port (e.g., localhost:8080)",
-				DefaultText: DefaultProviderHost,
-				Destination: &provider,
-				Value:       DefaultProviderHost,
+			{
+				Name:      "set",
+				Usage:     "Change a setting",
+				UsageText: "vaults config set <key> <value>",
+				Description: "The value is parsed as YAML, so lists are written as [a, b].\n\n" +
+					"EXAMPLES:\n\nvaults config set vaults.my.vault.tables '[t1, t2]'\n" +
+					"vaults config set vaults.my.vault.password '${PGPASSWORD}'",
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 2 {
+						return errors.New("must provide a key and a value")
+					}
+					keys, err := configKey(cCtx.Args().Get(0))
+					if err != nil {
+						return err
+					}
+
+					value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str"}
+					var parsed yaml.Node
+					if err := yaml.Unmarshal([]byte(cCtx.Args().Get(1)), &parsed); err != nil {
+						return fmt.Errorf("invalid value: %s", err)
+					}
+					if len(parsed.Content) > 0 {
+						value = parsed.Content[0]
+					}
+
+					return updateConfig(cCtx.Context, cCtx.String("dir"), func(doc *yaml.Node) error {
+						node, err := lookupConfigNode(doc, keys, true)
+						if err != nil {
+							return err
+						}
+						*node = *value
+						return nil
+					})
+				},
 			},
-			&cli.Int64Flag{
-				Name:        "timeout",
-				Aliases:     []string{"t"},
-				Category:    "OPTIONAL:",
-				Usage:       "Timeout for retrieval operation (seconds)",
-				DefaultText: "no timeout",
-				Destination: &timeout,
-				Value:       0,
+			{
+				Name:      "repair",
+				Usage:     "Reconcile the vaults in config.yaml with the vaults of an account",
+				UsageText: "vaults config repair [command options]",
+				Description: "Adds the account's vaults missing from the config, and removes the \n" +
+					"vaults of the provider that it does not know, e.g. left by a failed \n" +
+					"create. The settings and data of the other vaults are kept.\n\n" +
+					"EXAMPLE:\n\nvaults config repair --account 0x1234abcd --dry-run",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "account",
+						Aliases:     []string{"a"},
+						Category:    "REQUIRED:",
+						Usage:       "Ethereum wallet address",
+						Destination: &address,
+						Required:    true,
+					},
+					&cli.StringFlag{
+						Name:        "provider",
+						Aliases:     []string{"p"},
+						Category:    "OPTIONAL:",
+						Usage:       "The provider's address and port (e.g., localhost:8080)",
+						DefaultText: DefaultProviderHost,
+						Destination: &provider,
+						Value:       DefaultProviderHost,
+					},
+					&cli.BoolFlag{
+						Name:        "dry-run",
+						Category:    "OPTIONAL:",
+						Usage:       "Print the changes without making them",
+						Destination: &dryRun,
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					account, err := app.NewAccount(address)
+					if err != nil {
+						return fmt.Errorf("%s is not a valid Ethereum wallet address", address)
+					}
+
+					dir, err := defaultConfigLocation(cCtx.String("dir"))
+					if err != nil {
+						return fmt.Errorf("default config location: %s", err)
+					}
+					cfg, err := loadConfig(path.Join(dir, "config.yaml"))
+					if err != nil && !errors.Is(err, os.ErrNotExist) {
+						return fmt.Errorf("load config: %s", err)
+					}
+
+					bp := vaultsprovider.New(provider)
+					vaults, err := bp.ListVaults(cCtx.Context, app.ListVaultsParams{Account: account})
+					if err != nil {
+						return fmt.Errorf("failed to list vaults: %s", err)
+					}
+
+					remote := map[string]bool{}
+					missing := []string{}
+					for _, v := range vaults {
+						remote[string(v.Vault)] = true
+						if _, ok := cfg.Vaults[string(v.Vault)]; !ok {
+							missing = append(missing, string(v.Vault))
+						}
+					}
+
+					// a local vault of the provider that is not the account's may be another account's
+					stale := []string{}
+					for name, v := range cfg.Vaults {
+						host := v.ProviderHost
+						if host == "" {
+							host = DefaultProviderHost
+						}
+						if host != provider || remote[name] {
+							continue
+						}
+						_, err := bp.GetVault(cCtx.Context, app.GetVaultParams{Vault: app.Vault(name)})
+						if errors.Is(err, app.ErrVaultNotFound) {
+							stale = append(stale, name)
+						} else if err != nil {
+							return fmt.Errorf("failed to get vault %s: %s", name, err)
+						}
+					}
+					sort.Strings(missing)
+					sort.Strings(stale)
+
+					for _, name := range missing {
+						fmt.Printf("add %s\n", name)
+					}
+					for _, name := range stale {
+						fmt.Printf("remove %s\n", name)
+					}
+					if len(missing)+len(stale) == 0 {
+						fmt.Println("config.yaml is up to date")
+						return nil
+					}
+					if dryRun {
+						return nil
+					}
+
+					if err := updateConfig(cCtx.Context, dir, func(doc *yaml.Node) error {
+						for _, name := range missing {
+							if err := setVaultProvider(doc, name, provider); err != nil {
+								return err
+							}
+						}
+						for _, name := range stale {
+							if _, err := deleteConfigNode(doc, []string{"vaults", name}); err != nil {
+								return err
+							}
+						}
+						return nil
+					}); err != nil {
+						return err
+					}
+					for _, name := range missing {
+						if err := os.MkdirAll(path.Join(dir, name), 0o755); err != nil {
+							return fmt.Errorf("mk db dir: %s", err)
+						}
+					}
+
+					return nil
+				},
 			},
-		},
-		Action: func(cCtx *cli.Context) error {
-			arg := cCtx.Args().Get(0)
-			if arg == "" {
-				return errors.New("must provide an event CID")
-			}
+			{
+				Name:      "validate",
+				Usage:     "Check the settings, including the referenced environment variables",
+				UsageText: "vaults config validate",
+				Action: func(cCtx *cli.Context) error {
+					_, filename, err := readConfigDocument(cCtx.String("dir"))
+					if err != nil {
+						return err
+					}
+					buf, err := os.ReadFile(filename)
+					if err != nil && !errors.Is(err, os.ErrNotExist) {
+						return fmt.Errorf("read config: %s", err)
+					}
 
-			rootCid, err := cid.Parse(arg)
-			if err != nil {
-				return errors.New("CID is invalid")
-			}
+					cfg, err := decodeConfig(buf)
+					if err != nil {
+						return fmt.Errorf("invalid config: %s", err)
+					}
 
-			retriever := app.NewRetriever(vaultsprovider.New(provider), timeout)
-			if err := retriever.Retrieve(cCtx.Context, rootCid, output); err != nil {
-				return fmt.Errorf("failed to retrieve: %s", err)
-			}
+					errs := cfg.validate()
+					for _, err := range errs {
+						fmt.Fprintf(os.Stderr, "%s\n", err)
+					}
+					if len(errs) > 0 {
+						return cli.Exit(fmt.Sprintf("%d problems found in %s", len(errs), filename), 1)
+					}
 
-			return nil
+					fmt.Printf("%s is valid\n", filename)
+					return nil
+				},
+			},
 		},
 	}
 }
 
+// readConfigDocument reads config.yaml as a YAML document. It is empty if the file does not exist.
+func readConfigDocument(dir string) (*yaml.Node, string, error) {
+	dir, err := defaultConfigLocation(dir)
+	if err != nil {
+		return nil, "", fmt.Errorf("default config location: %s", err)
+	}
+	filename := path.Join(dir, "config.yaml")
+
+	doc := &yaml.Node{}
+	buf, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return doc, filename, nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("read config: %s", err)
+	}
+	if err := yaml.Unmarshal(buf, doc); err != nil {
+		return nil, "", fmt.Errorf("parse config: %s", err)
+	}
+
+	return doc, filename, nil
+}
+
 func newWalletCommand() *cli.Command {
 	var pkString string
 
@@ -771,6 +3588,70 @@ func newWalletCommand() *cli.Command {
 	}
 }
 
+// accountKeyFlags are the flags of the private key that signs the requests changing a vault.
+func accountKeyFlags(privateKey, keystore, password *string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "private-key",
+			Aliases:     []string{"k"},
+			Category:    "REQUIRED:",
+			Usage:       "Ethereum wallet private key",
+			EnvVars:     []string{"VAULTS_PRIVATE_KEY"},
+			Destination: privateKey,
+		},
+		&cli.StringFlag{
+			Name:        "keystore",
+			Category:    "REQUIRED:",
+			Usage:       "Path of an Ethereum JSON keystore file holding the private key",
+			Destination: keystore,
+		},
+		&cli.StringFlag{
+			Name:        "keystore-password",
+			Category:    "OPTIONAL:",
+			Usage:       "Password of the keystore file",
+			DefaultText: "prompt for it",
+			EnvVars:     []string{"VAULTS_KEYSTORE_PASSWORD"},
+			Destination: password,
+		},
+	}
+}
+
+// accountKey loads the private key given with accountKeyFlags. The keystore's password
+// is read from the terminal if it is not given.
+func accountKey(privateKey, keystore, password string) (*ecdsa.PrivateKey, error) {
+	switch {
+	case privateKey != "" && keystore != "":
+		return nil, errors.New("use either --private-key or --keystore")
+	case privateKey != "":
+		key, err := crypto.HexToECDSA(privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("private key: %s", err)
+		}
+		return key, nil
+	case keystore == "":
+		return nil, errors.New("missing private key: use --private-key, VAULTS_PRIVATE_KEY or --keystore")
+	}
+
+	filename, err := homedir.Expand(keystore)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: %s", err)
+	}
+	if password == "" {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, errors.New("missing keystore password: use --keystore-password or VAULTS_KEYSTORE_PASSWORD")
+		}
+		fmt.Fprint(os.Stderr, "Keystore password: ")
+		buf, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("read password: %s", err)
+		}
+		password = string(buf)
+	}
+
+	return signing.KeystoreToECDSA(filename, password)
+}
+
 func parseVaultName(name string) (ns string, rel string, err error) {
 	match := vaultNameRx.FindStringSubmatch(name)
 	if len(match) != 3 {
@@ -784,6 +3665,38 @@ func parseVaultName(name string) (ns string, rel string, err error) {
 	return
 }
 
+// DefaultFilenameRegex matches a unix timestamp, a date or an RFC3339 date-time in a file name.
+const DefaultFilenameRegex = `(\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:Z|[+-]\d{2}:\d{2})|\d{4}-\d{2}-\d{2}|\d{10})`
+
+func timestampFunc(timestamp, from, filenameRegex string) (app.TimestampFunc, error) {
+	if timestamp != "" && from != "" {
+		return nil, errors.New("--timestamp and --timestamp-from cannot be used together")
+	}
+
+	switch from {
+	case "":
+		if timestamp == "" {
+			timestamp = fmt.Sprint(time.Now().UTC().Unix())
+		}
+
+		ts, err := app.ParseTimestamp(timestamp)
+		if err != nil {
+			return nil, err
+		}
+		return app.FixedTimestamp(ts), nil
+	case "mtime":
+		return app.TimestampFromMtime(), nil
+	case "filename-regex":
+		rx, err := regexp.Compile(filenameRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filename regex: %s", err)
+		}
+		return app.TimestampFromFilename(rx), nil
+	default:
+		return nil, fmt.Errorf("invalid timestamp source: %s", from)
+	}
+}
+
 func validateBeforeAndAfter(before, after, at string) (app.Timestamp, app.Timestamp, error) {
 	if !strings.EqualFold(at, "") {
 		before, after = at, at
@@ -847,6 +3760,171 @@ func (s *DatabaseStreamSetup) CreatePublicationIfNotExists(ctx context.Context)
 	return nil
 }
 
+// ReconcilePublication creates the publication, or makes the tables of an
+// existing one match the requested tables if allowChange is set. It returns
+// the requested tables that were added to the publication, all of them when
+// it is created.
+func (s *DatabaseStreamSetup) ReconcilePublication(ctx context.Context, allowChange bool) ([]string, error) {
+	var exists bool
+	if err := s.pgConn.QueryRow(
+		ctx, "SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)", s.publication.FullName(),
+	).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("query publication: %s", err)
+	}
+	if !exists {
+		if err := s.CreatePublicationIfNotExists(ctx); err != nil {
+			return nil, err
+		}
+		return s.tables, nil
+	}
+
+	current, err := (&pgrepl.Conn{Conn: s.pgConn}).GetPublicationTables(ctx, s.publication)
+	if err != nil {
+		return nil, err
+	}
+
+	// publication tables are schema qualified, so resolve the requested ones
+	requested := map[string]string{}
+	for _, table := range s.tables {
+		var qualified string
+		if err := s.pgConn.QueryRow(ctx,
+			`SELECT n.nspname || '.' || c.relname
+			FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.oid = $1::regclass`, table,
+		).Scan(&qualified); err != nil {
+			return nil, fmt.Errorf("table %s: %s", table, err)
+		}
+		requested[qualified] = table
+	}
+
+	add, drop := []string{}, []string{}
+	for qualified := range requested {
+		if !slices.Contains(current, qualified) {
+			add = append(add, qualified)
+		}
+	}
+	for _, qualified := range current {
+		if _, ok := requested[qualified]; !ok {
+			drop = append(drop, qualified)
+		}
+	}
+	sort.Strings(add)
+	sort.Strings(drop)
+
+	if len(add) == 0 && len(drop) == 0 {
+		return []string{}, nil
+	}
+	if !allowChange {
+		return nil, fmt.Errorf(
+			"publication %s has tables [%s], but [%s] were requested; "+
+				"run with --allow-publication-change to add [%s] and drop [%s]",
+			s.publication.FullName(), strings.Join(current, ", "), strings.Join(s.tables, ", "),
+			strings.Join(add, ", "), strings.Join(drop, ", "),
+		)
+	}
+
+	for _, change := range []struct {
+		op     string
+		tables []string
+	}{{"ADD", add}, {"DROP", drop}} {
+		if len(change.tables) == 0 {
+			continue
+		}
+		idents := make([]string, len(change.tables))
+		for i, qualified := range change.tables {
+			idents[i] = pgx.Identifier(strings.SplitN(qualified, ".", 2)).Sanitize()
+		}
+		if _, err := s.pgConn.Exec(ctx, fmt.Sprintf(
+			"ALTER PUBLICATION %s %s TABLE %s", s.publication.FullName(), change.op, strings.Join(idents, ", "),
+		)); err != nil {
+			return nil, fmt.Errorf("alter publication: %s", err)
+		}
+		slog.Info("publication changed", "publication", s.publication.FullName(), "op", change.op, "tables", change.tables)
+	}
+
+	added := make([]string, len(add))
+	for i, qualified := range add {
+		added[i] = requested[qualified]
+	}
+
+	return added, nil
+}
+
+// Snapshot reads the rows of a table in a read only transaction, encoded as wal2json does.
+func (s *DatabaseStreamSetup) Snapshot(
+	ctx context.Context, schema app.TableSchema, fn func([]pgrepl.Record) error,
+) (pglogrepl.LSN, error) {
+	tx, err := s.pgConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return 0, fmt.Errorf("begin: %s", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	// the first query takes the snapshot
+	var lsn pglogrepl.LSN
+	if err := tx.QueryRow(ctx, "SELECT pg_current_wal_lsn()").Scan(&lsn); err != nil {
+		return 0, fmt.Errorf("current lsn: %s", err)
+	}
+
+	// wal2json writes numbers and booleans as JSON values, and anything else as text
+	exprs := make([]string, len(schema.Columns))
+	for i, c := range schema.Columns {
+		exprs[i] = pgx.Identifier{c.Name}.Sanitize()
+		switch c.Typ {
+		case "boolean", "bigint", "double precision", "integer", "numeric", "oid", "real", "smallint":
+		default:
+			exprs[i] += "::text"
+		}
+	}
+
+	rows, err := tx.Query(ctx, fmt.Sprintf(
+		"SELECT json_build_array(%s)::text FROM %s", strings.Join(exprs, ", "), pgx.Identifier{schema.Table}.Sanitize(),
+	))
+	if err != nil {
+		return 0, fmt.Errorf("query: %s", err)
+	}
+	defer rows.Close()
+
+	const batchSize = 1000
+	batch := []pgrepl.Record{}
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return 0, fmt.Errorf("scan: %s", err)
+		}
+		values := []json.RawMessage{}
+		if err := json.Unmarshal([]byte(row), &values); err != nil {
+			return 0, fmt.Errorf("decode row: %s", err)
+		}
+
+		record := pgrepl.Record{Action: "I", Table: schema.Table}
+		for i, c := range schema.Columns {
+			record.Columns = append(record.Columns, pgrepl.Column{Name: c.Name, Type: c.Typ, Value: values[i]})
+		}
+		batch = append(batch, record)
+
+		if len(batch) == batchSize {
+			if err := fn(batch); err != nil {
+				return 0, err
+			}
+			batch = []pgrepl.Record{}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("query: %s", err)
+	}
+
+	if len(batch) > 0 {
+		if err := fn(batch); err != nil {
+			return 0, err
+		}
+	}
+
+	return lsn, nil
+}
+
 // TableSchemas returns the schema of the tables.
 func (s *DatabaseStreamSetup) TableSchemas(ctx context.Context) ([]app.TableSchema, error) {
 	schemas := []app.TableSchema{}
@@ -1,12 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/dustin/go-humanize"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gofrs/flock"
 	"github.com/mitchellh/go-homedir"
+	"github.com/tablelandnetwork/basin-cli/internal/app"
 	"gopkg.in/yaml.v3"
 )
 
@@ -17,18 +30,289 @@ const DefaultProviderHost = "https://basin.tableland.xyz"
 // are buffered before being sent to the provider.
 const DefaultWindowSize = 3600
 
+// DefaultMaxRetainedWAL is the WAL size kept for a replication slot
+// above which stream warns at startup.
+const DefaultMaxRetainedWAL = "1GB"
+
 type config struct {
-	Vaults map[string]vault `yaml:"vaults"`
+	Vaults    map[string]vault `yaml:"vaults"`
+	Cache     cacheConfig      `yaml:"cache,omitempty"`
+	Retrieval retrievalConfig  `yaml:"retrieval,omitempty"`
+	Daemon    daemonConfig     `yaml:"daemon,omitempty"`
+}
+
+// DefaultDaemonPublication is the publication of the tables streamed by the daemon.
+const DefaultDaemonPublication = "daemon"
+
+type daemonConfig struct {
+	DBURI string `yaml:"dburi"`
+
+	// Publication names the publication and the replication slot shared by the pipelines.
+	Publication string `yaml:"publication,omitempty"`
+
+	// MetricsAddress is where the Prometheus metrics are served (e.g., :9090).
+	MetricsAddress string `yaml:"metrics_address,omitempty"`
+
+	// PrivateKey is the hex encoded private key that signs the events of
+	// all pipelines, or PrivateKeyFile the path of a file holding it.
+	PrivateKey     string `yaml:"private_key,omitempty"`
+	PrivateKeyFile string `yaml:"private_key_file,omitempty"`
+
+	// MaxRetainedWAL is the WAL size (e.g., 1GB) kept for the shared
+	// replication slot above which the daemon warns at startup.
+	MaxRetainedWAL string `yaml:"max_retained_wal,omitempty"`
+
+	Pipelines []daemonPipeline `yaml:"pipelines"`
+}
+
+// privateKey returns the private key of the daemon, or an empty string if it has none.
+func (c daemonConfig) privateKey() (string, error) {
+	return readPrivateKey(c.PrivateKey, c.PrivateKeyFile)
+}
+
+type daemonPipeline struct {
+	Vault        string   `yaml:"vault"`
+	Tables       []string `yaml:"tables"`
+	ProviderHost string   `yaml:"provider_host,omitempty"`
+	WindowSize   int64    `yaml:"window_size,omitempty"`
+}
+
+// tables returns the tables of all pipelines, without duplicates.
+func (c daemonConfig) tables() []string {
+	seen := map[string]bool{}
+	tables := []string{}
+	for _, p := range c.Pipelines {
+		for _, t := range p.Tables {
+			if !seen[t] {
+				seen[t] = true
+				tables = append(tables, t)
+			}
+		}
+	}
+
+	return tables
+}
+
+func (c daemonConfig) validate() error {
+	if c.DBURI == "" {
+		return errors.New("daemon.dburi is required")
+	}
+	if len(c.Pipelines) == 0 {
+		return errors.New("daemon.pipelines is empty")
+	}
+	if c.PrivateKey != "" && c.PrivateKeyFile != "" {
+		return errors.New("daemon.private_key and daemon.private_key_file are both set")
+	}
+	if key, err := c.privateKey(); err != nil {
+		return fmt.Errorf("daemon private key: %s", err)
+	} else if key != "" {
+		if _, err := crypto.HexToECDSA(key); err != nil {
+			return fmt.Errorf("daemon private key: %s", err)
+		}
+	}
+	if c.MaxRetainedWAL != "" {
+		if _, err := humanize.ParseBytes(c.MaxRetainedWAL); err != nil {
+			return fmt.Errorf("daemon.max_retained_wal: %s", err)
+		}
+	}
+
+	vaults := map[string]bool{}
+	for _, p := range c.Pipelines {
+		if _, _, err := parseVaultName(p.Vault); err != nil {
+			return err
+		}
+		if vaults[p.Vault] {
+			return fmt.Errorf("vault %s has more than one pipeline", p.Vault)
+		}
+		vaults[p.Vault] = true
+
+		if len(p.Tables) == 0 {
+			return fmt.Errorf("vault %s has no tables", p.Vault)
+		}
+	}
+
+	return nil
+}
+
+type cacheConfig struct {
+	// MaxSize is the size limit of the retrieval cache (e.g., 10GB).
+	MaxSize string `yaml:"max_size,omitempty"`
+}
+
+type retrievalConfig struct {
+	// Sources are tried in order. Defaults to the provider, then lassie.
+	Sources []retrievalSource `yaml:"sources,omitempty"`
+}
+
+type retrievalSource struct {
+	Kind           string        `yaml:"kind"`
+	URL            string        `yaml:"url,omitempty"`
+	Timeout        time.Duration `yaml:"timeout,omitempty"`
+	Protocols      string        `yaml:"protocols,omitempty"`
+	AllowProviders []string      `yaml:"allow_providers,omitempty"`
+	DenyProviders  []string      `yaml:"deny_providers,omitempty"`
+}
+
+func (c retrievalConfig) retrievalSources() []app.RetrievalSource {
+	sources := make([]app.RetrievalSource, len(c.Sources))
+	for i, s := range c.Sources {
+		sources[i] = app.RetrievalSource{
+			Kind:           s.Kind,
+			URL:            s.URL,
+			Timeout:        s.Timeout,
+			Protocols:      s.Protocols,
+			AllowProviders: s.AllowProviders,
+			DenyProviders:  s.DenyProviders,
+		}
+	}
+
+	return sources
 }
 
+// vault holds the settings of a vault. String values can reference
+// environment variables as ${NAME}, which are expanded when they are used.
 type vault struct {
-	User         string `yaml:"user"`
-	Password     string `yaml:"password"`
-	Host         string `yaml:"host"`
-	Port         int    `yaml:"port"`
-	Database     string `yaml:"database"`
+	// DBURI is the connection string of the database. If it is empty,
+	// it is built from User, Password, Host, Port and Database.
+	DBURI    string `yaml:"dburi,omitempty"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Database string `yaml:"database"`
+
+	// Tables are the tables streamed to the vault.
+	Tables []string `yaml:"tables,omitempty"`
+
+	// PrivateKey is the hex encoded private key of the vault's account,
+	// or PrivateKeyFile the path of a file holding it.
+	PrivateKey     string `yaml:"private_key,omitempty"`
+	PrivateKeyFile string `yaml:"private_key_file,omitempty"`
+
 	ProviderHost string `yaml:"provider_host"`
 	WindowSize   int64  `yaml:"window_size"`
+
+	// MaxRetainedWAL is the WAL size (e.g., 1GB) kept for the vault's
+	// replication slot above which stream warns at startup.
+	MaxRetainedWAL string `yaml:"max_retained_wal,omitempty"`
+}
+
+// dbURI returns the connection string of the vault's database, or an empty
+// string if it has none.
+func (v vault) dbURI() (string, error) {
+	if v.DBURI != "" {
+		return interpolate(v.DBURI)
+	}
+	if v.Host == "" {
+		return "", nil
+	}
+
+	fields := []string{v.User, v.Password, v.Host, v.Database}
+	for i, f := range fields {
+		value, err := interpolate(f)
+		if err != nil {
+			return "", err
+		}
+		fields[i] = value
+	}
+
+	u := &url.URL{Scheme: "postgresql", Host: fields[2], Path: "/" + fields[3]}
+	if v.Port != 0 {
+		u.Host = fmt.Sprintf("%s:%d", fields[2], v.Port)
+	}
+	if fields[0] != "" {
+		u.User = url.UserPassword(fields[0], fields[1])
+	}
+
+	return u.String(), nil
+}
+
+// privateKey returns the private key of the vault's account, or an empty
+// string if it has none.
+func (v vault) privateKey() (string, error) {
+	return readPrivateKey(v.PrivateKey, v.PrivateKeyFile)
+}
+
+// readPrivateKey returns the private key given in the config, either as
+// key or in the file at filename, or an empty string if neither is set.
+func readPrivateKey(key string, filename string) (string, error) {
+	if key != "" {
+		return interpolate(key)
+	}
+	if filename == "" {
+		return "", nil
+	}
+
+	filename, err := interpolate(filename)
+	if err != nil {
+		return "", err
+	}
+	filename, err = homedir.Expand(filename)
+	if err != nil {
+		return "", fmt.Errorf("private key file: %s", err)
+	}
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("private key file: %s", err)
+	}
+
+	return strings.TrimSpace(string(buf)), nil
+}
+
+func (v vault) validate() []error {
+	errs := []error{}
+	if v.DBURI != "" && v.Host != "" {
+		errs = append(errs, errors.New("dburi and host are both set"))
+	}
+	if _, err := v.dbURI(); err != nil {
+		errs = append(errs, fmt.Errorf("dburi: %s", err))
+	}
+	if v.PrivateKey != "" && v.PrivateKeyFile != "" {
+		errs = append(errs, errors.New("private_key and private_key_file are both set"))
+	}
+	if key, err := v.privateKey(); err != nil {
+		errs = append(errs, fmt.Errorf("private key: %s", err))
+	} else if key != "" {
+		if _, err := crypto.HexToECDSA(key); err != nil {
+			errs = append(errs, fmt.Errorf("private key: %s", err))
+		}
+	}
+	for _, t := range v.Tables {
+		if t == "" || strings.Contains(t, ",") {
+			errs = append(errs, fmt.Errorf("invalid table %q", t))
+		}
+	}
+	if v.WindowSize < 0 {
+		errs = append(errs, errors.New("window_size must not be negative"))
+	}
+	if v.MaxRetainedWAL != "" {
+		if _, err := humanize.ParseBytes(v.MaxRetainedWAL); err != nil {
+			errs = append(errs, fmt.Errorf("max_retained_wal: %s", err))
+		}
+	}
+
+	return errs
+}
+
+var envRefRx = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolate expands the ${NAME} references to environment variables in s.
+// It fails if a referenced variable is not set.
+func interpolate(s string) (string, error) {
+	var missing []string
+	expanded := envRefRx.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRefRx.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+
+	return expanded, nil
 }
 
 func newConfig() *config {
@@ -51,6 +335,223 @@ func loadConfig(path string) (*config, error) {
 	return conf, nil
 }
 
+// decodeConfig decodes a config, failing on unknown fields.
+func decodeConfig(buf []byte) (*config, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+
+	conf := newConfig()
+	if err := dec.Decode(conf); err != nil && !errors.Is(err, io.EOF) {
+		return &config{}, err
+	}
+
+	return conf, nil
+}
+
+// validate checks the config and returns every problem found.
+func (c *config) validate() []error {
+	errs := []error{}
+
+	names := make([]string, 0, len(c.Vaults))
+	for name := range c.Vaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, _, err := parseVaultName(name); err != nil {
+			errs = append(errs, fmt.Errorf("vaults.%s: %s", name, err))
+		}
+		for _, err := range c.Vaults[name].validate() {
+			errs = append(errs, fmt.Errorf("vaults.%s: %s", name, err))
+		}
+	}
+
+	if c.Cache.MaxSize != "" {
+		if _, err := humanize.ParseBytes(c.Cache.MaxSize); err != nil {
+			errs = append(errs, fmt.Errorf("cache.max_size: %s", err))
+		}
+	}
+
+	for i, source := range c.Retrieval.retrievalSources() {
+		if err := source.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("retrieval.sources.%d: %s", i, err))
+		}
+	}
+
+	if c.Daemon.DBURI != "" || len(c.Daemon.Pipelines) > 0 {
+		if err := c.Daemon.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("daemon: %s", err))
+		}
+		if _, err := interpolate(c.Daemon.DBURI); err != nil {
+			errs = append(errs, fmt.Errorf("daemon.dburi: %s", err))
+		}
+	}
+
+	return errs
+}
+
+// configKey splits a dotted key into the keys of the config's YAML mappings.
+// Vault names have a dot, so vaults.<ns>.<rel> is a single key.
+func configKey(key string) ([]string, error) {
+	keys := strings.Split(key, ".")
+	if keys[0] == "vaults" && len(keys) > 2 {
+		keys = append([]string{"vaults", keys[1] + "." + keys[2]}, keys[3:]...)
+	}
+	for _, k := range keys {
+		if k == "" {
+			return nil, fmt.Errorf("invalid key %q", key)
+		}
+	}
+
+	return keys, nil
+}
+
+// lookupConfigNode finds the node at keys in a YAML document. Missing
+// mappings are created if create is set, otherwise it returns nil.
+func lookupConfigNode(doc *yaml.Node, keys []string, create bool) (*yaml.Node, error) {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		if !create {
+			return nil, nil
+		}
+		*doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+
+	node := doc.Content[0]
+	for i, key := range keys {
+		switch node.Kind {
+		case yaml.MappingNode:
+			var next *yaml.Node
+			for j := 0; j+1 < len(node.Content); j += 2 {
+				if node.Content[j].Value == key {
+					next = node.Content[j+1]
+					break
+				}
+			}
+			if next == nil {
+				if !create {
+					return nil, nil
+				}
+				next = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, next)
+			}
+			node = next
+		case yaml.SequenceNode:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(node.Content) {
+				return nil, fmt.Errorf("invalid index %s of %s", key, strings.Join(keys[:i], "."))
+			}
+			node = node.Content[idx]
+		default:
+			if !create {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("%s is not a mapping", strings.Join(keys[:i], "."))
+		}
+	}
+
+	return node, nil
+}
+
+// setVaultProvider adds a vault to a config document, or changes its provider if it
+// is there. The vault's other settings are kept.
+func setVaultProvider(doc *yaml.Node, name string, provider string) error {
+	node, err := lookupConfigNode(doc, []string{"vaults", name, "provider_host"}, true)
+	if err != nil {
+		return err
+	}
+	*node = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: provider}
+
+	return nil
+}
+
+// deleteConfigNode removes the node at keys from a YAML document, and reports whether it was there.
+func deleteConfigNode(doc *yaml.Node, keys []string) (bool, error) {
+	parent, err := lookupConfigNode(doc, keys[:len(keys)-1], false)
+	if err != nil || parent == nil || parent.Kind != yaml.MappingNode {
+		return false, err
+	}
+
+	key := keys[len(keys)-1]
+	for j := 0; j+1 < len(parent.Content); j += 2 {
+		if parent.Content[j].Value == key {
+			parent.Content = append(parent.Content[:j], parent.Content[j+2:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// updateConfig changes config.yaml in a transaction. The file is read and written
+// holding a lock, so concurrent CLI processes do not lose each other's changes, and
+// it is replaced with a rename, so it is never left half written. Nothing is written
+// if update fails or the result is not a valid config.
+//
+// update changes the YAML document, which is empty if the file does not exist.
+func updateConfig(ctx context.Context, dir string, update func(doc *yaml.Node) error) error {
+	dir, err := defaultConfigLocation(dir)
+	if err != nil {
+		return fmt.Errorf("default config location: %s", err)
+	}
+
+	lock := flock.New(path.Join(dir, "config.yaml.lock"))
+	if _, err := lock.TryLockContext(ctx, 100*time.Millisecond); err != nil {
+		return fmt.Errorf("lock config: %s", err)
+	}
+	defer func() {
+		_ = lock.Unlock()
+	}()
+
+	doc, filename, err := readConfigDocument(dir)
+	if err != nil {
+		return err
+	}
+	if err := update(doc); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := yaml.NewEncoder(&buf).Encode(doc); err != nil {
+		return fmt.Errorf("encode: %s", err)
+	}
+	if _, err := decodeConfig(buf.Bytes()); err != nil {
+		return fmt.Errorf("invalid config: %s", err)
+	}
+
+	if err := writeFileAtomic(filename, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("write config: %s", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to filename, and renames it to filename.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(path.Dir(filename), "."+path.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
+
 func defaultConfigLocation(dir string) (string, error) {
 	if dir == "" {
 		// the default directory is home
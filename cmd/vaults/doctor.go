@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/tablelandnetwork/basin-cli/internal/app"
+	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
+	"github.com/urfave/cli/v2"
+)
+
+// Outcomes of a doctor check.
+const (
+	checkOK   = "OK"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+)
+
+type checkResult struct {
+	status string
+	name   string
+	detail string
+	fix    string
+}
+
+func newDoctorCommand() *cli.Command {
+	var dburi, tables, vault string
+
+	return &cli.Command{
+		Name:      "doctor",
+		Usage:     "Check that Postgres is ready to stream the tables to a vault",
+		UsageText: "vaults doctor [command options]",
+		Description: "Checks the replication settings of the database, the privileges of \n" +
+			"the role, the wal2json output plugin and the tables to stream, and \n" +
+			"suggests a fix for each problem found.\n\n" +
+			"EXAMPLE:\n\nvaults doctor --dburi [DBURI] --tables t1,t2",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "dburi",
+				Category:    "OPTIONAL:",
+				Usage:       "PostgreSQL connection string (e.g., postgresql://postgres:[PASSWORD]@[HOST]:[PORT]/postgres)",
+				DefaultText: "dburi in the vault's config",
+				EnvVars:     []string{"VAULTS_DBURI"},
+				Destination: &dburi,
+			},
+			&cli.StringFlag{
+				Name:        "tables",
+				Aliases:     []string{"t"},
+				Category:    "OPTIONAL:",
+				Usage:       "PostgreSQL tables to be replicated separated by comma (e.g. tbl1,tbl2,tbl3)",
+				DefaultText: "tables in the vault's config",
+				EnvVars:     []string{"VAULTS_TABLES"},
+				Destination: &tables,
+			},
+			&cli.StringFlag{
+				Name:        "vault",
+				Aliases:     []string{"v"},
+				Category:    "OPTIONAL:",
+				Usage:       "Vault name, to read its settings from the config and check its replication slot",
+				Destination: &vault,
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			ctx := cCtx.Context
+
+			var publication pgrepl.Publication
+			if vault != "" {
+				if _, _, err := parseVaultName(vault); err != nil {
+					return err
+				}
+				publication = pgrepl.Publication(strings.Replace(vault, ".", "_", -1))
+
+				var err error
+				if dburi, err = vaultDBURI(cCtx, dburi, vault); err != nil {
+					return err
+				}
+				if !cCtx.IsSet("tables") {
+					dir, err := defaultConfigLocation(cCtx.String("dir"))
+					if err != nil {
+						return fmt.Errorf("default config location: %s", err)
+					}
+					cfg, err := loadConfig(path.Join(dir, "config.yaml"))
+					if err != nil && !errors.Is(err, os.ErrNotExist) {
+						return fmt.Errorf("load config: %s", err)
+					}
+					tables = strings.Join(cfg.Vaults[vault].Tables, ",")
+				}
+			}
+			if dburi == "" {
+				return errors.New("missing dburi: use --dburi, VAULTS_DBURI or --vault")
+			}
+
+			setup, err := NewDatabaseStreamSetup(ctx, dburi, publication, tables)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = setup.Close(ctx)
+			}()
+
+			d := &doctor{conn: setup.pgConn}
+			d.checkWALLevel(ctx)
+			d.checkRole(ctx)
+			d.checkSlots(ctx, publication)
+			d.checkWALSenders(ctx)
+			d.checkOutputPlugin(ctx)
+			if tables != "" {
+				d.checkTables(ctx, setup)
+			}
+
+			failed := 0
+			for _, r := range d.results {
+				fmt.Printf("[%s] %s: %s\n", r.status, r.name, r.detail)
+				if r.fix != "" {
+					fmt.Printf("       fix: %s\n", strings.ReplaceAll(r.fix, "\n", "\n            "))
+				}
+				if r.status == checkFail {
+					failed++
+				}
+			}
+
+			if failed > 0 {
+				return cli.Exit(fmt.Sprintf("%d checks failed", failed), 1)
+			}
+			return nil
+		},
+	}
+}
+
+// doctor runs the checks on a connection, and keeps their results.
+type doctor struct {
+	conn    *pgx.Conn
+	results []checkResult
+
+	// set by the checks the output plugin check depends on
+	logical, replicationRole, freeSlot bool
+}
+
+func (d *doctor) add(status, name, detail, fix string) {
+	d.results = append(d.results, checkResult{status: status, name: name, detail: detail, fix: fix})
+}
+
+func (d *doctor) checkWALLevel(ctx context.Context) {
+	var level string
+	if err := d.conn.QueryRow(ctx, "SHOW wal_level").Scan(&level); err != nil {
+		d.add(checkFail, "wal_level", err.Error(), "")
+		return
+	}
+
+	if level != "logical" {
+		d.add(checkFail, "wal_level", fmt.Sprintf("is %s, logical replication needs logical", level),
+			"ALTER SYSTEM SET wal_level = logical; and restart Postgres.\n"+
+				"On Amazon RDS, set rds.logical_replication to 1 in the parameter group and reboot.")
+		return
+	}
+	d.logical = true
+	d.add(checkOK, "wal_level", level, "")
+}
+
+func (d *doctor) checkRole(ctx context.Context) {
+	var user string
+	var super, replication, rdsReplication bool
+	if err := d.conn.QueryRow(ctx, `
+		SELECT
+			current_user,
+			rolsuper,
+			rolreplication,
+			EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'rds_replication')
+				AND pg_has_role(current_user, 'rds_replication', 'member')
+		FROM pg_roles WHERE rolname = current_user
+	`).Scan(&user, &super, &replication, &rdsReplication); err != nil {
+		d.add(checkFail, "replication privilege", err.Error(), "")
+		return
+	}
+
+	switch {
+	case super:
+		d.add(checkOK, "replication privilege", fmt.Sprintf("%s is a superuser", user), "")
+	case replication:
+		d.add(checkOK, "replication privilege", fmt.Sprintf("%s has REPLICATION", user), "")
+	case rdsReplication:
+		d.add(checkOK, "replication privilege", fmt.Sprintf("%s is a member of rds_replication", user), "")
+	default:
+		d.add(checkFail, "replication privilege", fmt.Sprintf("%s cannot create replication slots", user),
+			fmt.Sprintf("ALTER ROLE %s WITH REPLICATION;\n", pgx.Identifier{user}.Sanitize())+
+				fmt.Sprintf("On Amazon RDS, GRANT rds_replication TO %s;", pgx.Identifier{user}.Sanitize()))
+		return
+	}
+	d.replicationRole = true
+}
+
+func (d *doctor) checkSlots(ctx context.Context, publication pgrepl.Publication) {
+	var max, used int
+	var exists bool
+	if err := d.conn.QueryRow(ctx, `
+		SELECT
+			current_setting('max_replication_slots')::int,
+			(SELECT count(*) FROM pg_replication_slots),
+			EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)
+	`, publication.SlotName()).Scan(&max, &used, &exists); err != nil {
+		d.add(checkFail, "replication slots", err.Error(), "")
+		return
+	}
+
+	detail := fmt.Sprintf("%d of max_replication_slots = %d in use", used, max)
+	d.freeSlot = used < max
+	switch {
+	case publication != "" && exists:
+		d.add(checkOK, "replication slots", detail+fmt.Sprintf(", including %s", publication.SlotName()), "")
+	case used >= max:
+		d.add(checkFail, "replication slots", detail+", none left for the stream",
+			"Drop abandoned slots with vaults pg teardown, or SELECT pg_drop_replication_slot('<slot>');\n"+
+				"or raise max_replication_slots and restart Postgres.")
+	default:
+		d.add(checkOK, "replication slots", detail, "")
+	}
+}
+
+func (d *doctor) checkWALSenders(ctx context.Context) {
+	var max, used int
+	if err := d.conn.QueryRow(ctx, `
+		SELECT current_setting('max_wal_senders')::int, (SELECT count(*) FROM pg_stat_replication)
+	`).Scan(&max, &used); err != nil {
+		d.add(checkFail, "wal senders", err.Error(), "")
+		return
+	}
+
+	detail := fmt.Sprintf("%d of max_wal_senders = %d in use", used, max)
+	if used >= max {
+		d.add(checkFail, "wal senders", detail+", none left for the stream",
+			"Stop unused replication connections, or raise max_wal_senders and restart Postgres.")
+		return
+	}
+	d.add(checkOK, "wal senders", detail, "")
+}
+
+// checkOutputPlugin creates a temporary slot with wal2json, which fails if the plugin is not installed.
+func (d *doctor) checkOutputPlugin(ctx context.Context) {
+	if !d.logical || !d.replicationRole || !d.freeSlot {
+		d.add(checkWarn, "wal2json", "not checked, it needs logical wal_level, replication privilege and a free slot", "")
+		return
+	}
+
+	slot := fmt.Sprintf("vaults_doctor_%d", os.Getpid())
+	if _, err := d.conn.Exec(ctx, "SELECT pg_create_logical_replication_slot($1, 'wal2json', true)", slot); err != nil {
+		d.add(checkFail, "wal2json", err.Error(),
+			"Install wal2json (https://github.com/eulerto/wal2json), e.g. apt install postgresql-<version>-wal2json.\n"+
+				"Amazon RDS and Supabase include it.")
+		return
+	}
+	_, _ = d.conn.Exec(ctx, "SELECT pg_drop_replication_slot($1)", slot)
+
+	d.add(checkOK, "wal2json", "output plugin available", "")
+}
+
+func (d *doctor) checkTables(ctx context.Context, setup *DatabaseStreamSetup) {
+	schemas, err := setup.TableSchemas(ctx)
+	if err != nil {
+		d.add(checkFail, "tables", err.Error(), "")
+		return
+	}
+	found := map[string]app.TableSchema{}
+	for _, schema := range schemas {
+		found[schema.Table] = schema
+	}
+
+	for _, table := range setup.tables {
+		name := fmt.Sprintf("table %s", table)
+		schema, ok := found[table]
+		if !ok {
+			d.add(checkFail, name, "not found", "Check the table name, it must be a table of the database.")
+			continue
+		}
+
+		var identity string
+		var owner bool
+		if err := d.conn.QueryRow(ctx, `
+			SELECT relreplident::text, pg_has_role(current_user, relowner, 'USAGE')
+			FROM pg_class WHERE oid = $1::regclass
+		`, table).Scan(&identity, &owner); err != nil {
+			d.add(checkFail, name, err.Error(), "")
+			continue
+		}
+
+		ident := pgx.Identifier{table}.Sanitize()
+		if !owner {
+			d.add(checkFail, name, "not owned by the current role, so it cannot be added to a publication",
+				fmt.Sprintf("ALTER TABLE %s OWNER TO <role>; or stream with the owner's role.", ident))
+		}
+
+		hasPK := len(schema.PrimaryKey()) > 0
+		switch {
+		case identity == "n" || (identity == "d" && !hasPK):
+			d.add(checkFail, name, "has no primary key or replica identity, so updates and deletes fail once it is published",
+				fmt.Sprintf("ALTER TABLE %s ADD PRIMARY KEY (<columns>); or ALTER TABLE %s REPLICA IDENTITY FULL;", ident, ident))
+		case identity != "f":
+			d.add(checkOK, name, "replica identity is the primary key or an index; "+
+				"use REPLICA IDENTITY FULL to keep the vault's digest if rows are updated or deleted", "")
+		default:
+			d.add(checkOK, name, "replica identity is full", "")
+		}
+
+		unsupported := []string{}
+		for _, c := range schema.Columns {
+			if !app.SupportsPostgresType(c.Typ) {
+				unsupported = append(unsupported, fmt.Sprintf("%s (%s)", c.Name, c.Typ))
+			}
+		}
+		if len(unsupported) > 0 {
+			d.add(checkFail, name, fmt.Sprintf("unsupported column types: %s", strings.Join(unsupported, ", ")),
+				fmt.Sprintf("ALTER TABLE %s ALTER COLUMN <column> TYPE text; or leave the table out.", ident))
+		}
+	}
+}
@@ -30,11 +30,26 @@ func main() {
 		Commands: []*cli.Command{
 			newVaultCreateCommand(),
 			newStreamCommand(),
+			newDaemonCommand(),
+			newReplayCommand(),
+			newCaptureCommand(),
+			newPgCommand(),
+			newDoctorCommand(),
 			newWriteCommand(),
+			newWatchCommand(),
 			newListCommand(),
+			newInfoCommand(),
+			newUpdateCommand(),
+			newDeleteCommand(),
 			newListEventsCommand(),
 			newSignCommand(),
 			newRetrieveCommand(),
+			newQueryCommand(),
+			newMaterializeCommand(),
+			newAuditCommand(),
+			newCacheCommand(),
+			newLedgerCommand(),
+			newConfigCommand(),
 			newWalletCommand(),
 		},
 	}
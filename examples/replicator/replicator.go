@@ -22,7 +22,8 @@ func main() {
 	}
 
 	for tx := range txs {
-		bytes, _ := json.MarshalIndent(tx, "", "    ")
+		// one tx per line, the transcript format vaults replay reads
+		bytes, _ := json.Marshal(tx)
 		fmt.Println(string(bytes))
 
 		replicator.Commit(context.Background(), tx.CommitLSN)
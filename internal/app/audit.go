@@ -0,0 +1,576 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/tablelandnetwork/basin-cli/pkg/ecmh"
+)
+
+// TableMetadataKey is the Parquet key-value metadata entry that records
+// the name of the replicated table an event was exported from.
+const TableMetadataKey = "vaults.table"
+
+// exportNameRegex matches the name of files exported by DBManager: <table>-<ts>.db.parquet.
+var exportNameRegex = regexp.MustCompile(`^(.+)-\d+\.db\.parquet$`)
+
+// Queryer runs queries, on a database or inside a transaction.
+type Queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// KeyRange is a range of primary keys. From is inclusive and To exclusive,
+// a nil bound is unbounded. Keys are in their text representation.
+type KeyRange struct {
+	From, To []string
+}
+
+// RowDiff is a row that differs between the source and the replica.
+// Source or Replica is nil when the row is missing from that side.
+type RowDiff struct {
+	Key     []string
+	Source  map[string]*string
+	Replica map[string]*string
+}
+
+// AuditTable is a table compared by an audit, either the source table
+// in Postgres or the replica rebuilt from the vault's events in DuckDB.
+type AuditTable struct {
+	q        Queryer
+	relation string
+	columns  []Column
+	pk       []Column
+}
+
+// NewAuditTable creates a new AuditTable. Column types are the SQL types of
+// the database the table is in, and the primary key columns must be marked.
+func NewAuditTable(q Queryer, relation string, columns []Column) (*AuditTable, error) {
+	pk := []Column{}
+	for _, c := range columns {
+		if c.IsPrimary {
+			pk = append(pk, c)
+		}
+	}
+	if len(pk) == 0 {
+		return nil, fmt.Errorf("table %s has no primary key", relation)
+	}
+
+	return &AuditTable{
+		q:        q,
+		relation: relation,
+		columns:  columns,
+		pk:       pk,
+	}, nil
+}
+
+// TextDigest returns the digest of all the rows of the table, computed as
+// the stream computes it, from the text representation of the columns.
+// It is meant for the source table in Postgres.
+func (t *AuditTable) TextDigest(ctx context.Context) (*ecmh.MultisetHash, int64, error) {
+	selects := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		selects[i] = fmt.Sprintf("CAST(%s AS TEXT)", quoteIdent(c.Name))
+	}
+
+	rows, err := t.q.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s", strings.Join(selects, ", "), quoteIdent(t.relation),
+	))
+	if err != nil {
+		return nil, 0, fmt.Errorf("scan table: %s", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	h := ecmh.NewMultisetHash()
+	var n int64
+	for rows.Next() {
+		texts := make([]sql.NullString, len(t.columns))
+		pointers := make([]any, len(t.columns))
+		for i := range texts {
+			pointers[i] = &texts[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, 0, fmt.Errorf("scan table: %s", err)
+		}
+
+		values := make(map[string]*string, len(t.columns))
+		for i, c := range t.columns {
+			if texts[i].Valid {
+				s := texts[i].String
+				values[c.Name] = &s
+			} else {
+				values[c.Name] = nil
+			}
+		}
+		h.InsertBytes(EncodeRow(values))
+		n++
+	}
+
+	return h, n, rows.Err()
+}
+
+// rangeDigest returns the digest and count of the rows in the range,
+// over their normalized values.
+func (t *AuditTable) rangeDigest(ctx context.Context, r KeyRange) (*ecmh.MultisetHash, int64, error) {
+	h := ecmh.NewMultisetHash()
+	var n int64
+	err := t.scan(ctx, r, -1, func(_ []string, values map[string]*string) error {
+		h.InsertBytes(EncodeRow(values))
+		n++
+		return nil
+	})
+
+	return h, n, err
+}
+
+// rows returns the rows in the range, keyed by their encoded primary key.
+func (t *AuditTable) rows(ctx context.Context, r KeyRange) (map[string][]string, map[string]map[string]*string, error) {
+	keys := map[string][]string{}
+	rows := map[string]map[string]*string{}
+	err := t.scan(ctx, r, -1, func(key []string, values map[string]*string) error {
+		k := strings.Join(key, "\x00")
+		keys[k] = key
+		rows[k] = values
+		return nil
+	})
+
+	return keys, rows, err
+}
+
+// splitKey returns the key of the row at offset in the range.
+func (t *AuditTable) splitKey(ctx context.Context, r KeyRange, offset int64) ([]string, error) {
+	var split []string
+	err := t.scan(ctx, r, offset, func(key []string, _ map[string]*string) error {
+		split = key
+		return nil
+	})
+
+	return split, err
+}
+
+// scan calls fn with the normalized rows in the range, ordered by primary key.
+// With a non negative offset, it only reads the row at that offset.
+func (t *AuditTable) scan(
+	ctx context.Context, r KeyRange, offset int64, fn func([]string, map[string]*string) error,
+) error {
+	conds, args := []string{}, []any{}
+	if r.From != nil {
+		cond, a := t.keyCondition(">", r.From, len(args))
+		conds, args = append(conds, cond), append(args, a...)
+	}
+	if r.To != nil {
+		cond, a := t.keyCondition("<", r.To, len(args))
+		conds, args = append(conds, cond), append(args, a...)
+	}
+
+	columns := make([]string, 0, len(t.pk)+len(t.columns))
+	order := make([]string, len(t.pk))
+	for i, k := range t.pk {
+		order[i] = quoteIdent(k.Name)
+	}
+	columns = append(columns, order...)
+	for _, c := range t.columns {
+		// numeric columns are replicated as doubles
+		typ := strings.ToLower(c.Typ)
+		if strings.HasPrefix(typ, "numeric") || strings.HasPrefix(typ, "decimal") {
+			columns = append(columns, fmt.Sprintf("CAST(%s AS FLOAT8)", quoteIdent(c.Name)))
+			continue
+		}
+		columns = append(columns, quoteIdent(c.Name))
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), quoteIdent(t.relation))
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY " + strings.Join(order, ", ")
+	if offset >= 0 {
+		query += fmt.Sprintf(" LIMIT 1 OFFSET %d", offset)
+	}
+
+	rows, err := t.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("scan range: %s", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		raw := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range raw {
+			pointers[i] = &raw[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return fmt.Errorf("scan range: %s", err)
+		}
+
+		key := make([]string, len(t.pk))
+		for i := range t.pk {
+			if v := normalizeValue(raw[i]); v != nil {
+				key[i] = *v
+			}
+		}
+		values := make(map[string]*string, len(t.columns))
+		for i, c := range t.columns {
+			values[c.Name] = normalizeValue(raw[len(t.pk)+i])
+		}
+
+		if err := fn(key, values); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// keyCondition compares the primary key to a key in lexicographic order.
+// The op is > for a lower bound, which includes the key, or < for an upper
+// bound, which excludes it.
+func (t *AuditTable) keyCondition(op string, key []string, argOffset int) (string, []any) {
+	args := []any{}
+	param := func(i int) string {
+		args = append(args, key[i])
+		return fmt.Sprintf("CAST(CAST($%d AS TEXT) AS %s)", argOffset+len(args), t.pk[i].Typ)
+	}
+
+	ors := []string{}
+	for i := range t.pk {
+		ands := []string{}
+		for j := 0; j < i; j++ {
+			ands = append(ands, fmt.Sprintf("%s = %s", quoteIdent(t.pk[j].Name), param(j)))
+		}
+		ands = append(ands, fmt.Sprintf("%s %s %s", quoteIdent(t.pk[i].Name), op, param(i)))
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+	if op == ">" {
+		ands := []string{}
+		for j := range t.pk {
+			ands = append(ands, fmt.Sprintf("%s = %s", quoteIdent(t.pk[j].Name), param(j)))
+		}
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+
+	return "(" + strings.Join(ors, " OR ") + ")", args
+}
+
+// Bisect finds the rows that differ between the source and the replica,
+// by splitting the primary key range in halves and comparing the digests
+// of each half, down to ranges of at most maxRows rows, which are compared
+// row by row.
+func Bisect(ctx context.Context, source, replica *AuditTable, maxRows int64) ([]RowDiff, error) {
+	if maxRows < 1 {
+		maxRows = 1
+	}
+
+	diffs := []RowDiff{}
+	var bisect func(r KeyRange) error
+	bisect = func(r KeyRange) error {
+		sh, sn, err := source.rangeDigest(ctx, r)
+		if err != nil {
+			return fmt.Errorf("source: %s", err)
+		}
+		rh, rn, err := replica.rangeDigest(ctx, r)
+		if err != nil {
+			return fmt.Errorf("replica: %s", err)
+		}
+		if sn == rn && sh.Equal(rh) {
+			return nil
+		}
+
+		if sn <= maxRows && rn <= maxRows {
+			d, err := compareRows(ctx, source, replica, r)
+			if err != nil {
+				return err
+			}
+			diffs = append(diffs, d...)
+			return nil
+		}
+
+		// split at the middle row of the side with more rows
+		side, n := source, sn
+		if rn > sn {
+			side, n = replica, rn
+		}
+		split, err := side.splitKey(ctx, r, n/2)
+		if err != nil {
+			return err
+		}
+
+		if err := bisect(KeyRange{From: r.From, To: split}); err != nil {
+			return err
+		}
+		return bisect(KeyRange{From: split, To: r.To})
+	}
+
+	if err := bisect(KeyRange{}); err != nil {
+		return []RowDiff{}, err
+	}
+
+	return diffs, nil
+}
+
+func compareRows(ctx context.Context, source, replica *AuditTable, r KeyRange) ([]RowDiff, error) {
+	sourceKeys, sourceRows, err := source.rows(ctx, r)
+	if err != nil {
+		return []RowDiff{}, fmt.Errorf("source: %s", err)
+	}
+	replicaKeys, replicaRows, err := replica.rows(ctx, r)
+	if err != nil {
+		return []RowDiff{}, fmt.Errorf("replica: %s", err)
+	}
+
+	keys := map[string][]string{}
+	for k, key := range sourceKeys {
+		keys[k] = key
+	}
+	for k, key := range replicaKeys {
+		keys[k] = key
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	diffs := []RowDiff{}
+	for _, k := range sorted {
+		s, r := sourceRows[k], replicaRows[k]
+		if s != nil && r != nil && string(EncodeRow(s)) == string(EncodeRow(r)) {
+			continue
+		}
+		diffs = append(diffs, RowDiff{Key: keys[k], Source: s, Replica: r})
+	}
+
+	return diffs, nil
+}
+
+// normalizeValue renders a value scanned from Postgres or DuckDB the same
+// way on both sides, so rows can be compared across databases.
+func normalizeValue(v any) *string {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case bool:
+		s = strconv.FormatBool(v)
+	case int8, int16, int32, int64, int, uint8, uint16, uint32, uint64, uint:
+		s = fmt.Sprint(v)
+	case float32:
+		s = strconv.FormatFloat(float64(v), 'g', -1, 64)
+	case float64:
+		s = strconv.FormatFloat(v, 'g', -1, 64)
+	case *big.Int:
+		s = v.String()
+	case time.Time:
+		s = v.UTC().Format(time.RFC3339Nano)
+	case [16]byte:
+		s = fmt.Sprintf("%x-%x-%x-%x-%x", v[0:4], v[4:6], v[6:8], v[8:10], v[10:16])
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	return &s
+}
+
+// LoadReplica rebuilds the rows of a replicated table into a DuckDB table
+// named after it, from the Parquet files of its events, oldest first.
+// A row replaces the previous one with the same primary key, and rows
+// whose _op column is D are deleted.
+func LoadReplica(ctx context.Context, db *sql.DB, table string, files []string, pk []string) ([]Column, error) {
+	if len(files) == 0 {
+		return nil, ErrNoEvents
+	}
+
+	quoted := make([]string, len(files))
+	for i, f := range files {
+		quoted[i] = quoteLiteral(f)
+	}
+	keys := make([]string, len(pk))
+	for i, k := range pk {
+		keys[i] = quoteIdent(k)
+	}
+
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(
+		`CREATE OR REPLACE TEMP TABLE _vaults_replica AS
+		 SELECT *, list_position([%s], filename) AS _vaults_event
+		 FROM read_parquet([%s], union_by_name = true, filename = true, file_row_number = true)`,
+		strings.Join(quoted, ", "), strings.Join(quoted, ", "),
+	)); err != nil {
+		return nil, fmt.Errorf("read events: %s", err)
+	}
+
+	var hasOp, hasLSN bool
+	rows, err := db.QueryContext(ctx, "SELECT column_name FROM information_schema.columns WHERE table_name = '_vaults_replica'")
+	if err != nil {
+		return nil, fmt.Errorf("describe events: %s", err)
+	}
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("describe events: %s", err)
+		}
+		hasOp = hasOp || c == OpColumn
+		hasLSN = hasLSN || c == LSNColumn
+	}
+	_ = rows.Close()
+
+	exclude := []string{"filename", "file_row_number", "_vaults_event"}
+	order := "_vaults_event DESC, file_row_number DESC"
+	filter := ""
+	if hasLSN {
+		exclude = append(exclude, quoteIdent(LSNColumn))
+		order = fmt.Sprintf("_vaults_event DESC, %s DESC, file_row_number DESC", quoteIdent(LSNColumn))
+	}
+	if hasOp {
+		exclude = append(exclude, quoteIdent(OpColumn))
+		filter = fmt.Sprintf("WHERE %s IS DISTINCT FROM 'D'", quoteIdent(OpColumn))
+	}
+
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(
+		`CREATE OR REPLACE TABLE %s AS
+		 SELECT * EXCLUDE (%s) FROM (
+			SELECT * FROM _vaults_replica
+			QUALIFY row_number() OVER (PARTITION BY %s ORDER BY %s) = 1
+		 ) %s`,
+		quoteIdent(table), strings.Join(exclude, ", "), strings.Join(keys, ", "), order, filter,
+	)); err != nil {
+		return nil, fmt.Errorf("rebuild table: %s", err)
+	}
+
+	if _, err := db.ExecContext(ctx, "DROP TABLE _vaults_replica"); err != nil {
+		return nil, fmt.Errorf("drop events: %s", err)
+	}
+
+	rows, err = db.QueryContext(ctx,
+		"SELECT column_name, data_type FROM information_schema.columns WHERE table_name = ? ORDER BY ordinal_position",
+		table,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("describe table: %s", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	columns := []Column{}
+	for rows.Next() {
+		var c Column
+		if err := rows.Scan(&c.Name, &c.Typ); err != nil {
+			return nil, fmt.Errorf("describe table: %s", err)
+		}
+		c.IsPrimary = slices.Contains(pk, c.Name)
+		columns = append(columns, c)
+	}
+
+	return columns, rows.Err()
+}
+
+// ReplicaEvent is an event of a vault exported from a replicated table.
+type ReplicaEvent struct {
+	CID       string
+	Timestamp int64
+	Table     string
+	Digest    string
+	Path      string
+}
+
+// ReplicaEvents reads the table and digest recorded in the metadata of the
+// vault's events, newest first, retrieving them into the cache. It stops
+// once fn returns false.
+func ReplicaEvents(
+	ctx context.Context, provider VaultsProvider, cache *ContentCache, vault Vault, fn func(ReplicaEvent) bool,
+) error {
+	events, err := ListAllEvents(ctx, provider, vault, Timestamp{}, Timestamp{})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp > events[j].Timestamp
+	})
+
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		return fmt.Errorf("cannot open db: %s", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	for _, event := range events {
+		c, err := cid.Parse(event.CID)
+		if err != nil {
+			return fmt.Errorf("parse cid: %s", err)
+		}
+		p, err := cache.Get(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		metadata, err := parquetMetadata(ctx, db, p)
+		if err != nil {
+			return fmt.Errorf("read metadata of %s: %s", event.CID, err)
+		}
+
+		table := metadata[TableMetadataKey]
+		if table == "" {
+			if m := exportNameRegex.FindStringSubmatch(filepath.Base(p)); m != nil {
+				table = m[1]
+			}
+		}
+
+		if !fn(ReplicaEvent{
+			CID:       event.CID,
+			Timestamp: event.Timestamp,
+			Table:     table,
+			Digest:    metadata[DigestMetadataKey],
+			Path:      p,
+		}) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func parquetMetadata(ctx context.Context, db *sql.DB, p string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT CAST(key AS VARCHAR), CAST(value AS VARCHAR) FROM parquet_kv_metadata(%s)", quoteLiteral(p),
+	))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	metadata := map[string]string{}
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		metadata[k] = v
+	}
+
+	return metadata, rows.Err()
+}
@@ -0,0 +1,169 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
+)
+
+func TestAuditTableTextDigest(t *testing.T) {
+	ctx := context.Background()
+	db := auditDB(t,
+		"CREATE TABLE t (id integer PRIMARY KEY, name varchar)",
+		"INSERT INTO t VALUES (1, 'a'), (2, NULL)",
+	)
+
+	table, err := NewAuditTable(db, "t", []Column{
+		{Name: "id", Typ: "integer", IsPrimary: true},
+		{Name: "name", Typ: "varchar"},
+	})
+	require.NoError(t, err)
+
+	// the digest matches the one the stream computes from the WAL
+	h, n, err := table.TextDigest(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+	require.True(t, h.Equal(rowsDigest(t, [][]string{{`1`, `"a"`}, {`2`, `null`}})))
+
+	_, err = NewAuditTable(db, "t", []Column{{Name: "id", Typ: "integer"}})
+	require.Error(t, err)
+}
+
+func TestBisectFindsDivergentRows(t *testing.T) {
+	ctx := context.Background()
+	db := auditDB(t,
+		"CREATE TABLE source (id integer, name varchar, amount decimal(10, 2))",
+		"INSERT INTO source SELECT i, 'row ' || i, i / 4 FROM range(1, 101) r(i)",
+		"CREATE TABLE replica (id integer, name varchar, amount double)",
+		"INSERT INTO replica SELECT * FROM source WHERE id <> 17",
+		"UPDATE replica SET name = 'changed' WHERE id = 60",
+		"INSERT INTO replica VALUES (200, 'extra', 1.5)",
+	)
+
+	source, err := NewAuditTable(db, "source", []Column{
+		{Name: "id", Typ: "integer", IsPrimary: true},
+		{Name: "name", Typ: "varchar"},
+		{Name: "amount", Typ: "numeric(10,2)"},
+	})
+	require.NoError(t, err)
+	replica, err := NewAuditTable(db, "replica", []Column{
+		{Name: "id", Typ: "INTEGER", IsPrimary: true},
+		{Name: "name", Typ: "VARCHAR"},
+		{Name: "amount", Typ: "DOUBLE"},
+	})
+	require.NoError(t, err)
+
+	diffs, err := Bisect(ctx, source, replica, 4)
+	require.NoError(t, err)
+	require.Len(t, diffs, 3)
+
+	require.Equal(t, []string{"17"}, diffs[0].Key)
+	require.NotNil(t, diffs[0].Source)
+	require.Nil(t, diffs[0].Replica)
+
+	require.Equal(t, []string{"60"}, diffs[1].Key)
+	require.Equal(t, "row 60", *diffs[1].Source["name"])
+	require.Equal(t, "changed", *diffs[1].Replica["name"])
+
+	require.Equal(t, []string{"200"}, diffs[2].Key)
+	require.Nil(t, diffs[2].Source)
+	require.Equal(t, "extra", *diffs[2].Replica["name"])
+
+	// identical tables have no differences
+	diffs, err = Bisect(ctx, source, source, 4)
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+}
+
+func TestBisectCompositeKey(t *testing.T) {
+	ctx := context.Background()
+	db := auditDB(t,
+		"CREATE TABLE source (a integer, b varchar, v integer)",
+		"INSERT INTO source SELECT i % 5, 'k' || (i // 5), i FROM range(0, 50) r(i)",
+		"CREATE TABLE replica AS SELECT * FROM source",
+		"DELETE FROM replica WHERE a = 3 AND b = 'k7'",
+	)
+
+	columns := []Column{
+		{Name: "a", Typ: "integer", IsPrimary: true},
+		{Name: "b", Typ: "varchar", IsPrimary: true},
+		{Name: "v", Typ: "integer"},
+	}
+	source, err := NewAuditTable(db, "source", columns)
+	require.NoError(t, err)
+	replica, err := NewAuditTable(db, "replica", columns)
+	require.NoError(t, err)
+
+	diffs, err := Bisect(ctx, source, replica, 2)
+	require.NoError(t, err)
+	require.Len(t, diffs, 1)
+	require.Equal(t, []string{"3", "k7"}, diffs[0].Key)
+	require.Nil(t, diffs[0].Replica)
+}
+
+func TestLoadReplica(t *testing.T) {
+	ctx := context.Background()
+	files := exportWindows(t, TableSchema{"t", cols},
+		[]*pgrepl.Tx{{CommitLSN: 100, Records: []pgrepl.Record{
+			walRecord("I", "t", nil, `1`, `"a"`),
+			walRecord("I", "t", nil, `2`, `"b"`),
+		}}},
+		[]*pgrepl.Tx{
+			{CommitLSN: 200, Records: []pgrepl.Record{
+				walRecord("U", "t", nil, `2`, `"bb"`),
+				walRecord("D", "t", []string{`1`}),
+			}},
+			{CommitLSN: 300, Records: []pgrepl.Record{
+				walRecord("I", "t", nil, `3`, `"c"`),
+			}},
+		},
+	)
+	db := auditDB(t)
+
+	columns, err := LoadReplica(ctx, db, "t", files, []string{"id"})
+	require.NoError(t, err)
+	require.Equal(t, []Column{
+		{Name: "id", Typ: "INTEGER", IsPrimary: true},
+		{Name: "name", Typ: "VARCHAR"},
+	}, columns)
+
+	rows, err := db.QueryContext(ctx, "SELECT id, name FROM t ORDER BY id")
+	require.NoError(t, err)
+	defer func() {
+		_ = rows.Close()
+	}()
+	got := []string{}
+	for rows.Next() {
+		var id int
+		var name string
+		require.NoError(t, rows.Scan(&id, &name))
+		got = append(got, fmt.Sprintf("%d:%s", id, name))
+	}
+	require.Equal(t, []string{"2:bb", "3:c"}, got)
+
+	_, err = LoadReplica(ctx, db, "t", []string{}, []string{"id"})
+	require.ErrorIs(t, err, ErrNoEvents)
+}
+
+func auditDB(t *testing.T, stmts ...string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("duckdb", "")
+	require.NoError(t, err)
+	// keep a single in-memory database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	for _, stmt := range stmts {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	return db
+}
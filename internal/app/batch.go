@@ -0,0 +1,249 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// TimestampFunc returns the event timestamp of a file.
+type TimestampFunc func(path string, fi os.FileInfo) (Timestamp, error)
+
+// FixedTimestamp gives every file the same timestamp.
+func FixedTimestamp(ts Timestamp) TimestampFunc {
+	return func(string, os.FileInfo) (Timestamp, error) {
+		return ts, nil
+	}
+}
+
+// TimestampFromMtime uses the file's modification time as timestamp.
+func TimestampFromMtime() TimestampFunc {
+	return func(_ string, fi os.FileInfo) (Timestamp, error) {
+		return NewTimestamp(fi.ModTime().UTC()), nil
+	}
+}
+
+// TimestampFromFilename extracts the timestamp from the file name.
+// The first capture group of rx, or the whole match if there is none,
+// is parsed with ParseTimestamp.
+func TimestampFromFilename(rx *regexp.Regexp) TimestampFunc {
+	return func(path string, _ os.FileInfo) (Timestamp, error) {
+		match := rx.FindStringSubmatch(filepath.Base(path))
+		if match == nil {
+			return Timestamp{}, fmt.Errorf("no timestamp found in file name %s", filepath.Base(path))
+		}
+
+		value := match[0]
+		if len(match) > 1 {
+			value = match[1]
+		}
+
+		return ParseTimestamp(value)
+	}
+}
+
+// ExpandPaths turns a list of files, directories and glob patterns into a
+// sorted list of files. Directories are walked recursively and only the
+// Parquet files inside them are included.
+func ExpandPaths(args []string) ([]string, error) {
+	seen := map[string]bool{}
+	files := []string{}
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			files = append(files, p)
+		}
+	}
+
+	for _, arg := range args {
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return []string{}, fmt.Errorf("glob %s: %s", arg, err)
+			}
+			if len(matches) == 0 {
+				return []string{}, fmt.Errorf("no files match %s", arg)
+			}
+		}
+
+		for _, match := range matches {
+			fi, err := os.Stat(match)
+			if err != nil {
+				return []string{}, fmt.Errorf("stat: %s", err)
+			}
+
+			if !fi.IsDir() {
+				add(match)
+				continue
+			}
+
+			if err := filepath.WalkDir(match, func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.Type().IsRegular() && strings.HasSuffix(d.Name(), ".parquet") {
+					add(p)
+				}
+				return nil
+			}); err != nil {
+				return []string{}, fmt.Errorf("walk %s: %s", match, err)
+			}
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// BatchItem is a file of a batch upload.
+type BatchItem struct {
+	Path      string
+	Size      int64
+	Hash      string
+	Timestamp Timestamp
+
+	// Skip is set when the file was already uploaded to the vault.
+	Skip bool
+}
+
+// BatchSummary is the outcome of a batch upload.
+type BatchSummary struct {
+	Uploaded int
+	Skipped  int
+	Bytes    int64
+	Failures map[string]error
+}
+
+// BatchUploader uploads many files to a vault with bounded concurrency.
+type BatchUploader struct {
+	uploader    *VaultsUploader
+	ledger      *Ledger
+	concurrency int
+	timestamp   TimestampFunc
+}
+
+// NewBatchUploader creates a new BatchUploader. The ledger is optional.
+func NewBatchUploader(
+	uploader *VaultsUploader, ledger *Ledger, concurrency int, timestamp TimestampFunc,
+) *BatchUploader {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &BatchUploader{
+		uploader:    uploader,
+		ledger:      ledger,
+		concurrency: concurrency,
+		timestamp:   timestamp,
+	}
+}
+
+// Plan stats, hashes and timestamps the files, and marks the ones
+// already recorded in the ledger as skipped.
+func (b *BatchUploader) Plan(ctx context.Context, files []string) ([]BatchItem, error) {
+	items := make([]BatchItem, 0, len(files))
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return []BatchItem{}, fmt.Errorf("stat: %s", err)
+		}
+
+		ts, err := b.timestamp(f, fi)
+		if err != nil {
+			return []BatchItem{}, err
+		}
+
+		item := BatchItem{
+			Path:      f,
+			Size:      fi.Size(),
+			Timestamp: ts,
+		}
+
+		if b.ledger != nil {
+			if item.Hash, err = HashFile(f); err != nil {
+				return []BatchItem{}, err
+			}
+			if item.Skip, err = b.ledger.Has(ctx, b.uploader.Vault(), item.Hash); err != nil {
+				return []BatchItem{}, err
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// Upload uploads the items that are not skipped. Failed uploads do not
+// stop the batch, they are reported in the summary.
+func (b *BatchUploader) Upload(ctx context.Context, items []BatchItem, progress io.Writer) BatchSummary {
+	summary := BatchSummary{Failures: map[string]error{}}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, b.concurrency)
+	for _, item := range items {
+		if item.Skip {
+			summary.Skipped++
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(item BatchItem) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := b.upload(ctx, item, progress)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				slog.Error("upload failed", "file", item.Path, "error", err)
+				summary.Failures[item.Path] = err
+				return
+			}
+			summary.Uploaded++
+			summary.Bytes += item.Size
+		}(item)
+	}
+	wg.Wait()
+
+	return summary
+}
+
+func (b *BatchUploader) upload(ctx context.Context, item BatchItem, progress io.Writer) error {
+	res, err := b.uploader.Upload(ctx, item.Path, progress, item.Timestamp, item.Size)
+	if err != nil {
+		return err
+	}
+
+	if b.ledger == nil {
+		return nil
+	}
+
+	return b.ledger.Record(ctx, LedgerEntry{
+		Vault:      b.uploader.Vault(),
+		FileHash:   item.Hash,
+		Filename:   filepath.Base(item.Path),
+		Size:       item.Size,
+		Timestamp:  item.Timestamp.Seconds(),
+		UploadedAt: time.Now().UTC(),
+		CID:        res.Event.CID,
+		Signature:  res.Signature,
+	})
+}
@@ -0,0 +1,272 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/exp/slog"
+)
+
+// ManifestFilename is the name of the manifest written by BatchRetriever.
+const ManifestFilename = "manifest.json"
+
+// ManifestEntry is a retrieved event in a manifest.
+type ManifestEntry struct {
+	Filename  string `json:"filename"`
+	Timestamp int64  `json:"timestamp"`
+
+	// SHA256 is the hex-encoded sha256 of the file when it was retrieved,
+	// to tell if it is still intact without rebuilding its DAG.
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest maps the CIDs of the retrieved events to their files.
+type Manifest struct {
+	Vault  Vault                    `json:"vault"`
+	Events map[string]ManifestEntry `json:"events"`
+}
+
+// RetrieveSummary is the outcome of a batch retrieval.
+type RetrieveSummary struct {
+	Retrieved int
+	Skipped   int
+	Failures  map[string]error
+}
+
+// BatchRetriever retrieves the events of a vault into a directory,
+// through the content cache.
+type BatchRetriever struct {
+	provider    VaultsProvider
+	cache       *ContentCache
+	concurrency int
+
+	mu       sync.Mutex
+	manifest *Manifest
+	names    map[string]string // filename -> cid
+	dir      string
+}
+
+// NewBatchRetriever creates a new BatchRetriever.
+func NewBatchRetriever(provider VaultsProvider, cache *ContentCache, concurrency int) *BatchRetriever {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &BatchRetriever{
+		provider:    provider,
+		cache:       cache,
+		concurrency: concurrency,
+	}
+}
+
+// ListEvents pages through all the events of a vault in the time range.
+func (b *BatchRetriever) ListEvents(
+	ctx context.Context, vault Vault, before Timestamp, after Timestamp,
+) ([]EventInfo, error) {
+	return ListAllEvents(ctx, b.provider, vault, before, after)
+}
+
+// Retrieve downloads the events of a vault in the time range into dir.
+// Events already listed in the manifest of dir are skipped when their
+// file still matches the CID. Failed downloads do not stop the batch,
+// they are reported in the summary.
+func (b *BatchRetriever) Retrieve(
+	ctx context.Context, vault Vault, before Timestamp, after Timestamp, dir string,
+) (RetrieveSummary, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return RetrieveSummary{}, fmt.Errorf("mkdir: %s", err)
+	}
+
+	if err := b.loadManifest(vault, dir); err != nil {
+		return RetrieveSummary{}, fmt.Errorf("load manifest: %s", err)
+	}
+
+	events, err := b.ListEvents(ctx, vault, before, after)
+	if err != nil {
+		return RetrieveSummary{}, err
+	}
+
+	summary := RetrieveSummary{Failures: map[string]error{}}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, b.concurrency)
+	for _, event := range events {
+		if b.retrieved(event.CID) {
+			summary.Skipped++
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(event EventInfo) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := b.retrieve(ctx, event)
+
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if err != nil {
+				slog.Error("retrieve failed", "cid", event.CID, "error", err)
+				summary.Failures[event.CID] = err
+				return
+			}
+			summary.Retrieved++
+		}(event)
+	}
+	wg.Wait()
+
+	if err := b.cache.Trim(); err != nil {
+		slog.Warn("trimming cache", "error", err)
+	}
+
+	return summary, nil
+}
+
+// retrieved tells if the event is in the manifest and its file is intact.
+// The file was verified against the CID when it was retrieved, so it is
+// intact if it still has the hash recorded then.
+func (b *BatchRetriever) retrieved(id string) bool {
+	entry, ok := b.manifest.Events[id]
+	if !ok {
+		return false
+	}
+
+	hash, err := HashFile(filepath.Join(b.dir, entry.Filename))
+	if err != nil {
+		slog.Warn("retrieving again", "cid", id, "file", entry.Filename, "error", err)
+		return false
+	}
+	if hash != entry.SHA256 {
+		slog.Warn("retrieving again", "cid", id, "file", entry.Filename, "error", "file changed")
+		return false
+	}
+
+	return true
+}
+
+func (b *BatchRetriever) retrieve(ctx context.Context, event EventInfo) error {
+	c, err := cid.Parse(event.CID)
+	if err != nil {
+		return fmt.Errorf("parse cid: %s", err)
+	}
+
+	cached, err := b.cache.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(cached)
+	if err != nil {
+		return fmt.Errorf("open cached file: %s", err)
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+
+	tmp, err := os.CreateTemp(b.dir, ".retrieve-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %s", err)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), src); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("copy cached file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %s", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	name := b.claimName(event.CID, filepath.Base(cached))
+	if err := os.Rename(tmp.Name(), filepath.Join(b.dir, name)); err != nil {
+		return fmt.Errorf("rename: %s", err)
+	}
+
+	b.manifest.Events[event.CID] = ManifestEntry{
+		Filename:  name,
+		Timestamp: event.Timestamp,
+		SHA256:    hex.EncodeToString(h.Sum(nil)),
+	}
+
+	return b.saveManifest()
+}
+
+// claimName picks the output file name of an event. Files are named after
+// the filename returned by the provider, prefixed with the CID when the name
+// is taken by another event or when the provider did not return one.
+func (b *BatchRetriever) claimName(id string, filename string) string {
+	name := filepath.Base(filename)
+	if filename == "" || name == "." || name == string(filepath.Separator) {
+		name = id
+	}
+
+	if owner, ok := b.names[name]; ok && owner != id {
+		name = fmt.Sprintf("%s-%s", id, name)
+	}
+	b.names[name] = id
+
+	return name
+}
+
+func (b *BatchRetriever) loadManifest(vault Vault, dir string) error {
+	b.dir = dir
+	b.names = map[string]string{}
+	b.manifest = &Manifest{Vault: vault, Events: map[string]ManifestEntry{}}
+
+	buf, err := os.ReadFile(filepath.Join(dir, ManifestFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return err
+	}
+	if m.Vault != vault {
+		return fmt.Errorf("%s belongs to vault %s", ManifestFilename, m.Vault)
+	}
+
+	for id, entry := range m.Events {
+		b.manifest.Events[id] = entry
+		b.names[entry.Filename] = id
+	}
+
+	return nil
+}
+
+func (b *BatchRetriever) saveManifest() error {
+	buf, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %s", err)
+	}
+
+	p := filepath.Join(b.dir, ManifestFilename)
+	if err := os.WriteFile(p+".tmp", buf, 0o644); err != nil {
+		return fmt.Errorf("write manifest: %s", err)
+	}
+	if err := os.Rename(p+".tmp", p); err != nil {
+		return fmt.Errorf("write manifest: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	"github.com/ipld/go-car/v2"
+	carstorage "github.com/ipld/go-car/v2/storage"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchRetrieve(t *testing.T) {
+	ctx := context.Background()
+	provider := newEventStoreMock()
+
+	// three events with the same filename
+	files := map[int64][]byte{}
+	for _, ts := range []int64{1700000000, 1700000100, 1700000200} {
+		files[ts] = make([]byte, 1000)
+		_, err := rand.Read(files[ts])
+		require.NoError(t, err)
+		provider.add(t, "data.parquet", ts, files[ts])
+	}
+
+	dir := t.TempDir()
+	batch := NewBatchRetriever(provider, newTestCache(t, provider), 2)
+	summary, err := batch.Retrieve(ctx, "test.data", Timestamp{}, NewTimestamp(time.Unix(1700000100, 0)), dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, summary.Retrieved)
+	require.Empty(t, summary.Failures)
+
+	manifest := readManifest(t, dir)
+	require.Equal(t, Vault("test.data"), manifest.Vault)
+	require.Len(t, manifest.Events, 2)
+
+	names := map[string]bool{}
+	for _, entry := range manifest.Events {
+		names[entry.Filename] = true
+		content, err := os.ReadFile(path.Join(dir, entry.Filename))
+		require.NoError(t, err)
+		require.Equal(t, files[entry.Timestamp], content)
+	}
+	require.Len(t, names, 2)
+	require.True(t, names["data.parquet"])
+
+	// running again skips the intact files and retrieves the missing and corrupted ones
+	require.NoError(t, os.WriteFile(path.Join(dir, "data.parquet"), []byte("corrupted"), 0o644))
+	summary, err = NewBatchRetriever(provider, newTestCache(t, provider), 2).
+		Retrieve(ctx, "test.data", Timestamp{}, Timestamp{}, dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, summary.Retrieved)
+	require.Equal(t, 1, summary.Skipped)
+	require.Empty(t, summary.Failures)
+
+	manifest = readManifest(t, dir)
+	require.Len(t, manifest.Events, 3)
+	for _, entry := range manifest.Events {
+		content, err := os.ReadFile(path.Join(dir, entry.Filename))
+		require.NoError(t, err)
+		require.Equal(t, files[entry.Timestamp], content)
+	}
+}
+
+func TestBatchRetrieverSkipsIntactFiles(t *testing.T) {
+	ctx := context.Background()
+
+	// imported with a chunker the provider's cache check doesn't know about
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetWriteStorage(discardStorage{})
+	link, _, err := builder.BuildUnixFSFile(bytes.NewReader(content), "size-4096", &lsys)
+	require.NoError(t, err)
+	root := link.(cidlink.Link).Cid
+
+	carPath := path.Join(t.TempDir(), "data.car")
+	f, err := os.Create(carPath)
+	require.NoError(t, err)
+	wc, err := carstorage.NewWritable(f, []cid.Cid{root}, car.WriteAsCarV1(true))
+	require.NoError(t, err)
+	lsys.SetWriteStorage(wc)
+	_, _, err = builder.BuildUnixFSFile(bytes.NewReader(content), "size-4096", &lsys)
+	require.NoError(t, err)
+	require.NoError(t, wc.Finalize())
+	require.NoError(t, f.Close())
+
+	fetches := 0
+	retriever := &Retriever{store: &carStore{
+		fetchCAR: func(_ context.Context, _ cid.Cid, dst string) error {
+			fetches++
+			buf, err := os.ReadFile(carPath)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(dst, buf, 0o644)
+		},
+	}}
+
+	provider := &growingProviderMock{}
+	provider.add(root.String(), 1700000000)
+
+	dir := t.TempDir()
+	retrieve := func() RetrieveSummary {
+		cache, err := NewContentCache(t.TempDir(), DefaultCacheSize, retriever)
+		require.NoError(t, err)
+		summary, err := NewBatchRetriever(provider, cache, 1).Retrieve(ctx, "test.data", Timestamp{}, Timestamp{}, dir)
+		require.NoError(t, err)
+		require.Empty(t, summary.Failures)
+		return summary
+	}
+
+	require.Equal(t, 1, retrieve().Retrieved)
+	require.Equal(t, 1, fetches)
+
+	// the intact file is not retrieved again
+	summary := retrieve()
+	require.Equal(t, 0, summary.Retrieved)
+	require.Equal(t, 1, summary.Skipped)
+	require.Equal(t, 1, fetches)
+
+	// a changed file is
+	require.NoError(t, os.WriteFile(path.Join(dir, root.String()), []byte("changed"), 0o644))
+	require.Equal(t, 1, retrieve().Retrieved)
+	require.Equal(t, 2, fetches)
+
+	data, err := os.ReadFile(path.Join(dir, root.String()))
+	require.NoError(t, err)
+	require.Equal(t, content, data)
+}
+
+func readManifest(t *testing.T, dir string) Manifest {
+	t.Helper()
+	buf, err := os.ReadFile(path.Join(dir, ManifestFilename))
+	require.NoError(t, err)
+	var manifest Manifest
+	require.NoError(t, json.Unmarshal(buf, &manifest))
+	return manifest
+}
+
+func newTestCache(t *testing.T, provider VaultsProvider) *ContentCache {
+	t.Helper()
+	cache, err := NewContentCache(t.TempDir(), DefaultCacheSize, NewRetriever(provider, 0))
+	require.NoError(t, err)
+	return cache
+}
+
+type storedEvent struct {
+	info     EventInfo
+	filename string
+	content  []byte
+}
+
+// eventStoreMock keeps the content of its events, like the provider's cache,
+// and lists them newest first, with inclusive bounds.
+type eventStoreMock struct {
+	vaultsProviderMock
+
+	mu         sync.Mutex
+	events     []storedEvent
+	retrievals int
+}
+
+func newEventStoreMock() *eventStoreMock {
+	return &eventStoreMock{}
+}
+
+func (bp *eventStoreMock) add(t *testing.T, filename string, ts int64, content []byte) string {
+	t.Helper()
+	c, err := ChunkCID(content)
+	require.NoError(t, err)
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.events = append([]storedEvent{{
+		info:     EventInfo{CID: c.String(), Timestamp: ts},
+		filename: filename,
+		content:  content,
+	}}, bp.events...)
+
+	return c.String()
+}
+
+func (bp *eventStoreMock) ListVaultEvents(
+	_ context.Context, params ListVaultEventsParams,
+) ([]EventInfo, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	events := []EventInfo{}
+	for _, e := range bp.events {
+		if params.Before != (Timestamp{}) && e.info.Timestamp > params.Before.Seconds() {
+			continue
+		}
+		if params.After != (Timestamp{}) && e.info.Timestamp < params.After.Seconds() {
+			continue
+		}
+		events = append(events, e.info)
+	}
+
+	if int(params.Offset) >= len(events) {
+		return []EventInfo{}, nil
+	}
+	events = events[params.Offset:]
+	if int(params.Limit) < len(events) {
+		events = events[:params.Limit]
+	}
+
+	return events, nil
+}
+
+func (bp *eventStoreMock) RetrieveEvent(
+	_ context.Context, params RetrieveEventParams, w io.Writer,
+) (string, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	for _, e := range bp.events {
+		if e.info.CID == params.CID.String() {
+			bp.retrievals++
+			_, err := w.Write(e.content)
+			return e.filename, err
+		}
+	}
+
+	return "", ErrNotFoundInCache
+}
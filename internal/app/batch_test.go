@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandPaths(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(dir, "a", "b"), 0o755))
+	for _, f := range []string{"x.parquet", "y.parquet", "notes.txt", "a/z.parquet", "a/b/w.parquet"} {
+		require.NoError(t, os.WriteFile(path.Join(dir, f), []byte("data"), 0o644))
+	}
+
+	files, err := ExpandPaths([]string{path.Join(dir, "a"), path.Join(dir, "*.parquet"), path.Join(dir, "x.parquet")})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		path.Join(dir, "a/b/w.parquet"),
+		path.Join(dir, "a/z.parquet"),
+		path.Join(dir, "x.parquet"),
+		path.Join(dir, "y.parquet"),
+	}, files)
+
+	// explicit files are included regardless of their extension
+	files, err = ExpandPaths([]string{path.Join(dir, "notes.txt")})
+	require.NoError(t, err)
+	require.Equal(t, []string{path.Join(dir, "notes.txt")}, files)
+
+	_, err = ExpandPaths([]string{path.Join(dir, "*.csv")})
+	require.Error(t, err)
+}
+
+func TestTimestampFromFilename(t *testing.T) {
+	tsFn := TimestampFromFilename(regexp.MustCompile(`export_(\d{4}-\d{2}-\d{2})`))
+
+	ts, err := tsFn("/data/export_2023-09-01.parquet", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1693526400), ts.Seconds())
+
+	_, err = tsFn("/data/export.parquet", nil)
+	require.Error(t, err)
+}
+
+func TestBatchUploaderSkipsUploadedFiles(t *testing.T) {
+	ctx := context.Background()
+	privateKey, err := crypto.HexToECDSA(pk)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	files := []string{}
+	for _, name := range []string{"a.parquet", "b.parquet", "c.parquet"} {
+		f := path.Join(dir, name)
+		require.NoError(t, os.WriteFile(f, []byte(name), 0o644))
+		files = append(files, f)
+	}
+
+	ledger, err := OpenLedger(ctx, path.Join(t.TempDir(), "ledger.db"))
+	require.NoError(t, err)
+
+	provider := &countingProviderMock{}
+	uploader := NewVaultsUploader(testNS, testTable, provider, privateKey)
+	batch := NewBatchUploader(uploader, ledger, 2, FixedTimestamp(NewTimestamp(time.Now())))
+
+	items, err := batch.Plan(ctx, files[:2])
+	require.NoError(t, err)
+	summary := batch.Upload(ctx, items, io.Discard)
+	require.Equal(t, 2, summary.Uploaded)
+	require.Equal(t, 0, summary.Skipped)
+	require.Empty(t, summary.Failures)
+
+	// the first two files are in the ledger now
+	items, err = batch.Plan(ctx, files)
+	require.NoError(t, err)
+	summary = batch.Upload(ctx, items, io.Discard)
+	require.Equal(t, 1, summary.Uploaded)
+	require.Equal(t, 2, summary.Skipped)
+	require.Equal(t, 3, provider.writes)
+}
+
+type countingProviderMock struct {
+	vaultsProviderMock
+
+	mu     sync.Mutex
+	writes int
+}
+
+func (bp *countingProviderMock) WriteVaultEvent(
+	_ context.Context, params WriteVaultEventParams,
+) (EventInfo, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	_, _ = io.Copy(params.ProgressBar, params.Content)
+	bp.writes++
+	return EventInfo{}, nil
+}
@@ -0,0 +1,267 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// DefaultCacheSize is the default size limit of the local content cache.
+const DefaultCacheSize = 10 << 30
+
+// SourceLocalCache is the source reported for content served by the local cache.
+const SourceLocalCache = "local cache"
+
+// CacheEntry is a file in the content cache.
+type CacheEntry struct {
+	CID      string
+	Filename string
+	Size     int64
+	LastUsed time.Time
+}
+
+// ContentCache is a local cache of retrieved events, keyed by CID.
+// Files are only added after they were verified by the Retriever,
+// so a cached file always matches its CID and a hit can be trusted
+// without touching the network.
+//
+// The content of a CID is kept at <dir>/<cid>/<filename>, and the file's
+// modification time is bumped on every hit to evict the least recently
+// used entries first.
+type ContentCache struct {
+	dir       string
+	maxSize   int64
+	retriever *Retriever
+
+	mu sync.Mutex
+}
+
+// NewContentCache creates a new ContentCache at dir. Trim keeps it under maxSize bytes.
+func NewContentCache(dir string, maxSize int64, retriever *Retriever) (*ContentCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir: %s", err)
+	}
+
+	return &ContentCache{
+		dir:       dir,
+		maxSize:   maxSize,
+		retriever: retriever,
+	}, nil
+}
+
+// Lookup returns the path of the cached content of a CID, if it is cached.
+func (c *ContentCache) Lookup(id cid.Cid) (string, bool) {
+	entries, err := os.ReadDir(filepath.Join(c.dir, id.String()))
+	if err != nil || len(entries) != 1 || !entries[0].Type().IsRegular() {
+		return "", false
+	}
+
+	p := filepath.Join(c.dir, id.String(), entries[0].Name())
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+
+	return p, true
+}
+
+// Get returns the path of the cached content of a CID,
+// retrieving it first if it is not cached.
+func (c *ContentCache) Get(ctx context.Context, id cid.Cid) (string, error) {
+	p, _, err := c.get(ctx, id)
+	return p, err
+}
+
+// get is like Get, and also returns the source that served the content.
+func (c *ContentCache) get(ctx context.Context, id cid.Cid) (string, string, error) {
+	if p, ok := c.Lookup(id); ok {
+		return p, SourceLocalCache, nil
+	}
+
+	f, err := c.retriever.store.fetch(ctx, id)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.remove()
+
+	tmp, err := os.CreateTemp(c.dir, ".retrieve-*")
+	if err != nil {
+		return "", "", fmt.Errorf("create temp file: %s", err)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if err := extractCAR(ctx, f.car, id, tmp); err != nil {
+		_ = tmp.Close()
+		return "", "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", "", fmt.Errorf("close temp file: %s", err)
+	}
+
+	name := filepath.Base(f.filename)
+	if f.filename == "" || name == "." || name == string(filepath.Separator) {
+		name = id.String()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// it may have been added while it was retrieved
+	if p, ok := c.Lookup(id); ok {
+		return p, SourceLocalCache, nil
+	}
+
+	entryDir := filepath.Join(c.dir, id.String())
+	if err := os.RemoveAll(entryDir); err != nil {
+		return "", "", fmt.Errorf("remove entry: %s", err)
+	}
+	if err := os.Mkdir(entryDir, 0o755); err != nil {
+		return "", "", fmt.Errorf("mkdir: %s", err)
+	}
+
+	p := filepath.Join(entryDir, name)
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return "", "", fmt.Errorf("rename: %s", err)
+	}
+
+	return p, f.source, nil
+}
+
+// Retrieve writes the content of a CID to output, or to stdout if output is
+// empty or "-", retrieving it into the cache first if it is not cached.
+// It returns the source that served the content.
+func (c *ContentCache) Retrieve(ctx context.Context, id cid.Cid, output string) (string, error) {
+	p, source, err := c.get(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	src, err := os.Open(p)
+	if err != nil {
+		return "", fmt.Errorf("open cached file: %s", err)
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+
+	w, closeFn, err := openOutput(output)
+	if err != nil {
+		return "", err
+	}
+	defer closeFn()
+
+	if _, err := io.Copy(w, src); err != nil {
+		return "", fmt.Errorf("write output: %s", err)
+	}
+
+	return source, nil
+}
+
+// List returns the cached entries, most recently used first.
+func (c *ContentCache) List() ([]CacheEntry, error) {
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		return []CacheEntry{}, fmt.Errorf("read dir: %s", err)
+	}
+
+	entries := []CacheEntry{}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		if _, err := cid.Parse(d.Name()); err != nil {
+			continue
+		}
+
+		files, err := os.ReadDir(filepath.Join(c.dir, d.Name()))
+		if err != nil || len(files) != 1 {
+			continue
+		}
+
+		fi, err := files[0].Info()
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, CacheEntry{
+			CID:      d.Name(),
+			Filename: fi.Name(),
+			Size:     fi.Size(),
+			LastUsed: fi.ModTime(),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+
+	return entries, nil
+}
+
+// Prune evicts the least recently used entries until the cache is
+// no larger than maxSize bytes. It returns the evicted entries.
+func (c *ContentCache) Prune(maxSize int64) ([]CacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.List()
+	if err != nil {
+		return []CacheEntry{}, err
+	}
+
+	var size int64
+	for _, e := range entries {
+		size += e.Size
+	}
+
+	evicted := []CacheEntry{}
+	for i := len(entries) - 1; i >= 0 && size > maxSize; i-- {
+		if err := os.RemoveAll(filepath.Join(c.dir, entries[i].CID)); err != nil {
+			return evicted, fmt.Errorf("remove entry: %s", err)
+		}
+		size -= entries[i].Size
+		evicted = append(evicted, entries[i])
+	}
+
+	return evicted, nil
+}
+
+// Trim evicts the least recently used entries to keep the cache under its size limit.
+// It is meant to be called once the cached files returned by Get are not used anymore.
+func (c *ContentCache) Trim() error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+
+	_, err := c.Prune(c.maxSize)
+	return err
+}
+
+// Clear removes every entry of the cache.
+func (c *ContentCache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dirs, err := os.ReadDir(c.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read dir: %s", err)
+	}
+
+	for _, d := range dirs {
+		if err := os.RemoveAll(filepath.Join(c.dir, d.Name())); err != nil {
+			return fmt.Errorf("remove entry: %s", err)
+		}
+	}
+
+	return nil
+}
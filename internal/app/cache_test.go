@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentCacheHitsDoNotRetrieve(t *testing.T) {
+	ctx := context.Background()
+	provider := &contentProviderMock{content: []byte("Hello")}
+	counter := &retrievalCounter{VaultsProvider: provider}
+	cache, err := NewContentCache(t.TempDir(), DefaultCacheSize, NewRetriever(counter, 0))
+	require.NoError(t, err)
+
+	c, err := ChunkCID([]byte("Hello"))
+	require.NoError(t, err)
+
+	_, ok := cache.Lookup(c)
+	require.False(t, ok)
+
+	p, err := cache.Get(ctx, c)
+	require.NoError(t, err)
+	require.Equal(t, "sample.txt", path.Base(p))
+	require.Equal(t, 1, counter.retrievals)
+
+	output := path.Join(t.TempDir(), "output")
+	source, err := cache.Retrieve(ctx, c, output)
+	require.NoError(t, err)
+	require.Equal(t, SourceLocalCache, source)
+	require.Equal(t, 1, counter.retrievals)
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello"), data)
+}
+
+func TestContentCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	ids := []cid.Cid{}
+	for i, content := range []string{"first", "second", "third"} {
+		cache, err := NewContentCache(dir, 0, NewRetriever(&contentProviderMock{content: []byte(content)}, 0))
+		require.NoError(t, err)
+
+		c, err := ChunkCID([]byte(content))
+		require.NoError(t, err)
+		p, err := cache.Get(ctx, c)
+		require.NoError(t, err)
+
+		// spread the last use of the entries apart
+		used := time.Now().Add(time.Duration(i-10) * time.Minute)
+		require.NoError(t, os.Chtimes(p, used, used))
+		ids = append(ids, c)
+	}
+
+	cache, err := NewContentCache(dir, 0, NewRetriever(&cacheMissProviderMock{}, 0))
+	require.NoError(t, err)
+
+	// using the first entry makes the second one the least recently used
+	_, ok := cache.Lookup(ids[0])
+	require.True(t, ok)
+
+	entries, err := cache.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, ids[0].String(), entries[0].CID)
+
+	evicted, err := cache.Prune(int64(len("first") + len("third")))
+	require.NoError(t, err)
+	require.Len(t, evicted, 1)
+	require.Equal(t, ids[1].String(), evicted[0].CID)
+
+	_, ok = cache.Lookup(ids[1])
+	require.False(t, ok)
+
+	require.NoError(t, cache.Clear())
+	entries, err = cache.List()
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+type retrievalCounter struct {
+	VaultsProvider
+	retrievals int
+}
+
+func (bp *retrievalCounter) RetrieveEvent(
+	ctx context.Context, params RetrieveEventParams, w io.Writer,
+) (string, error) {
+	bp.retrievals++
+	return bp.VaultsProvider.RetrieveEvent(ctx, params, w)
+}
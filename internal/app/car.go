@@ -0,0 +1,254 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	"github.com/ipfs/go-unixfsnode/file"
+	"github.com/ipld/go-car/v2"
+	carstorage "github.com/ipld/go-car/v2/storage"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/raw" // register raw codec
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage"
+	"github.com/multiformats/go-multihash"
+)
+
+// ErrContentMismatch is an error when retrieved content does not hash to the requested CID.
+var ErrContentMismatch = errors.New("content does not match the CID")
+
+// unixfsChunkers are the chunkers commonly used to import files, tried in
+// order when rebuilding a UnixFS DAG from a file. It is only needed for
+// files served by the provider's cache, which come without their DAG; a file
+// imported with other settings doesn't match and is retrieved from the next
+// source instead.
+var unixfsChunkers = []string{"size-1048576", "size-262144"}
+
+// verifyCAR checks that the CAR at carPath has root as one of its roots,
+// that every block in it matches its CID, and that the root block is present.
+func verifyCAR(carPath string, root cid.Cid) error {
+	f, err := os.Open(carPath)
+	if err != nil {
+		return fmt.Errorf("open car: %s", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	// the block reader checks the hash of every block it reads
+	br, err := car.NewBlockReader(f)
+	if err != nil {
+		return fmt.Errorf("read car: %s", err)
+	}
+
+	hasRoot := false
+	for _, r := range br.Roots {
+		if r.Equals(root) {
+			hasRoot = true
+		}
+	}
+	if !hasRoot {
+		return fmt.Errorf("car roots do not include %s", root)
+	}
+
+	foundRoot := false
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("verify block: %s", err)
+		}
+		if blk.Cid().Equals(root) {
+			foundRoot = true
+		}
+	}
+	if !foundRoot {
+		return fmt.Errorf("root block %s not found in car", root)
+	}
+
+	return nil
+}
+
+// extractCAR walks the UnixFS DAG under root in the CAR at carPath
+// and writes the reassembled file to w. Every block is checked against
+// its CID when it is loaded.
+func extractCAR(ctx context.Context, carPath string, root cid.Cid, w io.Writer) error {
+	f, err := os.Open(carPath)
+	if err != nil {
+		return fmt.Errorf("open car: %s", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	store, err := carstorage.OpenReadable(f)
+	if err != nil {
+		return fmt.Errorf("open car storage: %s", err)
+	}
+
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(store)
+	unixfsnode.AddUnixFSReificationToLinkSystem(&lsys)
+
+	if root.Prefix().Codec == cid.Raw {
+		rc, err := store.GetStream(ctx, root.KeyString())
+		if err != nil {
+			return fmt.Errorf("load root: %s", err)
+		}
+		defer func() {
+			_ = rc.Close()
+		}()
+		if _, err := io.Copy(w, rc); err != nil {
+			return fmt.Errorf("copy root: %s", err)
+		}
+		return nil
+	}
+
+	node, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, dagpb.Type.PBNode)
+	if err != nil {
+		return fmt.Errorf("load root: %s", err)
+	}
+
+	ufile, err := file.NewUnixFSFile(ctx, node, &lsys)
+	if err != nil {
+		return fmt.Errorf("not a unixfs file: %s", err)
+	}
+
+	rs, err := ufile.AsLargeBytes()
+	if err != nil {
+		return fmt.Errorf("read file: %s", err)
+	}
+
+	if _, err := io.Copy(w, rs); err != nil {
+		return fmt.Errorf("reassemble file: %s", err)
+	}
+
+	return nil
+}
+
+// fileToCAR verifies that the content of a plain file hashes to root,
+// by rebuilding its UnixFS DAG, and writes the DAG to a CAR at carPath.
+func fileToCAR(ctx context.Context, content io.ReadSeeker, root cid.Cid, carPath string) error {
+	var build func(*ipld.LinkSystem, storage.WritableStorage) (cid.Cid, error)
+	if root.Prefix().Codec == cid.Raw {
+		// the content is hashed as it is read, and only loaded as a block
+		// once it is known to match
+		if err := verifyRaw(content, root); err != nil {
+			return err
+		}
+
+		build = func(_ *ipld.LinkSystem, store storage.WritableStorage) (cid.Cid, error) {
+			data, err := io.ReadAll(content)
+			if err != nil {
+				return cid.Undef, err
+			}
+			return root, store.Put(ctx, root.KeyString(), data)
+		}
+	} else {
+		chunker, err := unixfsChunker(content, root)
+		if err != nil {
+			return err
+		}
+
+		build = func(lsys *ipld.LinkSystem, _ storage.WritableStorage) (cid.Cid, error) {
+			link, _, err := builder.BuildUnixFSFile(content, chunker, lsys)
+			if err != nil {
+				return cid.Undef, err
+			}
+			return link.(cidlink.Link).Cid, nil
+		}
+	}
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	f, err := os.Create(carPath)
+	if err != nil {
+		return fmt.Errorf("create car: %s", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	wc, err := carstorage.NewWritable(f, []cid.Cid{root}, car.WriteAsCarV1(true))
+	if err != nil {
+		return fmt.Errorf("new car: %s", err)
+	}
+
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetWriteStorage(wc)
+
+	c, err := build(&lsys, wc)
+	if errors.Is(err, ErrContentMismatch) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("build car: %s", err)
+	}
+	if !c.Equals(root) {
+		return ErrContentMismatch
+	}
+
+	return wc.Finalize()
+}
+
+// unixfsChunker finds the chunker the content was imported with, by
+// rebuilding its UnixFS DAG until the root matches.
+func unixfsChunker(content io.ReadSeeker, root cid.Cid) (string, error) {
+	for _, ch := range unixfsChunkers {
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+
+		lsys := cidlink.DefaultLinkSystem()
+		lsys.SetWriteStorage(discardStorage{})
+		link, _, err := builder.BuildUnixFSFile(content, ch, &lsys)
+		if err != nil {
+			return "", fmt.Errorf("build unixfs file: %s", err)
+		}
+		if link.(cidlink.Link).Cid.Equals(root) {
+			return ch, nil
+		}
+	}
+
+	return "", ErrContentMismatch
+}
+
+// verifyRaw checks that content hashes to the raw CID root.
+func verifyRaw(content io.ReadSeeker, root cid.Cid) error {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	prefix := root.Prefix()
+	h, err := multihash.SumStream(content, prefix.MhType, prefix.MhLength)
+	if err != nil {
+		return fmt.Errorf("hash content: %s", err)
+	}
+	if !bytes.Equal(h, root.Hash()) {
+		return ErrContentMismatch
+	}
+
+	return nil
+}
+
+// discardStorage is a write storage that keeps nothing.
+type discardStorage struct{}
+
+func (discardStorage) Has(context.Context, string) (bool, error) {
+	return false, nil
+}
+
+func (discardStorage) Put(context.Context, string, []byte) error {
+	return nil
+}
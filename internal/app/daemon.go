@@ -0,0 +1,274 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
+	"golang.org/x/exp/slog"
+)
+
+// replayedLSNFile keeps the commit LSN of the last tx replayed by a pipeline, in its db dir.
+const replayedLSNFile = "replayed_lsn"
+
+// StreamPipeline streams the changes of some of the replicated tables to a vault.
+type StreamPipeline struct {
+	vault Vault
+	dbm   *DBManager
+
+	tables map[string]bool
+
+	// lsn is the commit LSN of the last tx replayed by the pipeline.
+	lsn pglogrepl.LSN
+
+	// err is set once the pipeline fails. It is not fed after that.
+	err error
+
+	// started is set once the pipeline's db is open.
+	started bool
+}
+
+// NewStreamPipeline creates a pipeline that replays the changes of the DBManager's tables.
+func NewStreamPipeline(vault Vault, dbm *DBManager) (*StreamPipeline, error) {
+	lsn, err := readReplayedLSN(dbm.dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("read replayed lsn: %s", err)
+	}
+
+	tables := map[string]bool{}
+	for _, schema := range dbm.schemas {
+		tables[schema.Table] = true
+	}
+
+	return &StreamPipeline{
+		vault:  vault,
+		dbm:    dbm,
+		tables: tables,
+		lsn:    lsn,
+	}, nil
+}
+
+// StreamDaemon fans out the txs of a single replication slot to many vaults,
+// routing each record to the pipelines of its table.
+//
+// A pipeline that fails stops being fed, without affecting the others. The
+// slot is only acked up to the last tx the failed pipelines replayed, so their
+// changes are streamed again after a restart. Pipelines skip the txs they
+// replayed before.
+type StreamDaemon struct {
+	replicator Replicator
+	pipelines  []*StreamPipeline
+	metrics    *StreamMetrics
+
+	acked pglogrepl.LSN
+}
+
+// NewStreamDaemon creates a new StreamDaemon.
+func NewStreamDaemon(r Replicator, pipelines []*StreamPipeline, metrics *StreamMetrics) *StreamDaemon {
+	return &StreamDaemon{
+		replicator: r,
+		pipelines:  pipelines,
+		metrics:    metrics,
+	}
+}
+
+// Run runs the pipelines until the replication stops or all of them fail.
+// The windows a pipeline left behind are uploaded before it starts, and a
+// pipeline that can't upload them fails.
+func (d *StreamDaemon) Run(ctx context.Context) error {
+	for _, p := range d.pipelines {
+		if err := p.dbm.UploadAll(ctx); err != nil {
+			d.fail(p, fmt.Errorf("upload all: %s", err))
+			continue
+		}
+		if err := p.dbm.NewDB(ctx); err != nil {
+			d.fail(p, fmt.Errorf("new db: %s", err))
+			continue
+		}
+		p.started = true
+		d.metrics.up.WithLabelValues(string(p.vault)).Set(1)
+	}
+	defer func() {
+		for _, p := range d.pipelines {
+			if p.started {
+				p.dbm.Close()
+			}
+		}
+	}()
+
+	if d.healthy() == 0 {
+		return errors.New("all pipelines failed")
+	}
+
+	txs, _, err := d.replicator.StartReplication(ctx)
+	if err != nil {
+		return fmt.Errorf("start replication: %s", err)
+	}
+
+	for tx := range txs {
+		slog.Info("new transaction received", "lsn", tx.CommitLSN)
+		for _, p := range d.pipelines {
+			d.replay(ctx, p, tx)
+		}
+
+		if d.healthy() == 0 {
+			return errors.New("all pipelines failed")
+		}
+
+		if err := d.commit(ctx, tx.CommitLSN); err != nil {
+			return fmt.Errorf("commit: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// replay replays the records of the pipeline's tables in tx.
+func (d *StreamDaemon) replay(ctx context.Context, p *StreamPipeline, tx *pgrepl.Tx) {
+	if p.err != nil || tx.CommitLSN <= p.lsn {
+		return
+	}
+
+	records := []pgrepl.Record{}
+	for _, r := range tx.Records {
+		if p.tables[r.Table] {
+			records = append(records, r)
+		}
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	if err := p.dbm.Replay(ctx, &pgrepl.Tx{CommitLSN: tx.CommitLSN, Records: records}); err != nil {
+		d.fail(p, fmt.Errorf("replay: %s", err))
+		return
+	}
+	if err := writeReplayedLSN(p.dbm.dbDir, tx.CommitLSN); err != nil {
+		d.fail(p, fmt.Errorf("write replayed lsn: %s", err))
+		return
+	}
+	p.lsn = tx.CommitLSN
+
+	d.metrics.txs.WithLabelValues(string(p.vault)).Inc()
+	d.metrics.records.WithLabelValues(string(p.vault)).Add(float64(len(records)))
+	d.metrics.lsn.WithLabelValues(string(p.vault)).Set(float64(p.lsn))
+}
+
+// commit acks the slot up to lsn, or up to the oldest tx replayed by a failed pipeline.
+func (d *StreamDaemon) commit(ctx context.Context, lsn pglogrepl.LSN) error {
+	for _, p := range d.pipelines {
+		if p.err != nil && p.lsn < lsn {
+			lsn = p.lsn
+		}
+	}
+	if lsn <= d.acked {
+		return nil
+	}
+
+	if err := d.replicator.Commit(ctx, lsn); err != nil {
+		return err
+	}
+	d.acked = lsn
+	d.metrics.acked.Set(float64(lsn))
+	slog.Info("transaction acked", "lsn", lsn)
+
+	return nil
+}
+
+func (d *StreamDaemon) fail(p *StreamPipeline, err error) {
+	p.err = err
+	d.metrics.up.WithLabelValues(string(p.vault)).Set(0)
+	d.metrics.errors.WithLabelValues(string(p.vault)).Inc()
+	slog.Error(
+		"pipeline failed, the replication slot is held back until it is restarted",
+		"vault", p.vault, "lsn", p.lsn, "error", err,
+	)
+}
+
+func (d *StreamDaemon) healthy() int {
+	n := 0
+	for _, p := range d.pipelines {
+		if p.err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func readReplayedLSN(dir string) (pglogrepl.LSN, error) {
+	buf, err := os.ReadFile(path.Join(dir, replayedLSNFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return pglogrepl.ParseLSN(strings.TrimSpace(string(buf)))
+}
+
+func writeReplayedLSN(dir string, lsn pglogrepl.LSN) error {
+	tmp := path.Join(dir, replayedLSNFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(lsn.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, replayedLSNFile))
+}
+
+// StreamMetrics are the Prometheus metrics of a StreamDaemon.
+type StreamMetrics struct {
+	registry *prometheus.Registry
+
+	txs     *prometheus.CounterVec
+	records *prometheus.CounterVec
+	errors  *prometheus.CounterVec
+	up      *prometheus.GaugeVec
+	lsn     *prometheus.GaugeVec
+	acked   prometheus.Gauge
+}
+
+// NewStreamMetrics creates the metrics in their own registry.
+func NewStreamMetrics() *StreamMetrics {
+	m := &StreamMetrics{
+		registry: prometheus.NewRegistry(),
+		txs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vaults_stream_transactions_total",
+			Help: "Transactions replayed by the pipeline of a vault.",
+		}, []string{"vault"}),
+		records: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vaults_stream_records_total",
+			Help: "WAL records replayed by the pipeline of a vault.",
+		}, []string{"vault"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vaults_stream_errors_total",
+			Help: "Failures of the pipeline of a vault.",
+		}, []string{"vault"}),
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "vaults_stream_pipeline_up",
+			Help: "Whether the pipeline of a vault is running.",
+		}, []string{"vault"}),
+		lsn: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "vaults_stream_replayed_lsn",
+			Help: "Commit LSN of the last transaction replayed by the pipeline of a vault.",
+		}, []string{"vault"}),
+		acked: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "vaults_stream_acked_lsn",
+			Help: "LSN acked to the replication slot.",
+		}),
+	}
+	m.registry.MustRegister(m.txs, m.records, m.errors, m.up, m.lsn, m.acked)
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *StreamMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,182 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/require"
+	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
+)
+
+func TestStreamDaemonRoutesTables(t *testing.T) {
+	a, b := daemonPipeline(t, "a.t", "t"), daemonPipeline(t, "b.u", "u")
+	r := newCommitRecorderMock(
+		&pgrepl.Tx{CommitLSN: 100, Records: []pgrepl.Record{
+			walRecord("I", "t", nil, `1`, `"a"`),
+			walRecord("I", "u", nil, `1`, `"b"`),
+		}},
+		&pgrepl.Tx{CommitLSN: 200, Records: []pgrepl.Record{
+			walRecord("I", "u", nil, `2`, `"c"`),
+		}},
+	)
+
+	d := NewStreamDaemon(r, []*StreamPipeline{a, b}, NewStreamMetrics())
+	require.NoError(t, d.Run(context.Background()))
+
+	require.Equal(t, []pglogrepl.LSN{100, 200}, r.commits)
+	require.Equal(t, 1, countRows(t, a, "t"))
+	require.Equal(t, 2, countRows(t, b, "u"))
+
+	// the replayed lsn of each pipeline is kept
+	lsn, err := readReplayedLSN(a.dbm.dbDir)
+	require.NoError(t, err)
+	require.Equal(t, pglogrepl.LSN(100), lsn)
+	lsn, err = readReplayedLSN(b.dbm.dbDir)
+	require.NoError(t, err)
+	require.Equal(t, pglogrepl.LSN(200), lsn)
+}
+
+func TestStreamDaemonIsolatesFailures(t *testing.T) {
+	a, b := daemonPipeline(t, "a.t", "t"), daemonPipeline(t, "b.u", "u")
+	r := newCommitRecorderMock(
+		&pgrepl.Tx{CommitLSN: 100, Records: []pgrepl.Record{
+			walRecord("I", "t", nil, `1`, `"a"`),
+			walRecord("I", "u", nil, `1`, `"b"`),
+		}},
+		// an unsupported change, b fails
+		&pgrepl.Tx{CommitLSN: 200, Records: []pgrepl.Record{
+			walRecord("T", "u", nil),
+		}},
+		&pgrepl.Tx{CommitLSN: 300, Records: []pgrepl.Record{
+			walRecord("I", "t", nil, `2`, `"c"`),
+			walRecord("I", "u", nil, `3`, `"d"`),
+		}},
+	)
+
+	metrics := NewStreamMetrics()
+	d := NewStreamDaemon(r, []*StreamPipeline{a, b}, metrics)
+	require.NoError(t, d.Run(context.Background()))
+
+	require.NoError(t, a.err)
+	require.Error(t, b.err)
+	require.Equal(t, 2, countRows(t, a, "t"))
+	require.Equal(t, 1, countRows(t, b, "u"))
+
+	// the slot is held back at the last tx replayed by b
+	require.Equal(t, []pglogrepl.LSN{100}, r.commits)
+
+	// after a restart, a skips the txs it replayed
+	a, err := NewStreamPipeline("a.t", NewDBManager(a.dbm.dbDir, a.dbm.schemas, time.Hour, a.dbm.uploader))
+	require.NoError(t, err)
+	require.Equal(t, pglogrepl.LSN(300), a.lsn)
+	r = newCommitRecorderMock(&pgrepl.Tx{CommitLSN: 300, Records: []pgrepl.Record{
+		walRecord("I", "t", nil, `2`, `"c"`),
+	}})
+	require.NoError(t, NewStreamDaemon(r, []*StreamPipeline{a}, metrics).Run(context.Background()))
+	require.NoError(t, a.err)
+	// the restarted pipeline has a new db, and the tx was not replayed into it
+	require.Equal(t, 0, countRows(t, a, "t"))
+	require.Equal(t, []pglogrepl.LSN{300}, r.commits)
+}
+
+func TestStreamDaemonFailsPipelinesThatCannotUpload(t *testing.T) {
+	a, b := daemonPipeline(t, "a.t", "t"), daemonPipeline(t, "b.u", "u")
+	// a window of b that can't be exported
+	require.NoError(t, os.WriteFile(path.Join(b.dbm.dbDir, "1.db"), []byte("not a db"), 0o644))
+	r := newCommitRecorderMock(
+		&pgrepl.Tx{CommitLSN: 100, Records: []pgrepl.Record{
+			walRecord("I", "t", nil, `1`, `"a"`),
+			walRecord("I", "u", nil, `1`, `"b"`),
+		}},
+	)
+
+	d := NewStreamDaemon(r, []*StreamPipeline{a, b}, NewStreamMetrics())
+	require.NoError(t, d.Run(context.Background()))
+
+	require.NoError(t, a.err)
+	require.ErrorContains(t, b.err, "upload all")
+	require.Equal(t, 1, countRows(t, a, "t"))
+
+	// b never replayed a tx, so the slot is not acked
+	require.Empty(t, r.commits)
+}
+
+func daemonPipeline(t *testing.T, vault Vault, table string) *StreamPipeline {
+	t.Helper()
+
+	privateKey, err := crypto.HexToECDSA(pk)
+	require.NoError(t, err)
+	uploader := NewVaultsUploader(testNS, table, &countingProviderMock{}, privateKey)
+	dbm := NewDBManager(t.TempDir(), []TableSchema{{table, cols}}, time.Hour, uploader)
+	p, err := NewStreamPipeline(vault, dbm)
+	require.NoError(t, err)
+	return p
+}
+
+// countRows counts the rows in the current db of a pipeline.
+func countRows(t *testing.T, p *StreamPipeline, table string) int {
+	t.Helper()
+
+	db, err := sql.Open("duckdb", path.Join(p.dbm.dbDir, p.dbm.dbFname))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	var n int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM "+table).Scan(&n))
+	return n
+}
+
+// commitRecorderMock feeds the given txs and records the commits.
+type commitRecorderMock struct {
+	feed    chan *pgrepl.Tx
+	commits []pglogrepl.LSN
+}
+
+var _ Replicator = (*commitRecorderMock)(nil)
+
+func newCommitRecorderMock(txs ...*pgrepl.Tx) *commitRecorderMock {
+	feed := make(chan *pgrepl.Tx, len(txs))
+	for _, tx := range txs {
+		feed <- tx
+	}
+	close(feed)
+
+	return &commitRecorderMock{feed: feed}
+}
+
+func (rm *commitRecorderMock) StartReplication(_ context.Context) (chan *pgrepl.Tx, []string, error) {
+	return rm.feed, []string{}, nil
+}
+
+func (rm *commitRecorderMock) Commit(_ context.Context, lsn pglogrepl.LSN) error {
+	rm.commits = append(rm.commits, lsn)
+	return nil
+}
+
+func (rm *commitRecorderMock) Shutdown() {}
+
+func TestReplayedLSNFile(t *testing.T) {
+	dir := t.TempDir()
+
+	lsn, err := readReplayedLSN(dir)
+	require.NoError(t, err)
+	require.Equal(t, pglogrepl.LSN(0), lsn)
+
+	require.NoError(t, writeReplayedLSN(dir, 957398296))
+	lsn, err = readReplayedLSN(dir)
+	require.NoError(t, err)
+	require.Equal(t, pglogrepl.LSN(957398296), lsn)
+	require.NoFileExists(t, path.Join(dir, replayedLSNFile+".tmp"))
+
+	require.NoError(t, os.WriteFile(path.Join(dir, replayedLSNFile), []byte("nope"), 0o644))
+	_, err = readReplayedLSN(dir)
+	require.Error(t, err)
+}
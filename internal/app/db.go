@@ -13,21 +13,26 @@ import (
 	"sync"
 	"time"
 
+	"github.com/jackc/pglogrepl"
 	_ "github.com/marcboeker/go-duckdb" // register duckdb driver
+	"github.com/tablelandnetwork/basin-cli/pkg/ecmh"
 	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
 	"golang.org/x/exp/slog"
 )
 
 // Column represents a column in a table being replicated.
 type Column struct {
-	Name, Typ         string
-	IsNull, IsPrimary bool
+	Name      string `json:"name"`
+	Typ       string `json:"type"`
+	IsNull    bool   `json:"nullable"`
+	IsPrimary bool   `json:"primary"`
 }
 
 // DBManager manages a duckdb database.
 type DBManager struct {
 	// deps
 	uploader *VaultsUploader
+	ledger   *Ledger
 
 	// db attrs
 	db      *sql.DB
@@ -35,8 +40,15 @@ type DBManager struct {
 	dbFname string
 	schemas []TableSchema
 
+	// running digests of the replicated tables
+	digests tableDigests
+
+	// WAL range of the current window
+	window WindowRange
+
 	// configs
 	windowInterval time.Duration
+	manualRotation bool
 
 	// lock
 	mu sync.Mutex
@@ -47,8 +59,57 @@ type DBManager struct {
 
 // TableSchema represents a table and its schema.
 type TableSchema struct {
-	Table   string
-	Columns []Column
+	Table   string   `json:"table"`
+	Columns []Column `json:"columns"`
+}
+
+// PrimaryKeyMetadataKey is the Parquet key-value metadata entry that records
+// the comma separated primary key columns of an exported table.
+const PrimaryKeyMetadataKey = "vaults.primary_key"
+
+// FormatMetadataKey is the Parquet key-value metadata entry that records the
+// version of the layout of an exported table. Files without it are version 1,
+// where each row is an inserted row. Since version 2, each row is a change,
+// with its kind in OpColumn and its LSN in LSNColumn.
+const FormatMetadataKey = "vaults.format"
+
+// FormatVersion is the version of the layout of the exported tables.
+const FormatVersion = "2"
+
+// PrimaryKey returns the names of the primary key columns.
+func (ts TableSchema) PrimaryKey() []string {
+	pks := []string{}
+	for _, c := range ts.Columns {
+		if c.IsPrimary {
+			pks = append(pks, c.Name)
+		}
+	}
+	return pks
+}
+
+// kvMetadata returns the KV_METADATA option of the table's Parquet export.
+// The format version is only recorded for change logs, since windows
+// created before them hold the inserted rows.
+func (ts TableSchema) kvMetadata(digests tableDigests, window WindowRange, changeLog bool) string {
+	entries := []string{fmt.Sprintf("'%s': '%s'", TableMetadataKey, ts.Table)}
+	if changeLog {
+		entries = append(entries, fmt.Sprintf("'%s': '%s'", FormatMetadataKey, FormatVersion))
+	}
+	if pks := ts.PrimaryKey(); len(pks) > 0 {
+		entries = append(entries, fmt.Sprintf("'%s': '%s'", PrimaryKeyMetadataKey, strings.Join(pks, ",")))
+	}
+	if h := digests[ts.Table]; h != nil {
+		entries = append(entries, fmt.Sprintf("'%s': '%s'", DigestMetadataKey, h.String()))
+	}
+	windowEntries := window.Metadata()
+	for _, key := range []string{
+		StartLSNMetadataKey, EndLSNMetadataKey, MinCommitTimeMetadataKey, MaxCommitTimeMetadataKey, TxCountMetadataKey,
+	} {
+		if v, ok := windowEntries[key]; ok {
+			entries = append(entries, fmt.Sprintf("'%s': '%s'", key, v))
+		}
+	}
+	return fmt.Sprintf(", KV_METADATA {%s}", strings.Join(entries, ", "))
 }
 
 // NewDBManager creates a new DBManager.
@@ -60,9 +121,38 @@ func NewDBManager(
 		schemas:        schemas,
 		windowInterval: windowInterval,
 		uploader:       uploader,
+		digests:        tableDigests{},
 	}
 }
 
+// EnableLedger makes the uploaded files be recorded in the ledger.
+func (dbm *DBManager) EnableLedger(ledger *Ledger) {
+	dbm.ledger = ledger
+}
+
+// RotateManually makes windows be rotated only by Rotate, instead of
+// every window interval.
+func (dbm *DBManager) RotateManually() {
+	dbm.manualRotation = true
+}
+
+// Rotate exports and uploads the current window, and starts a new one.
+func (dbm *DBManager) Rotate(ctx context.Context) error {
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+
+	return dbm.replace(ctx)
+}
+
+// ExportedFile is a table of a window exported to a Parquet file.
+type ExportedFile struct {
+	Path    string
+	Table   string
+	Columns []Column
+	Rows    int64
+	Window  WindowRange
+}
+
 // NewDB creates a new duckdb database at the <ts>.db path.
 func (dbm *DBManager) NewDB(ctx context.Context) error {
 	now := time.Now()
@@ -75,13 +165,18 @@ func (dbm *DBManager) NewDB(ctx context.Context) error {
 
 	slog.Info("created new db", "at", dbPath)
 	dbm.db = db
+	dbm.window = WindowRange{}
 
 	if err := dbm.setup(ctx); err != nil {
 		return fmt.Errorf("cannot setup db: %s", err)
 	}
 
-	ticker := time.NewTicker(dbm.windowInterval)
 	dbm.close = make(chan struct{})
+	if dbm.manualRotation {
+		return nil
+	}
+
+	ticker := time.NewTicker(dbm.windowInterval)
 
 	go func() {
 		for {
@@ -116,17 +211,72 @@ func (dbm *DBManager) Replay(ctx context.Context, tx *pgrepl.Tx) error {
 		return err
 	}
 
+	digests, err := dbm.digests.apply(tx, dbm.schemas)
+	if err != nil {
+		return err
+	}
+	window, err := dbm.window.apply(tx)
+	if err != nil {
+		return err
+	}
+
+	dbTx, err := dbm.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %s", err)
+	}
+	defer func() {
+		_ = dbTx.Rollback()
+	}()
+
 	slog.Info("replaying", "query", query)
-	_, err = dbm.db.ExecContext(ctx, query)
+	_, err = dbTx.ExecContext(ctx, query)
 	if err != nil {
 		return fmt.Errorf("cannot replay WAL record: %v", err)
 	}
 
+	if err := digests.save(ctx, dbTx); err != nil {
+		return err
+	}
+	if err := window.save(ctx, dbTx); err != nil {
+		return err
+	}
+
+	if err := dbTx.Commit(); err != nil {
+		return fmt.Errorf("commit: %s", err)
+	}
+	dbm.digests = digests
+	dbm.window = window
+
+	return nil
+}
+
+// StartDigest starts an empty digest for the table, before its rows are
+// loaded from a snapshot.
+func (dbm *DBManager) StartDigest(ctx context.Context, table string) error {
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+
+	h := ecmh.NewMultisetHash()
+	dbTx, err := dbm.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %s", err)
+	}
+	defer func() {
+		_ = dbTx.Rollback()
+	}()
+	if err := (tableDigests{table: h}).save(ctx, dbTx); err != nil {
+		return err
+	}
+	if err := dbTx.Commit(); err != nil {
+		return fmt.Errorf("commit: %s", err)
+	}
+	dbm.digests[table] = h
+
 	return nil
 }
 
 // Export exports the current db to a parquet file at the given path.
-func (dbm *DBManager) Export(ctx context.Context, exportPath string) ([]string, error) {
+func (dbm *DBManager) Export(ctx context.Context, exportPath string) ([]ExportedFile, error) {
 	var err error
 	db := dbm.db
 	// db is nil before replication starts.
@@ -139,7 +289,7 @@ func (dbm *DBManager) Export(ctx context.Context, exportPath string) ([]string,
 		dbPath := strings.ReplaceAll(exportPath, ".parquet", "")
 		db, err = sql.Open("duckdb", dbPath)
 		if err != nil {
-			return []string{}, err
+			return []ExportedFile{}, err
 		}
 		defer func() {
 			if err := db.Close(); err != nil {
@@ -151,40 +301,65 @@ func (dbm *DBManager) Export(ctx context.Context, exportPath string) ([]string,
 		slog.Info("backing up current db")
 	}
 
-	exportedFiles := []string{}
+	digests, err := readDigests(ctx, db)
+	if err != nil {
+		return []ExportedFile{}, err
+	}
+
+	window, err := readWindowRange(ctx, db)
+	if err != nil {
+		return []ExportedFile{}, err
+	}
+
+	exportedFiles := []ExportedFile{}
 	for _, schema := range dbm.schemas {
 		var n int
 		if err := db.QueryRowContext(
 			ctx,
 			fmt.Sprintf("select count(1) from %s LIMIT 1", schema.Table),
 		).Scan(&n); err != nil {
-			return []string{}, fmt.Errorf("querying row count: %s", err)
+			return []ExportedFile{}, fmt.Errorf("querying row count: %s", err)
 		}
 
 		if n == 0 {
 			continue
 		}
 
+		var changeLog bool
+		if err := db.QueryRowContext(ctx,
+			"SELECT count(*) > 0 FROM information_schema.columns WHERE table_name = ? AND column_name = ?",
+			schema.Table, OpColumn,
+		).Scan(&changeLog); err != nil {
+			return []ExportedFile{}, fmt.Errorf("querying columns: %s", err)
+		}
+
 		exportedFileName := strings.Replace(exportPath, dbm.dbFname, fmt.Sprintf("%s-%s", schema.Table, dbm.dbFname), -1)
-		exportedFiles = append(exportedFiles, exportedFileName)
+		exportedFiles = append(exportedFiles, ExportedFile{
+			Path:    exportedFileName,
+			Table:   schema.Table,
+			Columns: schema.Columns,
+			Rows:    int64(n),
+			Window:  window,
+		})
 		_, err = db.ExecContext(ctx,
 			fmt.Sprintf(
 				`INSTALL parquet;
 				 LOAD parquet;
-				 COPY (SELECT * FROM %s) TO '%s' (FORMAT PARQUET)`,
-				schema.Table, exportedFileName))
+				 COPY (SELECT * FROM %s) TO '%s' (FORMAT PARQUET%s)`,
+				schema.Table, exportedFileName, schema.kvMetadata(digests, window, changeLog)))
 		if err != nil {
-			return []string{}, fmt.Errorf("cannot export to parquet file: %s", err)
+			return []ExportedFile{}, fmt.Errorf("cannot export to parquet file: %s", err)
 		}
 	}
 
 	return exportedFiles, nil
 }
 
-// UploadAt uploads a db dump at the given path.
+// UploadAt uploads an exported file.
 // It returns an error if a dumps cannot be uploaded.
 // It cleans up the db dumps and export files after uploading.
-func (dbm *DBManager) UploadAt(ctx context.Context, exportPath string) error {
+func (dbm *DBManager) UploadAt(ctx context.Context, file ExportedFile) error {
+	exportPath := file.Path
 	f, err := os.Open(exportPath)
 	if err != nil {
 		return fmt.Errorf("cannot open file: %s", err)
@@ -196,10 +371,18 @@ func (dbm *DBManager) UploadAt(ctx context.Context, exportPath string) error {
 	}
 
 	ts := NewTimestamp(time.Now().UTC())
-	if err := dbm.uploader.Upload(ctx, exportPath, io.Discard, ts, fi.Size()); err != nil {
+	res, err := dbm.uploader.UploadExport(ctx, file, io.Discard, ts, fi.Size())
+	if err != nil {
 		return fmt.Errorf("upload: %s", err)
 	}
 
+	if dbm.ledger != nil {
+		if err := dbm.record(ctx, file, fi.Size(), ts, res); err != nil {
+			// the file is in the vault, the ledger is only missing it
+			slog.Error("cannot record upload in the ledger", "file", exportPath, "error", err)
+		}
+	}
+
 	// cleanup the exported parquet file
 	slog.Info("deleting db parquet export", "at", exportPath)
 	if err := os.Remove(exportPath); err != nil {
@@ -211,6 +394,28 @@ func (dbm *DBManager) UploadAt(ctx context.Context, exportPath string) error {
 	return nil
 }
 
+func (dbm *DBManager) record(
+	ctx context.Context, file ExportedFile, size int64, ts Timestamp, res UploadResult,
+) error {
+	hash, err := HashFile(file.Path)
+	if err != nil {
+		return err
+	}
+
+	return dbm.ledger.Record(ctx, LedgerEntry{
+		Vault:      dbm.uploader.Vault(),
+		FileHash:   hash,
+		Filename:   path.Base(file.Path),
+		Size:       size,
+		Timestamp:  ts.Seconds(),
+		UploadedAt: time.Now().UTC(),
+		CID:        res.Event.CID,
+		Signature:  res.Signature,
+		Tables:     []string{file.Table},
+		Window:     file.Window,
+	})
+}
+
 // UploadAll uploads all db dumps in the db dir.
 func (dbm *DBManager) UploadAll(ctx context.Context) error {
 	files, err := os.ReadDir(dbm.dbDir)
@@ -224,6 +429,12 @@ func (dbm *DBManager) UploadAll(ctx context.Context) error {
 		fname := file.Name()
 		if re.MatchString(fname) {
 			dbPath := path.Join(dbm.dbDir, fname)
+
+			// the running digests carry on from the last window
+			if err := dbm.loadDigests(ctx, dbPath); err != nil {
+				return fmt.Errorf("load digests: %s", err)
+			}
+
 			exportAt := dbPath + ".parquet"
 			files, err := dbm.Export(ctx, exportAt)
 			if err != nil {
@@ -245,50 +456,169 @@ func (dbm *DBManager) UploadAll(ctx context.Context) error {
 	return nil
 }
 
+// loadDigests loads the running digests kept in a db.
+func (dbm *DBManager) loadDigests(ctx context.Context, dbPath string) error {
+	db, err := sql.Open("duckdb", dbPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	digests, err := readDigests(ctx, db)
+	if err != nil {
+		return err
+	}
+	for table, h := range digests {
+		dbm.digests[table] = h
+	}
+
+	return nil
+}
+
 // Close closes the current db.
 func (dbm *DBManager) Close() {
 	close(dbm.close)
 	_ = dbm.db.Close()
 }
 
-// queryFromWAL creates a query for a WAL TX records.
+// queryFromWAL creates a query for a WAL TX records. Each record is added to
+// the change log of its table, with its action in the _op column and its
+// LSN in the _lsn column. Deleted rows only have their identity columns,
+// and an update that changes the primary key also deletes the old key.
 func (dbm *DBManager) queryFromWAL(tx *pgrepl.Tx) (string, error) {
-	var columnValsStr string
-
 	// build an insert stmt for each record inside tx
 	stmts := []string{}
 	for _, r := range tx.Records {
-		cols := []string{}
-		for _, c := range r.Columns {
-			cols = append(cols, c.Name)
+		lsn, err := recordLSN(tx, r)
+		if err != nil {
+			return "", err
 		}
 
-		columnVals := []string{}
-		for _, c := range r.Columns {
-			ddbType, err := dbm.pgToDDBType(c.Type)
+		switch r.Action {
+		case "I":
+			stmt, err := dbm.changeStmt(r.Table, "I", r.Columns, lsn)
 			if err != nil {
 				return "", err
 			}
-			columnVal := ddbType.transformFn(string(c.Value))
-			columnVals = append(columnVals, columnVal)
+			stmts = append(stmts, stmt)
+		case "U":
+			if dbm.keyChanged(r) {
+				stmt, err := dbm.changeStmt(r.Table, "D", r.Identity, lsn)
+				if err != nil {
+					return "", err
+				}
+				stmts = append(stmts, stmt)
+			}
+			stmt, err := dbm.changeStmt(r.Table, "U", r.Columns, lsn)
+			if err != nil {
+				return "", err
+			}
+			stmts = append(stmts, stmt)
+		case "D":
+			if len(r.Identity) == 0 {
+				slog.Warn(
+					"deleted row has no identity and can't be replicated; "+
+						"set a REPLICA IDENTITY on the table to replicate deletes",
+					"table", r.Table,
+				)
+				continue
+			}
+			stmt, err := dbm.changeStmt(r.Table, "D", r.Identity, lsn)
+			if err != nil {
+				return "", err
+			}
+			stmts = append(stmts, stmt)
+		default:
+			return "", fmt.Errorf("unsupported action: %s", r.Action)
 		}
-		columnValsStr = strings.Join(columnVals, ", ")
-		recordVals := fmt.Sprintf("(%s)", columnValsStr)
+	}
 
-		stmt := fmt.Sprintf(
-			"insert into %s (%s) values %s",
-			r.Table,
-			strings.Join(cols, ", "),
-			recordVals,
-		)
+	return strings.Join(stmts, ";"), nil
+}
 
-		stmts = append(stmts, stmt)
+// changeStmt creates the insert stmt of a change into a table's change log.
+func (dbm *DBManager) changeStmt(table string, op string, columns []pgrepl.Column, lsn string) (string, error) {
+	cols := []string{}
+	columnVals := []string{}
+	for _, c := range columns {
+		ddbType, err := dbm.pgToDDBType(c.Type)
+		if err != nil {
+			return "", err
+		}
+		cols = append(cols, c.Name)
+		columnVals = append(columnVals, ddbType.transformFn(string(c.Value)))
 	}
+	cols = append(cols, OpColumn, LSNColumn)
+	columnVals = append(columnVals, fmt.Sprintf("'%s'", op), lsn)
+
+	return fmt.Sprintf(
+		"insert into %s (%s) values (%s)",
+		table,
+		strings.Join(cols, ", "),
+		strings.Join(columnVals, ", "),
+	), nil
+}
 
-	return strings.Join(stmts, ";"), nil
+// keyChanged reports whether an update changed the primary key of the row.
+func (dbm *DBManager) keyChanged(r pgrepl.Record) bool {
+	old := map[string]string{}
+	for _, c := range r.Identity {
+		old[c.Name] = string(c.Value)
+	}
+	if len(old) == 0 {
+		return false
+	}
+
+	for _, schema := range dbm.schemas {
+		if schema.Table != r.Table {
+			continue
+		}
+		for _, k := range schema.PrimaryKey() {
+			for _, c := range r.Columns {
+				if v, ok := old[k]; ok && c.Name == k && v != string(c.Value) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// recordLSN returns the _lsn value of a record: its own LSN, or the commit
+// LSN of its tx if it has none. It is null for snapshot batches.
+func recordLSN(tx *pgrepl.Tx, r pgrepl.Record) (string, error) {
+	lsn := tx.CommitLSN
+	if r.Lsn != "" {
+		var err error
+		if lsn, err = pglogrepl.ParseLSN(r.Lsn); err != nil {
+			return "", fmt.Errorf("invalid record lsn: %s", err)
+		}
+	}
+	if lsn == 0 {
+		return "null", nil
+	}
+
+	return fmt.Sprint(uint64(lsn)), nil
 }
 
 func (dbm *DBManager) replace(ctx context.Context) error {
+	if err := dbm.flush(ctx); err != nil {
+		return err
+	}
+
+	// Create a new db
+	if err := dbm.NewDB(ctx); err != nil {
+		return fmt.Errorf("new db: %v", err)
+	}
+
+	return nil
+}
+
+// flush exports, uploads and removes the current db, leaving none in its place.
+func (dbm *DBManager) flush(ctx context.Context) error {
 	// Export current db to a parquet file at a given path
 	exportAt := path.Join(dbm.dbDir, dbm.dbFname) + ".parquet"
 	files, err := dbm.Export(ctx, exportAt)
@@ -313,11 +643,6 @@ func (dbm *DBManager) replace(ctx context.Context) error {
 		return fmt.Errorf("cleanup: %s", err)
 	}
 
-	// Create a new db
-	if err := dbm.NewDB(ctx); err != nil {
-		return fmt.Errorf("new db: %v", err)
-	}
-
 	return nil
 }
 
@@ -335,11 +660,46 @@ func (dbm *DBManager) setup(ctx context.Context) error {
 		return err
 	}
 
-	return nil
+	if _, err := dbm.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (table_name varchar PRIMARY KEY, digest varchar)", digestsTable,
+	)); err != nil {
+		return err
+	}
+
+	if _, err := dbm.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s "+
+			"(start_lsn varchar, end_lsn varchar, txs bigint, min_commit_time varchar, max_commit_time varchar)",
+		windowTable,
+	)); err != nil {
+		return err
+	}
+
+	tx, err := dbm.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if err := dbm.digests.save(ctx, tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // pgToDDBType maps a PG type to a duckdb type.
 func (dbm *DBManager) pgToDDBType(typ string) (duckdbType, error) {
+	return pgToDDBType(typ)
+}
+
+// SupportsPostgresType reports whether columns of the Postgres type can be replicated.
+func SupportsPostgresType(typ string) bool {
+	_, err := pgToDDBType(typ)
+	return err == nil
+}
+
+func pgToDDBType(typ string) (duckdbType, error) {
 	// handle character(N), character varying(N), numeric(N, M)
 	if strings.HasSuffix(typ, ")") {
 		typ = strings.Split(typ, "(")[0]
@@ -358,43 +718,29 @@ func (dbm *DBManager) pgToDDBType(typ string) (duckdbType, error) {
 	return ddbType, nil
 }
 
+// genCreateQuery creates the change logs of the replicated tables. They have
+// no constraints, as they keep every change of a row in the window, and
+// deleted rows only have their identity columns.
 func (dbm *DBManager) genCreateQuery() (string, error) {
 	stmts := []string{}
 	for _, schema := range dbm.schemas {
-		var cols, pks string
-		for i, column := range schema.Columns {
+		if len(schema.Columns) == 0 {
+			return "", errors.New("schema must have at least one column")
+		}
+
+		cols := []string{}
+		for _, column := range schema.Columns {
 			ddbType, err := dbm.pgToDDBType(column.Typ)
 			if err != nil {
 				return "", err
 			}
-			col := fmt.Sprintf("%s %s", column.Name, ddbType.typeName)
-			if !column.IsNull {
-				col = fmt.Sprintf("%s NOT NULL", col)
-			}
-			if i == 0 {
-				cols = col
-				if column.IsPrimary {
-					pks = column.Name
-				}
-			} else {
-				cols = fmt.Sprintf("%s,%s", cols, col)
-				if column.IsPrimary {
-					pks = fmt.Sprintf("%s,%s", pks, column.Name)
-				}
-			}
-		}
-
-		if pks != "" {
-			cols = fmt.Sprintf("%s,PRIMARY KEY (%s)", cols, pks)
-		}
-
-		if cols == "" {
-			return "", errors.New("schema must have at least one column")
+			cols = append(cols, fmt.Sprintf("%s %s", column.Name, ddbType.typeName))
 		}
+		cols = append(cols, fmt.Sprintf("%s varchar NOT NULL", OpColumn), fmt.Sprintf("%s ubigint", LSNColumn))
 
 		stmt := fmt.Sprintf(
 			"CREATE TABLE IF NOT EXISTS %s (%s)",
-			schema.Table, cols)
+			schema.Table, strings.Join(cols, ","))
 		stmts = append(stmts, stmt)
 	}
 
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"path"
 	"strings"
 	"testing"
 	"time"
@@ -30,7 +31,9 @@ func TestGenCreateQuery(t *testing.T) {
 					float_col float,
 					double_col double,
 					decimal_col double,
-					udecimal_col double
+					udecimal_col double,
+					_op varchar NOT NULL,
+					_lsn ubigint
 				)`,
 		},
 		{
@@ -46,7 +49,9 @@ func TestGenCreateQuery(t *testing.T) {
 					blob_col blob,
 					json_col_old varchar,
 					json_col_new varchar,
-					uuid_col uuid
+					uuid_col uuid,
+					_op varchar NOT NULL,
+					_lsn ubigint
 				)`,
 		},
 		{
@@ -57,7 +62,9 @@ func TestGenCreateQuery(t *testing.T) {
 					time_col time,
 					timetz_col time with time zone,
 					timestamp_col timestamp,
-					timestamptz_col timestamp with time zone
+					timestamptz_col timestamp with time zone,
+					_op varchar NOT NULL,
+					_lsn ubigint
 				)`,
 		},
 		{
@@ -71,7 +78,9 @@ func TestGenCreateQuery(t *testing.T) {
 					float_col float[],
 					double_col double[],
 					numeric_col integer[],
-					unumeric_col integer[]
+					unumeric_col integer[],
+					_op varchar NOT NULL,
+					_lsn ubigint
 				)`,
 		},
 		{
@@ -85,7 +94,9 @@ func TestGenCreateQuery(t *testing.T) {
 					text_col varchar[],
 					blob_col blob[],
 					json_col varchar[],
-					uuid_col uuid[]
+					uuid_col uuid[],
+					_op varchar NOT NULL,
+					_lsn ubigint
 				)`,
 		},
 		{
@@ -96,14 +107,18 @@ func TestGenCreateQuery(t *testing.T) {
 					time_col time[],
 					timetz_col time with time zone[],
 					timestamp_col timestamp[],
-					timestamptz_col timestamp with time zone[]
+					timestamptz_col timestamp with time zone[],
+					_op varchar NOT NULL,
+					_lsn ubigint
 				)`,
 		},
 		{
 			"mac_addr_types",
 			macaddrTypeCols,
 			`CREATE TABLE IF NOT EXISTS mac_addr_types (
-					macaddr_col varchar
+					macaddr_col varchar,
+					_op varchar NOT NULL,
+					_lsn ubigint
 				)`,
 		},
 	}
@@ -153,6 +168,15 @@ func TestGenCreateQueryUnsupported(t *testing.T) {
 	}
 }
 
+func TestSupportsPostgresType(t *testing.T) {
+	for _, typ := range []string{"integer", "character varying(255)", "numeric(10, 2)", "text[]", "jsonb"} {
+		require.True(t, SupportsPostgresType(typ), typ)
+	}
+	for _, typ := range []string{"USER-DEFINED", "enum_type_foo[]", "tsvector"} {
+		require.False(t, SupportsPostgresType(typ), typ)
+	}
+}
+
 func TestQueryFromWAL(t *testing.T) {
 	testCases := []struct {
 		typ                 string
@@ -163,397 +187,397 @@ func TestQueryFromWAL(t *testing.T) {
 			"boolean",
 			[]string{"true", "false", "null"},
 			[]string{
-				"insert into t (id) values (true)",
-				"insert into t (id) values (false)",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (true, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (false, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"bigint",
 			[]string{"42", "-42", "null"},
 			[]string{
-				"insert into t (id) values (42)",
-				"insert into t (id) values (-42)",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (42, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (-42, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"double precision",
 			[]string{"42.01", "-42.01", "null"},
 			[]string{
-				"insert into t (id) values (42.01)",
-				"insert into t (id) values (-42.01)",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (42.01, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (-42.01, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"integer",
 			[]string{"42", "-42", "null"},
 			[]string{
-				"insert into t (id) values (42)",
-				"insert into t (id) values (-42)",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (42, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (-42, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"numeric(4, 7)",
 			[]string{"42.01", "-42.01", "null"},
 			[]string{
-				"insert into t (id) values (42.01)",
-				"insert into t (id) values (-42.01)",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (42.01, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (-42.01, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"real",
 			[]string{"42.01", "-42.01", "null"},
 			[]string{
-				"insert into t (id) values (42.01)",
-				"insert into t (id) values (-42.01)",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (42.01, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (-42.01, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"smallint",
 			[]string{"42", "-42", "null"},
 			[]string{
-				"insert into t (id) values (42)",
-				"insert into t (id) values (-42)",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (42, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (-42, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"oid",
 			[]string{"42.42", "null"},
 			[]string{
-				"insert into t (id) values (42.42)",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (42.42, 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"macaddr",
 			[]string{"\"08:00:2b:01:02:03\"", "null"},
 			[]string{
-				"insert into t (id) values ('08:00:2b:01:02:03')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('08:00:2b:01:02:03', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"bytea",
 			[]string{"\"00010203\"", "null"},
 			[]string{
-				"insert into t (id) values ('00010203')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('00010203', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"bpchar",
 			[]string{"\"a\"", "\"Z\"", "null"},
 			[]string{
-				"insert into t (id) values ('a')",
-				"insert into t (id) values ('Z')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('a', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values ('Z', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			`\"char\"`,
 			[]string{"\"a\"", "\"Z\"", "null"},
 			[]string{
-				"insert into t (id) values ('a')",
-				"insert into t (id) values ('Z')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('a', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values ('Z', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"character(1)",
 			[]string{"\"a\"", "\"Z\"", "null"},
 			[]string{
-				"insert into t (id) values ('a')",
-				"insert into t (id) values ('Z')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('a', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values ('Z', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"character(5)",
 			[]string{"\"aaaaa\"", "\"ZZZZZ\"", "null"},
 			[]string{
-				"insert into t (id) values ('aaaaa')",
-				"insert into t (id) values ('ZZZZZ')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('aaaaa', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values ('ZZZZZ', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"character varying",
 			[]string{"\"a\"", "\"Zzzzzzzz\"", "null"},
 			[]string{
-				"insert into t (id) values ('a')",
-				"insert into t (id) values ('Zzzzzzzz')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('a', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values ('Zzzzzzzz', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"character varying(5)",
 			[]string{"\"aaaaa\"", "\"ZZZZZ\"", "null"},
 			[]string{
-				"insert into t (id) values ('aaaaa')",
-				"insert into t (id) values ('ZZZZZ')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('aaaaa', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values ('ZZZZZ', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"json",
 			[]string{`"{\"foo\": \"bar\"}"`, `"{\"foo\": {\"bar\": 3}}"`, "null"},
 			[]string{
-				`insert into t (id) values ('{"foo": "bar"}')`,
-				`insert into t (id) values ('{"foo": {"bar": 3}}')`,
-				"insert into t (id) values (null)",
+				`insert into t (id, _op, _lsn) values ('{"foo": "bar"}', 'I', 957397144)`,
+				`insert into t (id, _op, _lsn) values ('{"foo": {"bar": 3}}', 'I', 957397144)`,
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"jsonb",
 			[]string{`"{\"foo\": \"bar\"}"`, `"{\"foo\": {\"bar\": 3}}"`, "null"},
 			[]string{
-				`insert into t (id) values ('{"foo": "bar"}')`,
-				`insert into t (id) values ('{"foo": {"bar": 3}}')`,
-				"insert into t (id) values (null)",
+				`insert into t (id, _op, _lsn) values ('{"foo": "bar"}', 'I', 957397144)`,
+				`insert into t (id, _op, _lsn) values ('{"foo": {"bar": 3}}', 'I', 957397144)`,
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"text",
 			[]string{"\"dpfkg\"", "null"},
 			[]string{
-				"insert into t (id) values ('dpfkg')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('dpfkg', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"uuid",
 			[]string{"\"a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11\"", "null"},
 			[]string{
-				"insert into t (id) values ('a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"date",
 			[]string{"\"2021-03-01\"", "null"},
 			[]string{
-				"insert into t (id) values ('2021-03-01')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('2021-03-01', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"time with time zone",
 			[]string{"\"12:00:00-08\"", "null"},
 			[]string{
-				"insert into t (id) values ('12:00:00-08')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('12:00:00-08', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"time without time zone",
 			[]string{"\"12:45:01\"", "null"},
 			[]string{
-				"insert into t (id) values ('12:45:01')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('12:45:01', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"timestamp with time zone",
 			[]string{"\"2021-03-01 12:45:01+08\"", "null"},
 			[]string{
-				"insert into t (id) values ('2021-03-01 12:45:01+08')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('2021-03-01 12:45:01+08', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"timestamp without time zone",
 			[]string{"\"2021-03-01 12:45:01\"", "null"},
 			[]string{
-				"insert into t (id) values ('2021-03-01 12:45:01')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('2021-03-01 12:45:01', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"interval",
 			[]string{"\"1 year\"", "\"2 mons\"", "\"21 days\"", "\"05:00:00\"", "\"-00:00:07\"", "\"1 year 2 mons 21 days 05:00:00\"", "\"-17 days\"", "null"}, // nolint
 			[]string{
-				"insert into t (id) values ('1 year')",
-				"insert into t (id) values ('2 mons')",
-				"insert into t (id) values ('21 days')",
-				"insert into t (id) values ('05:00:00')",
-				"insert into t (id) values ('-00:00:07')",
-				"insert into t (id) values ('1 year 2 mons 21 days 05:00:00')",
-				"insert into t (id) values ('-17 days')",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values ('1 year', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values ('2 mons', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values ('21 days', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values ('05:00:00', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values ('-00:00:07', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values ('1 year 2 mons 21 days 05:00:00', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values ('-17 days', 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"boolean[]",
 			[]string{`"{t,f,NULL}"`, "null"},
 			[]string{
-				"insert into t (id) values (list_value(true,false,null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value(true,false,null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"bigint[]",
 			[]string{"\"{42,-42,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value(42,-42,null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value(42,-42,null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"double precision[]",
 			[]string{"\"{42.01,-42.01,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value(42.01,-42.01,null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value(42.01,-42.01,null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"integer[]",
 			[]string{"\"{42,-42,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value(42,-42,null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value(42,-42,null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"numeric[]",
 			[]string{"\"{42.01,-42.01,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value(42.01,-42.01,null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value(42.01,-42.01,null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"real[]",
 			[]string{"\"{42.01,-42.01,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value(42.01,-42.01,null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value(42.01,-42.01,null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"smallint[]",
 			[]string{"\"{42,-42,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value(42,-42,null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value(42,-42,null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			`\"char\"[]`,
 			[]string{"\"{a,Z,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value('a','Z',null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value('a','Z',null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"character[]",
 			[]string{"\"{a,Z,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value('a','Z',null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value('a','Z',null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"character varying[]",
 			[]string{"\"{a,Z,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value('a','Z',null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value('a','Z',null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"text[]",
 			[]string{"\"{dpfkg,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value('dpfkg',null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value('dpfkg',null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"bytea[]",
 			[]string{`"{\"\\\\x3030303130323033\",NULL}"`, "null"},
 			[]string{
-				"insert into t (id) values (list_value('3030303130323033'::BLOB,null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value('3030303130323033'::BLOB,null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"json[]",
 			[]string{`"{\"{\\\"key\\\": \\\"value\\\"}\",NULL}"`, "null"},
 			[]string{
-				`insert into t (id) values (list_value('{"key": "value"}',null))`,
-				"insert into t (id) values (null)",
+				`insert into t (id, _op, _lsn) values (list_value('{"key": "value"}',null), 'I', 957397144)`,
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"jsonb[]",
 			[]string{`"{\"{\\\"key\\\": \\\"value\\\"}\",NULL}"`, "null"},
 			[]string{
-				`insert into t (id) values (list_value('{"key": "value"}',null))`,
-				"insert into t (id) values (null)",
+				`insert into t (id, _op, _lsn) values (list_value('{"key": "value"}',null), 'I', 957397144)`,
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"uuid[]",
 			[]string{"\"{a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value('a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11'::UUID,null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value('a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11'::UUID,null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"date[]",
 			[]string{"\"{2021-03-01,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value('2021-03-01',null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value('2021-03-01',null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"time with time zone[]",
 			[]string{"\"{12:45:01+08,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value('12:45:01+08',null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value('12:45:01+08',null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"time without time zone[]",
 			[]string{"\"{12:45:01,NULL}\"", "null"},
 			[]string{
-				"insert into t (id) values (list_value('12:45:01',null))",
-				"insert into t (id) values (null)",
+				"insert into t (id, _op, _lsn) values (list_value('12:45:01',null), 'I', 957397144)",
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"timestamp with time zone[]",
 			[]string{`"{\"2021-03-01 12:45:01+08\",NULL}"`, "null"},
 			[]string{
-				`insert into t (id) values (list_value('2021-03-01 12:45:01+08',null))`,
-				"insert into t (id) values (null)",
+				`insert into t (id, _op, _lsn) values (list_value('2021-03-01 12:45:01+08',null), 'I', 957397144)`,
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"timestamp without time zone[]",
 			[]string{`"{\"2021-03-01 12:45:01\",NULL}"`, "null"},
 			[]string{
-				`insert into t (id) values (list_value('2021-03-01 12:45:01',null))`,
-				"insert into t (id) values (null)",
+				`insert into t (id, _op, _lsn) values (list_value('2021-03-01 12:45:01',null), 'I', 957397144)`,
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 		{
 			"interval[]",
 			[]string{`"{\"1 day\",\"2 mons\",\"21 days\",05:00:00,\"-17 days\",NULL}"`, "null"},
 			[]string{
-				`insert into t (id) values (list_value('1 day','2 mons','21 days','05:00:00','-17 days',null))`,
-				"insert into t (id) values (null)",
+				`insert into t (id, _op, _lsn) values (list_value('1 day','2 mons','21 days','05:00:00','-17 days',null), 'I', 957397144)`,
+				"insert into t (id, _op, _lsn) values (null, 'I', 957397144)",
 			},
 		},
 	}
@@ -674,3 +698,60 @@ func TestReplayUnsupported(t *testing.T) {
 	err = dbm.Replay(ctx, &tx)
 	require.ErrorContains(t, err, errors.New("cannot replay WAL record").Error())
 }
+
+func TestQueryFromWALChanges(t *testing.T) {
+	dbm := NewDBManager(t.TempDir(), []TableSchema{{testTable, cols}}, time.Hour, nil)
+	updated := walRecord("U", testTable, []string{`1`, `"a"`}, `1`, `"b"`)
+	updated.Lsn = "0/C9"
+	query, err := dbm.queryFromWAL(&pgrepl.Tx{CommitLSN: 300, Records: []pgrepl.Record{
+		walRecord("I", testTable, nil, `1`, `"a"`),
+		updated,
+		// the key changed, the old one is deleted
+		walRecord("U", testTable, []string{`1`}, `2`, `"b"`),
+		walRecord("D", testTable, []string{`2`}),
+		// without identity, a delete can't be keyed
+		walRecord("D", testTable, nil),
+	}})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"insert into t (id, name, _op, _lsn) values (1, 'a', 'I', 300)",
+		"insert into t (id, name, _op, _lsn) values (1, 'b', 'U', 201)",
+		"insert into t (id, _op, _lsn) values (1, 'D', 300)",
+		"insert into t (id, name, _op, _lsn) values (2, 'b', 'U', 300)",
+		"insert into t (id, _op, _lsn) values (2, 'D', 300)",
+	}, strings.Split(query, ";"))
+
+	// snapshot batches have no lsn
+	query, err = dbm.queryFromWAL(&pgrepl.Tx{Records: []pgrepl.Record{walRecord("I", testTable, nil, `1`, `"a"`)}})
+	require.NoError(t, err)
+	require.Equal(t, "insert into t (id, name, _op, _lsn) values (1, 'a', 'I', null)", query)
+
+	_, err = dbm.queryFromWAL(&pgrepl.Tx{CommitLSN: 300, Records: []pgrepl.Record{walRecord("T", testTable, nil)}})
+	require.EqualError(t, err, "unsupported action: T")
+}
+
+// exportWindows replays the txs of each window into a window db, like
+// stream does, and returns the Parquet files the windows are exported to.
+func exportWindows(t *testing.T, schema TableSchema, windows ...[]*pgrepl.Tx) []string {
+	t.Helper()
+	ctx := context.Background()
+
+	dbm := NewDBManager(t.TempDir(), []TableSchema{schema}, time.Hour, nil)
+	dbm.RotateManually()
+
+	files := []string{}
+	for _, txs := range windows {
+		require.NoError(t, dbm.NewDB(ctx))
+		for _, tx := range txs {
+			require.NoError(t, dbm.Replay(ctx, tx))
+		}
+
+		exported, err := dbm.Export(ctx, path.Join(dbm.dbDir, dbm.dbFname)+".parquet")
+		require.NoError(t, err)
+		require.Len(t, exported, 1)
+		files = append(files, exported[0].Path)
+		dbm.Close()
+	}
+
+	return files
+}
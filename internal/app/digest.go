@@ -0,0 +1,205 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/tablelandnetwork/basin-cli/pkg/ecmh"
+	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
+	"golang.org/x/exp/slog"
+)
+
+// DigestMetadataKey is the Parquet key-value metadata entry that records the
+// multiset hash of the replicated table's rows at the end of the window.
+const DigestMetadataKey = "vaults.digest"
+
+// digestsTable keeps the running digests in the window's db, so an exported
+// window always carries the digests of the changes it holds.
+const digestsTable = "_vaults_digests"
+
+// EncodeRow returns the canonical encoding of a row, which is hashed into
+// the table's digest. Values are the Postgres text representation of the
+// columns, nil for NULL.
+//
+// Columns are sorted by name. Each one is encoded as the uvarint length of
+// its name, the name, then 0x00 for NULL or 0x01 followed by the uvarint
+// length of the value and the value.
+func EncodeRow(values map[string]*string) []byte {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := []byte{}
+	for _, name := range names {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		v := values[name]
+		if v == nil {
+			buf = append(buf, 0)
+			continue
+		}
+		buf = append(buf, 1)
+		buf = binary.AppendUvarint(buf, uint64(len(*v)))
+		buf = append(buf, *v...)
+	}
+
+	return buf
+}
+
+// walRowValues returns the text values of WAL columns. wal2json writes
+// numbers and booleans as JSON literals and everything else as strings.
+func walRowValues(columns []pgrepl.Column) (map[string]*string, error) {
+	values := make(map[string]*string, len(columns))
+	for _, c := range columns {
+		raw := string(c.Value)
+		switch {
+		case raw == "" || raw == jsonNULL:
+			values[c.Name] = nil
+		case raw[0] == '"':
+			var s string
+			if err := json.Unmarshal(c.Value, &s); err != nil {
+				return nil, fmt.Errorf("decode column %s: %s", c.Name, err)
+			}
+			values[c.Name] = &s
+		default:
+			values[c.Name] = &raw
+		}
+	}
+
+	return values, nil
+}
+
+// tableDigests are the running digests of the replicated tables.
+// A table's digest starts empty when its rows are loaded from a snapshot.
+// A nil digest means it is unknown, because the table was streamed without
+// a snapshot, or a row was updated or deleted without its old values.
+type tableDigests map[string]*ecmh.MultisetHash
+
+// apply returns the digests after the records of tx are applied.
+// The receiver is left unchanged.
+func (d tableDigests) apply(tx *pgrepl.Tx, schemas []TableSchema) (tableDigests, error) {
+	next := make(tableDigests, len(d))
+	for table, h := range d {
+		if h != nil {
+			h = h.Clone()
+		}
+		next[table] = h
+	}
+
+	columns := map[string]int{}
+	for _, schema := range schemas {
+		columns[schema.Table] = len(schema.Columns)
+	}
+
+	for _, r := range tx.Records {
+		n, ok := columns[r.Table]
+		if !ok {
+			continue
+		}
+		h, ok := next[r.Table]
+		if !ok {
+			slog.Warn(
+				"the table has no digest, since the rows it had before it was first streamed are not known; "+
+					"load them with --snapshot-new-tables when the table is added to keep one",
+				"table", r.Table,
+			)
+			next[r.Table] = nil
+			continue
+		}
+		if h == nil {
+			continue
+		}
+
+		if r.Action == "U" || r.Action == "D" {
+			if len(r.Identity) < n {
+				slog.Warn(
+					"old row values are missing, the digest of the table can't be kept anymore; "+
+						"set REPLICA IDENTITY FULL on the table to keep it",
+					"table", r.Table,
+				)
+				next[r.Table] = nil
+				continue
+			}
+			old, err := walRowValues(r.Identity)
+			if err != nil {
+				return nil, err
+			}
+			h.RemoveBytes(EncodeRow(old))
+		}
+
+		if r.Action == "I" || r.Action == "U" {
+			row, err := walRowValues(r.Columns)
+			if err != nil {
+				return nil, err
+			}
+			h.InsertBytes(EncodeRow(row))
+		}
+	}
+
+	return next, nil
+}
+
+// save writes the digests to the digests table.
+func (d tableDigests) save(ctx context.Context, tx *sql.Tx) error {
+	for table, h := range d {
+		var digest sql.NullString
+		if h != nil {
+			digest = sql.NullString{String: h.String(), Valid: true}
+		}
+		if _, err := tx.ExecContext(ctx,
+			fmt.Sprintf("INSERT OR REPLACE INTO %s VALUES (?, ?)", digestsTable), table, digest,
+		); err != nil {
+			return fmt.Errorf("save digest: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// readDigests reads the digests kept in a window's db.
+// It returns no digests for dbs created before digests were kept.
+func readDigests(ctx context.Context, db *sql.DB) (tableDigests, error) {
+	var n int
+	if err := db.QueryRowContext(ctx,
+		"SELECT count(*) FROM information_schema.tables WHERE table_name = ?", digestsTable,
+	).Scan(&n); err != nil {
+		return nil, fmt.Errorf("read digests: %s", err)
+	}
+	if n == 0 {
+		return tableDigests{}, nil
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT table_name, digest FROM %s", digestsTable))
+	if err != nil {
+		return nil, fmt.Errorf("read digests: %s", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	digests := tableDigests{}
+	for rows.Next() {
+		var table string
+		var digest sql.NullString
+		if err := rows.Scan(&table, &digest); err != nil {
+			return nil, fmt.Errorf("read digests: %s", err)
+		}
+		if !digest.Valid {
+			digests[table] = nil
+			continue
+		}
+		h := ecmh.NewMultisetHash()
+		if err := h.UnmarshalText([]byte(digest.String)); err != nil {
+			return nil, fmt.Errorf("invalid digest: %s", err)
+		}
+		digests[table] = h
+	}
+
+	return digests, rows.Err()
+}
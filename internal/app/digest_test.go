@@ -0,0 +1,149 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tablelandnetwork/basin-cli/pkg/ecmh"
+	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
+)
+
+func TestEncodeRow(t *testing.T) {
+	a, empty := "a", ""
+
+	// column order does not matter
+	require.Equal(t,
+		EncodeRow(map[string]*string{"id": &a, "name": nil}),
+		EncodeRow(map[string]*string{"name": nil, "id": &a}),
+	)
+
+	// NULL and an empty string are different
+	require.NotEqual(t,
+		EncodeRow(map[string]*string{"name": nil}),
+		EncodeRow(map[string]*string{"name": &empty}),
+	)
+
+	require.Equal(t, []byte{2, 'i', 'd', 1, 1, 'a', 4, 'n', 'a', 'm', 'e', 0},
+		EncodeRow(map[string]*string{"id": &a, "name": nil}))
+}
+
+func TestWALRowValues(t *testing.T) {
+	values, err := walRowValues([]pgrepl.Column{
+		{Name: "n", Value: json.RawMessage(`42.10`)},
+		{Name: "b", Value: json.RawMessage(`true`)},
+		{Name: "s", Value: json.RawMessage(`"it's \"quoted\""`)},
+		{Name: "z", Value: json.RawMessage(`null`)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "42.10", *values["n"])
+	require.Equal(t, "true", *values["b"])
+	require.Equal(t, `it's "quoted"`, *values["s"])
+	require.Nil(t, values["z"])
+}
+
+func TestTableDigestsApply(t *testing.T) {
+	schemas := []TableSchema{{Table: "t", Columns: []Column{{Name: "id"}, {Name: "name"}}}}
+
+	// the digest of t starts from an empty snapshot
+	digests, err := tableDigests{"t": ecmh.NewMultisetHash()}.apply(&pgrepl.Tx{Records: []pgrepl.Record{
+		walRecord("I", "t", nil, `1`, `"a"`),
+		walRecord("I", "t", nil, `2`, `"b"`),
+		walRecord("I", "t", nil, `3`, `"c"`),
+		walRecord("U", "t", []string{`2`, `"b"`}, `2`, `"bb"`),
+		walRecord("D", "t", []string{`3`, `"c"`}),
+		walRecord("I", "other", nil, `1`),
+	}}, schemas)
+	require.NoError(t, err)
+
+	// the digest is the one of the table's final rows
+	require.Equal(t, rowsDigest(t, [][]string{{`1`, `"a"`}, {`2`, `"bb"`}}).String(), digests["t"].String())
+	require.NotContains(t, digests, "other")
+
+	// tables without a snapshot have no digest
+	unknown, err := tableDigests{}.apply(&pgrepl.Tx{CommitLSN: 100, Records: []pgrepl.Record{
+		walRecord("I", "t", nil, `4`, `"d"`),
+	}}, schemas)
+	require.NoError(t, err)
+	require.Contains(t, unknown, "t")
+	require.Nil(t, unknown["t"])
+
+	// without the full old row, the digest becomes unknown
+	next, err := digests.apply(&pgrepl.Tx{Records: []pgrepl.Record{
+		walRecord("D", "t", []string{`1`}),
+	}}, schemas)
+	require.NoError(t, err)
+	require.Contains(t, next, "t")
+	require.Nil(t, next["t"])
+
+	// and the previous digests are left unchanged
+	require.NotNil(t, digests["t"])
+}
+
+func TestReplayKeepsDigests(t *testing.T) {
+	ctx := context.Background()
+	cols := []Column{
+		{Name: "id", Typ: "integer", IsNull: false},
+		{Name: "name", Typ: "text", IsNull: true},
+	}
+	dir := t.TempDir()
+	dbm := NewDBManager(dir, []TableSchema{{"t", cols}}, 3*time.Hour, nil)
+	require.NoError(t, dbm.NewDB(ctx))
+	require.NoError(t, dbm.StartDigest(ctx, "t"))
+
+	require.NoError(t, dbm.Replay(ctx, &pgrepl.Tx{Records: []pgrepl.Record{
+		walRecord("I", "t", nil, `1`, `"a"`),
+		walRecord("I", "t", nil, `2`, `null`),
+	}}))
+
+	digests, err := readDigests(ctx, dbm.db)
+	require.NoError(t, err)
+	expected := rowsDigest(t, [][]string{{`1`, `"a"`}, {`2`, `null`}}).String()
+	require.Equal(t, expected, digests["t"].String())
+
+	// a failed replay does not change the digest
+	require.Error(t, dbm.Replay(ctx, &pgrepl.Tx{Records: []pgrepl.Record{
+		walRecord("I", "t", nil, `"not a number"`, `"c"`),
+	}}))
+	require.Equal(t, expected, dbm.digests["t"].String())
+
+	// the digest is restored from the last window's db on restart
+	dbm.Close()
+	restarted := NewDBManager(dir, []TableSchema{{"t", cols}}, 3*time.Hour, nil)
+	require.NoError(t, restarted.loadDigests(ctx, path.Join(dir, dbm.dbFname)))
+	require.Equal(t, expected, restarted.digests["t"].String())
+
+	// and carries on to the next window
+	require.NoError(t, restarted.NewDB(ctx))
+	defer restarted.Close()
+	digests, err = readDigests(ctx, restarted.db)
+	require.NoError(t, err)
+	require.Equal(t, expected, digests["t"].String())
+}
+
+func walRecord(action string, table string, identity []string, values ...string) pgrepl.Record {
+	names, types := []string{"id", "name"}, []string{"integer", "text"}
+	r := pgrepl.Record{Action: action, Table: table}
+	for i, v := range values {
+		r.Columns = append(r.Columns, pgrepl.Column{Name: names[i], Type: types[i], Value: json.RawMessage(v)})
+	}
+	for i, v := range identity {
+		r.Identity = append(r.Identity, pgrepl.Column{Name: names[i], Type: types[i], Value: json.RawMessage(v)})
+	}
+	return r
+}
+
+func rowsDigest(t *testing.T, rows [][]string) *ecmh.MultisetHash {
+	t.Helper()
+
+	h := ecmh.NewMultisetHash()
+	for _, row := range rows {
+		values, err := walRowValues(walRecord("I", "t", nil, row...).Columns)
+		require.NoError(t, err)
+		h.InsertBytes(EncodeRow(values))
+	}
+	return h
+}
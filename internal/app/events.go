@@ -0,0 +1,184 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// listPageSize is the number of events fetched per ListVaultEvents call.
+const listPageSize = 100
+
+// DefaultFollowInterval is how often an EventFollower polls for new events.
+const DefaultFollowInterval = 10 * time.Second
+
+// PageEvents pages through all the events of a vault in the time range,
+// calling fn with each page as it arrives. Events already seen in previous
+// pages are left out.
+func PageEvents(
+	ctx context.Context,
+	provider VaultsProvider,
+	vault Vault,
+	before Timestamp,
+	after Timestamp,
+	fn func([]EventInfo) error,
+) error {
+	seen := map[string]bool{}
+	for offset := uint32(0); ; offset += listPageSize {
+		page, err := provider.ListVaultEvents(ctx, ListVaultEventsParams{
+			Vault:  vault,
+			Limit:  listPageSize,
+			Offset: offset,
+			Before: before,
+			After:  after,
+		})
+		if err != nil {
+			return fmt.Errorf("list events: %s", err)
+		}
+
+		events := []EventInfo{}
+		for _, e := range page {
+			if !seen[e.CID] {
+				seen[e.CID] = true
+				events = append(events, e)
+			}
+		}
+
+		if len(events) > 0 {
+			if err := fn(events); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < listPageSize {
+			return nil
+		}
+	}
+}
+
+// ListAllEvents pages through all the events of a vault in the time range.
+func ListAllEvents(
+	ctx context.Context, provider VaultsProvider, vault Vault, before Timestamp, after Timestamp,
+) ([]EventInfo, error) {
+	events := []EventInfo{}
+	if err := PageEvents(ctx, provider, vault, before, after, func(page []EventInfo) error {
+		events = append(events, page...)
+		return nil
+	}); err != nil {
+		return []EventInfo{}, err
+	}
+
+	return events, nil
+}
+
+// EventFollower polls a vault for new events.
+type EventFollower struct {
+	provider VaultsProvider
+	vault    Vault
+	interval time.Duration
+
+	// last is the newest timestamp seen, and seen the events at that timestamp
+	last int64
+	seen map[string]bool
+}
+
+// NewEventFollower creates a new EventFollower that reports the events
+// created after the given timestamp, which can be zero.
+func NewEventFollower(provider VaultsProvider, vault Vault, after Timestamp, interval time.Duration) *EventFollower {
+	if interval <= 0 {
+		interval = DefaultFollowInterval
+	}
+
+	last := int64(0)
+	if after != (Timestamp{}) {
+		last = after.Seconds()
+	}
+
+	return &EventFollower{
+		provider: provider,
+		vault:    vault,
+		interval: interval,
+		last:     last,
+		seen:     map[string]bool{},
+	}
+}
+
+// MarkSeen records events that were already reported, so they are not reported again.
+func (f *EventFollower) MarkSeen(events []EventInfo) {
+	for _, e := range events {
+		f.observe(e)
+	}
+}
+
+// Follow polls for new events until ctx is done, calling fn with
+// each batch of new events, oldest first. An error from fn stops it.
+func (f *EventFollower) Follow(ctx context.Context, fn func([]EventInfo) error) error {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		events, err := f.Poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			slog.Warn("polling events", "vault", f.vault, "error", err)
+		} else if len(events) > 0 {
+			if err := fn(events); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll returns the events created since the last poll, oldest first.
+func (f *EventFollower) Poll(ctx context.Context) ([]EventInfo, error) {
+	// ask from a second earlier, so that events created at the last timestamp
+	// are not missed whether the bound is inclusive or not, and filter out
+	// the ones already reported
+	after := Timestamp{}
+	if f.last > 1 {
+		after = NewTimestamp(time.Unix(f.last-1, 0).UTC())
+	}
+	events, err := ListAllEvents(ctx, f.provider, f.vault, Timestamp{}, after)
+	if err != nil {
+		return []EventInfo{}, err
+	}
+
+	fresh := []EventInfo{}
+	for _, e := range events {
+		if e.Timestamp < f.last || (e.Timestamp == f.last && f.seen[e.CID]) {
+			continue
+		}
+		fresh = append(fresh, e)
+	}
+
+	sort.SliceStable(fresh, func(i, j int) bool {
+		if fresh[i].Timestamp != fresh[j].Timestamp {
+			return fresh[i].Timestamp < fresh[j].Timestamp
+		}
+		return fresh[i].CID < fresh[j].CID
+	})
+	f.MarkSeen(fresh)
+
+	return fresh, nil
+}
+
+func (f *EventFollower) observe(e EventInfo) {
+	switch {
+	case e.Timestamp > f.last:
+		f.last = e.Timestamp
+		f.seen = map[string]bool{e.CID: true}
+	case e.Timestamp == f.last:
+		f.seen[e.CID] = true
+	}
+}
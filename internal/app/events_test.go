@@ -0,0 +1,118 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPageEventsStreamsPages(t *testing.T) {
+	provider := &pagingProviderMock{total: 250}
+
+	sizes := []int{}
+	err := PageEvents(context.Background(), provider, "test.data", Timestamp{}, Timestamp{}, func(page []EventInfo) error {
+		sizes = append(sizes, len(page))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int{100, 100, 50}, sizes)
+}
+
+func TestEventFollowerReportsNewEvents(t *testing.T) {
+	ctx := context.Background()
+	provider := &growingProviderMock{}
+	provider.add("a", 100)
+	provider.add("b", 200)
+
+	follower := NewEventFollower(provider, "test.data", Timestamp{}, time.Millisecond)
+	follower.MarkSeen([]EventInfo{{CID: "b", Timestamp: 200}})
+
+	// events older than the last seen one are not reported
+	events, err := follower.Poll(ctx)
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	// an event at the same second as the last seen one is not missed
+	provider.add("c", 200)
+	provider.add("d", 300)
+	events, err = follower.Poll(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"c", "d"}, eventCIDs(events))
+
+	events, err = follower.Poll(ctx)
+	require.NoError(t, err)
+	require.Empty(t, events)
+}
+
+func TestEventFollowerFollow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	provider := &growingProviderMock{}
+	provider.add("a", 100)
+	follower := NewEventFollower(provider, "test.data", NewTimestamp(time.Unix(50, 0)), time.Millisecond)
+
+	reported := []string{}
+	err := follower.Follow(ctx, func(events []EventInfo) error {
+		reported = append(reported, eventCIDs(events)...)
+		if len(reported) == 1 {
+			provider.add("b", 150)
+			return nil
+		}
+		cancel()
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, reported)
+}
+
+func eventCIDs(events []EventInfo) []string {
+	cids := make([]string, len(events))
+	for i, e := range events {
+		cids[i] = e.CID
+	}
+	return cids
+}
+
+// growingProviderMock lists its events newest first, with inclusive bounds.
+type growingProviderMock struct {
+	vaultsProviderMock
+	events []EventInfo
+}
+
+func (bp *growingProviderMock) add(c string, ts int64) {
+	bp.events = append(bp.events, EventInfo{CID: c, Timestamp: ts})
+	sort.SliceStable(bp.events, func(i, j int) bool {
+		return bp.events[i].Timestamp > bp.events[j].Timestamp
+	})
+}
+
+func (bp *growingProviderMock) ListVaultEvents(
+	_ context.Context, params ListVaultEventsParams,
+) ([]EventInfo, error) {
+	if params.Vault != "test.data" {
+		return nil, fmt.Errorf("unexpected vault %s", params.Vault)
+	}
+
+	events := []EventInfo{}
+	for _, e := range bp.events {
+		if params.After != (Timestamp{}) && e.Timestamp < params.After.Seconds() {
+			continue
+		}
+		events = append(events, e)
+	}
+
+	if int(params.Offset) >= len(events) {
+		return []EventInfo{}, nil
+	}
+	events = events[params.Offset:]
+	if len(events) > int(params.Limit) {
+		events = events[:params.Limit]
+	}
+
+	return events, nil
+}
@@ -0,0 +1,240 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// LedgerEntry is a file that was uploaded from this machine.
+type LedgerEntry struct {
+	Vault      Vault
+	FileHash   string
+	Filename   string
+	Size       int64
+	Timestamp  int64
+	UploadedAt time.Time
+
+	// CID is the CID of the event the provider created for the file.
+	// It is empty if the provider didn't respond with it.
+	CID       string
+	Signature string
+
+	// Tables and Window are the replicated tables and the WAL range
+	// the file was exported from. They are empty for written files.
+	Tables []string
+	Window WindowRange
+}
+
+// Ledger keeps track of the files uploaded from this machine,
+// so the same content is not sent to a vault twice.
+//
+// The ledger db is only open while it is used, so many processes,
+// e.g. a running stream and a write, can share it.
+type Ledger struct {
+	dbPath string
+}
+
+// ledgerColumns are the columns of the uploads table.
+const ledgerColumns = "vault, file_hash, filename, size, timestamp, uploaded_at, " +
+	"cid, signature, tables, start_lsn, end_lsn"
+
+// OpenLedger opens the ledger at the given path, creating it if needed.
+func OpenLedger(ctx context.Context, dbPath string) (*Ledger, error) {
+	l := &Ledger{dbPath: dbPath}
+	if err := l.with(ctx, func(db *sql.DB) error {
+		_, err := db.ExecContext(ctx,
+			`CREATE TABLE IF NOT EXISTS uploads (
+				vault varchar NOT NULL,
+				file_hash varchar NOT NULL,
+				filename varchar NOT NULL,
+				size bigint NOT NULL,
+				timestamp bigint NOT NULL,
+				uploaded_at timestamp NOT NULL,
+				cid varchar,
+				signature varchar,
+				tables varchar,
+				start_lsn varchar,
+				end_lsn varchar,
+				PRIMARY KEY (vault, file_hash)
+			)`,
+		)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("cannot setup ledger: %s", err)
+	}
+
+	return l, nil
+}
+
+// with opens the ledger db for the duration of fn.
+func (l *Ledger) with(ctx context.Context, fn func(db *sql.DB) error) error {
+	lock := flock.New(l.dbPath + ".lock")
+	if _, err := lock.TryLockContext(ctx, 50*time.Millisecond); err != nil {
+		return fmt.Errorf("lock ledger: %s", err)
+	}
+	defer func() {
+		_ = lock.Unlock()
+	}()
+
+	db, err := sql.Open("duckdb", l.dbPath)
+	if err != nil {
+		return fmt.Errorf("cannot open ledger: %s", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	return fn(db)
+}
+
+// Has reports whether a file with the given hash was already uploaded to the vault.
+func (l *Ledger) Has(ctx context.Context, vault Vault, fileHash string) (bool, error) {
+	var n int
+	if err := l.with(ctx, func(db *sql.DB) error {
+		return db.QueryRowContext(ctx,
+			"SELECT count(1) FROM uploads WHERE vault = ? AND file_hash = ?", string(vault), fileHash,
+		).Scan(&n)
+	}); err != nil {
+		return false, fmt.Errorf("query ledger: %s", err)
+	}
+
+	return n > 0, nil
+}
+
+// Record adds an uploaded file to the ledger.
+func (l *Ledger) Record(ctx context.Context, e LedgerEntry) error {
+	var start, end sql.NullString
+	if !e.Window.IsZero() {
+		start = sql.NullString{String: e.Window.StartLSN.String(), Valid: true}
+		end = sql.NullString{String: e.Window.EndLSN.String(), Valid: true}
+	}
+
+	if err := l.with(ctx, func(db *sql.DB) error {
+		_, err := db.ExecContext(ctx,
+			fmt.Sprintf("INSERT OR REPLACE INTO uploads (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", ledgerColumns),
+			string(e.Vault), e.FileHash, e.Filename, e.Size, e.Timestamp, e.UploadedAt,
+			e.CID, e.Signature, strings.Join(e.Tables, ","), start, end,
+		)
+		return err
+	}); err != nil {
+		return fmt.Errorf("insert into ledger: %s", err)
+	}
+
+	return nil
+}
+
+// Entries returns the files uploaded to the vault, or to all vaults if it is empty,
+// oldest first.
+func (l *Ledger) Entries(ctx context.Context, vault Vault) ([]LedgerEntry, error) {
+	query := fmt.Sprintf("SELECT %s FROM uploads", ledgerColumns)
+	args := []any{}
+	if vault != "" {
+		query += " WHERE vault = ?"
+		args = append(args, string(vault))
+	}
+	query += " ORDER BY uploaded_at, filename"
+
+	return l.query(ctx, query, args...)
+}
+
+// Find returns the files whose event CID or file hash is ref.
+func (l *Ledger) Find(ctx context.Context, ref string) ([]LedgerEntry, error) {
+	return l.query(ctx,
+		fmt.Sprintf("SELECT %s FROM uploads WHERE cid = ? OR file_hash = ? ORDER BY uploaded_at", ledgerColumns),
+		ref, ref,
+	)
+}
+
+func (l *Ledger) query(ctx context.Context, query string, args ...any) ([]LedgerEntry, error) {
+	entries := []LedgerEntry{}
+	if err := l.with(ctx, func(db *sql.DB) error {
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+
+		for rows.Next() {
+			var e LedgerEntry
+			var vault string
+			var cid, signature, tables, start, end sql.NullString
+			if err := rows.Scan(
+				&vault, &e.FileHash, &e.Filename, &e.Size, &e.Timestamp, &e.UploadedAt,
+				&cid, &signature, &tables, &start, &end,
+			); err != nil {
+				return err
+			}
+			e.Vault = Vault(vault)
+			e.CID = cid.String
+			e.Signature = signature.String
+			if tables.String != "" {
+				e.Tables = strings.Split(tables.String, ",")
+			}
+			if start.Valid && end.Valid {
+				if e.Window, err = parseWindowRange(start.String, end.String); err != nil {
+					return err
+				}
+			}
+			entries = append(entries, e)
+		}
+		return rows.Err()
+	}); err != nil {
+		return []LedgerEntry{}, fmt.Errorf("query ledger: %s", err)
+	}
+
+	return entries, nil
+}
+
+// MissingEvents returns the entries of the vault whose event is not listed
+// by the provider. Entries without a CID can't be checked, they are left out.
+func MissingEvents(
+	ctx context.Context, provider VaultsProvider, vault Vault, entries []LedgerEntry,
+) ([]LedgerEntry, error) {
+	events, err := ListAllEvents(ctx, provider, vault, Timestamp{}, Timestamp{})
+	if err != nil {
+		return []LedgerEntry{}, err
+	}
+
+	remote := make(map[string]bool, len(events))
+	for _, e := range events {
+		remote[e.CID] = true
+	}
+
+	missing := []LedgerEntry{}
+	for _, e := range entries {
+		if e.Vault == vault && e.CID != "" && !remote[e.CID] {
+			missing = append(missing, e)
+		}
+	}
+
+	return missing, nil
+}
+
+// HashFile returns the hex-encoded sha256 of a file's content.
+func HashFile(filepath string) (string, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return "", fmt.Errorf("open file: %s", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("read file: %s", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
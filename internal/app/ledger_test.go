@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLedger(t *testing.T) {
+	ctx := context.Background()
+	ledger, err := OpenLedger(ctx, path.Join(t.TempDir(), "ledger.db"))
+	require.NoError(t, err)
+
+	uploadedAt := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	streamed := LedgerEntry{
+		Vault:      "test.data",
+		FileHash:   "aa",
+		Filename:   "t-1.db.parquet",
+		Size:       100,
+		Timestamp:  1693526400,
+		UploadedAt: uploadedAt,
+		CID:        "cid-a",
+		Signature:  "sig-a",
+		Tables:     []string{"t"},
+		Window:     WindowRange{StartLSN: 0x16B3748, EndLSN: 0x16B3900},
+	}
+	written := LedgerEntry{
+		Vault:      "test.other",
+		FileHash:   "bb",
+		Filename:   "b.parquet",
+		Size:       200,
+		Timestamp:  1693526400,
+		UploadedAt: uploadedAt.Add(time.Minute),
+		CID:        "cid-b",
+		Signature:  "sig-b",
+	}
+	require.NoError(t, ledger.Record(ctx, streamed))
+	require.NoError(t, ledger.Record(ctx, written))
+
+	entries, err := ledger.Entries(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, []LedgerEntry{streamed, written}, entries)
+
+	entries, err = ledger.Entries(ctx, "test.other")
+	require.NoError(t, err)
+	require.Equal(t, []LedgerEntry{written}, entries)
+
+	// entries are found by their CID or file hash
+	entries, err = ledger.Find(ctx, "cid-a")
+	require.NoError(t, err)
+	require.Equal(t, []LedgerEntry{streamed}, entries)
+	entries, err = ledger.Find(ctx, "bb")
+	require.NoError(t, err)
+	require.Equal(t, []LedgerEntry{written}, entries)
+}
+
+func TestMissingEvents(t *testing.T) {
+	provider := &growingProviderMock{}
+	provider.add("a", 100)
+
+	entries := []LedgerEntry{
+		{Vault: "test.data", CID: "a"},
+		{Vault: "test.data", CID: "b"},
+		{Vault: "test.data"},
+		{Vault: "test.other", CID: "c"},
+	}
+	missing, err := MissingEvents(context.Background(), provider, "test.data", entries)
+	require.NoError(t, err)
+	require.Equal(t, []LedgerEntry{{Vault: "test.data", CID: "b"}}, missing)
+}
@@ -0,0 +1,358 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// OpColumn is the optional column of a change event with the change
+	// operation of the row: I (insert), U (update) or D (delete).
+	// The stream writes it to every exported row; rows of events
+	// without it are inserts.
+	OpColumn = "_op"
+
+	// LSNColumn is the optional column of a change event with the LSN of
+	// the change, written by the stream. It orders the changes to the same
+	// row inside an event.
+	LSNColumn = "_lsn"
+
+	// materializeStateTable keeps the events applied to a materialized table.
+	materializeStateTable = "_vaults_applied_events"
+)
+
+// MaterializeSummary is the outcome of a materialization.
+type MaterializeSummary struct {
+	Applied int
+	Rows    int64
+}
+
+// Materializer rebuilds the current state of a table from the change
+// events of a vault, in a DuckDB database.
+type Materializer struct {
+	db         *sql.DB
+	provider   VaultsProvider
+	cache      *ContentCache
+	primaryKey []string
+}
+
+// OpenMaterializer opens the DuckDB database at dbPath, creating it if needed.
+func OpenMaterializer(
+	ctx context.Context, dbPath string, provider VaultsProvider, cache *ContentCache,
+) (*Materializer, error) {
+	db, err := sql.Open("duckdb", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open db: %s", err)
+	}
+	// temporary tables live in a connection
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (
+			vault varchar NOT NULL,
+			cid varchar NOT NULL,
+			timestamp bigint NOT NULL,
+			primary_key varchar NOT NULL,
+			applied_at timestamp NOT NULL,
+			PRIMARY KEY (vault, cid)
+		)`, materializeStateTable),
+	); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("cannot setup db: %s", err)
+	}
+
+	return &Materializer{
+		db:       db,
+		provider: provider,
+		cache:    cache,
+	}, nil
+}
+
+// SetPrimaryKey overrides the primary key recorded in the events.
+func (m *Materializer) SetPrimaryKey(columns []string) {
+	m.primaryKey = columns
+}
+
+// Materialize applies the events of the vault that were not applied yet,
+// oldest first, to a table named after the vault's relation.
+func (m *Materializer) Materialize(ctx context.Context, vault Vault) (MaterializeSummary, error) {
+	_, rel, found := strings.Cut(string(vault), ".")
+	if !found {
+		return MaterializeSummary{}, fmt.Errorf("invalid vault name %s", vault)
+	}
+
+	events, err := m.pending(ctx, vault)
+	if err != nil {
+		return MaterializeSummary{}, err
+	}
+
+	defer func() {
+		if err := m.cache.Trim(); err != nil {
+			slog.Warn("trimming cache", "error", err)
+		}
+	}()
+
+	summary := MaterializeSummary{}
+	for _, event := range events {
+		c, err := cid.Parse(event.CID)
+		if err != nil {
+			return summary, fmt.Errorf("parse cid: %s", err)
+		}
+
+		p, err := m.cache.Get(ctx, c)
+		if err != nil {
+			return summary, err
+		}
+
+		slog.Info("applying event", "cid", event.CID, "timestamp", event.Timestamp)
+		if err := m.apply(ctx, vault, rel, event, p); err != nil {
+			return summary, fmt.Errorf("apply %s: %s", event.CID, err)
+		}
+		summary.Applied++
+	}
+
+	if err := m.db.QueryRowContext(ctx, fmt.Sprintf("SELECT count(*) FROM %s", quoteIdent(rel))).
+		Scan(&summary.Rows); err != nil && summary.Applied > 0 {
+		return summary, fmt.Errorf("count rows: %s", err)
+	}
+
+	return summary, nil
+}
+
+// ExportParquet writes the materialized table of the vault to a Parquet file.
+func (m *Materializer) ExportParquet(ctx context.Context, vault Vault, out string) error {
+	_, rel, found := strings.Cut(string(vault), ".")
+	if !found {
+		return fmt.Errorf("invalid vault name %s", vault)
+	}
+
+	var pk string
+	if err := m.db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT primary_key FROM %s WHERE vault = ? ORDER BY timestamp DESC, applied_at DESC LIMIT 1",
+		materializeStateTable,
+	), string(vault)).Scan(&pk); errors.Is(err, sql.ErrNoRows) {
+		return ErrNoEvents
+	} else if err != nil {
+		return fmt.Errorf("read state: %s", err)
+	}
+
+	if _, err := m.db.ExecContext(ctx, fmt.Sprintf(
+		"COPY %s TO %s (FORMAT PARQUET, KV_METADATA {'%s': %s})",
+		quoteIdent(rel), quoteLiteral(out), PrimaryKeyMetadataKey, quoteLiteral(pk),
+	)); err != nil {
+		return fmt.Errorf("cannot export to parquet file: %s", err)
+	}
+
+	return nil
+}
+
+// Close closes the database.
+func (m *Materializer) Close() error {
+	return m.db.Close()
+}
+
+// pending lists the events not applied yet, oldest first.
+func (m *Materializer) pending(ctx context.Context, vault Vault) ([]EventInfo, error) {
+	var last sql.NullInt64
+	if err := m.db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT max(timestamp) FROM %s WHERE vault = ?", materializeStateTable,
+	), string(vault)).Scan(&last); err != nil {
+		return []EventInfo{}, fmt.Errorf("read state: %s", err)
+	}
+
+	after := Timestamp{}
+	if last.Valid {
+		after = NewTimestamp(time.Unix(last.Int64, 0).UTC())
+	}
+
+	events, err := ListAllEvents(ctx, m.provider, vault, Timestamp{}, after)
+	if err != nil {
+		return []EventInfo{}, err
+	}
+
+	// events at the last timestamp may have been applied already
+	applied := map[string]bool{}
+	rows, err := m.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT cid FROM %s WHERE vault = ? AND timestamp >= ?", materializeStateTable,
+	), string(vault), last.Int64)
+	if err != nil {
+		return []EventInfo{}, fmt.Errorf("read state: %s", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return []EventInfo{}, fmt.Errorf("read state: %s", err)
+		}
+		applied[c] = true
+	}
+	if err := rows.Err(); err != nil {
+		return []EventInfo{}, fmt.Errorf("read state: %s", err)
+	}
+
+	pending := []EventInfo{}
+	for _, e := range events {
+		if !applied[e.CID] {
+			pending = append(pending, e)
+		}
+	}
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		if pending[i].Timestamp != pending[j].Timestamp {
+			return pending[i].Timestamp < pending[j].Timestamp
+		}
+		return pending[i].CID < pending[j].CID
+	})
+
+	return pending, nil
+}
+
+// apply merges the rows of an event into the table, in a transaction.
+// The last change of each primary key in the event wins.
+func (m *Materializer) apply(ctx context.Context, vault Vault, rel string, event EventInfo, p string) error {
+	columns, err := m.columns(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	pk, err := m.eventPrimaryKey(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	hasOp, hasLSN := false, false
+	data := []string{}
+	for _, c := range columns {
+		switch c {
+		case OpColumn:
+			hasOp = true
+		case LSNColumn:
+			hasLSN = true
+		default:
+			data = append(data, quoteIdent(c))
+		}
+	}
+
+	keys, match := []string{}, []string{}
+	for _, k := range pk {
+		if !slices.Contains(columns, k) {
+			return fmt.Errorf("primary key column %s not found", k)
+		}
+		keys = append(keys, quoteIdent(k))
+		match = append(match, fmt.Sprintf("%s.%s = b.%s", quoteIdent(rel), quoteIdent(k), quoteIdent(k)))
+	}
+
+	order := "file_row_number DESC"
+	if hasLSN {
+		order = fmt.Sprintf("%s DESC, %s", quoteIdent(LSNColumn), order)
+	}
+	filter := ""
+	if hasOp {
+		filter = fmt.Sprintf("WHERE %s IS DISTINCT FROM 'D'", quoteIdent(OpColumn))
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %s", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmts := []string{
+		fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s AS SELECT %s FROM read_parquet(%s) LIMIT 0",
+			quoteIdent(rel), strings.Join(data, ", "), quoteLiteral(p),
+		),
+		fmt.Sprintf(
+			`CREATE OR REPLACE TEMP TABLE _vaults_batch AS
+			 SELECT * FROM read_parquet(%s, file_row_number = true)
+			 QUALIFY row_number() OVER (PARTITION BY %s ORDER BY %s) = 1`,
+			quoteLiteral(p), strings.Join(keys, ", "), order,
+		),
+		fmt.Sprintf(
+			"DELETE FROM %s USING _vaults_batch b WHERE %s",
+			quoteIdent(rel), strings.Join(match, " AND "),
+		),
+		fmt.Sprintf(
+			"INSERT INTO %s BY NAME SELECT %s FROM _vaults_batch %s",
+			quoteIdent(rel), strings.Join(data, ", "), filter,
+		),
+		"DROP TABLE _vaults_batch",
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s VALUES (?, ?, ?, ?, ?)", materializeStateTable,
+	), string(vault), event.CID, event.Timestamp, strings.Join(pk, ","), time.Now().UTC()); err != nil {
+		return fmt.Errorf("record state: %s", err)
+	}
+
+	return tx.Commit()
+}
+
+func (m *Materializer) columns(ctx context.Context, p string) ([]string, error) {
+	rows, err := m.db.QueryContext(ctx, fmt.Sprintf("DESCRIBE SELECT * FROM read_parquet(%s)", quoteLiteral(p)))
+	if err != nil {
+		return []string{}, fmt.Errorf("describe: %s", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	rowColumns, err := rows.Columns()
+	if err != nil {
+		return []string{}, fmt.Errorf("describe: %s", err)
+	}
+
+	columns := []string{}
+	for rows.Next() {
+		values := make([]any, len(rowColumns))
+		pointers := make([]any, len(rowColumns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return []string{}, fmt.Errorf("describe: %s", err)
+		}
+		columns = append(columns, fmt.Sprint(values[0]))
+	}
+
+	return columns, rows.Err()
+}
+
+// eventPrimaryKey returns the primary key set with SetPrimaryKey,
+// or the one recorded in the Parquet metadata of the event.
+func (m *Materializer) eventPrimaryKey(ctx context.Context, p string) ([]string, error) {
+	if len(m.primaryKey) > 0 {
+		return m.primaryKey, nil
+	}
+
+	var value string
+	err := m.db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT CAST(value AS VARCHAR) FROM parquet_kv_metadata(%s) WHERE CAST(key AS VARCHAR) = ?",
+		quoteLiteral(p),
+	), PrimaryKeyMetadataKey).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && value == "") {
+		return []string{}, errors.New("no primary key recorded in the event, set one explicitly")
+	} else if err != nil {
+		return []string{}, fmt.Errorf("read metadata: %s", err)
+	}
+
+	return strings.Split(value, ","), nil
+}
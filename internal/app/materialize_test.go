@@ -0,0 +1,134 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
+)
+
+func TestMaterialize(t *testing.T) {
+	ctx := context.Background()
+	provider := newEventStoreMock()
+	write := func(ts int64, windows ...[]*pgrepl.Tx) {
+		for i, f := range exportWindows(t, TableSchema{"data", materializeCols}, windows...) {
+			content, err := os.ReadFile(f)
+			require.NoError(t, err)
+			provider.add(t, "data.parquet", ts+int64(i)*100, content)
+		}
+	}
+
+	// windows streamed with inserts, updates and deletes
+	write(1700000000,
+		[]*pgrepl.Tx{
+			{CommitLSN: 100, Records: []pgrepl.Record{
+				walRecord("I", "data", nil, `1`, `"a"`),
+				walRecord("I", "data", nil, `2`, `"b"`),
+			}},
+		},
+		[]*pgrepl.Tx{
+			{CommitLSN: 200, Records: []pgrepl.Record{
+				walRecord("U", "data", nil, `1`, `"a1"`),
+				walRecord("D", "data", []string{`2`}),
+				walRecord("I", "data", nil, `3`, `"c"`),
+			}},
+			// the key of 3 changes to 4
+			{CommitLSN: 300, Records: []pgrepl.Record{
+				walRecord("U", "data", []string{`3`}, `4`, `"c"`),
+				walRecord("I", "data", nil, `5`, `"e"`),
+			}},
+			{CommitLSN: 400, Records: []pgrepl.Record{
+				walRecord("D", "data", []string{`5`}),
+			}},
+		},
+	)
+
+	cache := newTestCache(t, provider)
+	dbPath := path.Join(t.TempDir(), "state.duckdb")
+	m, err := OpenMaterializer(ctx, dbPath, provider, cache)
+	require.NoError(t, err)
+
+	summary, err := m.Materialize(ctx, "test.data")
+	require.NoError(t, err)
+	require.Equal(t, 2, summary.Applied)
+	require.Equal(t, int64(2), summary.Rows)
+	require.NoError(t, m.Close())
+	require.Equal(t, map[int32]string{1: "a1", 4: "c"}, materializedRows(t, dbPath))
+
+	// refreshing only applies the new events
+	write(1700000200, []*pgrepl.Tx{
+		{CommitLSN: 500, Records: []pgrepl.Record{
+			walRecord("D", "data", []string{`4`}),
+			walRecord("I", "data", nil, `6`, `"f"`),
+		}},
+	})
+	m, err = OpenMaterializer(ctx, dbPath, provider, cache)
+	require.NoError(t, err)
+	summary, err = m.Materialize(ctx, "test.data")
+	require.NoError(t, err)
+	require.Equal(t, 1, summary.Applied)
+	require.Equal(t, int64(2), summary.Rows)
+
+	summary, err = m.Materialize(ctx, "test.data")
+	require.NoError(t, err)
+	require.Equal(t, 0, summary.Applied)
+
+	out := path.Join(t.TempDir(), "state.parquet")
+	require.NoError(t, m.ExportParquet(ctx, "test.data", out))
+	require.NoError(t, m.Close())
+	require.Equal(t, map[int32]string{1: "a1", 6: "f"}, materializedRows(t, dbPath))
+	require.FileExists(t, out)
+}
+
+func TestMaterializeOrdersChangesByLSN(t *testing.T) {
+	ctx := context.Background()
+	provider := newEventStoreMock()
+	pk := fmt.Sprintf("KV_METADATA {'%s': 'id'}", PrimaryKeyMetadataKey)
+	content, err := os.ReadFile(parquetFile(t,
+		"SELECT * FROM (VALUES (1, 'b', 'U', 2), (1, 'a', 'I', 1)) t(id, name, _op, _lsn)", pk))
+	require.NoError(t, err)
+	provider.add(t, "data.parquet", 1700000000, content)
+
+	dbPath := path.Join(t.TempDir(), "state.duckdb")
+	m, err := OpenMaterializer(ctx, dbPath, provider, newTestCache(t, provider))
+	require.NoError(t, err)
+	_, err = m.Materialize(ctx, "test.data")
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+	require.Equal(t, map[int32]string{1: "b"}, materializedRows(t, dbPath))
+}
+
+// materializeCols is the schema of the data table.
+var materializeCols = []Column{
+	{Name: "id", Typ: "integer", IsNull: false, IsPrimary: true},
+	{Name: "name", Typ: "text", IsNull: false, IsPrimary: false},
+}
+
+func materializedRows(t *testing.T, dbPath string) map[int32]string {
+	t.Helper()
+	db, err := sql.Open("duckdb", dbPath)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	rows, err := db.Query("SELECT id, name FROM data")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, rows.Close())
+	}()
+
+	state := map[int32]string{}
+	for rows.Next() {
+		var id int32
+		var name string
+		require.NoError(t, rows.Scan(&id, &name))
+		state[id] = name
+	}
+	return state
+}
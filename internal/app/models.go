@@ -15,6 +15,16 @@ type VaultWithCacheDuration struct {
 	CacheDuration *CacheDuration `json:"cache_duration"`
 }
 
+// VaultInfo represents the details of a vault.
+type VaultInfo struct {
+	Vault         Vault          `json:"vault"`
+	Owner         string         `json:"owner"`
+	CreatedAt     int64          `json:"created_at"`
+	CacheDuration *CacheDuration `json:"cache_duration"`
+	EventCount    int64          `json:"event_count"`
+	TotalSize     int64          `json:"total_size"`
+}
+
 // Account represents an account.
 type Account struct {
 	address common.Address
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/exp/slog"
+)
+
+// ErrNoEvents is an error when a vault has no events in the queried time range.
+var ErrNoEvents = errors.New("no events found")
+
+// QueryResult is the result of a query.
+type QueryResult struct {
+	Columns []string
+	Rows    [][]any
+}
+
+// Querier runs SQL queries over the Parquet files of a vault's events.
+type Querier struct {
+	provider    VaultsProvider
+	cache       *ContentCache
+	concurrency int
+}
+
+// NewQuerier creates a new Querier.
+func NewQuerier(provider VaultsProvider, cache *ContentCache, concurrency int) *Querier {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &Querier{
+		provider:    provider,
+		cache:       cache,
+		concurrency: concurrency,
+	}
+}
+
+// Query retrieves the events of the vault in the time range into the cache,
+// registers them as a view named after the vault's relation, and runs the query.
+func (q *Querier) Query(
+	ctx context.Context, vault Vault, before Timestamp, after Timestamp, query string,
+) (*QueryResult, error) {
+	_, rel, found := strings.Cut(string(vault), ".")
+	if !found {
+		return nil, fmt.Errorf("invalid vault name %s", vault)
+	}
+
+	events, err := ListAllEvents(ctx, q.provider, vault, before, after)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, ErrNoEvents
+	}
+
+	files, err := q.fetch(ctx, events)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := q.cache.Trim(); err != nil {
+			slog.Warn("trimming cache", "error", err)
+		}
+	}()
+
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open db: %s", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	quoted := make([]string, len(files))
+	for i, f := range files {
+		quoted[i] = quoteLiteral(f)
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(
+		`CREATE VIEW %s AS SELECT * FROM read_parquet([%s], union_by_name = true)`,
+		quoteIdent(rel), strings.Join(quoted, ", "),
+	)); err != nil {
+		return nil, fmt.Errorf("cannot create view: %s", err)
+	}
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query: %s", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("columns: %s", err)
+	}
+
+	result := &QueryResult{Columns: columns, Rows: [][]any{}}
+	for rows.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("scan: %s", err)
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query: %s", err)
+	}
+
+	return result, nil
+}
+
+// fetch gets the events into the cache, and returns their paths.
+func (q *Querier) fetch(ctx context.Context, events []EventInfo) ([]string, error) {
+	files := make([]string, len(events))
+	errs := make([]error, len(events))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, q.concurrency)
+	for i, event := range events {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, event EventInfo) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			c, err := cid.Parse(event.CID)
+			if err != nil {
+				errs[i] = fmt.Errorf("parse cid: %s", err)
+				return
+			}
+			files[i], errs[i] = q.cache.Get(ctx, c)
+		}(i, event)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// quoteIdent quotes a SQL identifier.
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// quoteLiteral quotes a SQL string literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
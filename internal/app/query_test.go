@@ -0,0 +1,62 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	provider := newEventStoreMock()
+	for i, rows := range []string{"range(1, 4)", "range(4, 6)"} {
+		content, err := os.ReadFile(parquetFile(t, fmt.Sprintf("SELECT range AS id FROM %s", rows)))
+		require.NoError(t, err)
+		provider.add(t, "data.parquet", int64(1700000000+i*100), content)
+	}
+
+	querier := NewQuerier(provider, newTestCache(t, provider), 2)
+
+	result, err := querier.Query(ctx, "test.data", Timestamp{}, Timestamp{},
+		"SELECT count(*) AS n, sum(id) AS total FROM data")
+	require.NoError(t, err)
+	require.Equal(t, []string{"n", "total"}, result.Columns)
+	require.Len(t, result.Rows, 1)
+	require.EqualValues(t, 5, result.Rows[0][0])
+	require.Equal(t, "15", fmt.Sprint(result.Rows[0][1]))
+	require.Equal(t, 2, provider.retrievals)
+
+	// the time range selects the events, and cached events are not retrieved again
+	after := NewTimestamp(time.Unix(1700000100, 0))
+	result, err = querier.Query(ctx, "test.data", Timestamp{}, after, "SELECT id FROM data ORDER BY id")
+	require.NoError(t, err)
+	require.Len(t, result.Rows, 2)
+	require.EqualValues(t, 4, result.Rows[0][0])
+	require.EqualValues(t, 5, result.Rows[1][0])
+	require.Equal(t, 2, provider.retrievals)
+
+	_, err = querier.Query(ctx, "test.data", NewTimestamp(time.Unix(1600000000, 0)), Timestamp{}, "SELECT 1")
+	require.ErrorIs(t, err, ErrNoEvents)
+}
+
+func parquetFile(t *testing.T, query string, options ...string) string {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	p := path.Join(t.TempDir(), "data.parquet")
+	_, err = db.Exec(fmt.Sprintf("COPY (%s) TO '%s' (%s)",
+		query, p, strings.Join(append([]string{"FORMAT PARQUET"}, options...), ", ")))
+	require.NoError(t, err)
+	return p
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
+	"golang.org/x/exp/slog"
+)
+
+// maxTranscriptLine is the size limit of a tx in a transcript.
+const maxTranscriptLine = 64 * 1024 * 1024
+
+// ReadTableSchemas reads the JSON encoded schemas of the replayed tables.
+func ReadTableSchemas(r io.Reader) ([]TableSchema, error) {
+	schemas := []TableSchema{}
+	if err := json.NewDecoder(r).Decode(&schemas); err != nil {
+		return []TableSchema{}, fmt.Errorf("decode schemas: %s", err)
+	}
+	for _, schema := range schemas {
+		if schema.Table == "" || len(schema.Columns) == 0 {
+			return []TableSchema{}, fmt.Errorf("schema of table %q has no name or columns", schema.Table)
+		}
+	}
+
+	return schemas, nil
+}
+
+// TranscriptWriter records txs as NDJSON, one pgrepl.Tx per line,
+// the format ReplayTranscript reads.
+type TranscriptWriter struct {
+	enc *json.Encoder
+}
+
+// NewTranscriptWriter creates a new TranscriptWriter writing to w.
+func NewTranscriptWriter(w io.Writer) *TranscriptWriter {
+	return &TranscriptWriter{enc: json.NewEncoder(w)}
+}
+
+// Write records a tx.
+func (tw *TranscriptWriter) Write(tx *pgrepl.Tx) error {
+	if err := tw.enc.Encode(tx); err != nil {
+		return fmt.Errorf("encode tx: %s", err)
+	}
+
+	return nil
+}
+
+// ReplayTranscript replays the txs of a transcript into the windows of dbm,
+// and uploads them. Windows are rotated by the commit time of the txs instead
+// of the wall clock, when it is a window interval past the first tx of the
+// window, so a transcript is always split in the same windows. It returns the
+// number of txs replayed.
+//
+// The db manager must rotate manually and have no current db.
+func ReplayTranscript(ctx context.Context, r io.Reader, dbm *DBManager) (int, error) {
+	if err := dbm.NewDB(ctx); err != nil {
+		return 0, err
+	}
+
+	n, err := replayTxs(ctx, r, dbm)
+	if err != nil {
+		return n, err
+	}
+
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+	if err := dbm.flush(ctx); err != nil {
+		return n, fmt.Errorf("upload last window: %s", err)
+	}
+
+	return n, nil
+}
+
+func replayTxs(ctx context.Context, r io.Reader, dbm *DBManager) (int, error) {
+	var start time.Time
+	n := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxTranscriptLine)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		tx := &pgrepl.Tx{}
+		if err := json.Unmarshal(scanner.Bytes(), tx); err != nil {
+			dbm.Close()
+			return n, fmt.Errorf("decode tx %d: %s", n+1, err)
+		}
+
+		commitTime, err := tx.CommitTime()
+		if err != nil {
+			dbm.Close()
+			return n, fmt.Errorf("tx %d: %s", n+1, err)
+		}
+		if !commitTime.IsZero() {
+			if start.IsZero() {
+				start = commitTime
+			} else if dbm.windowInterval > 0 && commitTime.Sub(start) >= dbm.windowInterval {
+				slog.Info("window interval passed", "commit_time", commitTime)
+				// a failed rotation leaves the db manager closed, or the
+				// window in place to be uploaded by the next run
+				if err := dbm.Rotate(ctx); err != nil {
+					return n, fmt.Errorf("rotate window: %s", err)
+				}
+				start = commitTime
+			}
+		}
+
+		if err := dbm.Replay(ctx, tx); err != nil {
+			dbm.Close()
+			return n, fmt.Errorf("replay tx %d: %s", n+1, err)
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		dbm.Close()
+		return n, fmt.Errorf("read transcript: %s", err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,66 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
+)
+
+func TestReadTableSchemas(t *testing.T) {
+	schemas, err := ReadTableSchemas(strings.NewReader(`[{"table": "t", "columns": [
+		{"name": "id", "type": "integer", "nullable": false, "primary": true},
+		{"name": "name", "type": "text", "nullable": true, "primary": false}
+	]}]`))
+	require.NoError(t, err)
+	require.Equal(t, []TableSchema{{"t", []Column{
+		{Name: "id", Typ: "integer", IsNull: false, IsPrimary: true},
+		{Name: "name", Typ: "text", IsNull: true, IsPrimary: false},
+	}}}, schemas)
+
+	_, err = ReadTableSchemas(strings.NewReader(`[{"table": "t"}]`))
+	require.Error(t, err)
+}
+
+func TestReplayTranscript(t *testing.T) {
+	ctx := context.Background()
+	privateKey, err := crypto.HexToECDSA(pk)
+	require.NoError(t, err)
+
+	// record a transcript of txs committed over two hours
+	var transcript bytes.Buffer
+	w := NewTranscriptWriter(&transcript)
+	for i, ts := range []string{
+		"2023-08-22 14:00:00.000000-03",
+		"2023-08-22 14:30:00.000000-03",
+		"2023-08-22 16:00:00.000000-03",
+	} {
+		r := walRecord("I", testTable, nil, []string{`1`, `2`, `3`}[i], `"a"`)
+		r.Timestamp = ts
+		require.NoError(t, w.Write(&pgrepl.Tx{CommitLSN: 100, Records: []pgrepl.Record{r}}))
+	}
+
+	provider := &countingProviderMock{}
+	dir := t.TempDir()
+	uploader := NewVaultsUploader(testNS, testTable, provider, privateKey)
+	dbm := NewDBManager(dir, []TableSchema{{testTable, cols}}, time.Hour, uploader)
+	dbm.RotateManually()
+
+	n, err := ReplayTranscript(ctx, &transcript, dbm)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	// the first two txs are in one window, the last one in another
+	require.Equal(t, 2, provider.writes)
+
+	// and no window is left behind
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
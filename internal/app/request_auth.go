@@ -0,0 +1,70 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tablelandnetwork/basin-cli/pkg/signing"
+)
+
+// DefaultRequestTTL is how long a signed request is valid for.
+const DefaultRequestTTL = 5 * time.Minute
+
+// SignedRequest is a request that changes a vault, and must be signed by
+// the vault's account.
+type SignedRequest interface {
+	// Message returns the message that is signed. It includes every
+	// parameter of the request, and its nonce and expiry.
+	Message() []byte
+}
+
+// RequestAuth authenticates a SignedRequest with the EIP-191 signature of its
+// message. The nonce and expiry prevent the signature from being replayed.
+type RequestAuth struct {
+	Nonce     string
+	Expiry    Timestamp
+	Signature string
+}
+
+// NewRequestAuth creates a RequestAuth with a random nonce that expires after ttl.
+// Its signature is set with SignRequest.
+func NewRequestAuth(ttl time.Duration) (RequestAuth, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return RequestAuth{}, fmt.Errorf("nonce: %s", err)
+	}
+
+	return RequestAuth{
+		Nonce:  hex.EncodeToString(nonce),
+		Expiry: NewTimestamp(time.Now().Add(ttl).UTC()),
+	}, nil
+}
+
+// SignRequest returns the hex encoded EIP-191 signature of the request's message.
+func SignRequest(pk *ecdsa.PrivateKey, req SignedRequest) (string, error) {
+	signature, err := signing.NewSigner(pk).SignMessage(req.Message())
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(signature), nil
+}
+
+// requestMessage builds the message of a signed request, with a line for the action,
+// one for each key and value pair in fields, and the nonce and expiry.
+func requestMessage(action string, vault Vault, auth RequestAuth, fields ...string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Vaults request: %s\n", action)
+	fmt.Fprintf(&b, "vault: %s\n", vault)
+	for i := 0; i+1 < len(fields); i += 2 {
+		fmt.Fprintf(&b, "%s: %s\n", fields[i], fields[i+1])
+	}
+	fmt.Fprintf(&b, "nonce: %s\n", auth.Nonce)
+	fmt.Fprintf(&b, "expiry: %d", auth.Expiry.Seconds())
+
+	return []byte(b.String())
+}
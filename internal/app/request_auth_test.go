@@ -0,0 +1,47 @@
+package app
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+	"github.com/tablelandnetwork/basin-cli/pkg/signing"
+)
+
+func TestRequestMessage(t *testing.T) {
+	account, err := NewAccount("0xFA0081C0Cf4CCC2d9Ca766a2F26dc05BF77b3317")
+	require.NoError(t, err)
+	auth := RequestAuth{Nonce: "abc", Expiry: NewTimestamp(time.Unix(1700000000, 0))}
+
+	require.Equal(t, "Vaults request: create vault\n"+
+		"vault: my.vault\n"+
+		"account: 0xFA0081C0Cf4CCC2d9Ca766a2F26dc05BF77b3317\n"+
+		"cache: 10\n"+
+		"nonce: abc\n"+
+		"expiry: 1700000000",
+		string(CreateVaultParams{Vault: "my.vault", Account: account, CacheDuration: 10, Auth: auth}.Message()))
+	require.Equal(t, "Vaults request: delete vault\nvault: my.vault\nnonce: abc\nexpiry: 1700000000",
+		string(DeleteVaultParams{Vault: "my.vault", Auth: auth}.Message()))
+}
+
+func TestSignRequest(t *testing.T) {
+	pk, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	auth, err := NewRequestAuth(DefaultRequestTTL)
+	require.NoError(t, err)
+	require.Len(t, auth.Nonce, 32)
+	require.Greater(t, auth.Expiry.Seconds(), time.Now().Unix())
+
+	req := UpdateVaultParams{Vault: "my.vault", CacheDuration: 60, Auth: auth}
+	req.Auth.Signature, err = SignRequest(pk, req)
+	require.NoError(t, err)
+
+	sig, err := hex.DecodeString(req.Auth.Signature)
+	require.NoError(t, err)
+	signer, err := signing.RecoverMessageSigner(req.Message(), sig)
+	require.NoError(t, err)
+	require.Equal(t, crypto.PubkeyToAddress(pk.PublicKey), signer)
+}
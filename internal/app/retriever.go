@@ -2,232 +2,245 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path"
+	"strings"
+	"time"
 
-	"github.com/filecoin-project/lassie/pkg/lassie"
-	"github.com/filecoin-project/lassie/pkg/storage"
-	"github.com/filecoin-project/lassie/pkg/types"
 	"github.com/ipfs/go-cid"
-	"github.com/ipld/go-car/v2"
-	carstorage "github.com/ipld/go-car/v2/storage"
-	"github.com/ipld/go-car/v2/storage/deferred"
-	trustlessutils "github.com/ipld/go-trustless-utils"
+	"golang.org/x/exp/slog"
 )
 
+// ErrUnsupportedCID is an error when a CID cannot be retrieved by any source.
+var ErrUnsupportedCID = errors.New("unsupported CID")
+
+// fetched is content retrieved from a store, as a verified CAR in a temporary file.
+type fetched struct {
+	car      string
+	filename string
+	source   string
+}
+
+func (f *fetched) remove() {
+	_ = os.Remove(f.car)
+}
+
 type retriever interface {
-	retrieveStdout(context.Context, cid.Cid, int64) error
-	retrieveFile(context.Context, cid.Cid, string, int64) error
+	fetch(context.Context, cid.Cid) (*fetched, error)
 }
 
 // Retriever is responsible for retrieving file from the network.
 type Retriever struct {
 	store   retriever
-	timeout int64
+	keepCAR bool
 }
 
-// NewRetriever creates a new Retriever.
+// NewRetriever creates a new Retriever that tries the provider's cache,
+// then the network with lassie.
 func NewRetriever(provider VaultsProvider, timeout int64) *Retriever {
-	return &Retriever{
-		store: &coldStore{
-			retriever: &cacheStore{
-				provider: provider,
-			},
-		},
-		timeout: timeout,
-	}
+	r, _ := NewRetrieverWithSources(provider, timeout, DefaultRetrievalSources())
+	return r
 }
 
-// Retrieve retrieves file from the network.
-func (r *Retriever) Retrieve(ctx context.Context, c cid.Cid, output string) error {
-	if output == "-" || output == "" {
-		return r.store.retrieveStdout(ctx, c, r.timeout)
+// NewRetrieverWithSources creates a new Retriever that tries the sources in order.
+// The timeout, in seconds, applies to the whole retrieval.
+func NewRetrieverWithSources(provider VaultsProvider, timeout int64, sources []RetrievalSource) (*Retriever, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no retrieval sources")
 	}
 
-	return r.store.retrieveFile(ctx, c, output, r.timeout)
-}
+	chain := &chainStore{timeout: time.Duration(timeout) * time.Second}
+	for _, s := range sources {
+		r, err := s.build(provider)
+		if err != nil {
+			return nil, fmt.Errorf("%s source: %s", s.Kind, err)
+		}
+		chain.sources = append(chain.sources, chainSource{
+			name:    s.Kind,
+			store:   r,
+			timeout: s.Timeout,
+		})
+	}
 
-type cacheStore struct {
-	provider VaultsProvider
+	return &Retriever{store: chain}, nil
 }
 
-func (cs *cacheStore) retrieveStdout(ctx context.Context, cid cid.Cid, timeout int64) error {
-	if _, err := cs.provider.RetrieveEvent(ctx, RetrieveEventParams{
-		Timeout: timeout,
-		CID:     cid,
-	}, os.Stdout); err != nil {
-		return fmt.Errorf("failed to retrieve to file: %s", err)
-	}
-
-	return nil
+// KeepCAR makes the retriever write the verified CAR instead of the extracted file.
+func (r *Retriever) KeepCAR(keep bool) {
+	r.keepCAR = keep
 }
 
-func (cs *cacheStore) retrieveFile(ctx context.Context, cid cid.Cid, output string, timeout int64) error {
-	f, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE, 0o666)
+// Retrieve retrieves file from the network. Every block is verified against
+// the CID before anything is written to output. It returns the source that
+// served the content.
+func (r *Retriever) Retrieve(ctx context.Context, c cid.Cid, output string) (string, error) {
+	f, err := r.store.fetch(ctx, c)
 	if err != nil {
-		return fmt.Errorf("failed to open tmp file: %s", err)
+		return "", err
 	}
-	defer func() {
-		_ = f.Close()
-	}()
+	defer f.remove()
 
-	_, _ = f.Seek(0, io.SeekStart)
-	_, err = cs.provider.RetrieveEvent(ctx, RetrieveEventParams{
-		Timeout: timeout,
-		CID:     cid,
-	}, f)
+	w, closeFn, err := openOutput(output)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve to file: %s", err)
+		return "", err
 	}
+	defer closeFn()
 
-	return nil
-}
-
-type coldStore struct {
-	retriever retriever
-}
-
-func (cs *coldStore) retrieveFile(ctx context.Context, c cid.Cid, output string, timeout int64) error {
-	// try cache first. no matter the error try cold store
-	err := cs.retriever.retrieveFile(ctx, c, output, timeout)
-	if err == nil {
-		return nil
+	if !r.keepCAR {
+		return f.source, extractCAR(ctx, f.car, c, w)
 	}
 
-	lassie, err := lassie.NewLassie(ctx)
+	carFile, err := os.Open(f.car)
 	if err != nil {
-		return fmt.Errorf("failed to create lassie instance: %s", err)
+		return "", fmt.Errorf("open car: %s", err)
 	}
+	defer func() {
+		_ = carFile.Close()
+	}()
 
-	carOpts := []car.Option{
-		car.WriteAsCarV1(true),
-		car.StoreIdentityCIDs(false),
-		car.UseWholeCIDs(false),
+	if _, err := io.Copy(w, carFile); err != nil {
+		return "", fmt.Errorf("write car: %s", err)
 	}
 
-	carPath := path.Join(".", fmt.Sprintf("%s.car", c.String()))
-	carWriter := deferred.NewDeferredCarWriterForPath(carPath, []cid.Cid{c}, carOpts...)
+	return f.source, nil
+}
 
-	carStore := storage.NewCachingTempStore(
-		carWriter.BlockWriteOpener(), storage.NewDeferredStorageCar(os.TempDir(), c),
-	)
-	defer func() {
-		_ = carStore.Close()
-	}()
+func openOutput(output string) (io.Writer, func(), error) {
+	if output == "-" || output == "" {
+		return os.Stdout, func() {}, nil
+	}
 
-	request, err := types.NewRequestForPath(carStore, c, "", trustlessutils.DagScopeAll, nil)
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %s", err)
+		return nil, nil, fmt.Errorf("failed to open output file: %s", err)
 	}
 
-	if _, err := lassie.Fetch(ctx, request, []types.FetchOption{}...); err != nil {
-		return fmt.Errorf("failed to fetch: %s", err)
-	}
+	return f, func() {
+		_ = f.Close()
+	}, nil
+}
 
-	carFile, err := os.Open(carPath)
+func tempCARPath(c cid.Cid) (string, error) {
+	f, err := os.CreateTemp("", fmt.Sprintf("%s-*.car", c.String()))
 	if err != nil {
-		return fmt.Errorf("opening car file: %s", err)
+		return "", fmt.Errorf("failed to create temporary file: %s", err)
 	}
-	defer func() {
-		_ = os.Remove(carFile.Name())
-		_ = carFile.Close()
-	}()
+	_ = f.Close()
 
-	rc, err := extract(carFile)
-	if err != nil {
-		return fmt.Errorf("extract: %s", err)
+	return f.Name(), nil
+}
+
+type chainSource struct {
+	name    string
+	store   retriever
+	timeout time.Duration
+}
+
+// chainStore tries its sources in order until one of them serves the content.
+type chainStore struct {
+	sources []chainSource
+	timeout time.Duration
+}
+
+func (cs *chainStore) fetch(ctx context.Context, c cid.Cid) (*fetched, error) {
+	if !c.Defined() || (c.Prefix().Codec != cid.Raw && c.Prefix().Codec != cid.DagProtobuf) {
+		return nil, ErrUnsupportedCID
 	}
 
-	f, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE, 0o666)
-	if err != nil {
-		return fmt.Errorf("failed to open tmp file: %s", err)
+	if cs.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cs.timeout)
+		defer cancel()
 	}
-	defer func() {
-		_ = f.Close()
-	}()
 
-	if _, err := io.Copy(f, rc); err != nil {
-		return fmt.Errorf("failed to write to stdout: %s", err)
+	errs := []string{}
+	for _, s := range cs.sources {
+		f, err := cs.fetchFrom(ctx, s, c)
+		if err == nil {
+			f.source = s.name
+			slog.Debug("retrieved", "cid", c, "source", s.name)
+			return f, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", s.name, err))
+
+		// the retrieval was canceled or ran out of time,
+		// so there is no point in trying other sources
+		if ctx.Err() != nil {
+			break
+		}
+		slog.Debug("retrieval failed, trying the next source", "cid", c, "source", s.name, "error", err)
 	}
 
-	return nil
+	return nil, fmt.Errorf("failed to retrieve %s: %s", c, strings.Join(errs, "; "))
 }
 
-func (cs *coldStore) retrieveStdout(ctx context.Context, c cid.Cid, timeout int64) error {
-	// try cache first. no matter the error try cold store
-	err := cs.retriever.retrieveStdout(ctx, c, timeout)
-	if err == nil {
-		return nil
+func (cs *chainStore) fetchFrom(ctx context.Context, s chainSource, c cid.Cid) (*fetched, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
 	}
 
-	lassie, err := lassie.NewLassie(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to create lassie instance: %s", err)
-	}
+	return s.store.fetch(ctx, c)
+}
 
-	carOpts := []car.Option{
-		car.WriteAsCarV1(true),
-		car.StoreIdentityCIDs(false),
-		car.UseWholeCIDs(false),
-	}
+type cacheStore struct {
+	provider VaultsProvider
+}
 
-	// Create a temporary file only for writing to stdout case
-	tmpFile, err := os.CreateTemp("", fmt.Sprintf("%s.car", c.String()))
+// fetch downloads the file from the provider's cache and checks it against the CID.
+func (cs *cacheStore) fetch(ctx context.Context, c cid.Cid) (*fetched, error) {
+	raw, err := os.CreateTemp("", c.String())
 	if err != nil {
-		return fmt.Errorf("failed to create temporary file: %s", err)
+		return nil, fmt.Errorf("failed to create temporary file: %s", err)
 	}
 	defer func() {
-		_ = os.Remove(tmpFile.Name())
-	}()
-	carWriter := deferred.NewDeferredCarWriterForPath(tmpFile.Name(), []cid.Cid{c}, carOpts...)
-
-	carStore := storage.NewCachingTempStore(
-		carWriter.BlockWriteOpener(), storage.NewDeferredStorageCar(os.TempDir(), c),
-	)
-	defer func() {
-		_ = carStore.Close()
+		_ = raw.Close()
+		_ = os.Remove(raw.Name())
 	}()
 
-	request, err := types.NewRequestForPath(carStore, c, "", trustlessutils.DagScopeAll, nil)
+	filename, err := cs.provider.RetrieveEvent(ctx, RetrieveEventParams{
+		CID: c,
+	}, raw)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %s", err)
-	}
-
-	if _, err := lassie.Fetch(ctx, request, []types.FetchOption{}...); err != nil {
-		return fmt.Errorf("failed to fetch: %s", err)
+		return nil, fmt.Errorf("failed to retrieve from cache: %s", err)
 	}
 
-	_, _ = tmpFile.Seek(0, io.SeekStart)
-	rc, err := extract(tmpFile)
+	carPath, err := tempCARPath(c)
 	if err != nil {
-		return fmt.Errorf("extract: %s", err)
+		return nil, err
 	}
 
-	_, err = io.Copy(os.Stdout, rc)
-	if err != nil {
-		return fmt.Errorf("failed to write to stdout: %s", err)
+	if err := fileToCAR(ctx, raw, c, carPath); err != nil {
+		_ = os.Remove(carPath)
+		return nil, err
 	}
 
-	return nil
+	return &fetched{car: carPath, filename: filename}, nil
+}
+
+// carStore fetches the DAG under a CID into a CAR file, and verifies it.
+type carStore struct {
+	fetchCAR func(context.Context, cid.Cid, string) error
 }
 
-func extract(f *os.File) (io.ReadCloser, error) {
-	store, err := carstorage.OpenReadable(f)
+func (cs *carStore) fetch(ctx context.Context, c cid.Cid) (*fetched, error) {
+	carPath, err := tempCARPath(c)
 	if err != nil {
 		return nil, err
 	}
 
-	blkCid, err := cid.Parse(store.Roots()[0].String())
-	if err != nil {
+	if err := cs.fetchCAR(ctx, c, carPath); err != nil {
+		_ = os.Remove(carPath)
 		return nil, err
 	}
 
-	rc, err := store.GetStream(context.Background(), blkCid.KeyString())
-	if err != nil {
-		return nil, err
+	if err := verifyCAR(carPath, c); err != nil {
+		_ = os.Remove(carPath)
+		return nil, fmt.Errorf("verify car: %s", err)
 	}
 
-	return rc, nil
+	return &fetched{car: carPath}, nil
 }
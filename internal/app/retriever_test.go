@@ -1,22 +1,39 @@
 package app
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/stretchr/testify/require"
 )
 
+const (
+	// roots of the fixture CARs in testdata
+	unixfsCID = "bafybeiaay4g3mlaqxkax7c4izudagkcsya7ppddllcgqwxjbapwrygr7pa"
+	rawCID    = "bafkreibnxihnoiinlw5y44hzsul2mgdczny2nnzckzkjurprtljsv65cny"
+)
+
 func TestRetrieverFileOutput(t *testing.T) {
 	retriever := NewRetriever(&vaultsProviderMock{}, 0)
 	output, err := os.CreateTemp("", "")
 	require.NoError(t, err)
-	cid := cid.Cid{}
-	err = retriever.Retrieve(context.Background(), cid, output.Name())
+	cid, err := ChunkCID([]byte("Hello"))
+	require.NoError(t, err)
+	source, err := retriever.Retrieve(context.Background(), cid, output.Name())
 	require.NoError(t, err)
+	require.Equal(t, SourceProvider, source)
 
 	_, _ = output.Seek(0, 0)
 	data, err := io.ReadAll(output)
@@ -32,7 +49,9 @@ func TestRetrieverStdoutOutput(t *testing.T) {
 
 	retriever := NewRetriever(&vaultsProviderMock{}, 0)
 
-	err := retriever.Retrieve(context.Background(), cid.Cid{}, "-")
+	cid, err := ChunkCID([]byte("Hello"))
+	require.NoError(t, err)
+	_, err = retriever.Retrieve(context.Background(), cid, "-")
 	require.NoError(t, err)
 
 	_ = w.Close()
@@ -41,3 +60,281 @@ func TestRetrieverStdoutOutput(t *testing.T) {
 
 	require.Equal(t, []byte("Hello"), data)
 }
+
+func TestRetrieverReassemblesUnixFSFile(t *testing.T) {
+	retriever := newFixtureRetriever(t, "testdata/unixfs.car")
+	output := path.Join(t.TempDir(), "output")
+
+	_, err := retriever.Retrieve(context.Background(), cid.MustParse(unixfsCID), output)
+	require.NoError(t, err)
+
+	expected, err := os.ReadFile("testdata/unixfs.txt")
+	require.NoError(t, err)
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+}
+
+func TestRetrieverRawBlock(t *testing.T) {
+	retriever := newFixtureRetriever(t, "testdata/raw.car")
+	output := path.Join(t.TempDir(), "output")
+
+	_, err := retriever.Retrieve(context.Background(), cid.MustParse(rawCID), output)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello from a raw block"), data)
+}
+
+func TestRetrieverKeepCAR(t *testing.T) {
+	retriever := newFixtureRetriever(t, "testdata/unixfs.car")
+	retriever.KeepCAR(true)
+	output := path.Join(t.TempDir(), "output.car")
+
+	_, err := retriever.Retrieve(context.Background(), cid.MustParse(unixfsCID), output)
+	require.NoError(t, err)
+
+	expected, err := os.ReadFile("testdata/unixfs.car")
+	require.NoError(t, err)
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+}
+
+func TestRetrieverRejectsCorruptedCAR(t *testing.T) {
+	buf, err := os.ReadFile("testdata/unixfs.car")
+	require.NoError(t, err)
+
+	// flip a byte of the file content stored in the blocks
+	i := bytes.Index(buf, []byte("lazy dog"))
+	require.NotEqual(t, -1, i)
+	buf[i] = 'L'
+	corrupted := path.Join(t.TempDir(), "corrupted.car")
+	require.NoError(t, os.WriteFile(corrupted, buf, 0o644))
+
+	retriever := newFixtureRetriever(t, corrupted)
+	output := path.Join(t.TempDir(), "output")
+
+	_, err = retriever.Retrieve(context.Background(), cid.MustParse(unixfsCID), output)
+	require.Error(t, err)
+	require.NoFileExists(t, output)
+}
+
+func TestRetrieverRejectsMismatchedCacheContent(t *testing.T) {
+	// the mock returns "Hello", which does not match the CID, so the
+	// retriever must fall back to the network
+	networkCalls := 0
+	retriever := &Retriever{
+		store: &chainStore{sources: []chainSource{
+			{name: SourceProvider, store: &cacheStore{provider: &vaultsProviderMock{}}},
+			{name: SourceLassie, store: &carStore{
+				fetchCAR: func(context.Context, cid.Cid, string) error {
+					networkCalls++
+					return errors.New("not available")
+				},
+			}},
+		}},
+	}
+
+	c, err := ChunkCID([]byte("Goodbye"))
+	require.NoError(t, err)
+	_, err = retriever.Retrieve(context.Background(), c, path.Join(t.TempDir(), "output"))
+	require.Error(t, err)
+	require.Equal(t, 1, networkCalls)
+
+	_, err = (&cacheStore{provider: &vaultsProviderMock{}}).fetch(context.Background(), c)
+	require.ErrorIs(t, err, ErrContentMismatch)
+}
+
+func TestRetrieverGatewaySource(t *testing.T) {
+	// a file server laid out as <dir>/ipfs/<cid> stands in for a trustless gateway
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(path.Join(dir, "ipfs"), 0o755))
+	buf, err := os.ReadFile("testdata/unixfs.car")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path.Join(dir, "ipfs", unixfsCID), buf, 0o644))
+	gateway := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer gateway.Close()
+
+	retriever, err := NewRetrieverWithSources(&cacheMissProviderMock{}, 0, []RetrievalSource{
+		{Kind: SourceProvider},
+		{Kind: SourceGateway, URL: gateway.URL},
+	})
+	require.NoError(t, err)
+
+	output := path.Join(t.TempDir(), "output")
+	source, err := retriever.Retrieve(context.Background(), cid.MustParse(unixfsCID), output)
+	require.NoError(t, err)
+	require.Equal(t, SourceGateway, source)
+
+	expected, err := os.ReadFile("testdata/unixfs.txt")
+	require.NoError(t, err)
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+
+	// content the gateway does not have is an error
+	_, err = retriever.Retrieve(context.Background(), cid.MustParse(rawCID), output)
+	require.ErrorContains(t, err, "gateway: gateway responded with status 404")
+}
+
+func TestRetrieverSourceTimeoutFallsBack(t *testing.T) {
+	retriever := &Retriever{
+		store: &chainStore{sources: []chainSource{
+			{name: "slow", timeout: 10 * time.Millisecond, store: &carStore{
+				fetchCAR: func(ctx context.Context, _ cid.Cid, _ string) error {
+					<-ctx.Done()
+					return ctx.Err()
+				},
+			}},
+			{name: "fixture", store: newFixtureRetriever(t, "testdata/raw.car").store},
+		}},
+	}
+
+	source, err := retriever.Retrieve(context.Background(), cid.MustParse(rawCID), path.Join(t.TempDir(), "output"))
+	require.NoError(t, err)
+	require.Equal(t, "fixture", source)
+}
+
+func TestRetrieverDoesNotFallBack(t *testing.T) {
+	calls := 0
+	counting := &carStore{
+		fetchCAR: func(ctx context.Context, _ cid.Cid, _ string) error {
+			calls++
+			return ctx.Err()
+		},
+	}
+	retriever := &Retriever{
+		store: &chainStore{sources: []chainSource{
+			{name: "first", store: counting},
+			{name: "second", store: counting},
+		}},
+	}
+	output := path.Join(t.TempDir(), "output")
+
+	// a CID that no source can serve
+	_, err := retriever.Retrieve(context.Background(), cid.Undef, output)
+	require.ErrorIs(t, err, ErrUnsupportedCID)
+	c, err := cid.Parse("bafyreigdmqpykrgxyaxtlafqpqhzrb7qy2rh75nldvfd4tucqmqqme5yby")
+	require.NoError(t, err)
+	_, err = retriever.Retrieve(context.Background(), c, output)
+	require.ErrorIs(t, err, ErrUnsupportedCID)
+	require.Equal(t, 0, calls)
+
+	// a canceled retrieval
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = retriever.Retrieve(ctx, cid.MustParse(rawCID), output)
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestRetrievalSourceValidate(t *testing.T) {
+	require.NoError(t, RetrievalSource{Kind: SourceGateway, URL: "https://trustless-gateway.link"}.Validate())
+	require.NoError(t, RetrievalSource{Kind: SourceLassie, Protocols: "bitswap,http"}.Validate())
+	require.Error(t, RetrievalSource{Kind: SourceGateway, URL: "trustless-gateway.link"}.Validate())
+	require.Error(t, RetrievalSource{Kind: SourceLassie, Protocols: "carrier-pigeon"}.Validate())
+	require.Error(t, RetrievalSource{Kind: SourceLassie, DenyProviders: []string{"not-a-peer"}}.Validate())
+	require.Error(t, RetrievalSource{Kind: "ftp"}.Validate())
+}
+
+func TestRetrieverCacheUnixFSFile(t *testing.T) {
+	content, err := os.ReadFile("testdata/unixfs.txt")
+	require.NoError(t, err)
+
+	// content retrieved from the cache is rebuilt into a DAG to be checked
+	// against the CID, using the default chunker
+	c := unixfsRoot(t, content)
+	cs := &cacheStore{provider: &contentProviderMock{content: content}}
+	f, err := cs.fetch(context.Background(), c)
+	require.NoError(t, err)
+	defer f.remove()
+	require.Equal(t, "sample.txt", f.filename)
+	require.NoError(t, verifyCAR(f.car, c))
+
+	var out bytes.Buffer
+	require.NoError(t, extractCAR(context.Background(), f.car, c, &out))
+	require.Equal(t, content, out.Bytes())
+}
+
+func TestBatchRetrieverListEventsPages(t *testing.T) {
+	provider := &pagingProviderMock{total: 250}
+	batch := NewBatchRetriever(provider, nil, 1)
+
+	events, err := batch.ListEvents(context.Background(), "test.data", Timestamp{}, Timestamp{})
+	require.NoError(t, err)
+	require.Len(t, events, 250)
+	require.Equal(t, 3, provider.calls)
+}
+
+// newFixtureRetriever returns a Retriever whose cache always misses
+// and whose network fetch copies the CAR at carPath.
+func newFixtureRetriever(t *testing.T, carPath string) *Retriever {
+	t.Helper()
+
+	return &Retriever{
+		store: &chainStore{sources: []chainSource{
+			{name: SourceProvider, store: &cacheStore{provider: &cacheMissProviderMock{}}},
+			{name: SourceLassie, store: &carStore{
+				fetchCAR: func(_ context.Context, _ cid.Cid, dst string) error {
+					buf, err := os.ReadFile(carPath)
+					if err != nil {
+						return err
+					}
+					return os.WriteFile(dst, buf, 0o644)
+				},
+			}},
+		}},
+	}
+}
+
+type cacheMissProviderMock struct {
+	vaultsProviderMock
+}
+
+func (bp *cacheMissProviderMock) RetrieveEvent(
+	_ context.Context, _ RetrieveEventParams, _ io.Writer,
+) (string, error) {
+	return "", ErrNotFoundInCache
+}
+
+type contentProviderMock struct {
+	vaultsProviderMock
+	content []byte
+}
+
+func (bp *contentProviderMock) RetrieveEvent(
+	_ context.Context, _ RetrieveEventParams, w io.Writer,
+) (string, error) {
+	_, _ = w.Write(bp.content)
+	return "sample.txt", nil
+}
+
+func unixfsRoot(t *testing.T, content []byte) cid.Cid {
+	t.Helper()
+
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetWriteStorage(discardStorage{})
+	link, _, err := builder.BuildUnixFSFile(bytes.NewReader(content), unixfsChunkers[0], &lsys)
+	require.NoError(t, err)
+
+	return link.(cidlink.Link).Cid
+}
+
+type pagingProviderMock struct {
+	vaultsProviderMock
+	total int
+	calls int
+}
+
+func (bp *pagingProviderMock) ListVaultEvents(
+	_ context.Context, params ListVaultEventsParams,
+) ([]EventInfo, error) {
+	bp.calls++
+	events := []EventInfo{}
+	for i := int(params.Offset); i < bp.total && i < int(params.Offset+params.Limit); i++ {
+		events = append(events, EventInfo{CID: fmt.Sprintf("event-%d", i), Timestamp: int64(i)})
+	}
+	return events, nil
+}
@@ -0,0 +1,213 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/lassie"
+	"github.com/filecoin-project/lassie/pkg/storage"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage/deferred"
+	trustlessutils "github.com/ipld/go-trustless-utils"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multicodec"
+)
+
+// Kinds of retrieval sources.
+const (
+	// SourceProvider retrieves from the cache of the vaults provider.
+	SourceProvider = "provider"
+
+	// SourceGateway retrieves from a trustless IPFS HTTP gateway.
+	SourceGateway = "gateway"
+
+	// SourceLassie retrieves from the network with lassie.
+	SourceLassie = "lassie"
+)
+
+// RetrievalSource is a source the Retriever can get content from.
+type RetrievalSource struct {
+	// Kind is one of SourceProvider, SourceGateway or SourceLassie.
+	Kind string
+
+	// URL is the base URL of the gateway.
+	URL string
+
+	// Timeout limits the time spent on this source. Zero means no limit.
+	Timeout time.Duration
+
+	// Protocols restricts the protocols used by lassie, e.g. "bitswap,http".
+	Protocols string
+
+	// AllowProviders and DenyProviders are peer IDs of storage providers
+	// lassie can or cannot retrieve from.
+	AllowProviders []string
+	DenyProviders  []string
+}
+
+// DefaultRetrievalSources returns the provider cache followed by lassie.
+func DefaultRetrievalSources() []RetrievalSource {
+	return []RetrievalSource{
+		{Kind: SourceProvider},
+		{Kind: SourceLassie},
+	}
+}
+
+// Validate checks that the source is well formed.
+func (s RetrievalSource) Validate() error {
+	_, err := s.build(nil)
+	return err
+}
+
+func (s RetrievalSource) build(provider VaultsProvider) (retriever, error) {
+	switch s.Kind {
+	case SourceProvider:
+		return &cacheStore{provider: provider}, nil
+	case SourceGateway:
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid gateway url %q", s.URL)
+		}
+		gw := &gatewayStore{url: strings.TrimSuffix(s.URL, "/"), client: http.DefaultClient}
+		return &carStore{fetchCAR: gw.fetchCAR}, nil
+	case SourceLassie:
+		ls := &lassieStore{}
+		if s.Protocols != "" {
+			protocols, err := types.ParseProtocolsString(s.Protocols)
+			if err != nil {
+				return nil, fmt.Errorf("invalid protocols: %s", err)
+			}
+			ls.protocols = protocols
+		}
+
+		var err error
+		if ls.allow, err = parsePeers(s.AllowProviders); err != nil {
+			return nil, err
+		}
+		if ls.deny, err = parsePeers(s.DenyProviders); err != nil {
+			return nil, err
+		}
+		return &carStore{fetchCAR: ls.fetchCAR}, nil
+	default:
+		return nil, fmt.Errorf("unknown retrieval source %q", s.Kind)
+	}
+}
+
+func parsePeers(ids []string) (map[peer.ID]bool, error) {
+	peers := map[peer.ID]bool{}
+	for _, id := range ids {
+		p, err := peer.Decode(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid provider peer id %s: %s", id, err)
+		}
+		peers[p] = true
+	}
+
+	return peers, nil
+}
+
+// gatewayStore fetches CARs from a trustless gateway,
+// as specified in https://specs.ipfs.tech/http-gateways/trustless-gateway.
+type gatewayStore struct {
+	url    string
+	client *http.Client
+}
+
+func (gs *gatewayStore) fetchCAR(ctx context.Context, c cid.Cid, carPath string) error {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, fmt.Sprintf("%s/ipfs/%s?format=car&dag-scope=all", gs.url, c), nil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %s", err)
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.car")
+
+	resp, err := gs.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %s", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gateway responded with status %d", resp.StatusCode)
+	}
+
+	f, err := os.OpenFile(carPath, os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("open car: %s", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return fmt.Errorf("download car: %s", err)
+	}
+
+	return f.Close()
+}
+
+// lassieStore fetches CARs from the network with lassie.
+type lassieStore struct {
+	protocols []multicodec.Code
+	allow     map[peer.ID]bool
+	deny      map[peer.ID]bool
+}
+
+func (ls *lassieStore) fetchCAR(ctx context.Context, c cid.Cid, carPath string) error {
+	opts := []lassie.LassieOption{}
+	if len(ls.protocols) > 0 {
+		opts = append(opts, lassie.WithProtocols(ls.protocols))
+	}
+	if len(ls.allow) > 0 {
+		opts = append(opts, lassie.WithProviderAllowList(ls.allow))
+	}
+	if len(ls.deny) > 0 {
+		opts = append(opts, lassie.WithProviderBlockList(ls.deny))
+	}
+
+	l, err := lassie.NewLassie(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create lassie instance: %s", err)
+	}
+
+	carOpts := []car.Option{
+		car.WriteAsCarV1(true),
+		car.StoreIdentityCIDs(false),
+		car.UseWholeCIDs(false),
+	}
+
+	carWriter := deferred.NewDeferredCarWriterForPath(carPath, []cid.Cid{c}, carOpts...)
+	defer func() {
+		_ = carWriter.Close()
+	}()
+
+	carStore := storage.NewCachingTempStore(
+		carWriter.BlockWriteOpener(), storage.NewDeferredStorageCar(os.TempDir(), c),
+	)
+	defer func() {
+		_ = carStore.Close()
+	}()
+
+	request, err := types.NewRequestForPath(carStore, c, "", trustlessutils.DagScopeAll, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %s", err)
+	}
+	request.Protocols = ls.protocols
+
+	if _, err := l.Fetch(ctx, request); err != nil {
+		return fmt.Errorf("failed to fetch: %s", err)
+	}
+
+	return nil
+}
@@ -19,11 +19,23 @@ type Replicator interface {
 	Shutdown()
 }
 
+// Snapshotter reads the current rows of a table, in batches of insert records.
+// It returns the LSN the rows are consistent with.
+type Snapshotter interface {
+	Snapshot(ctx context.Context, schema TableSchema, fn func([]pgrepl.Record) error) (pglogrepl.LSN, error)
+}
+
 // VaultsStreamer contains logic of streaming Postgres changes to Vaults Provider.
 type VaultsStreamer struct {
 	namespace  string
 	replicator Replicator
 	dbMngr     *DBManager
+
+	snapshotter Snapshotter
+	snapshots   []TableSchema
+
+	// whether replayed txs are confirmed to the replicator
+	commits bool
 }
 
 // NewVaultsStreamer creates new streamer.
@@ -32,9 +44,25 @@ func NewVaultsStreamer(ns string, r Replicator, dbm *DBManager) *VaultsStreamer
 		namespace:  ns,
 		replicator: r,
 		dbMngr:     dbm,
+		commits:    true,
 	}
 }
 
+// DisableCommits makes the streamer not confirm the replayed txs to the
+// replicator, so the replication slot is not consumed. The same txs are
+// streamed again the next time the slot is used.
+func (b *VaultsStreamer) DisableCommits() {
+	b.commits = false
+}
+
+// SnapshotTables makes the streamer load the current rows of the tables into
+// the first window, before streaming. Changes to them up to the LSN of the
+// snapshot are skipped, as they are part of it.
+func (b *VaultsStreamer) SnapshotTables(s Snapshotter, schemas []TableSchema) {
+	b.snapshotter = s
+	b.snapshots = schemas
+}
+
 // Run runs the VaultsStreamer logic.
 func (b *VaultsStreamer) Run(ctx context.Context) error {
 	// Open a local DB for replaying txs
@@ -43,6 +71,22 @@ func (b *VaultsStreamer) Run(ctx context.Context) error {
 	}
 	defer b.dbMngr.Close()
 
+	skip := map[string]pglogrepl.LSN{}
+	for _, schema := range b.snapshots {
+		// the digest of the table starts from its snapshot
+		if err := b.dbMngr.StartDigest(ctx, schema.Table); err != nil {
+			return fmt.Errorf("snapshot %s: %s", schema.Table, err)
+		}
+		lsn, err := b.snapshotter.Snapshot(ctx, schema, func(records []pgrepl.Record) error {
+			return b.dbMngr.Replay(ctx, &pgrepl.Tx{Records: records})
+		})
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %s", schema.Table, err)
+		}
+		skip[schema.Table] = lsn
+		slog.Info("table snapshot loaded", "table", schema.Table, "lsn", lsn)
+	}
+
 	// Start replication
 	txs, _, err := b.replicator.StartReplication(ctx)
 	if err != nil {
@@ -51,14 +95,48 @@ func (b *VaultsStreamer) Run(ctx context.Context) error {
 
 	for tx := range txs {
 		slog.Info("new transaction received")
+		if tx = skipSnapshotted(tx, skip); len(tx.Records) == 0 {
+			if err := b.commit(ctx, tx.CommitLSN); err != nil {
+				return err
+			}
+			continue
+		}
 		if err := b.dbMngr.Replay(ctx, tx); err != nil {
 			return fmt.Errorf("replay: %s", err)
 		}
-		if err := b.replicator.Commit(ctx, tx.CommitLSN); err != nil {
-			return fmt.Errorf("commit: %s", err)
+		if err := b.commit(ctx, tx.CommitLSN); err != nil {
+			return err
 		}
-		slog.Info("transaction acked")
 	}
 
 	return nil
 }
+
+func (b *VaultsStreamer) commit(ctx context.Context, lsn pglogrepl.LSN) error {
+	if !b.commits {
+		return nil
+	}
+	if err := b.replicator.Commit(ctx, lsn); err != nil {
+		return fmt.Errorf("commit: %s", err)
+	}
+	slog.Info("transaction acked")
+
+	return nil
+}
+
+// skipSnapshotted removes the records of tables whose snapshot already has the tx.
+func skipSnapshotted(tx *pgrepl.Tx, skip map[string]pglogrepl.LSN) *pgrepl.Tx {
+	if len(skip) == 0 {
+		return tx
+	}
+
+	records := []pgrepl.Record{}
+	for _, r := range tx.Records {
+		if lsn, ok := skip[r.Table]; ok && tx.CommitLSN <= lsn {
+			continue
+		}
+		records = append(records, r)
+	}
+
+	return &pgrepl.Tx{CommitLSN: tx.CommitLSN, Records: records}
+}
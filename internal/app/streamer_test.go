@@ -3,8 +3,10 @@ package app
 import (
 	"bufio"
 	"context"
+	"database/sql"
 	"io"
 	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
@@ -68,7 +70,7 @@ func TestVaultsStreamerOne(t *testing.T) {
 
 	// sleep for winSize time and receive next message
 	// to trigger db replacement
-	time.Sleep(winSize + 1)
+	time.Sleep(winSize + 500*time.Millisecond)
 
 	// receive second tx
 	wal2, _, err := reader.ReadLine()
@@ -101,9 +103,13 @@ func TestVaultsStreamerOne(t *testing.T) {
 	// it will upload all the parquet files in the db dir
 	ch2 := make(chan *os.File)
 	go func() {
-		// reset the db and uploader channel
+		// stop the current window once it is rotated,
+		// then reset the db and uploader channel
+		dbm.mu.Lock()
+		dbm.Close()
 		dbm.db = nil
 		dbm.dbFname = ""
+		dbm.mu.Unlock()
 		uploader.provider = &vaultsProviderMock{
 			owner:          make(map[string]string),
 			uploaderInputs: ch2,
@@ -234,6 +240,18 @@ func (bp *vaultsProviderMock) ListVaults(_ context.Context, _ ListVaultsParams)
 	return []VaultWithCacheDuration{}, nil
 }
 
+func (bp *vaultsProviderMock) GetVault(_ context.Context, _ GetVaultParams) (VaultInfo, error) {
+	return VaultInfo{}, nil
+}
+
+func (bp *vaultsProviderMock) UpdateVault(_ context.Context, _ UpdateVaultParams) error {
+	return nil
+}
+
+func (bp *vaultsProviderMock) DeleteVault(_ context.Context, _ DeleteVaultParams) error {
+	return nil
+}
+
 func (bp *vaultsProviderMock) ListVaultEvents(
 	context.Context, ListVaultEventsParams,
 ) ([]EventInfo, error) {
@@ -242,7 +260,7 @@ func (bp *vaultsProviderMock) ListVaultEvents(
 
 func (bp *vaultsProviderMock) WriteVaultEvent(
 	_ context.Context, params WriteVaultEventParams,
-) error {
+) (EventInfo, error) {
 	file := params.Content.(*os.File)
 	file.Fd()
 
@@ -250,21 +268,21 @@ func (bp *vaultsProviderMock) WriteVaultEvent(
 	// because the original file will be deleted by the uploader
 	newFile, err := os.Create(file.Name() + ".copy")
 	if err != nil {
-		return err
+		return EventInfo{}, err
 	}
 	_, err = io.Copy(newFile, file)
 	if err != nil {
-		return err
+		return EventInfo{}, err
 	}
 
 	err = newFile.Sync() // flush to disk
 	if err != nil {
-		return err
+		return EventInfo{}, err
 	}
 
 	bp.uploaderInputs <- newFile
 	close(bp.uploaderInputs)
-	return nil
+	return EventInfo{}, nil
 }
 
 func (bp *vaultsProviderMock) RetrieveEvent(
@@ -273,3 +291,77 @@ func (bp *vaultsProviderMock) RetrieveEvent(
 	_, _ = w.Write([]byte("Hello"))
 	return "sample.txt", nil
 }
+
+func (bp *vaultsProviderMock) StartUpload(_ context.Context, _ StartUploadParams) (string, error) {
+	return "", nil
+}
+
+func (bp *vaultsProviderMock) UploadStatus(_ context.Context, _ UploadStatusParams) ([]int, error) {
+	return []int{}, nil
+}
+
+func (bp *vaultsProviderMock) WriteChunk(_ context.Context, _ WriteChunkParams) error {
+	return nil
+}
+
+func (bp *vaultsProviderMock) CompleteUpload(_ context.Context, _ CompleteUploadParams) (EventInfo, error) {
+	return EventInfo{}, nil
+}
+
+func TestSnapshotTables(t *testing.T) {
+	dbm := NewDBManager(t.TempDir(), []TableSchema{{testTable, cols}}, time.Hour, nil)
+	r := newCommitRecorderMock(
+		// already in the snapshot
+		&pgrepl.Tx{CommitLSN: 100, Records: []pgrepl.Record{walRecord("I", testTable, nil, `2`, `"b"`)}},
+		&pgrepl.Tx{CommitLSN: 300, Records: []pgrepl.Record{walRecord("I", testTable, nil, `3`, `"c"`)}},
+	)
+
+	streamer := NewVaultsStreamer(testNS, r, dbm)
+	streamer.SnapshotTables(&snapshotterMock{
+		lsn:     200,
+		records: []pgrepl.Record{walRecord("I", testTable, nil, `1`, `"a"`), walRecord("I", testTable, nil, `2`, `"b"`)},
+	}, []TableSchema{{testTable, cols}})
+	require.NoError(t, streamer.Run(context.Background()))
+
+	// skipped txs are still acked
+	require.Equal(t, []pglogrepl.LSN{100, 300}, r.commits)
+
+	db, err := sql.Open("duckdb", path.Join(dbm.dbDir, dbm.dbFname))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	var ids string
+	require.NoError(t, db.QueryRow("SELECT string_agg(id, ',' ORDER BY id) FROM t").Scan(&ids))
+	require.Equal(t, "1,2,3", ids)
+
+	// the snapshot is part of the digest
+	require.True(t, dbm.digests[testTable].Equal(rowsDigest(t, [][]string{{`1`, `"a"`}, {`2`, `"b"`}, {`3`, `"c"`}})))
+}
+
+type snapshotterMock struct {
+	lsn     pglogrepl.LSN
+	records []pgrepl.Record
+}
+
+func (s *snapshotterMock) Snapshot(
+	_ context.Context, _ TableSchema, fn func([]pgrepl.Record) error,
+) (pglogrepl.LSN, error) {
+	return s.lsn, fn(s.records)
+}
+
+func TestVaultsStreamerDisableCommits(t *testing.T) {
+	dbm := NewDBManager(t.TempDir(), []TableSchema{{testTable, cols}}, time.Hour, nil)
+	r := newCommitRecorderMock(
+		&pgrepl.Tx{CommitLSN: 100, Records: []pgrepl.Record{walRecord("I", testTable, nil, `1`, `"a"`)}},
+		&pgrepl.Tx{CommitLSN: 200, Records: []pgrepl.Record{walRecord("I", testTable, nil, `2`, `"b"`)}},
+	)
+
+	streamer := NewVaultsStreamer(testNS, r, dbm)
+	streamer.DisableCommits()
+	require.NoError(t, streamer.Run(context.Background()))
+
+	// the txs are replayed, but the slot is not consumed
+	require.Empty(t, r.commits)
+	require.Equal(t, WindowRange{StartLSN: 100, EndLSN: 200, Txs: 2}, dbm.window)
+}
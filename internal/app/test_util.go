@@ -35,8 +35,9 @@ func importLocalDB(t *testing.T, file *os.File) *sql.Rows {
 		t.Fatal(err)
 	}
 
+	// only the row values, without the change log columns
 	parquetQuery := fmt.Sprintf(
-		"SELECT * FROM read_parquet('%s')", file.Name())
+		"SELECT * EXCLUDE (%s, %s) FROM read_parquet('%s')", OpColumn, LSNColumn, file.Name())
 	rows, err := db.Query(parquetQuery)
 	if err != nil {
 		t.Fatal(err)
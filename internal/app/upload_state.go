@@ -0,0 +1,125 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// DefaultChunkSize is the size of each chunk of a resumable upload.
+const DefaultChunkSize = 16 << 20
+
+// chunkPrefix is the CID prefix used to content-address upload chunks.
+var chunkPrefix = cid.Prefix{
+	Version:  1,
+	Codec:    cid.Raw,
+	MhType:   multihash.SHA2_256,
+	MhLength: -1,
+}
+
+// ChunkCID returns the content address of a chunk.
+func ChunkCID(data []byte) (cid.Cid, error) {
+	return chunkPrefix.Sum(data)
+}
+
+// uploadState is the local record of a resumable upload.
+// It is persisted after every acknowledged chunk so an
+// interrupted upload can continue where it stopped.
+type uploadState struct {
+	SessionID string   `json:"session_id"`
+	Vault     Vault    `json:"vault"`
+	Filename  string   `json:"filename"`
+	Signature string   `json:"signature"`
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunk_size"`
+	Chunks    []string `json:"chunks"`
+	Acked     []int    `json:"acked"`
+}
+
+// uploadStateStore keeps upload states as JSON files in a directory.
+type uploadStateStore struct {
+	dir string
+}
+
+// key identifies an upload by vault, file name and file signature,
+// so the same content sent to the same vault maps to the same state.
+func (s *uploadStateStore) key(vault Vault, filename, signature string) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s", vault, filename, signature)))
+	return hex.EncodeToString(h[:16])
+}
+
+func (s *uploadStateStore) path(key string) string {
+	return path.Join(s.dir, key+".json")
+}
+
+func (s *uploadStateStore) load(key string) (*uploadState, error) {
+	buf, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	var st uploadState
+	if err := json.Unmarshal(buf, &st); err != nil {
+		return nil, fmt.Errorf("unmarshal: %s", err)
+	}
+
+	return &st, nil
+}
+
+func (s *uploadStateStore) save(key string, st *uploadState) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("mkdir: %s", err)
+	}
+
+	buf, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("marshal: %s", err)
+	}
+
+	tmp := s.path(key) + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		return fmt.Errorf("write: %s", err)
+	}
+
+	return os.Rename(tmp, s.path(key))
+}
+
+func (s *uploadStateStore) remove(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// chunkCIDs splits the content into chunks of the given size and
+// returns the CID of each one.
+func chunkCIDs(r io.Reader, chunkSize int64) ([]cid.Cid, error) {
+	cids := []cid.Cid{}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			c, err := ChunkCID(buf[:n])
+			if err != nil {
+				return nil, fmt.Errorf("chunk cid: %s", err)
+			}
+			cids = append(cids, c)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cids, nil
+}
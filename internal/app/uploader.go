@@ -1,15 +1,18 @@
 package app
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 
 	"github.com/tablelandnetwork/basin-cli/pkg/signing"
+	"golang.org/x/exp/slog"
 )
 
 // VaultsUploader contains logic of uploading Parquet files to Vaults Provider.
@@ -18,6 +21,10 @@ type VaultsUploader struct {
 	relation   string
 	privateKey *ecdsa.PrivateKey
 	provider   VaultsProvider
+
+	// resumable uploads
+	states    *uploadStateStore
+	chunkSize int64
 }
 
 // NewVaultsUploader creates new uploader.
@@ -32,13 +39,49 @@ func NewVaultsUploader(
 	}
 }
 
+// Vault returns the vault the uploader writes to.
+func (bu *VaultsUploader) Vault() Vault {
+	return Vault(fmt.Sprintf("%s.%s", bu.namespace, bu.relation))
+}
+
+// EnableResumableUploads makes files larger than chunkSize be uploaded
+// in signed, content-addressed chunks. The progress of each upload is
+// kept in stateDir, so an interrupted upload resumes at the last
+// acknowledged chunk.
+func (bu *VaultsUploader) EnableResumableUploads(stateDir string, chunkSize int64) {
+	bu.states = &uploadStateStore{dir: stateDir}
+	bu.chunkSize = chunkSize
+}
+
+// UploadResult is a file written to a vault.
+type UploadResult struct {
+	// Event is the event the provider created for the file. Its CID is empty
+	// if the provider didn't respond with it.
+	Event     EventInfo
+	Signature string
+}
+
 // Upload sends file to provider for upload.
 func (bu *VaultsUploader) Upload(
 	ctx context.Context, filepath string, progress io.Writer, ts Timestamp, sz int64,
-) error {
+) (UploadResult, error) {
+	return bu.upload(ctx, filepath, nil, progress, ts, sz)
+}
+
+// UploadExport sends a table exported from a window to provider for upload,
+// along with what the file holds.
+func (bu *VaultsUploader) UploadExport(
+	ctx context.Context, file ExportedFile, progress io.Writer, ts Timestamp, sz int64,
+) (UploadResult, error) {
+	return bu.upload(ctx, file.Path, &file, progress, ts, sz)
+}
+
+func (bu *VaultsUploader) upload(
+	ctx context.Context, filepath string, export *ExportedFile, progress io.Writer, ts Timestamp, sz int64,
+) (UploadResult, error) {
 	f, err := os.Open(filepath)
 	if err != nil {
-		return fmt.Errorf("open file: %s", err)
+		return UploadResult{}, fmt.Errorf("open file: %s", err)
 	}
 	defer func() {
 		_ = f.Close()
@@ -47,7 +90,7 @@ func (bu *VaultsUploader) Upload(
 	signer := signing.NewSigner(bu.privateKey)
 	signatureBytes, err := signer.SignFile(filepath)
 	if err != nil {
-		return fmt.Errorf("signing the file: %s", err)
+		return UploadResult{}, fmt.Errorf("signing the file: %s", err)
 	}
 	signature := hex.EncodeToString(signatureBytes)
 
@@ -57,19 +100,167 @@ func (bu *VaultsUploader) Upload(
 		filename = parts[len(parts)-1]
 	}
 
+	vault := bu.Vault()
+	if bu.states != nil && bu.chunkSize > 0 && sz > bu.chunkSize {
+		var window WindowRange
+		if export != nil {
+			window = export.Window
+		}
+		event, err := bu.uploadChunked(ctx, f, vault, filename, signature, window, progress, ts, sz)
+		if err != nil {
+			return UploadResult{}, err
+		}
+		return UploadResult{Event: event, Signature: signature}, nil
+	}
+
 	params := WriteVaultEventParams{
-		Vault:       Vault(fmt.Sprintf("%s.%s", bu.namespace, bu.relation)),
+		Vault:       vault,
 		Timestamp:   ts,
 		Content:     f,
 		Filename:    filename,
 		ProgressBar: progress,
 		Signature:   signature,
 		Size:        sz,
+		Export:      export,
+	}
+
+	event, err := bu.provider.WriteVaultEvent(ctx, params)
+	if err != nil {
+		return UploadResult{}, fmt.Errorf("write vault event: %s", err)
+	}
+
+	return UploadResult{Event: event, Signature: signature}, nil
+}
+
+func (bu *VaultsUploader) uploadChunked(
+	ctx context.Context,
+	f *os.File,
+	vault Vault,
+	filename string,
+	signature string,
+	window WindowRange,
+	progress io.Writer,
+	ts Timestamp,
+	sz int64,
+) (EventInfo, error) {
+	key := bu.states.key(vault, filename, signature)
+	st, err := bu.states.load(key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return EventInfo{}, fmt.Errorf("load upload state: %s", err)
+	}
+
+	// the provider may have forgotten the session, in that case we start over
+	if st != nil {
+		received, err := bu.provider.UploadStatus(ctx, UploadStatusParams{
+			Vault:     vault,
+			SessionID: st.SessionID,
+		})
+		if errors.Is(err, ErrUploadNotFound) {
+			st = nil
+		} else if err != nil {
+			return EventInfo{}, fmt.Errorf("upload status: %s", err)
+		} else {
+			st.Acked = received
+			slog.Info("resuming upload", "session", st.SessionID, "acked", len(received), "chunks", len(st.Chunks))
+		}
+	}
+
+	if st == nil {
+		cids, err := chunkCIDs(f, bu.chunkSize)
+		if err != nil {
+			return EventInfo{}, fmt.Errorf("chunk file: %s", err)
+		}
+
+		sessionID, err := bu.provider.StartUpload(ctx, StartUploadParams{
+			Vault:     vault,
+			Filename:  filename,
+			Timestamp: ts,
+			Signature: signature,
+			Size:      sz,
+			ChunkSize: bu.chunkSize,
+			Chunks:    cids,
+			Window:    window,
+		})
+		if err != nil {
+			return EventInfo{}, fmt.Errorf("start upload: %s", err)
+		}
+
+		chunks := make([]string, len(cids))
+		for i, c := range cids {
+			chunks[i] = c.String()
+		}
+		st = &uploadState{
+			SessionID: sessionID,
+			Vault:     vault,
+			Filename:  filename,
+			Signature: signature,
+			Size:      sz,
+			ChunkSize: bu.chunkSize,
+			Chunks:    chunks,
+			Acked:     []int{},
+		}
 	}
 
-	if err := bu.provider.WriteVaultEvent(ctx, params); err != nil {
-		return fmt.Errorf("write vault event: %s", err)
+	if err := bu.states.save(key, st); err != nil {
+		return EventInfo{}, fmt.Errorf("save upload state: %s", err)
+	}
+
+	acked := make(map[int]bool, len(st.Acked))
+	for _, i := range st.Acked {
+		acked[i] = true
+	}
+
+	buf := make([]byte, st.ChunkSize)
+	for i, chunk := range st.Chunks {
+		n, err := f.ReadAt(buf, int64(i)*st.ChunkSize)
+		if err != nil && err != io.EOF {
+			return EventInfo{}, fmt.Errorf("read chunk %d: %s", i, err)
+		}
+		data := buf[:n]
+
+		if acked[i] {
+			_, _ = progress.Write(data)
+			continue
+		}
+
+		c, err := ChunkCID(data)
+		if err != nil {
+			return EventInfo{}, fmt.Errorf("chunk cid: %s", err)
+		}
+		if c.String() != chunk {
+			return EventInfo{}, fmt.Errorf("chunk %d changed since the upload started", i)
+		}
+
+		chunkSignature, err := signing.NewSigner(bu.privateKey).SignBytes(data)
+		if err != nil {
+			return EventInfo{}, fmt.Errorf("signing chunk %d: %s", i, err)
+		}
+
+		if err := bu.provider.WriteChunk(ctx, WriteChunkParams{
+			Vault:     vault,
+			SessionID: st.SessionID,
+			Index:     i,
+			CID:       c,
+			Signature: hex.EncodeToString(chunkSignature),
+			Content:   io.TeeReader(bytes.NewReader(data), progress),
+			Size:      int64(n),
+		}); err != nil {
+			return EventInfo{}, fmt.Errorf("write chunk %d: %s", i, err)
+		}
+
+		st.Acked = append(st.Acked, i)
+		if err := bu.states.save(key, st); err != nil {
+			return EventInfo{}, fmt.Errorf("save upload state: %s", err)
+		}
+	}
+
+	event, err := bu.provider.CompleteUpload(ctx, CompleteUploadParams{
+		Vault:     vault,
+		SessionID: st.SessionID,
+	})
+	if err != nil {
+		return EventInfo{}, fmt.Errorf("complete upload: %s", err)
 	}
 
-	return nil
+	return event, bu.states.remove(key)
 }
@@ -3,6 +3,7 @@ package app
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 
 	"github.com/ipfs/go-cid"
@@ -12,9 +13,18 @@ import (
 type VaultsProvider interface {
 	CreateVault(context.Context, CreateVaultParams) error
 	ListVaults(context.Context, ListVaultsParams) ([]VaultWithCacheDuration, error)
+	GetVault(context.Context, GetVaultParams) (VaultInfo, error)
+	UpdateVault(context.Context, UpdateVaultParams) error
+	DeleteVault(context.Context, DeleteVaultParams) error
 	ListVaultEvents(context.Context, ListVaultEventsParams) ([]EventInfo, error)
-	WriteVaultEvent(context.Context, WriteVaultEventParams) error
+	WriteVaultEvent(context.Context, WriteVaultEventParams) (EventInfo, error)
 	RetrieveEvent(context.Context, RetrieveEventParams, io.Writer) (string, error)
+
+	// Resumable uploads
+	StartUpload(context.Context, StartUploadParams) (string, error)
+	UploadStatus(context.Context, UploadStatusParams) ([]int, error)
+	WriteChunk(context.Context, WriteChunkParams) error
+	CompleteUpload(context.Context, CompleteUploadParams) (EventInfo, error)
 }
 
 // CreateVaultParams ...
@@ -22,6 +32,15 @@ type CreateVaultParams struct {
 	Vault         Vault
 	Account       *Account
 	CacheDuration CacheDuration
+	Auth          RequestAuth
+}
+
+// Message returns the message the account signs to create the vault.
+func (p CreateVaultParams) Message() []byte {
+	return requestMessage("create vault", p.Vault, p.Auth,
+		"account", p.Account.Hex(),
+		"cache", fmt.Sprint(p.CacheDuration),
+	)
 }
 
 // ListVaultsParams ...
@@ -29,6 +48,34 @@ type ListVaultsParams struct {
 	Account *Account
 }
 
+// GetVaultParams ...
+type GetVaultParams struct {
+	Vault Vault
+}
+
+// UpdateVaultParams ...
+type UpdateVaultParams struct {
+	Vault         Vault
+	CacheDuration CacheDuration
+	Auth          RequestAuth
+}
+
+// Message returns the message the vault owner signs to update the vault.
+func (p UpdateVaultParams) Message() []byte {
+	return requestMessage("update vault", p.Vault, p.Auth, "cache", fmt.Sprint(p.CacheDuration))
+}
+
+// DeleteVaultParams ...
+type DeleteVaultParams struct {
+	Vault Vault
+	Auth  RequestAuth
+}
+
+// Message returns the message the vault owner signs to delete the vault.
+func (p DeleteVaultParams) Message() []byte {
+	return requestMessage("delete vault", p.Vault, p.Auth)
+}
+
 // ListVaultEventsParams ...
 type ListVaultEventsParams struct {
 	Vault  Vault
@@ -47,6 +94,10 @@ type WriteVaultEventParams struct {
 	Content     io.Reader
 	ProgressBar io.Writer
 	Size        int64
+
+	// Export is the window table the file was exported from.
+	// It is nil for files that were not streamed.
+	Export *ExportedFile
 }
 
 // RetrieveEventParams ...
@@ -55,5 +106,49 @@ type RetrieveEventParams struct {
 	CID     cid.Cid
 }
 
+// StartUploadParams ...
+type StartUploadParams struct {
+	Vault     Vault
+	Filename  string
+	Timestamp Timestamp
+	Signature string
+	Size      int64
+	ChunkSize int64
+	Chunks    []cid.Cid
+
+	// Window is the WAL range of the window the file was exported from.
+	// It is zero for files that were not streamed.
+	Window WindowRange
+}
+
+// UploadStatusParams ...
+type UploadStatusParams struct {
+	Vault     Vault
+	SessionID string
+}
+
+// WriteChunkParams ...
+type WriteChunkParams struct {
+	Vault     Vault
+	SessionID string
+	Index     int
+	CID       cid.Cid
+	Signature string
+	Content   io.Reader
+	Size      int64
+}
+
+// CompleteUploadParams ...
+type CompleteUploadParams struct {
+	Vault     Vault
+	SessionID string
+}
+
 // ErrNotFoundInCache is an error when file is not found in cache.
 var ErrNotFoundInCache = errors.New("not found in cache")
+
+// ErrVaultNotFound is an error when a vault is unknown to the provider.
+var ErrVaultNotFound = errors.New("vault not found")
+
+// ErrUploadNotFound is an error when an upload session is unknown to the provider.
+var ErrUploadNotFound = errors.New("upload session not found")
@@ -0,0 +1,359 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/exp/slog"
+)
+
+// doneSuffix is the suffix of the marker file that signals a file is complete.
+const doneSuffix = ".done"
+
+// WatcherConfig configures a DirWatcher.
+type WatcherConfig struct {
+	// StableFor is how long a file's size must stay unchanged before it is uploaded.
+	StableFor time.Duration
+
+	// DoneMarker makes the watcher wait for a <file>.done marker
+	// instead of waiting for the file to be stable.
+	DoneMarker bool
+
+	// ArchiveDir is where uploaded files are moved to.
+	// If empty, uploaded files are deleted.
+	ArchiveDir string
+
+	// RetryPath is the file where failed uploads are kept across restarts.
+	RetryPath string
+
+	// MaxRetryDelay caps the exponential backoff between retries.
+	MaxRetryDelay time.Duration
+
+	// Ledger records the uploaded files. If set, files already in it are
+	// not uploaded again, e.g. when archiving a file failed after its upload.
+	Ledger *Ledger
+}
+
+// DirWatcher watches a directory and uploads the Parquet files dropped into it.
+type DirWatcher struct {
+	dir      string
+	uploader *VaultsUploader
+	cfg      WatcherConfig
+
+	// files seen but not uploaded yet
+	pending map[string]*pendingFile
+
+	// files that failed to upload
+	retries map[string]*retryEntry
+
+	// how often pending files and retries are checked
+	tick time.Duration
+}
+
+type pendingFile struct {
+	size     int64
+	changeAt time.Time
+}
+
+type retryEntry struct {
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error"`
+}
+
+// NewDirWatcher creates a new DirWatcher.
+func NewDirWatcher(dir string, uploader *VaultsUploader, cfg WatcherConfig) *DirWatcher {
+	if cfg.MaxRetryDelay == 0 {
+		cfg.MaxRetryDelay = time.Hour
+	}
+
+	return &DirWatcher{
+		dir:      dir,
+		uploader: uploader,
+		cfg:      cfg,
+		pending:  make(map[string]*pendingFile),
+		retries:  make(map[string]*retryEntry),
+		tick:     time.Second,
+	}
+}
+
+// Run watches the directory until the context is canceled.
+func (w *DirWatcher) Run(ctx context.Context) error {
+	if err := w.loadRetries(); err != nil {
+		return fmt.Errorf("load retries: %s", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("new watcher: %s", err)
+	}
+	defer func() {
+		_ = watcher.Close()
+	}()
+
+	if err := watcher.Add(w.dir); err != nil {
+		return fmt.Errorf("watch %s: %s", w.dir, err)
+	}
+	slog.Info("watching directory", "dir", w.dir)
+
+	// files that were dropped while the watcher was not running
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return fmt.Errorf("read dir: %s", err)
+	}
+	for _, e := range entries {
+		w.track(filepath.Join(w.dir, e.Name()))
+	}
+
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
+				w.track(event.Name)
+			}
+			if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				delete(w.pending, event.Name)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Error("watcher error", "error", err)
+		case <-ticker.C:
+			w.process(ctx, time.Now())
+		}
+	}
+}
+
+// track adds a file to the pending list, or refreshes its size.
+func (w *DirWatcher) track(p string) {
+	name := filepath.Base(p)
+	if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".parquet") {
+		return
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+
+	pf, ok := w.pending[p]
+	if !ok || pf.size != fi.Size() {
+		w.pending[p] = &pendingFile{size: fi.Size(), changeAt: time.Now()}
+	}
+}
+
+// process uploads the pending files that are ready and the retries that are due.
+func (w *DirWatcher) process(ctx context.Context, now time.Time) {
+	for p, pf := range w.pending {
+		if _, ok := w.retries[p]; ok {
+			delete(w.pending, p)
+			continue
+		}
+
+		ready, err := w.ready(p, pf, now)
+		if err != nil {
+			slog.Error("checking file", "file", p, "error", err)
+			delete(w.pending, p)
+			continue
+		}
+		if !ready {
+			continue
+		}
+
+		delete(w.pending, p)
+		w.upload(ctx, p, now)
+	}
+
+	for p, r := range w.retries {
+		if now.Before(r.NextAttempt) {
+			continue
+		}
+		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+			slog.Warn("dropping retry of a file that no longer exists", "file", p)
+			delete(w.retries, p)
+			w.saveRetries()
+			continue
+		}
+		w.upload(ctx, p, now)
+	}
+}
+
+func (w *DirWatcher) ready(p string, pf *pendingFile, now time.Time) (bool, error) {
+	if w.cfg.DoneMarker {
+		_, err := os.Stat(p + doneSuffix)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return false, err
+	}
+
+	if fi.Size() != pf.size {
+		pf.size = fi.Size()
+		pf.changeAt = now
+		return false, nil
+	}
+
+	return now.Sub(pf.changeAt) >= w.cfg.StableFor, nil
+}
+
+func (w *DirWatcher) upload(ctx context.Context, p string, now time.Time) {
+	err := w.uploadOnce(ctx, p)
+	if err == nil {
+		err = w.finish(p)
+	}
+
+	if err != nil {
+		r, ok := w.retries[p]
+		if !ok {
+			r = &retryEntry{}
+			w.retries[p] = r
+		}
+		r.Attempts++
+		r.LastError = err.Error()
+		r.NextAttempt = now.Add(w.backoff(r.Attempts))
+		slog.Error("upload failed", "file", p, "attempts", r.Attempts, "next_attempt", r.NextAttempt, "error", err)
+		w.saveRetries()
+		return
+	}
+
+	if _, ok := w.retries[p]; ok {
+		delete(w.retries, p)
+		w.saveRetries()
+	}
+	slog.Info("uploaded", "file", p)
+}
+
+// uploadOnce uploads a file unless the ledger has it already. The event
+// timestamp is the file's modification time, when the data was produced,
+// so it doesn't depend on how long the file waited to be uploaded.
+func (w *DirWatcher) uploadOnce(ctx context.Context, p string) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	ts := NewTimestamp(fi.ModTime().UTC())
+
+	var hash string
+	if w.cfg.Ledger != nil {
+		if hash, err = HashFile(p); err != nil {
+			return err
+		}
+		uploaded, err := w.cfg.Ledger.Has(ctx, w.uploader.Vault(), hash)
+		if err != nil {
+			return err
+		}
+		if uploaded {
+			slog.Info("already uploaded", "file", p)
+			return nil
+		}
+	}
+
+	slog.Info("uploading", "file", p)
+	res, err := w.uploader.Upload(ctx, p, io.Discard, ts, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	if w.cfg.Ledger == nil {
+		return nil
+	}
+
+	return w.cfg.Ledger.Record(ctx, LedgerEntry{
+		Vault:      w.uploader.Vault(),
+		FileHash:   hash,
+		Filename:   filepath.Base(p),
+		Size:       fi.Size(),
+		Timestamp:  ts.Seconds(),
+		UploadedAt: time.Now().UTC(),
+		CID:        res.Event.CID,
+		Signature:  res.Signature,
+	})
+}
+
+// finish archives or deletes an uploaded file and its done marker.
+func (w *DirWatcher) finish(p string) error {
+	if w.cfg.ArchiveDir == "" {
+		if err := os.Remove(p); err != nil {
+			return fmt.Errorf("delete: %s", err)
+		}
+	} else {
+		if err := os.MkdirAll(w.cfg.ArchiveDir, 0o755); err != nil {
+			return fmt.Errorf("mkdir: %s", err)
+		}
+		if err := os.Rename(p, filepath.Join(w.cfg.ArchiveDir, filepath.Base(p))); err != nil {
+			return fmt.Errorf("archive: %s", err)
+		}
+	}
+
+	if err := os.Remove(p + doneSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("delete marker: %s", err)
+	}
+
+	return nil
+}
+
+func (w *DirWatcher) backoff(attempts int) time.Duration {
+	d := time.Duration(1<<uint(min(attempts, 20))) * time.Second
+	if d > w.cfg.MaxRetryDelay {
+		return w.cfg.MaxRetryDelay
+	}
+	return d
+}
+
+func (w *DirWatcher) loadRetries() error {
+	if w.cfg.RetryPath == "" {
+		return nil
+	}
+
+	buf, err := os.ReadFile(w.cfg.RetryPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, &w.retries)
+}
+
+func (w *DirWatcher) saveRetries() {
+	if w.cfg.RetryPath == "" {
+		return
+	}
+
+	buf, err := json.MarshalIndent(w.retries, "", "  ")
+	if err != nil {
+		slog.Error("marshal retries", "error", err)
+		return
+	}
+
+	tmp := w.cfg.RetryPath + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		slog.Error("write retries", "error", err)
+		return
+	}
+	if err := os.Rename(tmp, w.cfg.RetryPath); err != nil {
+		slog.Error("write retries", "error", err)
+	}
+}
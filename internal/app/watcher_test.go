@@ -0,0 +1,172 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirWatcherArchivesUploadedFiles(t *testing.T) {
+	privateKey, err := crypto.HexToECDSA(pk)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	archive := path.Join(dir, "archive")
+
+	// a file dropped before the watcher starts is picked up too
+	require.NoError(t, os.WriteFile(path.Join(dir, "early.parquet"), []byte("early"), 0o644))
+
+	provider := &countingProviderMock{}
+	uploader := NewVaultsUploader(testNS, testTable, provider, privateKey)
+	w := NewDirWatcher(dir, uploader, WatcherConfig{
+		StableFor:  100 * time.Millisecond,
+		ArchiveDir: archive,
+	})
+	w.tick = 20 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, os.WriteFile(path.Join(dir, "late.parquet"), []byte("late"), 0o644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "ignored.tmp"), []byte("tmp"), 0o644))
+
+	require.Eventually(t, func() bool {
+		_, err1 := os.Stat(path.Join(archive, "early.parquet"))
+		_, err2 := os.Stat(path.Join(archive, "late.parquet"))
+		return err1 == nil && err2 == nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+
+	require.Equal(t, 2, provider.writes)
+	require.NoFileExists(t, path.Join(dir, "early.parquet"))
+	require.NoFileExists(t, path.Join(dir, "late.parquet"))
+	require.FileExists(t, path.Join(dir, "ignored.tmp"))
+}
+
+func TestDirWatcherDoneMarker(t *testing.T) {
+	privateKey, err := crypto.HexToECDSA(pk)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	provider := &countingProviderMock{}
+	uploader := NewVaultsUploader(testNS, testTable, provider, privateKey)
+	w := NewDirWatcher(dir, uploader, WatcherConfig{DoneMarker: true})
+
+	f := path.Join(dir, "data.parquet")
+	require.NoError(t, os.WriteFile(f, []byte("data"), 0o644))
+	w.track(f)
+
+	// without the marker the file is not uploaded, no matter how long it waits
+	w.process(context.Background(), time.Now().Add(time.Hour))
+	require.Equal(t, 0, provider.writes)
+
+	require.NoError(t, os.WriteFile(f+doneSuffix, []byte{}, 0o644))
+	w.process(context.Background(), time.Now())
+	require.Equal(t, 1, provider.writes)
+
+	// files are deleted when there is no archive dir
+	require.NoFileExists(t, f)
+	require.NoFileExists(t, f+doneSuffix)
+}
+
+func TestDirWatcherPersistsRetries(t *testing.T) {
+	privateKey, err := crypto.HexToECDSA(pk)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	retryPath := path.Join(t.TempDir(), "retries.json")
+	provider := &failingProviderMock{}
+	uploader := NewVaultsUploader(testNS, testTable, provider, privateKey)
+	w := NewDirWatcher(dir, uploader, WatcherConfig{RetryPath: retryPath})
+
+	f := path.Join(dir, "data.parquet")
+	require.NoError(t, os.WriteFile(f, []byte("data"), 0o644))
+	w.track(f)
+
+	now := time.Now()
+	w.process(context.Background(), now)
+	require.FileExists(t, f)
+
+	buf, err := os.ReadFile(retryPath)
+	require.NoError(t, err)
+	var retries map[string]*retryEntry
+	require.NoError(t, json.Unmarshal(buf, &retries))
+	require.Equal(t, 1, retries[f].Attempts)
+	require.Equal(t, "write vault event: provider down", retries[f].LastError)
+
+	// a restarted watcher picks the retry up once it is due
+	w = NewDirWatcher(dir, NewVaultsUploader(testNS, testTable, &countingProviderMock{}, privateKey), WatcherConfig{
+		RetryPath: retryPath,
+	})
+	require.NoError(t, w.loadRetries())
+	w.process(context.Background(), now)
+	require.FileExists(t, f)
+
+	w.process(context.Background(), now.Add(time.Minute))
+	require.NoFileExists(t, f)
+	require.Empty(t, w.retries)
+}
+
+func TestDirWatcherDoesNotRewriteUploadedFiles(t *testing.T) {
+	privateKey, err := crypto.HexToECDSA(pk)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	ledger, err := OpenLedger(ctx, path.Join(t.TempDir(), "ledger.db"))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	// archiving fails while the archive dir is a file
+	archive := path.Join(t.TempDir(), "archive")
+	require.NoError(t, os.WriteFile(archive, []byte{}, 0o644))
+
+	provider := &countingProviderMock{}
+	uploader := NewVaultsUploader(testNS, testTable, provider, privateKey)
+	w := NewDirWatcher(dir, uploader, WatcherConfig{ArchiveDir: archive, Ledger: ledger})
+
+	f := path.Join(dir, "data.parquet")
+	require.NoError(t, os.WriteFile(f, []byte("data"), 0o644))
+	mtime := time.Unix(1700000000, 0)
+	require.NoError(t, os.Chtimes(f, mtime, mtime))
+	w.track(f)
+
+	now := time.Now()
+	w.process(ctx, now)
+	require.Equal(t, 1, provider.writes)
+	require.Equal(t, 1, w.retries[f].Attempts)
+	require.FileExists(t, f)
+
+	// the retry only archives the file
+	require.NoError(t, os.Remove(archive))
+	w.process(ctx, now.Add(time.Hour))
+	require.Equal(t, 1, provider.writes)
+	require.Empty(t, w.retries)
+	require.FileExists(t, path.Join(archive, "data.parquet"))
+
+	// the event timestamp is the file's modification time
+	entries, err := ledger.Entries(ctx, uploader.Vault())
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, mtime.Unix(), entries[0].Timestamp)
+}
+
+type failingProviderMock struct {
+	vaultsProviderMock
+}
+
+func (bp *failingProviderMock) WriteVaultEvent(_ context.Context, _ WriteVaultEventParams) (EventInfo, error) {
+	return EventInfo{}, errors.New("provider down")
+}
@@ -0,0 +1,194 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
+)
+
+// windowTable keeps the WAL range of the txs replayed into the window's db,
+// so it is known when the window is exported after a restart.
+const windowTable = "_vaults_window"
+
+// The Parquet key-value metadata entries that record the WAL range of the
+// window a table was exported from. Consumers can order events by them and
+// detect gaps or overlaps between consecutive windows.
+const (
+	StartLSNMetadataKey      = "vaults.start_lsn"
+	EndLSNMetadataKey        = "vaults.end_lsn"
+	MinCommitTimeMetadataKey = "vaults.min_commit_time"
+	MaxCommitTimeMetadataKey = "vaults.max_commit_time"
+	TxCountMetadataKey       = "vaults.tx_count"
+)
+
+// WindowRange is the WAL range of the txs replayed into a window.
+// It is zero for windows without txs.
+type WindowRange struct {
+	// StartLSN and EndLSN are the commit LSNs of the first and last txs.
+	StartLSN pglogrepl.LSN
+	EndLSN   pglogrepl.LSN
+
+	// MinCommitTime and MaxCommitTime are the commit times of the earliest
+	// and latest txs. They are zero if the txs have no timestamps.
+	MinCommitTime time.Time
+	MaxCommitTime time.Time
+
+	// Txs is the number of txs.
+	Txs int64
+}
+
+// IsZero reports whether no tx was replayed into the window.
+func (w WindowRange) IsZero() bool {
+	return w.StartLSN == 0 && w.EndLSN == 0
+}
+
+// Metadata returns the entries of the range in the Parquet key-value metadata.
+// Commit times are RFC 3339 formatted.
+func (w WindowRange) Metadata() map[string]string {
+	if w.IsZero() {
+		return map[string]string{}
+	}
+
+	entries := map[string]string{
+		StartLSNMetadataKey: w.StartLSN.String(),
+		EndLSNMetadataKey:   w.EndLSN.String(),
+		TxCountMetadataKey:  fmt.Sprint(w.Txs),
+	}
+	if !w.MinCommitTime.IsZero() {
+		entries[MinCommitTimeMetadataKey] = w.MinCommitTime.Format(time.RFC3339Nano)
+		entries[MaxCommitTimeMetadataKey] = w.MaxCommitTime.Format(time.RFC3339Nano)
+	}
+
+	return entries
+}
+
+// apply returns the range after tx is replayed. Snapshot batches have no
+// commit LSN and are not WAL txs, so they don't change it.
+func (w WindowRange) apply(tx *pgrepl.Tx) (WindowRange, error) {
+	if tx.CommitLSN == 0 {
+		return w, nil
+	}
+
+	commitTime, err := tx.CommitTime()
+	if err != nil {
+		return WindowRange{}, err
+	}
+
+	if w.IsZero() {
+		w.StartLSN, w.EndLSN = tx.CommitLSN, tx.CommitLSN
+	}
+	if tx.CommitLSN < w.StartLSN {
+		w.StartLSN = tx.CommitLSN
+	}
+	if tx.CommitLSN > w.EndLSN {
+		w.EndLSN = tx.CommitLSN
+	}
+	if !commitTime.IsZero() {
+		if w.MinCommitTime.IsZero() || commitTime.Before(w.MinCommitTime) {
+			w.MinCommitTime = commitTime
+		}
+		if commitTime.After(w.MaxCommitTime) {
+			w.MaxCommitTime = commitTime
+		}
+	}
+	w.Txs++
+
+	return w, nil
+}
+
+// save writes the range to the window table.
+func (w WindowRange) save(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s", windowTable)); err != nil {
+		return fmt.Errorf("save window range: %s", err)
+	}
+	if w.IsZero() {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx,
+		fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?)", windowTable),
+		w.StartLSN.String(), w.EndLSN.String(), w.Txs, formatCommitTime(w.MinCommitTime), formatCommitTime(w.MaxCommitTime),
+	); err != nil {
+		return fmt.Errorf("save window range: %s", err)
+	}
+
+	return nil
+}
+
+// readWindowRange reads the range kept in a window's db.
+// It returns a zero range if no transactions were replayed into it,
+// or if the db was created before ranges were kept.
+func readWindowRange(ctx context.Context, db *sql.DB) (WindowRange, error) {
+	var n int
+	if err := db.QueryRowContext(ctx,
+		"SELECT count(*) FROM information_schema.tables WHERE table_name = ?", windowTable,
+	).Scan(&n); err != nil {
+		return WindowRange{}, fmt.Errorf("read window range: %s", err)
+	}
+	if n == 0 {
+		return WindowRange{}, nil
+	}
+
+	var start, end, minTime, maxTime string
+	var txs int64
+	err := db.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT start_lsn, end_lsn, txs, min_commit_time, max_commit_time FROM %s", windowTable),
+	).Scan(&start, &end, &txs, &minTime, &maxTime)
+	if err == sql.ErrNoRows {
+		return WindowRange{}, nil
+	}
+	if err != nil {
+		return WindowRange{}, fmt.Errorf("read window range: %s", err)
+	}
+
+	w, err := parseWindowRange(start, end)
+	if err != nil {
+		return WindowRange{}, err
+	}
+	w.Txs = txs
+	if w.MinCommitTime, err = parseCommitTime(minTime); err != nil {
+		return WindowRange{}, err
+	}
+	if w.MaxCommitTime, err = parseCommitTime(maxTime); err != nil {
+		return WindowRange{}, err
+	}
+
+	return w, nil
+}
+
+func parseWindowRange(start, end string) (WindowRange, error) {
+	startLSN, err := pglogrepl.ParseLSN(start)
+	if err != nil {
+		return WindowRange{}, fmt.Errorf("invalid start lsn: %s", err)
+	}
+	endLSN, err := pglogrepl.ParseLSN(end)
+	if err != nil {
+		return WindowRange{}, fmt.Errorf("invalid end lsn: %s", err)
+	}
+
+	return WindowRange{StartLSN: startLSN, EndLSN: endLSN}, nil
+}
+
+// formatCommitTime formats a commit time kept in the window table,
+// an empty string if it is zero.
+func formatCommitTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseCommitTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid commit time: %s", err)
+	}
+	return t, nil
+}
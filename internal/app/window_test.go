@@ -0,0 +1,155 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+	"github.com/tablelandnetwork/basin-cli/pkg/pgrepl"
+)
+
+func TestReplayKeepsWindowRange(t *testing.T) {
+	ctx := context.Background()
+	cols := []Column{
+		{Name: "id", Typ: "integer", IsNull: false},
+		{Name: "name", Typ: "text", IsNull: true},
+	}
+	dir := t.TempDir()
+	dbm := NewDBManager(dir, []TableSchema{{"t", cols}}, 3*time.Hour, nil)
+	require.NoError(t, dbm.NewDB(ctx))
+
+	// snapshot batches are not WAL txs
+	require.NoError(t, dbm.Replay(ctx, &pgrepl.Tx{Records: []pgrepl.Record{
+		walRecord("I", "t", nil, `0`, `"snapshot"`),
+	}}))
+	require.True(t, dbm.window.IsZero())
+
+	require.NoError(t, dbm.Replay(ctx, &pgrepl.Tx{CommitLSN: 200, Records: []pgrepl.Record{
+		timedWALRecord("2023-08-22 14:44:04.5-03", `1`, `"a"`),
+	}}))
+	require.NoError(t, dbm.Replay(ctx, &pgrepl.Tx{CommitLSN: 300, Records: []pgrepl.Record{
+		timedWALRecord("2023-08-22 14:44:02-03", `2`, `"b"`),
+	}}))
+
+	// a failed replay does not change the range
+	require.Error(t, dbm.Replay(ctx, &pgrepl.Tx{CommitLSN: 400, Records: []pgrepl.Record{
+		walRecord("I", "t", nil, `"not a number"`, `"c"`),
+	}}))
+
+	expected := WindowRange{
+		StartLSN:      200,
+		EndLSN:        300,
+		MinCommitTime: time.Date(2023, 8, 22, 17, 44, 2, 0, time.UTC),
+		MaxCommitTime: time.Date(2023, 8, 22, 17, 44, 4, 500000000, time.UTC),
+		Txs:           2,
+	}
+	require.Equal(t, expected, dbm.window)
+
+	// the range is kept in the window's db, to be exported after a restart
+	dbm.Close()
+	db, err := sql.Open("duckdb", path.Join(dir, dbm.dbFname))
+	require.NoError(t, err)
+	window, err := readWindowRange(ctx, db)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.Equal(t, expected, window)
+
+	// and the next window starts empty
+	restarted := NewDBManager(dir, []TableSchema{{"t", cols}}, 3*time.Hour, nil)
+	require.NoError(t, restarted.NewDB(ctx))
+	defer restarted.Close()
+	require.True(t, restarted.window.IsZero())
+}
+
+func TestUploadAllUpgradesBaselineWindows(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// a window db left by a version without digests, window ranges or change logs
+	dbPath := path.Join(dir, "1700000000000000000.db")
+	db, err := sql.Open("duckdb", dbPath)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, "CREATE TABLE t (id integer NOT NULL,name varchar NOT NULL,PRIMARY KEY (id))")
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, "INSERT INTO t VALUES (1, 'a')")
+	require.NoError(t, err)
+
+	window, err := readWindowRange(ctx, db)
+	require.NoError(t, err)
+	require.True(t, window.IsZero())
+	require.NoError(t, db.Close())
+
+	privateKey, err := crypto.HexToECDSA(pk)
+	require.NoError(t, err)
+	provider := &countingProviderMock{}
+	uploader := NewVaultsUploader(testNS, testTable, provider, privateKey)
+	dbm := NewDBManager(dir, []TableSchema{{testTable, cols}}, 3*time.Hour, uploader)
+
+	// the export keeps the layout of the window
+	files, err := dbm.Export(ctx, dbPath+".parquet")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.True(t, files[0].Window.IsZero())
+	metadata := exportedMetadata(t, files[0].Path)
+	require.Equal(t, testTable, metadata[TableMetadataKey])
+	require.NotContains(t, metadata, FormatMetadataKey)
+	require.NotContains(t, metadata, StartLSNMetadataKey)
+	require.NotContains(t, metadata, DigestMetadataKey)
+
+	require.NoError(t, dbm.UploadAll(ctx))
+	require.Equal(t, 1, provider.writes)
+	require.NoFileExists(t, dbPath)
+}
+
+func TestExportWritesWindowMetadata(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbm := NewDBManager(dir, []TableSchema{{testTable, cols}}, 3*time.Hour, nil)
+	require.NoError(t, dbm.NewDB(ctx))
+	defer dbm.Close()
+
+	require.NoError(t, dbm.Replay(ctx, &pgrepl.Tx{CommitLSN: 200, Records: []pgrepl.Record{
+		timedWALRecord("2023-08-22 14:44:02-03", `1`, `"a"`),
+	}}))
+	require.NoError(t, dbm.Replay(ctx, &pgrepl.Tx{CommitLSN: 300, Records: []pgrepl.Record{
+		timedWALRecord("2023-08-22 14:44:04-03", `2`, `"b"`),
+	}}))
+
+	files, err := dbm.Export(ctx, path.Join(dir, dbm.dbFname)+".parquet")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, int64(2), files[0].Window.Txs)
+
+	metadata := exportedMetadata(t, files[0].Path)
+	require.Equal(t, FormatVersion, metadata[FormatMetadataKey])
+	require.Equal(t, "0/C8", metadata[StartLSNMetadataKey])
+	require.Equal(t, "0/12C", metadata[EndLSNMetadataKey])
+	require.Equal(t, "2023-08-22T17:44:02Z", metadata[MinCommitTimeMetadataKey])
+	require.Equal(t, "2023-08-22T17:44:04Z", metadata[MaxCommitTimeMetadataKey])
+	require.Equal(t, "2", metadata[TxCountMetadataKey])
+}
+
+func timedWALRecord(timestamp string, values ...string) pgrepl.Record {
+	r := walRecord("I", testTable, nil, values...)
+	r.Timestamp = timestamp
+	return r
+}
+
+// exportedMetadata reads the key-value metadata of an exported file.
+func exportedMetadata(t *testing.T, filename string) map[string]string {
+	t.Helper()
+
+	db, err := sql.Open("duckdb", "")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	metadata, err := parquetMetadata(context.Background(), db, filename)
+	require.NoError(t, err)
+
+	return metadata
+}
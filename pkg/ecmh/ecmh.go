@@ -1,25 +1,49 @@
 package ecmh
 
-import "github.com/bwesterb/go-ristretto"
+import (
+	"fmt"
+
+	"github.com/bwesterb/go-ristretto"
+)
+
+// DomainSeparationTag is prepended to the items hashed by InsertBytes and RemoveBytes.
+const DomainSeparationTag = "vaults-ecmh-v1"
+
+// Size is the length of a marshaled multiset hash.
+const Size = 32
 
 // MultisetHash is a multiset hash based on ECMH
 // implementated using ristretto points.
+//
+// The hash of a multiset is the sum of the points of its items,
+// so the hash of the empty multiset is the identity point.
 type MultisetHash struct {
 	accumulator *ristretto.Point
 }
 
-// NewMultisetHash creates a new multiset hash.
+// NewMultisetHash creates a new multiset hash of the empty multiset.
 func NewMultisetHash() *MultisetHash {
 	p := ristretto.Point{}
-	// shoud we use SetZero() here? base is the generator
-	// point
-	p.SetBase()
+	p.SetZero()
 
 	return &MultisetHash{
 		accumulator: &p,
 	}
 }
 
+// HashToPoint maps an item to a point. It hashes DomainSeparationTag followed
+// by data with SHA-512, maps each half of the hash to a point with Elligator 2,
+// and adds them, as RistrettoPoint::hash_from_bytes::<Sha512> does in
+// curve25519-dalek.
+func HashToPoint(data []byte) *ristretto.Point {
+	buf := make([]byte, 0, len(DomainSeparationTag)+len(data))
+	buf = append(buf, DomainSeparationTag...)
+	buf = append(buf, data...)
+
+	var p ristretto.Point
+	return p.DeriveDalek(buf)
+}
+
 // String returns the string representation of the multiset hash.
 func (h *MultisetHash) String() string {
 	return h.accumulator.String()
@@ -37,6 +61,11 @@ func (h *MultisetHash) InsertAll(ps []*ristretto.Point) {
 	}
 }
 
+// InsertBytes inserts an item into the multiset hash, mapped with HashToPoint.
+func (h *MultisetHash) InsertBytes(data []byte) {
+	h.Insert(HashToPoint(data))
+}
+
 // Union unions two multisets.
 func (h *MultisetHash) Union(other *MultisetHash) {
 	h.accumulator.Add(h.accumulator, other.accumulator)
@@ -58,3 +87,56 @@ func (h *MultisetHash) RemoveAll(ps []*ristretto.Point) {
 		h.Remove(item)
 	}
 }
+
+// RemoveBytes removes an item from the multiset hash, mapped with HashToPoint.
+func (h *MultisetHash) RemoveBytes(data []byte) {
+	h.Remove(HashToPoint(data))
+}
+
+// Equal reports whether two multiset hashes are equal.
+func (h *MultisetHash) Equal(other *MultisetHash) bool {
+	return h.accumulator.Equals(other.accumulator)
+}
+
+// Clone returns a copy of the multiset hash.
+func (h *MultisetHash) Clone() *MultisetHash {
+	var p ristretto.Point
+	p.Set(h.accumulator)
+	return &MultisetHash{accumulator: &p}
+}
+
+// MarshalBinary returns the canonical 32 bytes encoding of the multiset hash.
+func (h *MultisetHash) MarshalBinary() ([]byte, error) {
+	return h.accumulator.MarshalBinary()
+}
+
+// UnmarshalBinary sets the multiset hash from its canonical encoding.
+func (h *MultisetHash) UnmarshalBinary(data []byte) error {
+	if len(data) != Size {
+		return fmt.Errorf("multiset hash should be %d bytes, not %d", Size, len(data))
+	}
+
+	var p ristretto.Point
+	if err := p.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	h.accumulator = &p
+
+	return nil
+}
+
+// MarshalText returns the string representation of the multiset hash.
+func (h *MultisetHash) MarshalText() ([]byte, error) {
+	return h.accumulator.MarshalText()
+}
+
+// UnmarshalText sets the multiset hash from its string representation.
+func (h *MultisetHash) UnmarshalText(text []byte) error {
+	var p ristretto.Point
+	if err := p.UnmarshalText(text); err != nil {
+		return err
+	}
+	h.accumulator = &p
+
+	return nil
+}
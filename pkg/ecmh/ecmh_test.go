@@ -1,6 +1,8 @@
 package ecmh
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"testing"
 
@@ -82,3 +84,91 @@ func TestECMHUnionDiff(t *testing.T) {
 		require.Equal(t, cr1, cr3)
 	}
 }
+
+// testVectors are the hashes of multisets of items inserted with InsertBytes.
+var testVectors = []struct {
+	items []string
+	hash  string
+}{
+	{
+		items: []string{},
+		hash:  "0000000000000000000000000000000000000000000000000000000000000000",
+	},
+	{
+		items: []string{""},
+		hash:  "8427731a544b2f6d0e82d31752ba45222e22b53c0dc374d34860721d455ea511",
+	},
+	{
+		items: []string{"apple"},
+		hash:  "b453c5657ded5165e08e8fc5aba6bf0a164af54275efff627bfb288c499f8d5f",
+	},
+	{
+		items: []string{"apple", "banana", "cherry"},
+		hash:  "7c30354c52580e3bf6958db6eaff41049de73d2d5c529393b104da251be7ef14",
+	},
+	{
+		items: []string{"apple", "banana", "cherry", "apple"},
+		hash:  "ec65998e6878dcd0900bf8f4bd4532a0fec0f160a2c4cfe3c05d8300b334231f",
+	}, // multisets
+}
+
+func TestECMHTestVectors(t *testing.T) {
+	for _, tc := range testVectors {
+		h := NewMultisetHash()
+		for _, item := range tc.items {
+			h.InsertBytes([]byte(item))
+		}
+
+		b, err := h.MarshalBinary()
+		require.NoError(t, err)
+		require.Equal(t, tc.hash, hex.EncodeToString(b))
+
+		// the order of insertion does not matter
+		reversed := NewMultisetHash()
+		for i := len(tc.items) - 1; i >= 0; i-- {
+			reversed.InsertBytes([]byte(tc.items[i]))
+		}
+		require.True(t, h.Equal(reversed))
+	}
+}
+
+func TestECMHEmpty(t *testing.T) {
+	h := NewMultisetHash()
+	require.True(t, h.Equal(NewMultisetHash()))
+
+	h.InsertBytes([]byte("apple"))
+	require.False(t, h.Equal(NewMultisetHash()))
+
+	h.RemoveBytes([]byte("apple"))
+	require.True(t, h.Equal(NewMultisetHash()))
+}
+
+func TestECMHMarshal(t *testing.T) {
+	h := NewMultisetHash()
+	h.InsertBytes([]byte("apple"))
+	h.InsertBytes([]byte("banana"))
+
+	b, err := h.MarshalBinary()
+	require.NoError(t, err)
+	require.Len(t, b, Size)
+
+	other := NewMultisetHash()
+	require.NoError(t, other.UnmarshalBinary(b))
+	require.True(t, h.Equal(other))
+
+	text, err := h.MarshalText()
+	require.NoError(t, err)
+	require.Equal(t, h.String(), string(text))
+	other = NewMultisetHash()
+	require.NoError(t, other.UnmarshalText(text))
+	require.True(t, h.Equal(other))
+
+	// a clone does not change with the original
+	clone := h.Clone()
+	h.InsertBytes([]byte("cherry"))
+	require.False(t, h.Equal(clone))
+	require.True(t, clone.Equal(other))
+
+	require.Error(t, other.UnmarshalBinary(b[:31]))
+	require.Error(t, other.UnmarshalBinary(bytes.Repeat([]byte{0xff}, Size)))
+}
@@ -54,3 +54,60 @@ func (c *Conn) ConfirmedFlushLSN(ctx context.Context, slot string) (pglogrepl.LS
 	}
 	return lsn, nil
 }
+
+// SlotStatus is the state of a replication slot.
+type SlotStatus struct {
+	Active            bool
+	ConfirmedFlushLSN pglogrepl.LSN
+	CurrentLSN        pglogrepl.LSN
+
+	// RetainedWAL is the number of bytes of WAL kept for the slot.
+	RetainedWAL int64
+}
+
+// GetSlotStatus fetches the state of a replication slot.
+// The error wraps pgx.ErrNoRows if the slot does not exist.
+func (c *Conn) GetSlotStatus(ctx context.Context, slot string) (SlotStatus, error) {
+	var status SlotStatus
+	if err := c.QueryRow(ctx,
+		`
+			SELECT
+				active,
+				COALESCE(confirmed_flush_lsn, '0/0'),
+				pg_current_wal_lsn(),
+				COALESCE(pg_wal_lsn_diff(pg_current_wal_lsn(), restart_lsn), 0)::bigint
+			FROM pg_replication_slots
+			WHERE slot_name = $1
+		`, slot,
+	).Scan(&status.Active, &status.ConfirmedFlushLSN, &status.CurrentLSN, &status.RetainedWAL); err != nil {
+		return SlotStatus{}, fmt.Errorf("query row: %w", err)
+	}
+	return status, nil
+}
+
+// CreateSlot creates a logical replication slot at the current LSN.
+func (c *Conn) CreateSlot(ctx context.Context, slot string) (pglogrepl.LSN, error) {
+	var lsn pglogrepl.LSN
+	if err := c.QueryRow(
+		ctx, "SELECT lsn FROM pg_create_logical_replication_slot($1, $2)", slot, outputPlugin,
+	).Scan(&lsn); err != nil {
+		return 0, fmt.Errorf("create slot: %s", err)
+	}
+	return lsn, nil
+}
+
+// DropSlot drops a replication slot. It fails if the slot is in use.
+func (c *Conn) DropSlot(ctx context.Context, slot string) error {
+	if _, err := c.Exec(ctx, "SELECT pg_drop_replication_slot($1)", slot); err != nil {
+		return fmt.Errorf("drop slot: %s", err)
+	}
+	return nil
+}
+
+// DropPublication drops a publication, if it exists.
+func (c *Conn) DropPublication(ctx context.Context, p Publication) error {
+	if _, err := c.Exec(ctx, fmt.Sprintf("DROP PUBLICATION IF EXISTS %s", p.FullName())); err != nil {
+		return fmt.Errorf("drop publication: %s", err)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"strings"
 	"sync"
 
@@ -30,6 +31,11 @@ func (p Publication) FullName() string {
 	return fmt.Sprintf("pub_basin_%s", string(p))
 }
 
+// SlotName is the name of the replication slot of the publication.
+func (p Publication) SlotName() string {
+	return fmt.Sprintf("basin_%s", string(p))
+}
+
 // PgReplicator is a component that replicates Postgres data.
 type PgReplicator struct {
 	slot   string
@@ -59,6 +65,19 @@ type PgReplicator struct {
 
 // New creates a new Postgres replicator.
 func New(connStr string, publication Publication) (*PgReplicator, error) {
+	return newReplicator(connStr, publication, publication.SlotName(), false)
+}
+
+// NewTemporary creates a Postgres replicator on a temporary replication slot
+// of its own, leaving the publication's slot untouched. It streams the changes
+// committed after it is created. Postgres drops the slot when the replicator's
+// connection is closed.
+func NewTemporary(connStr string, publication Publication) (*PgReplicator, error) {
+	slot := fmt.Sprintf("%s_tmp_%d", publication.SlotName(), os.Getpid())
+	return newReplicator(connStr, publication, slot, true)
+}
+
+func newReplicator(connStr string, publication Publication, slot string, temporary bool) (*PgReplicator, error) {
 	ctx := context.Background()
 
 	config, err := pgconn.ParseConfig(connStr)
@@ -68,7 +87,7 @@ func New(connStr string, publication Publication) (*PgReplicator, error) {
 
 	r := &PgReplicator{}
 	r.feed = make(chan *Tx)
-	r.slot = fmt.Sprintf("basin_%s", publication)
+	r.slot = slot
 
 	// Connect to the database
 	pgxConn, err := pgx.Connect(ctx, connStr)
@@ -102,14 +121,18 @@ func New(connStr string, publication Publication) (*PgReplicator, error) {
 	}
 	r.tables = tables
 
-	// Fetch the confirmed flush lsn.
-	lsn, err := conn.ConfirmedFlushLSN(ctx, r.slot)
+	// Fetch the confirmed flush lsn. Temporary slots are always new.
+	var lsn pglogrepl.LSN
+	err = pgx.ErrNoRows
+	if !temporary {
+		lsn, err = conn.ConfirmedFlushLSN(ctx, r.slot)
+	}
 
 	// If no replication slot was found we create one.
 	if errors.Is(err, pgx.ErrNoRows) {
 		result, err := pglogrepl.CreateReplicationSlot(
 			context.Background(), r.pgConn, r.slot, outputPlugin, pglogrepl.CreateReplicationSlotOptions{
-				Temporary:      false,
+				Temporary:      temporary,
 				SnapshotAction: "NOEXPORT_SNAPSHOT",
 			},
 		)
@@ -7,6 +7,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/jackc/pgx/v5"
 	_ "github.com/lib/pq"
 	"github.com/ory/dockertest/v3"
 	"github.com/tablelandnetwork/basin-cli/test"
@@ -100,3 +101,70 @@ func toJSON(t *testing.T, v any) json.RawMessage {
 
 	return bytes
 }
+
+func TestSlotLifecycle(t *testing.T) {
+	ctx := context.Background()
+	_, err := db.ExecContext(ctx, `
+		create table s(id int primary key, name text);
+		create publication pub_basin_s for table s;
+	`)
+	require.NoError(t, err)
+
+	pgxConn, err := pgx.Connect(ctx, uri)
+	require.NoError(t, err)
+	conn := &Conn{pgxConn}
+	defer func() {
+		require.NoError(t, conn.Close(ctx))
+	}()
+
+	publication := Publication("s")
+	lsn, err := conn.CreateSlot(ctx, publication.SlotName())
+	require.NoError(t, err)
+
+	status, err := conn.GetSlotStatus(ctx, publication.SlotName())
+	require.NoError(t, err)
+	require.False(t, status.Active)
+	require.GreaterOrEqual(t, status.CurrentLSN, lsn)
+	require.GreaterOrEqual(t, status.RetainedWAL, int64(0))
+
+	require.NoError(t, conn.DropSlot(ctx, publication.SlotName()))
+	_, err = conn.GetSlotStatus(ctx, publication.SlotName())
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+
+	require.NoError(t, conn.DropPublication(ctx, publication))
+	tables, err := conn.GetPublicationTables(ctx, publication)
+	require.NoError(t, err)
+	require.Empty(t, tables)
+}
+
+func TestTemporarySlot(t *testing.T) {
+	ctx := context.Background()
+	_, err := db.ExecContext(ctx, `
+		create table c(id int primary key, name text);
+		create publication pub_basin_c for table c;
+	`)
+	require.NoError(t, err)
+
+	publication := Publication("c")
+	replicator, err := NewTemporary(uri, publication)
+	require.NoError(t, err)
+	feed, _, err := replicator.StartReplication(ctx)
+	require.NoError(t, err)
+
+	_, err = db.ExecContext(ctx, "insert into c values (1, 'foo')")
+	require.NoError(t, err)
+	tx := <-feed
+	require.Equal(t, 1, len(tx.Records))
+
+	// the publication's slot is not created
+	pgxConn, err := pgx.Connect(ctx, uri)
+	require.NoError(t, err)
+	conn := &Conn{pgxConn}
+	defer func() {
+		require.NoError(t, conn.Close(ctx))
+	}()
+	_, err = conn.GetSlotStatus(ctx, publication.SlotName())
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+
+	replicator.Shutdown()
+}
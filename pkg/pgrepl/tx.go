@@ -2,6 +2,8 @@ package pgrepl
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/jackc/pglogrepl"
 )
@@ -12,6 +14,31 @@ type Tx struct {
 	Records   []Record      `json:"records"`
 }
 
+// timestampLayouts are the layouts of the timestamps wal2json writes,
+// e.g. 2023-08-22 14:44:02.043586-03 or 2023-08-22 14:44:02.043586+05:30.
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+}
+
+// CommitTime returns the commit time of the tx, which wal2json writes in
+// each of its records. It is zero if the records have no timestamp.
+func (tx *Tx) CommitTime() (time.Time, error) {
+	for _, r := range tx.Records {
+		if r.Timestamp == "" {
+			continue
+		}
+		for _, layout := range timestampLayouts {
+			if t, err := time.Parse(layout, r.Timestamp); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid timestamp: %s", r.Timestamp)
+	}
+
+	return time.Time{}, nil
+}
+
 // Record is the WAL record information encoded in JSON.
 type Record struct {
 	Action     string       `json:"action"`
@@ -23,6 +50,10 @@ type Record struct {
 	Table      string       `json:"table"`
 	Columns    []Column     `json:"columns"`
 	PrimaryKey []PrimaryKey `json:"pk"`
+
+	// Identity has the old values of an updated or deleted row. It only has
+	// the replica identity columns, all of them with REPLICA IDENTITY FULL.
+	Identity []Column `json:"identity"`
 }
 
 // Column contains column information.
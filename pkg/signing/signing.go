@@ -7,6 +7,8 @@ import (
 	"io"
 	"os"
 
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"golang.org/x/crypto/sha3"
@@ -30,6 +32,21 @@ func FileToECDSA(hexPath string) (*ecdsa.PrivateKey, error) {
 	return crypto.LoadECDSA(hexPath)
 }
 
+// KeystoreToECDSA decrypts the private key of an Ethereum JSON keystore file.
+func KeystoreToECDSA(path string, password string) (*ecdsa.PrivateKey, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read keystore: %s", err)
+	}
+
+	key, err := keystore.DecryptKey(buf, password)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt keystore: %s", err)
+	}
+
+	return key.PrivateKey, nil
+}
+
 // NewSigner creates a new signer.
 func NewSigner(pk *ecdsa.PrivateKey) *Signer {
 	return &Signer{
@@ -122,3 +139,36 @@ func (s *Signer) SignBytes(data []byte) ([]byte, error) {
 
 	return signature, nil
 }
+
+// SignMessage signs a message as EIP-191 personal_sign does, so the signature
+// can be checked like one made by a wallet. Its V value is 27 or 28.
+func (s *Signer) SignMessage(message []byte) ([]byte, error) {
+	signature, err := crypto.Sign(accounts.TextHash(message), s.privateKey)
+	if err != nil {
+		return []byte{}, fmt.Errorf("sign: %s", err)
+	}
+	signature[crypto.RecoveryIDOffset] += 27
+
+	return signature, nil
+}
+
+// RecoverMessageSigner returns the address that signed a message with SignMessage,
+// or with a wallet's personal_sign.
+func RecoverMessageSigner(message []byte, signature []byte) (common.Address, error) {
+	if len(signature) != crypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("signature must be %d bytes", crypto.SignatureLength)
+	}
+
+	sig := make([]byte, len(signature))
+	copy(sig, signature)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+
+	pub, err := crypto.SigToPub(accounts.TextHash(message), sig)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("recover: %s", err)
+	}
+
+	return crypto.PubkeyToAddress(*pub), nil
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/stretchr/testify/require"
 )
 
@@ -124,6 +126,45 @@ func TestSignBytes(t *testing.T) {
 	}
 }
 
+func TestSignMessage(t *testing.T) {
+	privateKey, err := HexToECDSA("f81ab2709b7cf1f2ebbbd50bd730b267879a495318f7aac16bbe7caa8a8f2d8d")
+	require.NoError(t, err)
+	address := crypto.PubkeyToAddress(privateKey.PublicKey)
+
+	signature, err := NewSigner(privateKey).SignMessage([]byte("hello"))
+	require.NoError(t, err)
+	require.Contains(t, []byte{27, 28}, signature[crypto.RecoveryIDOffset])
+
+	// it matches the signature of eth_sign/personal_sign
+	hash := crypto.Keccak256([]byte("\x19Ethereum Signed Message:\n5hello"))
+	pub, err := crypto.SigToPub(hash, append(signature[:64:64], signature[64]-27))
+	require.NoError(t, err)
+	require.Equal(t, address, crypto.PubkeyToAddress(*pub))
+
+	signer, err := RecoverMessageSigner([]byte("hello"), signature)
+	require.NoError(t, err)
+	require.Equal(t, address, signer)
+
+	signer, err = RecoverMessageSigner([]byte("hello!"), signature)
+	require.NoError(t, err)
+	require.NotEqual(t, address, signer)
+
+	_, err = RecoverMessageSigner([]byte("hello"), signature[:64])
+	require.Error(t, err)
+}
+
+func TestKeystoreToECDSA(t *testing.T) {
+	account, err := keystore.StoreKey(t.TempDir(), "secret", keystore.LightScryptN, keystore.LightScryptP)
+	require.NoError(t, err)
+
+	privateKey, err := KeystoreToECDSA(account.URL.Path, "secret")
+	require.NoError(t, err)
+	require.Equal(t, account.Address, crypto.PubkeyToAddress(privateKey.PublicKey))
+
+	_, err = KeystoreToECDSA(account.URL.Path, "wrong")
+	require.Error(t, err)
+}
+
 func TestPrivateKey(t *testing.T) {
 	testCases := []struct {
 		name    string
@@ -0,0 +1,278 @@
+package vaultsprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tablelandnetwork/basin-cli/internal/app"
+)
+
+// FSProvider is a Vaults Provider that writes events to a local directory
+// instead of sending them anywhere. Each event file is written next to a
+// JSON sidecar, <filename>.json, describing it. It backs dry runs of stream.
+type FSProvider struct {
+	mu  sync.Mutex
+	dir string
+}
+
+var _ app.VaultsProvider = (*FSProvider)(nil)
+
+// errNotSupported is returned for the parts of the API that make no sense
+// without a provider, like vault management and resumable uploads.
+var errNotSupported = errors.New("not supported by the filesystem provider")
+
+// FSEvent is the JSON sidecar of an event written by FSProvider.
+type FSEvent struct {
+	Vault     app.Vault `json:"vault"`
+	CID       string    `json:"cid"`
+	Filename  string    `json:"filename"`
+	Timestamp int64     `json:"timestamp"`
+	Signature string    `json:"signature"`
+	Size      int64     `json:"size"`
+
+	// The following are only set for files exported from a stream window.
+	Table         string     `json:"table,omitempty"`
+	Rows          int64      `json:"rows,omitempty"`
+	StartLSN      string     `json:"start_lsn,omitempty"`
+	EndLSN        string     `json:"end_lsn,omitempty"`
+	MinCommitTime string     `json:"min_commit_time,omitempty"`
+	MaxCommitTime string     `json:"max_commit_time,omitempty"`
+	TxCount       int64      `json:"tx_count,omitempty"`
+	Schema        []FSColumn `json:"schema,omitempty"`
+}
+
+// FSColumn is a column of the table an event was exported from.
+type FSColumn struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+	Primary  bool   `json:"primary"`
+}
+
+// NewFSProvider creates a new FSProvider writing to dir.
+func NewFSProvider(dir string) (*FSProvider, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create dir: %s", err)
+	}
+
+	return &FSProvider{dir: dir}, nil
+}
+
+// CreateVault is not supported.
+func (p *FSProvider) CreateVault(context.Context, app.CreateVaultParams) error {
+	return errNotSupported
+}
+
+// ListVaults is not supported.
+func (p *FSProvider) ListVaults(context.Context, app.ListVaultsParams) ([]app.VaultWithCacheDuration, error) {
+	return nil, errNotSupported
+}
+
+// GetVault is not supported.
+func (p *FSProvider) GetVault(context.Context, app.GetVaultParams) (app.VaultInfo, error) {
+	return app.VaultInfo{}, errNotSupported
+}
+
+// UpdateVault is not supported.
+func (p *FSProvider) UpdateVault(context.Context, app.UpdateVaultParams) error {
+	return errNotSupported
+}
+
+// DeleteVault is not supported.
+func (p *FSProvider) DeleteVault(context.Context, app.DeleteVaultParams) error {
+	return errNotSupported
+}
+
+// ListVaultEvents lists the events written to the vault, newest first,
+// like the Vaults Provider does.
+func (p *FSProvider) ListVaultEvents(
+	_ context.Context, params app.ListVaultEventsParams,
+) ([]app.EventInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	events, err := p.events()
+	if err != nil {
+		return []app.EventInfo{}, err
+	}
+
+	limit, offset := int(params.Limit), int(params.Offset)
+	if limit == 0 {
+		limit = 10
+	}
+	before, after := params.Before.Seconds(), params.After.Seconds()
+
+	infos := []app.EventInfo{}
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		if e.Vault != params.Vault {
+			continue
+		}
+		if before > 0 && e.Timestamp > before {
+			continue
+		}
+		if after > 0 && e.Timestamp < after {
+			continue
+		}
+		infos = append(infos, app.EventInfo{CID: e.CID, Timestamp: e.Timestamp})
+	}
+
+	if offset > len(infos) {
+		offset = len(infos)
+	}
+	infos = infos[offset:]
+	if limit < len(infos) {
+		infos = infos[:limit]
+	}
+
+	return infos, nil
+}
+
+// WriteVaultEvent writes the event's file and its sidecar to the directory.
+func (p *FSProvider) WriteVaultEvent(
+	_ context.Context, params app.WriteVaultEventParams,
+) (app.EventInfo, error) {
+	content, err := io.ReadAll(io.TeeReader(params.Content, params.ProgressBar))
+	if err != nil {
+		return app.EventInfo{}, fmt.Errorf("read content: %s", err)
+	}
+
+	c, err := app.ChunkCID(content)
+	if err != nil {
+		return app.EventInfo{}, fmt.Errorf("cid: %s", err)
+	}
+
+	e := FSEvent{
+		Vault:     params.Vault,
+		CID:       c.String(),
+		Filename:  params.Filename,
+		Timestamp: params.Timestamp.Seconds(),
+		Signature: params.Signature,
+		Size:      int64(len(content)),
+	}
+	if export := params.Export; export != nil {
+		e.Table = export.Table
+		e.Rows = export.Rows
+		window := export.Window.Metadata()
+		e.StartLSN = window[app.StartLSNMetadataKey]
+		e.EndLSN = window[app.EndLSNMetadataKey]
+		e.MinCommitTime = window[app.MinCommitTimeMetadataKey]
+		e.MaxCommitTime = window[app.MaxCommitTimeMetadataKey]
+		e.TxCount = export.Window.Txs
+		for _, col := range export.Columns {
+			e.Schema = append(e.Schema, FSColumn{
+				Name:     col.Name,
+				Type:     col.Typ,
+				Nullable: col.IsNull,
+				Primary:  col.IsPrimary,
+			})
+		}
+	}
+
+	sidecar, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return app.EventInfo{}, fmt.Errorf("marshal sidecar: %s", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := os.WriteFile(path.Join(p.dir, params.Filename), content, 0o644); err != nil {
+		return app.EventInfo{}, fmt.Errorf("write file: %s", err)
+	}
+	if err := os.WriteFile(path.Join(p.dir, params.Filename+".json"), sidecar, 0o644); err != nil {
+		return app.EventInfo{}, fmt.Errorf("write sidecar: %s", err)
+	}
+
+	return app.EventInfo{CID: e.CID, Timestamp: e.Timestamp}, nil
+}
+
+// RetrieveEvent copies the file of the event with the given CID to w.
+func (p *FSProvider) RetrieveEvent(
+	_ context.Context, params app.RetrieveEventParams, w io.Writer,
+) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	events, err := p.events()
+	if err != nil {
+		return "", err
+	}
+
+	for _, e := range events {
+		if e.CID != params.CID.String() {
+			continue
+		}
+
+		content, err := os.ReadFile(path.Join(p.dir, e.Filename))
+		if err != nil {
+			return "", fmt.Errorf("read file: %s", err)
+		}
+		if _, err := io.Copy(w, bytes.NewReader(content)); err != nil {
+			return "", fmt.Errorf("copy content: %s", err)
+		}
+		return e.Filename, nil
+	}
+
+	return "", app.ErrNotFoundInCache
+}
+
+// StartUpload is not supported.
+func (p *FSProvider) StartUpload(context.Context, app.StartUploadParams) (string, error) {
+	return "", errNotSupported
+}
+
+// UploadStatus is not supported.
+func (p *FSProvider) UploadStatus(context.Context, app.UploadStatusParams) ([]int, error) {
+	return nil, errNotSupported
+}
+
+// WriteChunk is not supported.
+func (p *FSProvider) WriteChunk(context.Context, app.WriteChunkParams) error {
+	return errNotSupported
+}
+
+// CompleteUpload is not supported.
+func (p *FSProvider) CompleteUpload(context.Context, app.CompleteUploadParams) (app.EventInfo, error) {
+	return app.EventInfo{}, errNotSupported
+}
+
+// events reads the sidecars in the directory, ordered by timestamp.
+func (p *FSProvider) events() ([]FSEvent, error) {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %s", err)
+	}
+
+	events := []FSEvent{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		buf, err := os.ReadFile(path.Join(p.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read sidecar: %s", err)
+		}
+		var e FSEvent
+		if err := json.Unmarshal(buf, &e); err != nil {
+			return nil, fmt.Errorf("decode sidecar %s: %s", entry.Name(), err)
+		}
+		events = append(events, e)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp < events[j].Timestamp
+	})
+
+	return events, nil
+}
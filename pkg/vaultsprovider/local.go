@@ -0,0 +1,589 @@
+package vaultsprovider
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ipfs/go-cid"
+	"github.com/tablelandnetwork/basin-cli/internal/app"
+	"github.com/tablelandnetwork/basin-cli/pkg/signing"
+)
+
+// LocalServer is an in-memory stand-in for the Vaults Provider HTTP API.
+// It is meant to be served with net/http/httptest so the CLI and the
+// client in this package can be exercised offline.
+type LocalServer struct {
+	mu      sync.Mutex
+	vaults  map[app.Vault]*localVault
+	events  map[string]*localEvent
+	uploads map[string]*localUpload
+
+	// nonces of the signed requests seen, with their expiry
+	nonces map[string]int64
+}
+
+type localVault struct {
+	owner         common.Address
+	createdAt     int64
+	cacheDuration app.CacheDuration
+	events        []*localEvent
+}
+
+// maxRequestTTL is how far in the future the expiry of a signed request may be.
+const maxRequestTTL = time.Hour
+
+type localEvent struct {
+	cid       cid.Cid
+	timestamp int64
+	filename  string
+	content   []byte
+}
+
+type localUpload struct {
+	vault     app.Vault
+	filename  string
+	timestamp int64
+	signature []byte
+	size      int64
+	chunkSize int64
+	chunks    []cid.Cid
+	received  map[int][]byte
+}
+
+// NewLocalServer creates a new LocalServer.
+func NewLocalServer() *LocalServer {
+	return &LocalServer{
+		vaults:  make(map[app.Vault]*localVault),
+		events:  make(map[string]*localEvent),
+		uploads: make(map[string]*localUpload),
+		nonces:  make(map[string]int64),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *LocalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) >= 2 && parts[0] == "v2" && parts[1] == "vaults" && r.Method == http.MethodGet:
+		s.listVaults(w, r)
+	case len(parts) == 2 && parts[0] == "vaults" && r.Method == http.MethodPost:
+		s.createVault(w, r, app.Vault(parts[1]))
+	case len(parts) == 2 && parts[0] == "vaults" && r.Method == http.MethodGet:
+		s.getVault(w, app.Vault(parts[1]))
+	case len(parts) == 2 && parts[0] == "vaults" && r.Method == http.MethodPatch:
+		s.updateVault(w, r, app.Vault(parts[1]))
+	case len(parts) == 2 && parts[0] == "vaults" && r.Method == http.MethodDelete:
+		s.deleteVault(w, r, app.Vault(parts[1]))
+	case len(parts) == 3 && parts[0] == "vaults" && parts[2] == "events" && r.Method == http.MethodGet:
+		s.listEvents(w, r, app.Vault(parts[1]))
+	case len(parts) == 3 && parts[0] == "vaults" && parts[2] == "events" && r.Method == http.MethodPost:
+		s.writeEvent(w, r, app.Vault(parts[1]))
+	case len(parts) == 2 && parts[0] == "events" && r.Method == http.MethodGet:
+		s.retrieveEvent(w, parts[1])
+	case len(parts) == 3 && parts[0] == "vaults" && parts[2] == "uploads" && r.Method == http.MethodPost:
+		s.startUpload(w, r, app.Vault(parts[1]))
+	case len(parts) == 4 && parts[0] == "vaults" && parts[2] == "uploads" && r.Method == http.MethodGet:
+		s.uploadStatus(w, app.Vault(parts[1]), parts[3])
+	case len(parts) == 6 && parts[0] == "vaults" && parts[2] == "uploads" && parts[4] == "chunks" &&
+		r.Method == http.MethodPut:
+		s.writeChunk(w, r, app.Vault(parts[1]), parts[3], parts[5])
+	case len(parts) == 5 && parts[0] == "vaults" && parts[2] == "uploads" && parts[4] == "complete" &&
+		r.Method == http.MethodPost:
+		s.completeUpload(w, app.Vault(parts[1]), parts[3])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *LocalServer) createVault(w http.ResponseWriter, r *http.Request, vault app.Vault) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	account, err := app.NewAccount(r.PostForm.Get("account"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid account")
+		return
+	}
+	owner := common.HexToAddress(account.Hex())
+
+	var cache uint64
+	if v := r.PostForm.Get("cache"); v != "" {
+		if cache, err = strconv.ParseUint(v, 10, 32); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid cache")
+			return
+		}
+	}
+
+	params := app.CreateVaultParams{Vault: vault, Account: account, CacheDuration: app.CacheDuration(cache)}
+	if params.Auth, err = parseRequestAuth(r.PostForm); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if status, err := s.verifyRequest(owner, params.Auth, params); err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	if _, ok := s.vaults[vault]; ok {
+		writeError(w, http.StatusConflict, "vault already exists")
+		return
+	}
+
+	s.vaults[vault] = &localVault{
+		owner:         owner,
+		createdAt:     time.Now().Unix(),
+		cacheDuration: app.CacheDuration(cache),
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *LocalServer) getVault(w http.ResponseWriter, vault app.Vault) {
+	v, ok := s.vaults[vault]
+	if !ok {
+		writeError(w, http.StatusNotFound, "vault not found")
+		return
+	}
+
+	var size int64
+	for _, e := range v.events {
+		size += int64(len(e.content))
+	}
+	cache := v.cacheDuration
+
+	writeJSON(w, http.StatusOK, app.VaultInfo{
+		Vault:         vault,
+		Owner:         v.owner.Hex(),
+		CreatedAt:     v.createdAt,
+		CacheDuration: &cache,
+		EventCount:    int64(len(v.events)),
+		TotalSize:     size,
+	})
+}
+
+func (s *LocalServer) updateVault(w http.ResponseWriter, r *http.Request, vault app.Vault) {
+	v, ok := s.vaults[vault]
+	if !ok {
+		writeError(w, http.StatusNotFound, "vault not found")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cache, err := strconv.ParseUint(r.PostForm.Get("cache"), 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid cache")
+		return
+	}
+
+	params := app.UpdateVaultParams{Vault: vault, CacheDuration: app.CacheDuration(cache)}
+	if params.Auth, err = parseRequestAuth(r.PostForm); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if status, err := s.verifyRequest(v.owner, params.Auth, params); err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	v.cacheDuration = params.CacheDuration
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *LocalServer) deleteVault(w http.ResponseWriter, r *http.Request, vault app.Vault) {
+	v, ok := s.vaults[vault]
+	if !ok {
+		writeError(w, http.StatusNotFound, "vault not found")
+		return
+	}
+
+	auth, err := parseRequestAuth(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	params := app.DeleteVaultParams{Vault: vault, Auth: auth}
+	if status, err := s.verifyRequest(v.owner, params.Auth, params); err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	for _, e := range v.events {
+		if s.events[e.cid.String()] == e {
+			delete(s.events, e.cid.String())
+		}
+	}
+	for id, u := range s.uploads {
+		if u.vault == vault {
+			delete(s.uploads, id)
+		}
+	}
+	delete(s.vaults, vault)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *LocalServer) listVaults(w http.ResponseWriter, r *http.Request) {
+	account := common.HexToAddress(r.URL.Query().Get("account"))
+
+	vaults := []app.VaultWithCacheDuration{}
+	for name, v := range s.vaults {
+		if v.owner != account {
+			continue
+		}
+		cache := v.cacheDuration
+		vaults = append(vaults, app.VaultWithCacheDuration{Vault: name, CacheDuration: &cache})
+	}
+	sort.Slice(vaults, func(i, j int) bool { return vaults[i].Vault < vaults[j].Vault })
+
+	writeJSON(w, http.StatusOK, vaults)
+}
+
+func (s *LocalServer) listEvents(w http.ResponseWriter, r *http.Request, vault app.Vault) {
+	v, ok := s.vaults[vault]
+	if !ok {
+		writeError(w, http.StatusNotFound, "vault not found")
+		return
+	}
+
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	before, _ := strconv.ParseInt(q.Get("before"), 10, 64)
+	after, _ := strconv.ParseInt(q.Get("after"), 10, 64)
+	if limit == 0 {
+		limit = 10
+	}
+
+	// newest events first
+	events := []app.EventInfo{}
+	for i := len(v.events) - 1; i >= 0; i-- {
+		e := v.events[i]
+		if before > 0 && e.timestamp > before {
+			continue
+		}
+		if after > 0 && e.timestamp < after {
+			continue
+		}
+		events = append(events, app.EventInfo{
+			CID:       e.cid.String(),
+			Timestamp: e.timestamp,
+		})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Timestamp > events[j].Timestamp })
+
+	if offset > len(events) {
+		offset = len(events)
+	}
+	events = events[offset:]
+	if limit < len(events) {
+		events = events[:limit]
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
+
+func (s *LocalServer) writeEvent(w http.ResponseWriter, r *http.Request, vault app.Vault) {
+	v, ok := s.vaults[vault]
+	if !ok {
+		writeError(w, http.StatusNotFound, "vault not found")
+		return
+	}
+
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	q := r.URL.Query()
+	ts, _ := strconv.ParseInt(q.Get("timestamp"), 10, 64)
+	signature, err := hex.DecodeString(q.Get("signature"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid signature")
+		return
+	}
+
+	if err := verifySignature(v.owner, content, signature); err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	e, err := s.addEvent(v, r.Header.Get("filename"), ts, content)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, app.EventInfo{CID: e.cid.String(), Timestamp: e.timestamp})
+}
+
+func (s *LocalServer) retrieveEvent(w http.ResponseWriter, id string) {
+	e, ok := s.events[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "event not found")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s\"", e.cid, e.filename))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(e.content)
+}
+
+func (s *LocalServer) startUpload(w http.ResponseWriter, r *http.Request, vault app.Vault) {
+	if _, ok := s.vaults[vault]; !ok {
+		writeError(w, http.StatusNotFound, "vault not found")
+		return
+	}
+
+	var req startUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	signature, err := hex.DecodeString(req.Signature)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid signature")
+		return
+	}
+
+	if req.ChunkSize <= 0 || int64(len(req.Chunks)) != (req.Size+req.ChunkSize-1)/req.ChunkSize {
+		writeError(w, http.StatusBadRequest, "chunks do not match size")
+		return
+	}
+
+	chunks := make([]cid.Cid, len(req.Chunks))
+	for i, c := range req.Chunks {
+		if chunks[i], err = cid.Parse(c); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid chunk cid: %s", c))
+			return
+		}
+	}
+
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	sessionID := hex.EncodeToString(id)
+	s.uploads[sessionID] = &localUpload{
+		vault:     vault,
+		filename:  req.Filename,
+		timestamp: req.Timestamp,
+		signature: signature,
+		size:      req.Size,
+		chunkSize: req.ChunkSize,
+		chunks:    chunks,
+		received:  make(map[int][]byte),
+	}
+
+	writeJSON(w, http.StatusCreated, startUploadResponse{SessionID: sessionID})
+}
+
+func (s *LocalServer) uploadStatus(w http.ResponseWriter, vault app.Vault, sessionID string) {
+	u, ok := s.uploads[sessionID]
+	if !ok || u.vault != vault {
+		writeError(w, http.StatusNotFound, "upload not found")
+		return
+	}
+
+	received := []int{}
+	for i := range u.received {
+		received = append(received, i)
+	}
+	sort.Ints(received)
+
+	writeJSON(w, http.StatusOK, uploadStatusResponse{Received: received})
+}
+
+func (s *LocalServer) writeChunk(
+	w http.ResponseWriter, r *http.Request, vault app.Vault, sessionID string, index string,
+) {
+	u, ok := s.uploads[sessionID]
+	if !ok || u.vault != vault {
+		writeError(w, http.StatusNotFound, "upload not found")
+		return
+	}
+
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 || i >= len(u.chunks) {
+		writeError(w, http.StatusBadRequest, "invalid chunk index")
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c, err := app.ChunkCID(data)
+	if err != nil || !c.Equals(u.chunks[i]) || r.Header.Get("chunk-cid") != c.String() {
+		writeError(w, http.StatusBadRequest, "chunk does not match its cid")
+		return
+	}
+
+	signature, err := hex.DecodeString(r.URL.Query().Get("signature"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid signature")
+		return
+	}
+	if err := verifySignature(s.vaults[vault].owner, data, signature); err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	u.received[i] = data
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *LocalServer) completeUpload(w http.ResponseWriter, vault app.Vault, sessionID string) {
+	u, ok := s.uploads[sessionID]
+	if !ok || u.vault != vault {
+		writeError(w, http.StatusNotFound, "upload not found")
+		return
+	}
+
+	var buf bytes.Buffer
+	for i := range u.chunks {
+		data, ok := u.received[i]
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("missing chunk %d", i))
+			return
+		}
+		buf.Write(data)
+	}
+
+	if int64(buf.Len()) != u.size {
+		writeError(w, http.StatusBadRequest, "upload size mismatch")
+		return
+	}
+
+	v := s.vaults[vault]
+	if err := verifySignature(v.owner, buf.Bytes(), u.signature); err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	e, err := s.addEvent(v, u.filename, u.timestamp, buf.Bytes())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	delete(s.uploads, sessionID)
+
+	writeJSON(w, http.StatusCreated, app.EventInfo{CID: e.cid.String(), Timestamp: e.timestamp})
+}
+
+func (s *LocalServer) addEvent(v *localVault, filename string, ts int64, content []byte) (*localEvent, error) {
+	c, err := app.ChunkCID(content)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &localEvent{
+		cid:       c,
+		timestamp: ts,
+		filename:  filename,
+		content:   content,
+	}
+	v.events = append(v.events, e)
+	s.events[c.String()] = e
+
+	return e, nil
+}
+
+// verifySignature checks that signature is the owner's signature of the keccak hash of data.
+func verifySignature(owner common.Address, data []byte, signature []byte) error {
+	pub, err := crypto.SigToPub(crypto.Keccak256(data), signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+
+	if crypto.PubkeyToAddress(*pub) != owner {
+		return fmt.Errorf("signature does not belong to the vault owner")
+	}
+
+	return nil
+}
+
+// parseRequestAuth parses the nonce, expiry and signature of a signed request.
+func parseRequestAuth(values url.Values) (app.RequestAuth, error) {
+	expiry, err := strconv.ParseInt(values.Get("expiry"), 10, 64)
+	if err != nil {
+		return app.RequestAuth{}, fmt.Errorf("invalid expiry")
+	}
+	if values.Get("nonce") == "" {
+		return app.RequestAuth{}, fmt.Errorf("missing nonce")
+	}
+
+	return app.RequestAuth{
+		Nonce:     values.Get("nonce"),
+		Expiry:    app.NewTimestamp(time.Unix(expiry, 0)),
+		Signature: values.Get("signature"),
+	}, nil
+}
+
+// verifyRequest checks that a signed request has not expired or been seen before,
+// and that it is signed by signer.
+func (s *LocalServer) verifyRequest(signer common.Address, auth app.RequestAuth, req app.SignedRequest) (int, error) {
+	expiry := auth.Expiry.Seconds()
+	now := time.Now()
+	for nonce, exp := range s.nonces {
+		if exp < now.Unix() {
+			delete(s.nonces, nonce)
+		}
+	}
+
+	switch {
+	case expiry < now.Unix():
+		return http.StatusUnauthorized, fmt.Errorf("request expired")
+	case expiry > now.Add(maxRequestTTL).Unix():
+		return http.StatusBadRequest, fmt.Errorf("expiry is too far in the future")
+	}
+	if _, ok := s.nonces[auth.Nonce]; ok {
+		return http.StatusUnauthorized, fmt.Errorf("nonce already used")
+	}
+
+	sig, err := hex.DecodeString(auth.Signature)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid signature")
+	}
+	address, err := signing.RecoverMessageSigner(req.Message(), sig)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("invalid signature: %s", err)
+	}
+	if address != signer {
+		return http.StatusUnauthorized, fmt.Errorf("request is not signed by %s", signer.Hex())
+	}
+	s.nonces[auth.Nonce] = expiry
+
+	return http.StatusOK, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
@@ -1,6 +1,7 @@
 package vaultsprovider
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -40,6 +41,7 @@ func (bp *VaultsProvider) CreateVault(ctx context.Context, params app.CreateVaul
 	form := url.Values{}
 	form.Add("account", params.Account.Hex())
 	form.Add("cache", fmt.Sprint(params.CacheDuration))
+	addRequestAuth(form, params.Auth)
 
 	req, err := http.NewRequestWithContext(
 		ctx, http.MethodPost, fmt.Sprintf("%s/vaults/%s", bp.provider, params.Vault), strings.NewReader(form.Encode()))
@@ -57,7 +59,7 @@ func (bp *VaultsProvider) CreateVault(ctx context.Context, params app.CreateVaul
 	}()
 
 	if resp.StatusCode != http.StatusCreated {
-		return errors.New("account was not created")
+		return decodeError(resp)
 	}
 
 	return nil
@@ -88,6 +90,97 @@ func (bp *VaultsProvider) ListVaults(
 	return vaults, nil
 }
 
+// GetVault gets the details of a vault.
+func (bp *VaultsProvider) GetVault(ctx context.Context, params app.GetVaultParams) (app.VaultInfo, error) {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, fmt.Sprintf("%s/vaults/%s", bp.provider, params.Vault), nil)
+	if err != nil {
+		return app.VaultInfo{}, fmt.Errorf("could not create request: %s", err)
+	}
+
+	resp, err := bp.client.Do(req)
+	if err != nil {
+		return app.VaultInfo{}, fmt.Errorf("request to get vault failed: %s", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return app.VaultInfo{}, app.ErrVaultNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return app.VaultInfo{}, decodeError(resp)
+	}
+
+	var info app.VaultInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return app.VaultInfo{}, fmt.Errorf("failed to read response: %s", err)
+	}
+	return info, nil
+}
+
+// UpdateVault changes the cache duration of a vault.
+func (bp *VaultsProvider) UpdateVault(ctx context.Context, params app.UpdateVaultParams) error {
+	form := url.Values{}
+	form.Add("cache", fmt.Sprint(params.CacheDuration))
+	addRequestAuth(form, params.Auth)
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPatch, fmt.Sprintf("%s/vaults/%s", bp.provider, params.Vault), strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("could not create request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := bp.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to update vault failed: %s", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return app.ErrVaultNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp)
+	}
+
+	return nil
+}
+
+// DeleteVault deletes a vault and its events.
+func (bp *VaultsProvider) DeleteVault(ctx context.Context, params app.DeleteVaultParams) error {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodDelete, fmt.Sprintf("%s/vaults/%s", bp.provider, params.Vault), nil)
+	if err != nil {
+		return fmt.Errorf("could not create request: %s", err)
+	}
+
+	q := req.URL.Query()
+	addRequestAuth(q, params.Auth)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := bp.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to delete vault failed: %s", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return app.ErrVaultNotFound
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return decodeError(resp)
+	}
+
+	return nil
+}
+
 // ListVaultEvents lists all events from a given vault.
 func (bp *VaultsProvider) ListVaultEvents(
 	ctx context.Context, params app.ListVaultEventsParams,
@@ -121,7 +214,9 @@ func (bp *VaultsProvider) ListVaultEvents(
 }
 
 // WriteVaultEvent write an event.
-func (bp *VaultsProvider) WriteVaultEvent(ctx context.Context, params app.WriteVaultEventParams) error {
+func (bp *VaultsProvider) WriteVaultEvent(
+	ctx context.Context, params app.WriteVaultEventParams,
+) (app.EventInfo, error) {
 	req, err := http.NewRequestWithContext(
 		ctx,
 		http.MethodPost,
@@ -129,10 +224,15 @@ func (bp *VaultsProvider) WriteVaultEvent(ctx context.Context, params app.WriteV
 		io.TeeReader(params.Content, params.ProgressBar),
 	)
 	if err != nil {
-		return fmt.Errorf("could not create request: %s", err)
+		return app.EventInfo{}, fmt.Errorf("could not create request: %s", err)
 	}
 
 	req.Header.Add("filename", params.Filename)
+	if params.Export != nil {
+		for key, v := range params.Export.Window.Metadata() {
+			req.Header.Add(windowHeaders[key], v)
+		}
+	}
 
 	q := req.URL.Query()
 	q.Add("timestamp", fmt.Sprint(params.Timestamp.Seconds()))
@@ -146,7 +246,7 @@ func (bp *VaultsProvider) WriteVaultEvent(ctx context.Context, params app.WriteV
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("request to write vault event failed: %s", err)
+		return app.EventInfo{}, fmt.Errorf("request to write vault event failed: %s", err)
 	}
 	defer func() {
 		_ = resp.Body.Close()
@@ -158,13 +258,13 @@ func (bp *VaultsProvider) WriteVaultEvent(ctx context.Context, params app.WriteV
 		}
 		var r response
 		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-			return fmt.Errorf("failed to decode response: %s", err)
+			return app.EventInfo{}, fmt.Errorf("failed to decode response: %s", err)
 		}
 
-		return fmt.Errorf(r.Error)
+		return app.EventInfo{}, fmt.Errorf(r.Error)
 	}
 
-	return nil
+	return decodeEventInfo(resp), nil
 }
 
 // RetrieveEvent retrieves an event.
@@ -212,3 +312,220 @@ func (bp *VaultsProvider) RetrieveEvent(
 	}
 	return strings.Join(parts[1:], "-"), nil
 }
+
+// StartUpload opens a resumable upload session.
+func (bp *VaultsProvider) StartUpload(ctx context.Context, params app.StartUploadParams) (string, error) {
+	chunks := make([]string, len(params.Chunks))
+	for i, c := range params.Chunks {
+		chunks[i] = c.String()
+	}
+
+	body, err := json.Marshal(startUploadRequest{
+		Filename:  params.Filename,
+		Timestamp: params.Timestamp.Seconds(),
+		Signature: params.Signature,
+		Size:      params.Size,
+		ChunkSize: params.ChunkSize,
+		Chunks:    chunks,
+		Window:    params.Window.Metadata(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("marshal: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, fmt.Sprintf("%s/vaults/%s/uploads", bp.provider, params.Vault), bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("could not create request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := bp.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request to start upload failed: %s", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", decodeError(resp)
+	}
+
+	var r startUploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", fmt.Errorf("failed to read response: %s", err)
+	}
+
+	return r.SessionID, nil
+}
+
+// UploadStatus returns the indexes of the chunks the provider has received.
+func (bp *VaultsProvider) UploadStatus(ctx context.Context, params app.UploadStatusParams) ([]int, error) {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, fmt.Sprintf("%s/vaults/%s/uploads/%s", bp.provider, params.Vault, params.SessionID), nil)
+	if err != nil {
+		return []int{}, fmt.Errorf("could not create request: %s", err)
+	}
+
+	resp, err := bp.client.Do(req)
+	if err != nil {
+		return []int{}, fmt.Errorf("request to get upload status failed: %s", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return []int{}, app.ErrUploadNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return []int{}, decodeError(resp)
+	}
+
+	var r uploadStatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return []int{}, fmt.Errorf("failed to read response: %s", err)
+	}
+
+	return r.Received, nil
+}
+
+// WriteChunk writes a chunk of a resumable upload.
+func (bp *VaultsProvider) WriteChunk(ctx context.Context, params app.WriteChunkParams) error {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPut,
+		fmt.Sprintf("%s/vaults/%s/uploads/%s/chunks/%d", bp.provider, params.Vault, params.SessionID, params.Index),
+		params.Content,
+	)
+	if err != nil {
+		return fmt.Errorf("could not create request: %s", err)
+	}
+
+	req.Header.Add("chunk-cid", params.CID.String())
+
+	q := req.URL.Query()
+	q.Add("signature", params.Signature)
+	req.URL.RawQuery = q.Encode()
+	req.ContentLength = params.Size
+
+	client := &http.Client{
+		Timeout: 0,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to write chunk failed: %s", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return app.ErrUploadNotFound
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return decodeError(resp)
+	}
+
+	return nil
+}
+
+// CompleteUpload finishes a resumable upload, turning it into a vault event.
+func (bp *VaultsProvider) CompleteUpload(
+	ctx context.Context, params app.CompleteUploadParams,
+) (app.EventInfo, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf("%s/vaults/%s/uploads/%s/complete", bp.provider, params.Vault, params.SessionID),
+		nil,
+	)
+	if err != nil {
+		return app.EventInfo{}, fmt.Errorf("could not create request: %s", err)
+	}
+
+	client := &http.Client{
+		Timeout: 0,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return app.EventInfo{}, fmt.Errorf("request to complete upload failed: %s", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return app.EventInfo{}, app.ErrUploadNotFound
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return app.EventInfo{}, decodeError(resp)
+	}
+
+	return decodeEventInfo(resp), nil
+}
+
+// addRequestAuth adds the nonce, expiry and signature of a signed request to its form or query.
+func addRequestAuth(v url.Values, auth app.RequestAuth) {
+	v.Add("nonce", auth.Nonce)
+	v.Add("expiry", fmt.Sprint(auth.Expiry.Seconds()))
+	v.Add("signature", auth.Signature)
+}
+
+type startUploadRequest struct {
+	Filename  string   `json:"filename"`
+	Timestamp int64    `json:"timestamp"`
+	Signature string   `json:"signature"`
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunk_size"`
+	Chunks    []string `json:"chunks"`
+
+	// Window has the window metadata entries of a streamed file.
+	Window map[string]string `json:"window,omitempty"`
+}
+
+// windowHeaders are the headers a streamed file is written with, carrying
+// the window metadata entries.
+var windowHeaders = map[string]string{
+	app.StartLSNMetadataKey:      "window-start-lsn",
+	app.EndLSNMetadataKey:        "window-end-lsn",
+	app.MinCommitTimeMetadataKey: "window-min-commit-time",
+	app.MaxCommitTimeMetadataKey: "window-max-commit-time",
+	app.TxCountMetadataKey:       "window-tx-count",
+}
+
+type startUploadResponse struct {
+	SessionID string `json:"session_id"`
+}
+
+type uploadStatusResponse struct {
+	Received []int `json:"received"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// decodeEventInfo decodes the event a successful write responds with. Providers
+// that respond without one still wrote the event, so an empty EventInfo is
+// returned in that case instead of an error.
+func decodeEventInfo(resp *http.Response) app.EventInfo {
+	var e app.EventInfo
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return app.EventInfo{}
+	}
+
+	return e
+}
+
+func decodeError(resp *http.Response) error {
+	var r errorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return errors.New(r.Error)
+}
@@ -0,0 +1,436 @@
+package vaultsprovider
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+	"github.com/tablelandnetwork/basin-cli/internal/app"
+)
+
+const pk = "f81ab2709b7cf1f2ebbbd50bd730b267879a495318f7aac16bbe7caa8a8f2d8d"
+
+func TestWriteAndRetrieveEvent(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(NewLocalServer())
+	defer srv.Close()
+
+	bp := New(srv.URL)
+	createVault(t, bp)
+
+	content := randomFile(t, 1000)
+	uploader := app.NewVaultsUploader("test", "data", bp, privateKey(t))
+	ts := app.NewTimestamp(time.Unix(1700000000, 0))
+	res, err := uploader.Upload(ctx, content, io.Discard, ts, 1000)
+	require.NoError(t, err)
+
+	events, err := bp.ListVaultEvents(ctx, app.ListVaultEventsParams{Vault: "test.data", Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, int64(1700000000), events[0].Timestamp)
+	require.Equal(t, events[0].CID, res.Event.CID)
+	require.NotEmpty(t, res.Signature)
+
+	assertEventContent(t, bp, events[0].CID, content)
+}
+
+func TestFSProvider(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	bp, err := NewFSProvider(dir)
+	require.NoError(t, err)
+
+	content := randomFile(t, 1000)
+	uploader := app.NewVaultsUploader("test", "data", bp, privateKey(t))
+	res, err := uploader.UploadExport(ctx, app.ExportedFile{
+		Path:    content,
+		Table:   "t",
+		Columns: []app.Column{{Name: "id", Typ: "integer", IsPrimary: true}},
+		Rows:    3,
+		Window:  testWindow,
+	}, io.Discard, app.NewTimestamp(time.Unix(1700000000, 0)), 1000)
+	require.NoError(t, err)
+
+	// the file is written with a sidecar describing it
+	filename := path.Base(content)
+	require.FileExists(t, path.Join(dir, filename))
+	buf, err := os.ReadFile(path.Join(dir, filename+".json"))
+	require.NoError(t, err)
+	var sidecar FSEvent
+	require.NoError(t, json.Unmarshal(buf, &sidecar))
+	require.Equal(t, FSEvent{
+		Vault:         "test.data",
+		CID:           res.Event.CID,
+		Filename:      filename,
+		Timestamp:     1700000000,
+		Signature:     res.Signature,
+		Size:          1000,
+		Table:         "t",
+		Rows:          3,
+		StartLSN:      "0/16B3748",
+		EndLSN:        "0/16B3900",
+		MinCommitTime: "2023-08-22T17:44:02Z",
+		MaxCommitTime: "2023-08-22T17:44:04Z",
+		TxCount:       2,
+		Schema:        []FSColumn{{Name: "id", Type: "integer", Nullable: false, Primary: true}},
+	}, sidecar)
+
+	events, err := bp.ListVaultEvents(ctx, app.ListVaultEventsParams{Vault: "test.data"})
+	require.NoError(t, err)
+	require.Equal(t, []app.EventInfo{{CID: res.Event.CID, Timestamp: 1700000000}}, events)
+
+	id, err := cid.Parse(res.Event.CID)
+	require.NoError(t, err)
+	var retrieved bytes.Buffer
+	_, err = bp.RetrieveEvent(ctx, app.RetrieveEventParams{CID: id}, &retrieved)
+	require.NoError(t, err)
+	expected, err := os.ReadFile(content)
+	require.NoError(t, err)
+	require.Equal(t, expected, retrieved.Bytes())
+}
+
+func TestWriteStreamedFileSendsWindow(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	headers := http.Header{}
+	var startBody startUploadRequest
+	local := NewLocalServer()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/events"):
+			headers = r.Header.Clone()
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/uploads"):
+			body, _ := io.ReadAll(r.Body)
+			_ = json.Unmarshal(body, &startBody)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		mu.Unlock()
+		local.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	bp := New(srv.URL)
+	createVault(t, bp)
+	uploader := app.NewVaultsUploader("test", "data", bp, privateKey(t))
+	file := app.ExportedFile{Path: randomFile(t, 1000), Table: "t", Window: testWindow}
+	_, err := uploader.UploadExport(ctx, file, io.Discard, app.NewTimestamp(time.Now()), 1000)
+	require.NoError(t, err)
+
+	require.Equal(t, "0/16B3748", headers.Get("window-start-lsn"))
+	require.Equal(t, "0/16B3900", headers.Get("window-end-lsn"))
+	require.Equal(t, "2023-08-22T17:44:02Z", headers.Get("window-min-commit-time"))
+	require.Equal(t, "2023-08-22T17:44:04Z", headers.Get("window-max-commit-time"))
+	require.Equal(t, "2", headers.Get("window-tx-count"))
+
+	// resumable uploads send it when the upload starts
+	uploader.EnableResumableUploads(t.TempDir(), 256)
+	file.Path = randomFile(t, 1000)
+	_, err = uploader.UploadExport(ctx, file, io.Discard, app.NewTimestamp(time.Now()), 1000)
+	require.NoError(t, err)
+	require.Equal(t, testWindow.Metadata(), startBody.Window)
+}
+
+func TestVaultLifecycle(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(NewLocalServer())
+	defer srv.Close()
+
+	bp := New(srv.URL)
+	createVault(t, bp)
+
+	content := randomFile(t, 1000)
+	uploader := app.NewVaultsUploader("test", "data", bp, privateKey(t))
+	_, err := uploader.Upload(ctx, content, io.Discard, app.NewTimestamp(time.Now()), 1000)
+	require.NoError(t, err)
+
+	info, err := bp.GetVault(ctx, app.GetVaultParams{Vault: "test.data"})
+	require.NoError(t, err)
+	require.Equal(t, crypto.PubkeyToAddress(privateKey(t).PublicKey).Hex(), info.Owner)
+	require.NotZero(t, info.CreatedAt)
+	require.Equal(t, app.CacheDuration(0), *info.CacheDuration)
+	require.Equal(t, int64(1), info.EventCount)
+	require.Equal(t, int64(1000), info.TotalSize)
+
+	update := app.UpdateVaultParams{Vault: "test.data", CacheDuration: 60, Auth: requestAuth(t)}
+	update.Auth.Signature = signRequest(t, privateKey(t), update)
+	require.NoError(t, bp.UpdateVault(ctx, update))
+	info, err = bp.GetVault(ctx, app.GetVaultParams{Vault: "test.data"})
+	require.NoError(t, err)
+	require.Equal(t, app.CacheDuration(60), *info.CacheDuration)
+
+	// a signed request cannot be replayed
+	require.ErrorContains(t, bp.UpdateVault(ctx, update), "nonce already used")
+
+	// only the owner can delete the vault
+	other, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	del := app.DeleteVaultParams{Vault: "test.data", Auth: requestAuth(t)}
+	del.Auth.Signature = signRequest(t, other, del)
+	require.ErrorContains(t, bp.DeleteVault(ctx, del), "is not signed by")
+
+	// a signature of another request is rejected
+	del.Auth.Signature = update.Auth.Signature
+	require.ErrorContains(t, bp.DeleteVault(ctx, del), "is not signed by")
+
+	// so is an expired one
+	expired := app.DeleteVaultParams{Vault: "test.data", Auth: requestAuth(t)}
+	expired.Auth.Expiry = app.NewTimestamp(time.Now().Add(-time.Minute))
+	expired.Auth.Signature = signRequest(t, privateKey(t), expired)
+	require.ErrorContains(t, bp.DeleteVault(ctx, expired), "expired")
+
+	del.Auth.Signature = signRequest(t, privateKey(t), del)
+	require.NoError(t, bp.DeleteVault(ctx, del))
+	_, err = bp.GetVault(ctx, app.GetVaultParams{Vault: "test.data"})
+	require.ErrorIs(t, err, app.ErrVaultNotFound)
+	require.ErrorIs(t, bp.DeleteVault(ctx, del), app.ErrVaultNotFound)
+}
+
+func TestCreateVaultRequiresSignature(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(NewLocalServer())
+	defer srv.Close()
+	bp := New(srv.URL)
+
+	// the account does not match the signer
+	other, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	account, err := app.NewAccount(crypto.PubkeyToAddress(privateKey(t).PublicKey).Hex())
+	require.NoError(t, err)
+	params := app.CreateVaultParams{Vault: "test.data", Account: account, CacheDuration: 10, Auth: requestAuth(t)}
+	params.Auth.Signature = signRequest(t, other, params)
+	require.ErrorContains(t, bp.CreateVault(ctx, params), "is not signed by")
+
+	// the cache is part of the signed message
+	params.Auth = requestAuth(t)
+	params.Auth.Signature = signRequest(t, privateKey(t), params)
+	params.CacheDuration = 20
+	require.ErrorContains(t, bp.CreateVault(ctx, params), "is not signed by")
+
+	params.CacheDuration = 10
+	require.NoError(t, bp.CreateVault(ctx, params))
+	info, err := bp.GetVault(ctx, app.GetVaultParams{Vault: "test.data"})
+	require.NoError(t, err)
+	require.Equal(t, account.Hex(), info.Owner)
+}
+
+func TestResumableUpload(t *testing.T) {
+	ctx := context.Background()
+
+	// fail the third chunk once to simulate a network blip
+	var mu sync.Mutex
+	failed := false
+	chunkWrites := 0
+	local := NewLocalServer()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/chunks/") {
+			mu.Lock()
+			chunkWrites++
+			if !failed && strings.HasSuffix(r.URL.Path, "/chunks/2") {
+				failed = true
+				mu.Unlock()
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			mu.Unlock()
+		}
+		local.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	bp := New(srv.URL)
+	createVault(t, bp)
+
+	stateDir := t.TempDir()
+	content := randomFile(t, 10*1024+10)
+	uploader := app.NewVaultsUploader("test", "data", bp, privateKey(t))
+	uploader.EnableResumableUploads(stateDir, 1024)
+
+	ts := app.NewTimestamp(time.Unix(1700000000, 0))
+	_, err := uploader.Upload(ctx, content, io.Discard, ts, 10*1024+10)
+	require.Error(t, err)
+
+	// the state of the interrupted upload is kept
+	states, err := os.ReadDir(stateDir)
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	require.Equal(t, 3, chunkWrites)
+
+	// resuming only sends the chunks that were not acknowledged
+	var progress bytes.Buffer
+	res, err := uploader.Upload(ctx, content, &progress, ts, 10*1024+10)
+	require.NoError(t, err)
+	require.NotEmpty(t, res.Event.CID)
+	require.Equal(t, 3+9, chunkWrites)
+	require.Equal(t, 10*1024+10, progress.Len())
+
+	states, err = os.ReadDir(stateDir)
+	require.NoError(t, err)
+	require.Len(t, states, 0)
+
+	events, err := bp.ListVaultEvents(ctx, app.ListVaultEventsParams{Vault: "test.data", Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	assertEventContent(t, bp, events[0].CID, content)
+}
+
+func TestResumableUploadExpiredSession(t *testing.T) {
+	ctx := context.Background()
+
+	// the first provider fails every chunk after the first one
+	flaky := httptest.NewServer(failChunks(NewLocalServer(), "/chunks/1"))
+	defer flaky.Close()
+
+	stateDir := t.TempDir()
+	content := randomFile(t, 4096)
+	ts := app.NewTimestamp(time.Unix(1700000000, 0))
+
+	bp := New(flaky.URL)
+	createVault(t, bp)
+	uploader := app.NewVaultsUploader("test", "data", bp, privateKey(t))
+	uploader.EnableResumableUploads(stateDir, 1024)
+	_, err := uploader.Upload(ctx, content, io.Discard, ts, 4096)
+	require.Error(t, err)
+
+	// the second provider does not know the session, so the upload starts over
+	srv := httptest.NewServer(NewLocalServer())
+	defer srv.Close()
+
+	bp = New(srv.URL)
+	createVault(t, bp)
+	_, err = bp.UploadStatus(ctx, app.UploadStatusParams{Vault: "test.data", SessionID: "unknown"})
+	require.ErrorIs(t, err, app.ErrUploadNotFound)
+
+	uploader = app.NewVaultsUploader("test", "data", bp, privateKey(t))
+	uploader.EnableResumableUploads(stateDir, 1024)
+	_, err = uploader.Upload(ctx, content, io.Discard, ts, 4096)
+	require.NoError(t, err)
+
+	events, err := bp.ListVaultEvents(ctx, app.ListVaultEventsParams{Vault: "test.data", Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assertEventContent(t, bp, events[0].CID, content)
+}
+
+func TestWriteChunkRejectsWrongCID(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(NewLocalServer())
+	defer srv.Close()
+
+	bp := New(srv.URL)
+	createVault(t, bp)
+
+	data := []byte("hello")
+	c, err := app.ChunkCID(data)
+	require.NoError(t, err)
+
+	sessionID, err := bp.StartUpload(ctx, app.StartUploadParams{
+		Vault:     "test.data",
+		Filename:  "hello.txt",
+		Signature: "00",
+		Size:      int64(len(data)),
+		ChunkSize: 1024,
+		Chunks:    []cid.Cid{c},
+	})
+	require.NoError(t, err)
+
+	err = bp.WriteChunk(ctx, app.WriteChunkParams{
+		Vault:     "test.data",
+		SessionID: sessionID,
+		Index:     0,
+		CID:       c,
+		Signature: "00",
+		Content:   bytes.NewReader([]byte("world")),
+		Size:      5,
+	})
+	require.ErrorContains(t, err, "chunk does not match its cid")
+}
+
+var testWindow = app.WindowRange{
+	StartLSN:      0x16B3748,
+	EndLSN:        0x16B3900,
+	MinCommitTime: time.Date(2023, 8, 22, 17, 44, 2, 0, time.UTC),
+	MaxCommitTime: time.Date(2023, 8, 22, 17, 44, 4, 0, time.UTC),
+	Txs:           2,
+}
+
+func failChunks(h http.Handler, suffix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, suffix) {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func privateKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	k, err := crypto.HexToECDSA(pk)
+	require.NoError(t, err)
+	return k
+}
+
+func requestAuth(t *testing.T) app.RequestAuth {
+	t.Helper()
+	auth, err := app.NewRequestAuth(app.DefaultRequestTTL)
+	require.NoError(t, err)
+	return auth
+}
+
+func signRequest(t *testing.T, key *ecdsa.PrivateKey, req app.SignedRequest) string {
+	t.Helper()
+	signature, err := app.SignRequest(key, req)
+	require.NoError(t, err)
+	return signature
+}
+
+func createVault(t *testing.T, bp *VaultsProvider) {
+	t.Helper()
+	account, err := app.NewAccount(crypto.PubkeyToAddress(privateKey(t).PublicKey).Hex())
+	require.NoError(t, err)
+	params := app.CreateVaultParams{Vault: "test.data", Account: account, Auth: requestAuth(t)}
+	params.Auth.Signature = signRequest(t, privateKey(t), params)
+	require.NoError(t, bp.CreateVault(context.Background(), params))
+}
+
+func randomFile(t *testing.T, size int) string {
+	t.Helper()
+	buf := make([]byte, size)
+	_, err := rand.Read(buf)
+	require.NoError(t, err)
+
+	p := path.Join(t.TempDir(), "data.parquet")
+	require.NoError(t, os.WriteFile(p, buf, 0o644))
+	return p
+}
+
+func assertEventContent(t *testing.T, bp *VaultsProvider, id string, filepath string) {
+	t.Helper()
+	c, err := cid.Parse(id)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	filename, err := bp.RetrieveEvent(context.Background(), app.RetrieveEventParams{CID: c}, &buf)
+	require.NoError(t, err)
+	require.Equal(t, "data.parquet", filename)
+
+	expected, err := os.ReadFile(filepath)
+	require.NoError(t, err)
+	require.Equal(t, expected, buf.Bytes())
+}